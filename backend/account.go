@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	// deletedNicknamePrefix marks the names a deleted user's scores are kept
+	// under; players cannot register it
+	deletedNicknamePrefix = "deleted-"
+	// accountDeletionWindow is how long a deletion confirmation stays valid
+	accountDeletionWindow = 5 * time.Minute
+)
+
+// GenerateDeletedNickname returns a random name such as "deleted-3fa91c0e".
+// Each deleted user gets their own, so their scores don't merge on a board.
+func GenerateDeletedNickname() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return deletedNicknamePrefix + hex.EncodeToString(b), nil
+}
+
+type deletionConfirmation struct {
+	nickname  string
+	expiresAt time.Time
+}
+
+// deletionConfirmationStore holds single-use tokens that confirm an account
+// deletion, keyed by token hash
+type deletionConfirmationStore struct {
+	mu     sync.Mutex
+	tokens map[string]deletionConfirmation
+}
+
+var deletionConfirmations = &deletionConfirmationStore{tokens: make(map[string]deletionConfirmation)}
+
+// Issue returns a new confirmation token for deleting nickname
+func (s *deletionConfirmationStore) Issue(nickname string, now time.Time) (string, error) {
+	token, err := GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, c := range s.tokens {
+		if now.After(c.expiresAt) {
+			delete(s.tokens, hash)
+		}
+	}
+	s.tokens[hashToken(token)] = deletionConfirmation{nickname: nickname, expiresAt: now.Add(accountDeletionWindow)}
+	return token, nil
+}
+
+// Redeem consumes a token, reporting whether it confirms deleting nickname
+func (s *deletionConfirmationStore) Redeem(token, nickname string, now time.Time) bool {
+	hash := hashToken(token)
+	s.mu.Lock()
+	c, ok := s.tokens[hash]
+	delete(s.tokens, hash)
+	s.mu.Unlock()
+
+	return ok && c.nickname == nickname && !now.After(c.expiresAt)
+}
+
+// onApiAccountExport returns everything kept about the caller as one JSON
+// download
+func onApiAccountExport(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+
+		export := AccountExport{ExportedAt: time.Now().UTC()}
+		var err error
+		if export.Account, err = store.ExportUser(session.Nickname); err != nil {
+			writeAccountError(w, "export", err)
+			return
+		}
+		if export.Sessions, err = listSessionInfos(session); err != nil {
+			writeAccountError(w, "export", err)
+			return
+		}
+		rating, err := store.GetRating(session.Nickname)
+		if err != nil {
+			writeAccountError(w, "export", err)
+			return
+		}
+		export.Rating = &rating
+		if export.Achievements, err = store.GetUserAchievements(session.Nickname); err != nil {
+			writeAccountError(w, "export", err)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pacman-%s.json"`, session.Nickname))
+		writeJSON(w, export)
+	}
+}
+
+// onApiAccountDelete deletes the caller's account in two steps: a request
+// without a confirmation returns one, and sending it back within
+// accountDeletionWindow deletes the account and ends every login
+func onApiAccountDelete(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		var req AccountDeleteRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		keepScores := true
+		switch req.Scores {
+		case "", "anonymize":
+		case "delete":
+			keepScores = false
+		default:
+			http.Error(w, "scores must be anonymize or delete", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		if req.Confirmation == "" {
+			token, err := deletionConfirmations.Issue(session.Nickname, now)
+			if err != nil {
+				writeAccountError(w, "delete", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(AccountDeleteConfirmation{
+				Confirmation: token,
+				ExpiresIn:    int(accountDeletionWindow.Seconds()),
+				Message:      "Send the confirmation back to delete your account. This cannot be undone.",
+			})
+			return
+		}
+		if !deletionConfirmations.Redeem(req.Confirmation, session.Nickname, now) {
+			http.Error(w, "Invalid or expired confirmation", http.StatusForbidden)
+			return
+		}
+
+		anonymousName, err := GenerateDeletedNickname()
+		if err != nil {
+			writeAccountError(w, "delete", err)
+			return
+		}
+		if err := lobby.store.DeleteUser(session.Nickname, anonymousName, keepScores); err != nil {
+			writeAccountError(w, "delete", err)
+			return
+		}
+		// With Postgres the sessions went with the account; this ends them
+		// in the other session stores and drops open connections
+		if err := RevokeAllUserSessions(session.Nickname); err != nil {
+			fmt.Println("Session revoke error after account deletion:", err)
+		}
+		lobby.DisconnectUser(session.Nickname)
+		lobby.BoardsChanged(db.BoardChange{})
+
+		writeMessage(w, "Account deleted")
+	}
+}
+
+func writeAccountError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, db.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	fmt.Printf("Account %s error: %v\n", action, err)
+	http.Error(w, "Server error", http.StatusInternalServerError)
+}
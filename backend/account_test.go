@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func TestAccountExport(t *testing.T) {
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	if err := lobby.store.CreateUser("pacfan", "secret123", "pac@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	lobby.SaveResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: 300})
+	lobby.SaveResult(db.GameResult{Mode: db.GameModePair, Players: []string{"pacfan", "inky"}, GhostCount: 4, Score: 800})
+	session, _ := CreateSession("pacfan", ClientInfo{UserAgent: "laptop"})
+
+	if rec := doRequest(mux, "GET", "/api/me/export", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", rec.Code)
+	}
+	rec := doRequest(mux, "GET", "/api/me/export", session.Token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "attachment") {
+		t.Error("Expected the export to download as a file")
+	}
+	var export AccountExport
+	if err := json.NewDecoder(rec.Body).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Account.Email != "pac@example.com" || len(export.Account.Games) != 2 {
+		t.Errorf("Expected the account with both games, got %+v", export.Account)
+	}
+	if len(export.Sessions) != 1 || !export.Sessions[0].Current {
+		t.Errorf("Expected the current session, got %+v", export.Sessions)
+	}
+}
+
+func deleteAccount(mux http.Handler, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/api/me", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAccountDeleteNeedsConfirmation(t *testing.T) {
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	for _, nickname := range []string{"pacfan", "inky"} {
+		if err := lobby.store.CreateUser(nickname, "secret123", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lobby.SaveResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: 300})
+	session, _ := CreateSession("pacfan", ClientInfo{})
+	other, _ := CreateSession("inky", ClientInfo{})
+
+	rec := deleteAccount(mux, session.Token, "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 asking for confirmation, got %d", rec.Code)
+	}
+	var confirm AccountDeleteConfirmation
+	if err := json.NewDecoder(rec.Body).Decode(&confirm); err != nil || confirm.Confirmation == "" {
+		t.Fatalf("Expected a confirmation, got %+v, %v", confirm, err)
+	}
+	if err := lobby.store.VerifyUser("pacfan", "secret123"); err != nil {
+		t.Fatalf("Expected the account kept until confirmed, got %v", err)
+	}
+
+	// Another user cannot use it
+	if rec := deleteAccount(mux, other.Token, `{"confirmation":"`+confirm.Confirmation+`"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for someone else's confirmation, got %d", rec.Code)
+	}
+	// And it was spent trying
+	if rec := deleteAccount(mux, session.Token, `{"confirmation":"`+confirm.Confirmation+`"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a used confirmation, got %d", rec.Code)
+	}
+
+	json.NewDecoder(deleteAccount(mux, session.Token, "").Body).Decode(&confirm)
+	if rec := deleteAccount(mux, session.Token, `{"confirmation":"`+confirm.Confirmation+`","scores":"forget"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown scores option, got %d", rec.Code)
+	}
+	if rec := deleteAccount(mux, session.Token, `{"confirmation":"`+confirm.Confirmation+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the account deleted, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if err := lobby.store.VerifyUser("pacfan", "secret123"); err == nil {
+		t.Error("Expected the login gone")
+	}
+	if _, ok := ValidateSession(session.Token); ok {
+		t.Error("Expected the session ended")
+	}
+	entries, _, _ := lobby.store.GetBoardPage(db.Board{Mode: db.GameModeSingle, GhostCount: 4}, 0, 10)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Nickname, deletedNicknamePrefix) {
+		t.Fatalf("Expected the score kept anonymously, got %+v", entries)
+	}
+	if msg := ValidateNickname(entries[0].Nickname); msg == "" {
+		t.Error("Expected the anonymous name to be reserved")
+	}
+}
+
+func TestDeletionConfirmationExpires(t *testing.T) {
+	store := &deletionConfirmationStore{tokens: make(map[string]deletionConfirmation)}
+	now := time.Now()
+	token, err := store.Issue("pacfan", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Redeem(token, "pacfan", now.Add(accountDeletionWindow+time.Second)) {
+		t.Error("Expected an expired confirmation to be refused")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+// Achievement is something a player can unlock once
+type Achievement struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// achievementProgress is what the rules know about a player when an event
+// happens
+type achievementProgress struct {
+	Nickname      string
+	Mode          GameMode
+	GhostCount    int
+	DiedThisLevel bool
+	GamesPlayed   int // Only known for EventGameOver
+}
+
+// achievementRule unlocks an achievement when Check matches an event
+type achievementRule struct {
+	Achievement
+	Check func(p achievementProgress, ev GameEvent) bool
+}
+
+var achievementRules = []achievementRule{
+	{
+		Achievement: Achievement{"ghost_streak", "Ghost Gourmet", "Eat 4 ghosts with one power pellet"},
+		Check: func(p achievementProgress, ev GameEvent) bool {
+			return ev.Type == EventGhostEaten && ev.Streak >= 4
+		},
+	},
+	{
+		Achievement: Achievement{"clean_level", "Untouchable", "Clear a level without dying"},
+		Check: func(p achievementProgress, ev GameEvent) bool {
+			return ev.Type == EventLevelCleared && !p.DiedThisLevel
+		},
+	},
+	{
+		// Pair games have no winner, so clearing a level together counts
+		Achievement: Achievement{"pair_ten_ghosts", "Against the Horde", "Clear a level in a pair game with 10 ghosts"},
+		Check: func(p achievementProgress, ev GameEvent) bool {
+			return ev.Type == EventLevelCleared && p.Mode == ModePair && p.GhostCount >= MaxGhostCount
+		},
+	},
+	{
+		Achievement: Achievement{"games_100", "Centurion", "Play 100 games"},
+		Check: func(p achievementProgress, ev GameEvent) bool {
+			return ev.Type == EventGameOver && p.GamesPlayed >= 100
+		},
+	},
+}
+
+// evaluateAchievements returns the achievements the event earns the player
+func evaluateAchievements(p achievementProgress, ev GameEvent) []Achievement {
+	var earned []Achievement
+	for _, rule := range achievementRules {
+		if rule.Check(p, ev) {
+			earned = append(earned, rule.Achievement)
+		}
+	}
+	return earned
+}
+
+// InitAchievements writes the achievement catalog to the store
+func InitAchievements(store db.Store) {
+	defs := make([]db.AchievementDef, len(achievementRules))
+	for i, rule := range achievementRules {
+		defs[i] = db.AchievementDef{ID: rule.ID, Name: rule.Name, Description: rule.Description}
+	}
+	if err := store.SyncAchievements(defs); err != nil {
+		fmt.Println("Warning: cannot sync achievements:", err)
+	}
+}
+
+// achievementTracker follows one game's events for its players. Handle runs
+// with the game lock held, so awards happen on their own goroutine.
+type achievementTracker struct {
+	game    *GameState
+	mode    GameMode
+	died    map[string]bool // Players who died on the current level
+	awarded map[string]bool // nickname/id pairs already awarded this game
+	award   func(nickname string, a Achievement)
+}
+
+// trackAchievements hooks a tracker into the game's events
+func trackAchievements(lobby *Lobby, game *GameState, mode GameMode) {
+	newAchievementTracker(game, mode, func(nickname string, a Achievement) {
+		awardAchievement(lobby, nickname, a)
+	})
+}
+
+func newAchievementTracker(game *GameState, mode GameMode, award func(string, Achievement)) *achievementTracker {
+	t := &achievementTracker{
+		game:    game,
+		mode:    mode,
+		died:    make(map[string]bool),
+		awarded: make(map[string]bool),
+		award:   award,
+	}
+	game.OnEvent = t.Handle
+	return t
+}
+
+func (t *achievementTracker) Handle(ev GameEvent) {
+	if ev.Type == EventDeath {
+		t.died[ev.Player] = true
+	}
+
+	// Events for everyone, like a cleared level, only reach players still in
+	// the game
+	players := []string{ev.Player}
+	if ev.Player == "" {
+		players = players[:0]
+		for nickname, p := range t.game.Players {
+			if p.Alive {
+				players = append(players, nickname)
+			}
+		}
+	}
+	for _, nickname := range players {
+		p := achievementProgress{
+			Nickname:      nickname,
+			Mode:          t.mode,
+			GhostCount:    t.game.GhostCount,
+			DiedThisLevel: t.died[nickname],
+		}
+		for _, a := range evaluateAchievements(p, ev) {
+			key := nickname + "/" + a.ID
+			if t.awarded[key] {
+				continue
+			}
+			t.awarded[key] = true
+			go t.award(nickname, a)
+		}
+	}
+
+	if ev.Type == EventLevelCleared {
+		clear(t.died)
+	}
+}
+
+// checkCareerAchievements evaluates the rules that depend on a player's whole
+// history. It runs after the game's result has been saved.
+func checkCareerAchievements(lobby *Lobby, mode GameMode, nicknames ...string) {
+	for _, nickname := range nicknames {
+		games, err := lobby.store.CountGamesPlayed(nickname)
+		if err != nil {
+			fmt.Println("Achievement games count error:", err)
+			continue
+		}
+		p := achievementProgress{Nickname: nickname, Mode: mode, GamesPlayed: games}
+		for _, a := range evaluateAchievements(p, GameEvent{Type: EventGameOver}) {
+			awardAchievement(lobby, nickname, a)
+		}
+	}
+}
+
+// awardAchievement stores an achievement and, the first time a player earns
+// it, tells their connected clients
+func awardAchievement(lobby *Lobby, nickname string, a Achievement) {
+	isNew, err := lobby.store.UnlockAchievement(nickname, a.ID)
+	if err != nil {
+		fmt.Printf("Achievement unlock error (%s for %s): %v\n", a.ID, nickname, err)
+		return
+	}
+	if isNew {
+		lobby.SendToUser(nickname, map[string]interface{}{
+			"type":        "achievement_unlocked",
+			"achievement": a,
+		})
+	}
+}
+
+// AchievementStatus is an achievement and whether a player has unlocked it
+type AchievementStatus struct {
+	Achievement
+	Unlocked   bool       `json:"unlocked"`
+	UnlockedAt *time.Time `json:"unlockedAt,omitempty"`
+}
+
+func onApiUserAchievements(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		unlocked, err := store.GetUserAchievements(r.PathValue("nickname"))
+		if err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			fmt.Println("Achievements query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, achievementStatuses(unlocked))
+	}
+}
+
+// achievementStatuses lists every achievement in rule order, marking the
+// unlocked ones
+func achievementStatuses(unlocked []db.UnlockedAchievement) []AchievementStatus {
+	at := make(map[string]time.Time, len(unlocked))
+	for _, u := range unlocked {
+		at[u.ID] = u.UnlockedAt
+	}
+	statuses := make([]AchievementStatus, len(achievementRules))
+	for i, rule := range achievementRules {
+		statuses[i] = AchievementStatus{Achievement: rule.Achievement}
+		if t, ok := at[rule.ID]; ok {
+			statuses[i].Unlocked = true
+			statuses[i].UnlockedAt = &t
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+type award struct {
+	nickname string
+	id       string
+}
+
+// recordAwards tracks the game's achievements into a channel instead of the
+// database
+func recordAwards(game *GameState, mode GameMode) chan award {
+	awards := make(chan award, 16)
+	newAchievementTracker(game, mode, func(nickname string, a Achievement) {
+		awards <- award{nickname, a.ID}
+	})
+	return awards
+}
+
+func expectAwards(t *testing.T, awards chan award, want ...award) {
+	t.Helper()
+	got := map[award]bool{}
+	for range want {
+		select {
+		case a := <-awards:
+			got[a] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Expected awards %v, got %v", want, got)
+		}
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("Expected award %v, got %v", w, got)
+		}
+	}
+	select {
+	case a := <-awards:
+		t.Errorf("Unexpected award %v", a)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestGhostStreakAchievement(t *testing.T) {
+	game := NewGame([]string{"tester"}, 4)
+	awards := recordAwards(game, ModeSingle)
+	p := game.Players["tester"]
+	p.Pos = Position{X: 1, Y: 1}
+	game.PowerModeTime = 5000
+
+	for i := 0; i < 3; i++ {
+		game.resolveCollision(&game.Ghosts[i], p)
+	}
+	expectAwards(t, awards)
+
+	game.resolveCollision(&game.Ghosts[3], p)
+	expectAwards(t, awards, award{"tester", "ghost_streak"})
+
+	// A fifth ghost on the same pellet does not award it twice
+	game.resolveCollision(&game.Ghosts[0], p)
+	expectAwards(t, awards)
+}
+
+func TestGhostStreakResetsOnNewPellet(t *testing.T) {
+	game := NewGame([]string{"tester"}, 4)
+	awards := recordAwards(game, ModeSingle)
+	p := game.Players["tester"]
+	game.PowerModeTime = 5000
+
+	for i := 0; i < 2; i++ {
+		game.resolveCollision(&game.Ghosts[i], p)
+	}
+	game.Grid[1][1] = CellPower
+	game.handleEating(p, Position{X: 1, Y: 1})
+	for i := 0; i < 2; i++ {
+		game.resolveCollision(&game.Ghosts[i], p)
+	}
+	expectAwards(t, awards)
+}
+
+func TestClearingLevelStartsNextOne(t *testing.T) {
+	game := NewGame([]string{"tester"}, 1)
+	awards := recordAwards(game, ModeSingle)
+	game.dotsLeft = 0
+	game.Grid[1][1] = CellEmpty
+
+	game.Update()
+
+	expectAwards(t, awards, award{"tester", "clean_level"})
+	if game.Level != 2 {
+		t.Errorf("Expected level 2, got %d", game.Level)
+	}
+	if game.Grid[1][1] != CellDot || game.dotsLeft != game.countDots() || game.dotsLeft == 0 {
+		t.Errorf("Expected the map to be refilled, %d dots left", game.dotsLeft)
+	}
+}
+
+func TestPairLevelAchievements(t *testing.T) {
+	game := NewGame([]string{"alice", "bob"}, MaxGhostCount)
+	awards := recordAwards(game, ModePair)
+
+	// Bob dies on the first level; alice clears it with ten ghosts
+	bob := game.Players["bob"]
+	game.PowerModeTime = 0
+	game.resolveCollision(&game.Ghosts[0], bob)
+	game.dotsLeft = 0
+	game.Update()
+
+	expectAwards(t, awards, award{"alice", "clean_level"}, award{"alice", "pair_ten_ghosts"})
+
+	// Bob is out of the game, so later levels do not count for him either
+	game.dotsLeft = 0
+	game.Update()
+	expectAwards(t, awards)
+}
+
+func TestCareerAchievementNeedsHundredGames(t *testing.T) {
+	over := GameEvent{Type: EventGameOver}
+	if got := evaluateAchievements(achievementProgress{GamesPlayed: 99}, over); len(got) != 0 {
+		t.Errorf("Expected nothing at 99 games, got %v", got)
+	}
+	got := evaluateAchievements(achievementProgress{GamesPlayed: 100}, over)
+	if len(got) != 1 || got[0].ID != "games_100" {
+		t.Errorf("Expected games_100 at 100 games, got %v", got)
+	}
+}
+
+func TestAchievementStatusesMarkUnlocked(t *testing.T) {
+	at := time.Date(2026, 5, 14, 12, 0, 0, 0, time.UTC)
+	statuses := achievementStatuses([]db.UnlockedAchievement{{ID: "clean_level", UnlockedAt: at}})
+	if len(statuses) != len(achievementRules) {
+		t.Fatalf("Expected every achievement listed, got %d", len(statuses))
+	}
+	for _, s := range statuses {
+		unlocked := s.ID == "clean_level"
+		if s.Unlocked != unlocked || (unlocked && !s.UnlockedAt.Equal(at)) {
+			t.Errorf("Unexpected status %+v", s)
+		}
+	}
+}
+
+func TestUserAchievements(t *testing.T) {
+	mux, lobby := newTestServer(t)
+	InitAchievements(lobby.store)
+	if err := lobby.store.CreateUser("pacfan", "secret123", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lobby.store.UnlockAchievement("pacfan", "clean_level"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doRequest(mux, "GET", "/api/users/pacfan/achievements", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var statuses []AchievementStatus
+	json.NewDecoder(rec.Body).Decode(&statuses)
+	if len(statuses) != len(achievementRules) {
+		t.Fatalf("Expected every achievement listed, got %+v", statuses)
+	}
+	for _, s := range statuses {
+		if s.Unlocked != (s.ID == "clean_level") {
+			t.Errorf("Unexpected status %+v", s)
+		}
+	}
+
+	if rec := doRequest(mux, "GET", "/api/users/nobody/achievements", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", rec.Code)
+	}
+}
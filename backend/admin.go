@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	defaultAdminListLimit = 50
+	maxAdminListLimit     = 500
+)
+
+// sessionHandler is a handler that runs after the caller has been authenticated
+type sessionHandler func(w http.ResponseWriter, r *http.Request, session db.SessionRecord)
+
+// requireRole authenticates the request and only calls next if the user has
+// the given role and is not banned
+func requireRole(store db.Store, role string, next sessionHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		status, err := store.GetUserStatus(session.Nickname)
+		if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+			fmt.Println("Role lookup error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err != nil || status.Banned || status.Role != role {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r, session)
+	}
+}
+
+// isBanned reports whether a user is banned. An unknown user is not; any
+// other error is returned so callers can refuse the request rather than let
+// a banned user through.
+func isBanned(store db.Store, nickname string) (bool, error) {
+	status, err := store.GetUserStatus(nickname)
+	if errors.Is(err, db.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status.Banned, nil
+}
+
+// rejectBanned answers 403 for a banned user and 503 when the ban cannot be
+// checked, returning true if it answered
+func rejectBanned(w http.ResponseWriter, store db.Store, nickname string) bool {
+	banned, err := isBanned(store, nickname)
+	if err != nil {
+		fmt.Println("Ban check error:", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return true
+	}
+	if banned {
+		http.Error(w, "Account banned", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// PromoteAdminsFromEnv gives the admin role to the comma-separated nicknames
+// in ADMIN_NICKNAMES, so a fresh deployment has someone to moderate it
+func PromoteAdminsFromEnv(store db.Store) {
+	for _, nickname := range strings.Split(os.Getenv("ADMIN_NICKNAMES"), ",") {
+		nickname = strings.TrimSpace(nickname)
+		if nickname == "" {
+			continue
+		}
+		if err := store.SetUserRole(nickname, db.RoleAdmin); err != nil {
+			fmt.Printf("Warning: cannot make %s an admin: %v\n", nickname, err)
+		}
+	}
+}
+
+func registerAdminRoutes(mux *http.ServeMux, lobby *Lobby) {
+	store := lobby.store
+	mux.HandleFunc("/api/admin/scores", requireRole(store, db.RoleAdmin, onAdminScores(store)))
+	mux.HandleFunc("/api/admin/scores/{id}", requireRole(store, db.RoleAdmin, onAdminScoreDelete(lobby)))
+	mux.HandleFunc("/api/admin/pair-scores", requireRole(store, db.RoleAdmin, onAdminPairScores(store)))
+	mux.HandleFunc("/api/admin/pair-scores/{id}", requireRole(store, db.RoleAdmin, onAdminPairScoreDelete(lobby)))
+	mux.HandleFunc("/api/admin/users/{nickname}/ban", requireRole(store, db.RoleAdmin, onAdminBan(lobby)))
+	mux.HandleFunc("/api/admin/users/{nickname}/unban", requireRole(store, db.RoleAdmin, onAdminUnban(store)))
+	mux.HandleFunc("/api/admin/users/{nickname}/rename", requireRole(store, db.RoleAdmin, onAdminRename(lobby)))
+	mux.HandleFunc("/api/admin/games", requireRole(store, db.RoleAdmin, onAdminGames(lobby)))
+	mux.HandleFunc("/api/admin/games/{id}", requireRole(store, db.RoleAdmin, onAdminGameEnd(lobby)))
+	mux.HandleFunc("/api/admin/audit", requireRole(store, db.RoleAdmin, onAdminAudit(store)))
+}
+
+// auditAdminAction records an admin action. A failure is logged rather than
+// undoing the action, which has already taken effect.
+func auditAdminAction(store db.Store, admin, action, target string, details interface{}) {
+	if err := store.RecordAdminAction(admin, action, target, details); err != nil {
+		fmt.Printf("Audit error (%s %s by %s): %v\n", action, target, admin, err)
+	}
+}
+
+func listLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return defaultAdminListLimit
+	}
+	if limit > maxAdminListLimit {
+		return maxAdminListLimit
+	}
+	return limit
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeMessage(w http.ResponseWriter, message string) {
+	writeJSON(w, map[string]string{"message": message})
+}
+
+func onAdminScores(store db.Store) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, _ db.SessionRecord) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ghosts, _ := strconv.Atoi(r.URL.Query().Get("ghosts"))
+		scores, err := store.ListScores(r.URL.Query().Get("nickname"), ghosts, listLimit(r))
+		if err != nil {
+			fmt.Println("Admin score list error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, scores)
+	}
+}
+
+func onAdminPairScores(store db.Store) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, _ db.SessionRecord) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ghosts, _ := strconv.Atoi(r.URL.Query().Get("ghosts"))
+		scores, err := store.ListPairScores(r.URL.Query().Get("nickname"), ghosts, listLimit(r))
+		if err != nil {
+			fmt.Println("Admin pair score list error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, scores)
+	}
+}
+
+func onAdminScoreDelete(lobby *Lobby) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, session db.SessionRecord) {
+		deleteScoreByID(w, r, session, lobby, "delete_score", lobby.store.DeleteScore)
+	}
+}
+
+func onAdminPairScoreDelete(lobby *Lobby) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, session db.SessionRecord) {
+		deleteScoreByID(w, r, session, lobby, "delete_pair_score", lobby.store.DeletePairScore)
+	}
+}
+
+func deleteScoreByID(w http.ResponseWriter, r *http.Request, session db.SessionRecord, lobby *Lobby, action string, del func(int) error) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid score id", http.StatusBadRequest)
+		return
+	}
+	if err := del(id); err != nil {
+		if errors.Is(err, db.ErrScoreNotFound) {
+			http.Error(w, "Score not found", http.StatusNotFound)
+		} else {
+			fmt.Println("Admin score delete error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+	// The score's board isn't known here, so treat them all as changed
+	lobby.BoardsChanged(db.BoardChange{})
+	auditAdminAction(lobby.store, session.Nickname, action, strconv.Itoa(id), nil)
+	writeMessage(w, "Score deleted")
+}
+
+func onAdminBan(lobby *Lobby) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, session db.SessionRecord) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nickname := r.PathValue("nickname")
+		if nickname == session.Nickname {
+			http.Error(w, "You cannot ban yourself", http.StatusBadRequest)
+			return
+		}
+		var req BanRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := lobby.store.BanUser(nickname, req.Reason); err != nil {
+			writeUserActionError(w, "ban", err)
+			return
+		}
+		if err := RevokeAllUserSessions(nickname); err != nil {
+			fmt.Println("Session revoke error after ban:", err)
+		}
+		lobby.DisconnectUser(nickname)
+
+		auditAdminAction(lobby.store, session.Nickname, "ban_user", nickname, map[string]string{"reason": req.Reason})
+		writeMessage(w, "User banned")
+	}
+}
+
+func onAdminUnban(store db.Store) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, session db.SessionRecord) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nickname := r.PathValue("nickname")
+		if err := store.UnbanUser(nickname); err != nil {
+			writeUserActionError(w, "unban", err)
+			return
+		}
+		auditAdminAction(store, session.Nickname, "unban_user", nickname, nil)
+		writeMessage(w, "User unbanned")
+	}
+}
+
+func onAdminRename(lobby *Lobby) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, session db.SessionRecord) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nickname := r.PathValue("nickname")
+		var req RenameRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		newNickname := NormalizeNickname(req.Nickname)
+		if msg := ValidateNickname(newNickname); msg != "" {
+			writeFieldErrors(w, http.StatusBadRequest, FieldErrors{"nickname": msg})
+			return
+		}
+
+		if err := lobby.store.RenameUser(nickname, newNickname); err != nil {
+			if errors.Is(err, db.ErrUsernameTaken) {
+				writeFieldErrors(w, http.StatusConflict, FieldErrors{"nickname": "Nickname already taken"})
+				return
+			}
+			writeUserActionError(w, "rename", err)
+			return
+		}
+		lobby.BoardsChanged(db.BoardChange{})
+		// Sessions and connections carry the old nickname, so the player
+		// has to log in again under the new one
+		if err := RevokeAllUserSessions(nickname); err != nil {
+			fmt.Println("Session revoke error after rename:", err)
+		}
+		lobby.DisconnectUser(nickname)
+
+		auditAdminAction(lobby.store, session.Nickname, "rename_user", nickname, map[string]string{"newNickname": newNickname})
+		writeMessage(w, "User renamed")
+	}
+}
+
+func writeUserActionError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, db.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	fmt.Printf("Admin %s error: %v\n", action, err)
+	http.Error(w, "Database error", http.StatusInternalServerError)
+}
+
+func onAdminGames(lobby *Lobby) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, _ db.SessionRecord) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, lobby.Games())
+	}
+}
+
+func onAdminGameEnd(lobby *Lobby) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, session db.SessionRecord) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid game id", http.StatusBadRequest)
+			return
+		}
+		if !lobby.EndGame(id, "ended_by_admin") {
+			http.Error(w, "Game not found", http.StatusNotFound)
+			return
+		}
+		auditAdminAction(lobby.store, session.Nickname, "end_game", strconv.FormatUint(id, 10), nil)
+		writeMessage(w, "Game ended")
+	}
+}
+
+func onAdminAudit(store db.Store) sessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, _ db.SessionRecord) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := store.ListAdminActions(listLimit(r))
+		if err != nil {
+			fmt.Println("Audit list error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+	}
+}
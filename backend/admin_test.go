@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func TestEndGameStopsSingleGameWithoutScore(t *testing.T) {
+	l := newTestLobby()
+	client := NewClient("cheater", nil, l)
+	l.clients[client] = true
+
+	startSinglePlayerGame(client, 4)
+	games := l.Games()
+	if len(games) != 1 || games[0].Mode != ModeSingle || games[0].Players[0] != "cheater" {
+		t.Fatalf("Expected one single game for cheater, got %+v", games)
+	}
+
+	if !l.EndGame(games[0].ID, "ended_by_admin") {
+		t.Fatal("Expected EndGame to find the game")
+	}
+	if client.GetGame() != nil {
+		t.Error("Expected the client to be detached from the game")
+	}
+	if len(l.Games()) != 0 {
+		t.Error("Expected no running games")
+	}
+	if l.scheduler.Stats().ActiveGames != 0 {
+		t.Error("Expected the game to be removed from the scheduler")
+	}
+	if l.EndGame(games[0].ID, "ended_by_admin") {
+		t.Error("Expected a second EndGame to report the game as gone")
+	}
+
+	client.queueMu.Lock()
+	last := client.queue[len(client.queue)-1]
+	client.queueMu.Unlock()
+	var msg map[string]interface{}
+	json.Unmarshal(last.data, &msg)
+	if msg["type"] != "game_ended" || msg["reason"] != "ended_by_admin" {
+		t.Errorf("Expected a game_ended message, got %v", msg)
+	}
+}
+
+func TestEndGameAbortsPairSession(t *testing.T) {
+	shortenPairTimings(t)
+	l, session, a, b := newTestSession(t)
+
+	session.Ready(a)
+	session.Ready(b)
+	waitFor(t, func() bool { return a.GetGame() != nil }, "game start after countdown")
+
+	if !l.EndGame(a.GetGame().ID, "ended_by_admin") {
+		t.Fatal("Expected EndGame to find the pair game")
+	}
+	if sessionPhase(session) != phaseClosed {
+		t.Error("Expected the pair session to be closed")
+	}
+	if a.PairSession() != nil || b.PairSession() != nil || b.GetGame() != nil {
+		t.Error("Expected both players to be detached")
+	}
+}
+
+// newAdminTestServer returns a server with an admin and a player signed in,
+// returning their access tokens
+func newAdminTestServer(t *testing.T) (*http.ServeMux, *Lobby, string, string) {
+	t.Helper()
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	for _, nickname := range []string{"warden", "pacfan"} {
+		if err := lobby.store.CreateUser(nickname, "secret123", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lobby.store.SetUserRole("warden", db.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	admin, _ := CreateSession("warden", ClientInfo{})
+	player, _ := CreateSession("pacfan", ClientInfo{})
+	return mux, lobby, admin.Token, player.Token
+}
+
+func TestAdminRoutesRequireAdminRole(t *testing.T) {
+	mux, lobby, admin, player := newAdminTestServer(t)
+
+	if rec := doRequest(mux, http.MethodGet, "/api/admin/audit", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, http.MethodGet, "/api/admin/audit", player); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a player, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/warden/ban", player, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a player unable to ban, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, http.MethodGet, "/api/admin/audit", admin); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for an admin, got %d", rec.Code)
+	}
+
+	// A banned admin loses access at once
+	if err := lobby.store.BanUser("warden", "compromised"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(mux, http.MethodGet, "/api/admin/audit", admin); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a banned admin, got %d", rec.Code)
+	}
+}
+
+func TestAdminBanAndUnban(t *testing.T) {
+	mux, lobby, admin, player := newAdminTestServer(t)
+	prev := authLimiters
+	t.Cleanup(func() { authLimiters = prev })
+	authLimiters.ip = NewMemoryLimiter(ipLoginPolicy)
+	authLimiters.account = NewMemoryLimiter(accountLoginPolicy)
+
+	client, peer := newTestClientPair(t)
+	client.Nickname = "pacfan"
+	lobby.clients[client] = true
+	go client.WritePump()
+
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/warden/ban", admin, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for banning oneself, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/nobody/ban", admin, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", rec.Code)
+	}
+	rec := doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/ban", admin, `{"reason":"cheating"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the ban to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if _, ok := ValidateSession(player); ok {
+		t.Error("Expected the ban to revoke the player's sessions")
+	}
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := peer.ReadMessage(); !websocket.IsCloseError(err, CloseSessionRevoked) {
+		t.Errorf("Expected the connection closed as revoked, got %v", err)
+	}
+	login := `{"nickname":"pacfan","password":"secret123"}`
+	if rec := doJSON(mux, http.MethodPost, "/api/login", "", login); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a banned login refused, got %d", rec.Code)
+	}
+
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/unban", admin, ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the unban to succeed, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/login", "", login); rec.Code != http.StatusOK {
+		t.Errorf("Expected login after the unban, got %d", rec.Code)
+	}
+}
+
+func TestAdminRename(t *testing.T) {
+	mux, lobby, admin, player := newAdminTestServer(t)
+	if err := lobby.store.SaveGameResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/rename", admin, `{"nickname":"x"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid nickname, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/rename", admin, `{"nickname":"Warden"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a taken nickname, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/admin/users/nobody/rename", admin, `{"nickname":"someone"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", rec.Code)
+	}
+	rec := doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/rename", admin, `{"nickname":"pacfriend"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the rename to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if _, ok := ValidateSession(player); ok {
+		t.Error("Expected the rename to end the old nickname's sessions")
+	}
+	scores, err := lobby.store.ListScores("pacfriend", 0, 10)
+	if err != nil || len(scores) != 1 {
+		t.Errorf("Expected the score moved to the new nickname, got %+v %v", scores, err)
+	}
+}
+
+func TestAdminScoreDelete(t *testing.T) {
+	mux, lobby, admin, _ := newAdminTestServer(t)
+	if err := lobby.store.SaveGameResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: 300}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lobby.store.SaveGameResult(db.GameResult{Mode: db.GameModePair, Players: []string{"pacfan", "warden"}, GhostCount: 4, Score: 800}); err != nil {
+		t.Fatal(err)
+	}
+
+	var scores []db.AdminScoreEntry
+	json.NewDecoder(doRequest(mux, http.MethodGet, "/api/admin/scores?nickname=pacfan", admin).Body).Decode(&scores)
+	if len(scores) != 1 {
+		t.Fatalf("Expected one single score, got %+v", scores)
+	}
+	var pairs []db.AdminPairScoreEntry
+	json.NewDecoder(doRequest(mux, http.MethodGet, "/api/admin/pair-scores", admin).Body).Decode(&pairs)
+	if len(pairs) != 1 {
+		t.Fatalf("Expected one pair score, got %+v", pairs)
+	}
+
+	single := "/api/admin/scores/" + strconv.Itoa(scores[0].ID)
+	// The ids only match results of their own mode
+	if rec := doRequest(mux, http.MethodDelete, "/api/admin/pair-scores/"+strconv.Itoa(scores[0].ID), admin); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a single score as a pair score, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, http.MethodDelete, "/api/admin/scores/abc", admin); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad id, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, http.MethodDelete, single, admin); rec.Code != http.StatusOK {
+		t.Errorf("Expected the score deleted, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, http.MethodDelete, single, admin); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted score, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, http.MethodDelete, "/api/admin/pair-scores/"+strconv.Itoa(pairs[0].ID), admin); rec.Code != http.StatusOK {
+		t.Errorf("Expected the pair score deleted, got %d", rec.Code)
+	}
+}
+
+func TestAdminAuditLog(t *testing.T) {
+	mux, _, admin, _ := newAdminTestServer(t)
+
+	doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/ban", admin, `{"reason":"cheating"}`)
+	doJSON(mux, http.MethodPost, "/api/admin/users/pacfan/unban", admin, "")
+	// Failed actions are not recorded
+	doJSON(mux, http.MethodPost, "/api/admin/users/nobody/ban", admin, "")
+
+	var entries []db.AuditEntry
+	rec := doRequest(mux, http.MethodGet, "/api/admin/audit?limit=10", admin)
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected two audit entries, got %+v", entries)
+	}
+	if entries[0].Action != "unban_user" || entries[1].Action != "ban_user" {
+		t.Errorf("Expected newest first, got %s then %s", entries[0].Action, entries[1].Action)
+	}
+	var details map[string]string
+	json.Unmarshal(entries[1].Details, &details)
+	if entries[1].Admin != "warden" || entries[1].Target != "pacfan" || details["reason"] != "cheating" {
+		t.Errorf("Unexpected ban entry %+v", entries[1])
+	}
+}
@@ -2,29 +2,55 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
 )
 
 // Session management for secure WebSocket authentication
-var (
-	sessions   = make(map[string]*Session)
-	sessionsMu sync.RWMutex
-)
+var sessionStore db.SessionStore = db.NewMemorySessionStore()
 
 type Session struct {
-	Token     string
-	Nickname  string
-	CreatedAt time.Time
-	ExpiresAt time.Time
+	Token        string // Short-lived access token
+	RefreshToken string // Single-use token to obtain the next access token
+	FamilyID     string // Identifies the login across token rotations
+	Nickname     string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
 }
 
-const sessionDuration = 24 * time.Hour
+const (
+	accessTokenDuration = 15 * time.Minute
+	// refreshTokenDuration slides forward on every rotation, so a player
+	// stays logged in as long as they come back within this window
+	refreshTokenDuration = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// lastSeenResolution limits how often last_seen_at is written per session
+const lastSeenResolution = 1 * time.Minute
+
+// InitSessionStore switches to the PostgreSQL store when a database is
+// configured, so sessions survive restarts and are shared between replicas.
+func InitSessionStore() {
+	if db.IsConfigured() {
+		sessionStore = db.PostgresSessionStore{}
+	} else {
+		fmt.Println("Warning: no database, sessions are kept in memory")
+	}
+}
 
 // GenerateSessionToken creates a cryptographically secure session token
 func GenerateSessionToken() (string, error) {
@@ -35,68 +61,321 @@ func GenerateSessionToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// hashToken returns the value stored in place of a raw token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientInfo describes where a login came from, for the session list
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// trustedProxies are the addresses allowed to set X-Forwarded-For, read from
+// the comma-separated IPs and CIDR ranges in TRUSTED_PROXIES
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			fmt.Printf("Warning: ignoring invalid TRUSTED_PROXIES entry %q\n", entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfoFromRequest reads the user agent and client IP. X-Forwarded-For
+// is only read when the connection comes from a trusted proxy, and then the
+// right-most hop that is not itself a trusted proxy is the client, since
+// anything left of it may have been sent by the client.
+func clientInfoFromRequest(r *http.Request) ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if isTrustedProxy(ip) {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+	return ClientInfo{UserAgent: r.UserAgent(), IP: ip}
+}
+
 // CreateSession creates a new session for an authenticated user
-func CreateSession(nickname string) (*Session, error) {
+func CreateSession(nickname string, info ClientInfo) (*Session, error) {
+	familyID, err := GenerateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = sessionStore.CreateFamily(db.FamilyRecord{
+		ID:         familyID,
+		Nickname:   nickname,
+		UserAgent:  info.UserAgent,
+		IP:         info.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store session family: %w", err)
+	}
+	return issueSession(nickname, familyID)
+}
+
+// issueSession stores a fresh access token and refresh token in a family
+func issueSession(nickname, familyID string) (*Session, error) {
 	token, err := GenerateSessionToken()
 	if err != nil {
 		return nil, err
 	}
+	refreshToken, err := GenerateSessionToken()
+	if err != nil {
+		return nil, err
+	}
 
+	now := time.Now()
 	session := &Session{
-		Token:     token,
-		Nickname:  nickname,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(sessionDuration),
+		Token:        token,
+		RefreshToken: refreshToken,
+		FamilyID:     familyID,
+		Nickname:     nickname,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(accessTokenDuration),
+	}
+
+	err = sessionStore.CreateSession(db.SessionRecord{
+		TokenHash:  hashToken(token),
+		FamilyID:   familyID,
+		Nickname:   nickname,
+		CreatedAt:  session.CreatedAt,
+		ExpiresAt:  session.ExpiresAt,
+		LastSeenAt: now,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store session: %w", err)
 	}
 
-	sessionsMu.Lock()
-	sessions[token] = session
-	sessionsMu.Unlock()
+	err = sessionStore.CreateRefreshToken(db.RefreshTokenRecord{
+		TokenHash: hashToken(refreshToken),
+		FamilyID:  familyID,
+		Nickname:  nickname,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenDuration),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("store refresh token: %w", err)
+	}
 
 	return session, nil
 }
 
+// RefreshSession rotates a refresh token into a new access/refresh pair in
+// the same family. A token that was already rotated indicates theft, so the
+// whole family is revoked.
+func RefreshSession(refreshToken string) (*Session, error) {
+	hash := hashToken(refreshToken)
+	rec, err := sessionStore.GetRefreshToken(hash)
+	if errors.Is(err, db.ErrRefreshTokenNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.Revoked || time.Now().After(rec.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	fresh, err := sessionStore.MarkRefreshTokenUsed(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		fmt.Printf("Refresh token reuse detected for %s, revoking family\n", rec.Nickname)
+		if err := sessionStore.RevokeFamily(rec.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if err := sessionStore.TouchFamily(rec.FamilyID, time.Now()); err != nil {
+		fmt.Println("Session family touch error:", err)
+	}
+	return issueSession(rec.Nickname, rec.FamilyID)
+}
+
 // ValidateSession checks if a session token is valid and returns the associated nickname
 func ValidateSession(token string) (string, bool) {
-	sessionsMu.RLock()
-	session, exists := sessions[token]
-	sessionsMu.RUnlock()
-
-	if !exists {
+	rec, ok := LookupSession(token)
+	if !ok {
 		return "", false
 	}
+	return rec.Nickname, true
+}
+
+// LookupSession returns the stored session for a valid access token
+func LookupSession(token string) (db.SessionRecord, bool) {
+	hash := hashToken(token)
+	rec, err := sessionStore.GetSession(hash)
+	if err != nil {
+		if !errors.Is(err, db.ErrSessionNotFound) {
+			fmt.Println("Session lookup error:", err)
+		}
+		return db.SessionRecord{}, false
+	}
 
-	if time.Now().After(session.ExpiresAt) {
+	now := time.Now()
+	if now.After(rec.ExpiresAt) {
 		// Session expired, remove it
-		sessionsMu.Lock()
-		delete(sessions, token)
-		sessionsMu.Unlock()
-		return "", false
+		sessionStore.DeleteSession(hash)
+		return db.SessionRecord{}, false
 	}
 
-	return session.Nickname, true
+	if now.Sub(rec.LastSeenAt) > lastSeenResolution {
+		if err := sessionStore.TouchSession(hash, now); err != nil {
+			fmt.Println("Session touch error:", err)
+		}
+		if err := sessionStore.TouchFamily(rec.FamilyID, now); err != nil {
+			fmt.Println("Session family touch error:", err)
+		}
+	}
+
+	return rec, true
 }
 
-// DeleteSession removes a session (for logout)
+// DeleteSession removes a session and every token rotated from it (for logout)
 func DeleteSession(token string) {
-	sessionsMu.Lock()
-	delete(sessions, token)
-	sessionsMu.Unlock()
+	hash := hashToken(token)
+	if rec, err := sessionStore.GetSession(hash); err == nil && rec.FamilyID != "" {
+		if err := sessionStore.RevokeFamily(rec.FamilyID); err != nil {
+			fmt.Println("Session family revoke error:", err)
+		}
+		return
+	}
+	if err := sessionStore.DeleteSession(hash); err != nil {
+		fmt.Println("Session delete error:", err)
+	}
+}
+
+// ListSessions returns every active login of a user, most recent first
+func ListSessions(nickname string) ([]db.FamilyRecord, error) {
+	return sessionStore.ListFamilies(nickname)
+}
+
+// RevokeUserSession ends one login of a user. It reports false if the
+// session does not exist or belongs to someone else.
+func RevokeUserSession(nickname, familyID string) (bool, error) {
+	rec, err := sessionStore.GetFamily(familyID)
+	if errors.Is(err, db.ErrFamilyNotFound) || (err == nil && rec.Nickname != nickname) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, sessionStore.RevokeFamily(familyID)
+}
+
+// RevokeAllUserSessions ends every login of a user
+func RevokeAllUserSessions(nickname string) error {
+	return RevokeOtherUserSessions(nickname, "")
 }
 
-// CleanupExpiredSessions periodically removes expired sessions
+// RevokeOtherUserSessions ends every login of a user except keepFamilyID
+func RevokeOtherUserSessions(nickname, keepFamilyID string) error {
+	families, err := sessionStore.ListFamilies(nickname)
+	if err != nil {
+		return err
+	}
+	for _, f := range families {
+		if f.ID == keepFamilyID {
+			continue
+		}
+		if err := sessionStore.RevokeFamily(f.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	const bearerPrefix = "Bearer "
+	if len(authHeader) <= len(bearerPrefix) || authHeader[:len(bearerPrefix)] != bearerPrefix {
+		return "", false
+	}
+	return authHeader[len(bearerPrefix):], true
+}
+
+// requireSession validates the bearer token, writing a 401 if it is missing or invalid
+func requireSession(w http.ResponseWriter, r *http.Request) (db.SessionRecord, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		http.Error(w, "Missing or invalid authorization header", http.StatusUnauthorized)
+		return db.SessionRecord{}, false
+	}
+	session, valid := LookupSession(token)
+	if !valid {
+		http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+		return db.SessionRecord{}, false
+	}
+	return session, true
+}
+
+// CleanupExpiredSessions periodically sweeps expired sessions from the store
 func CleanupExpiredSessions() {
 	ticker := time.NewTicker(1 * time.Hour)
 	go func() {
 		for range ticker.C {
-			sessionsMu.Lock()
-			now := time.Now()
-			for token, session := range sessions {
-				if now.After(session.ExpiresAt) {
-					delete(sessions, token)
-				}
+			n, err := sessionStore.DeleteExpiredSessions(time.Now())
+			if err != nil {
+				fmt.Println("Session cleanup error:", err)
+				continue
+			}
+			if n > 0 {
+				fmt.Printf("Removed %d expired sessions\n", n)
 			}
-			sessionsMu.Unlock()
 		}
 	}()
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+// useMemorySessions gives a test its own empty session store
+func useMemorySessions(t *testing.T) *db.MemorySessionStore {
+	t.Helper()
+	prev := sessionStore
+	store := db.NewMemorySessionStore()
+	sessionStore = store
+	t.Cleanup(func() { sessionStore = prev })
+	return store
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	store := useMemorySessions(t)
+
+	session, err := CreateSession("tester", ClientInfo{})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	if _, err := store.GetSession(session.Token); err != db.ErrSessionNotFound {
+		t.Error("Expected the raw token not to be stored")
+	}
+
+	nickname, ok := ValidateSession(session.Token)
+	if !ok || nickname != "tester" {
+		t.Fatalf("Expected valid session for tester, got %q %v", nickname, ok)
+	}
+
+	DeleteSession(session.Token)
+	if _, ok := ValidateSession(session.Token); ok {
+		t.Error("Expected session to be invalid after delete")
+	}
+}
+
+func TestExpiredSessionIsRejectedAndSwept(t *testing.T) {
+	store := useMemorySessions(t)
+
+	session, err := CreateSession("tester", ClientInfo{})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	hash := hashToken(session.Token)
+	rec, _ := store.GetSession(hash)
+	rec.ExpiresAt = time.Now().Add(-time.Minute)
+	store.CreateSession(rec)
+
+	if _, ok := ValidateSession(session.Token); ok {
+		t.Error("Expected expired session to be rejected")
+	}
+
+	other, _ := CreateSession("other", ClientInfo{})
+	rec, _ = store.GetSession(hashToken(other.Token))
+	rec.ExpiresAt = time.Now().Add(-time.Minute)
+	store.CreateSession(rec)
+
+	if n, _ := store.DeleteExpiredSessions(time.Now()); n != 1 {
+		t.Errorf("Expected 1 expired session swept, got %d", n)
+	}
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	useMemorySessions(t)
+
+	first, err := CreateSession("tester", ClientInfo{})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	second, err := RefreshSession(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+
+	if second.Token == first.Token || second.RefreshToken == first.RefreshToken {
+		t.Error("Expected new tokens after refresh")
+	}
+	if second.FamilyID != first.FamilyID {
+		t.Error("Expected rotated tokens to stay in the same family")
+	}
+	if nickname, ok := ValidateSession(second.Token); !ok || nickname != "tester" {
+		t.Error("Expected the rotated access token to be valid")
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	useMemorySessions(t)
+
+	first, _ := CreateSession("tester", ClientInfo{})
+	second, err := RefreshSession(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+
+	if _, err := RefreshSession(first.RefreshToken); err != ErrRefreshTokenReused {
+		t.Fatalf("Expected ErrRefreshTokenReused, got %v", err)
+	}
+	if _, ok := ValidateSession(second.Token); ok {
+		t.Error("Expected access tokens of the family to be revoked")
+	}
+	if _, err := RefreshSession(second.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected the latest refresh token to be revoked too, got %v", err)
+	}
+}
+
+func TestRevokeOtherUserSessionsKeepsCurrent(t *testing.T) {
+	useMemorySessions(t)
+
+	current, _ := CreateSession("tester", ClientInfo{})
+	other, _ := CreateSession("tester", ClientInfo{})
+	stranger, _ := CreateSession("someone", ClientInfo{})
+
+	if err := RevokeOtherUserSessions("tester", current.FamilyID); err != nil {
+		t.Fatalf("RevokeOtherUserSessions: %v", err)
+	}
+	if _, ok := ValidateSession(current.Token); !ok {
+		t.Error("Expected the current session to survive")
+	}
+	if _, ok := ValidateSession(other.Token); ok {
+		t.Error("Expected the other session to be revoked")
+	}
+	if _, ok := ValidateSession(stranger.Token); !ok {
+		t.Error("Expected other users' sessions to be untouched")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is the time allowed to write a single frame to the peer
+	writeWait = 10 * time.Second
+	// maxQueuedFrames bounds the outbound queue; state frames are coalesced
+	// so only lobby/control messages can fill it up
+	maxQueuedFrames = 256
+	// CloseSlowConsumer is the close code sent to clients whose queue overflowed
+	CloseSlowConsumer = 4008
+	// CloseSessionRevoked is the close code sent when the login was revoked
+	CloseSessionRevoked = 4001
+)
+
+var (
+	ErrClientClosed = errors.New("client connection closed")
+	ErrSlowConsumer = errors.New("client outbound queue full")
+)
+
+type outboundFrame struct {
+	data  []byte
+	state bool // Game state snapshot; superseded by any newer snapshot
+}
+
+type Client struct {
+	Nickname string
+	FamilyID string // Session family the connection was authenticated with
+	Conn     *websocket.Conn
+	Lobby    *Lobby
+	mu       sync.RWMutex
+	Game     *GameState   // Nil if in lobby/waiting; guarded by mu
+	pair     *pairSession // Current pair match, if any; guarded by mu
+
+	queueMu   sync.Mutex
+	queue     []outboundFrame // Pending frames; guarded by queueMu
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte // Close frame WritePump sends on its way out; set before done is closed
+}
+
+func NewClient(nickname string, conn *websocket.Conn, lobby *Lobby) *Client {
+	return &Client{
+		Nickname: nickname,
+		Conn:     conn,
+		Lobby:    lobby,
+		queue:    make([]outboundFrame, 0, 16),
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *Client) GetGame() *GameState {
+	c.mu.RLock()
+	game := c.Game
+	c.mu.RUnlock()
+	return game
+}
+
+func (c *Client) SetGame(game *GameState) {
+	c.mu.Lock()
+	c.Game = game
+	c.mu.Unlock()
+}
+
+// PairSession returns the pair match the client is part of, if any
+func (c *Client) PairSession() *pairSession {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pair
+}
+
+func (c *Client) setPairSession(s *pairSession) {
+	c.mu.Lock()
+	c.pair = s
+	c.mu.Unlock()
+}
+
+// clearPairSession detaches the client only if it still belongs to s
+func (c *Client) clearPairSession(s *pairSession) {
+	c.mu.Lock()
+	if c.pair == s {
+		c.pair = nil
+	}
+	c.mu.Unlock()
+}
+
+// SendJSON queues a message for delivery by the writer goroutine.
+// It never blocks on the network.
+func (c *Client) SendJSON(message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(outboundFrame{data: data})
+}
+
+// SendState queues a game state snapshot. Any snapshot still waiting in the
+// queue is dropped, since only the newest state matters to the client.
+func (c *Client) SendState(state interface{}) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return c.SendStateFrame(data)
+}
+
+// SendStateFrame is SendState for an already encoded snapshot, so a pair game
+// can marshal once and share the bytes between both players.
+func (c *Client) SendStateFrame(data []byte) error {
+	return c.enqueue(outboundFrame{data: data, state: true})
+}
+
+func (c *Client) enqueue(frame outboundFrame) error {
+	if c.closed() {
+		return ErrClientClosed
+	}
+
+	c.queueMu.Lock()
+	if frame.state {
+		// Drop stale snapshots but keep the order of other messages intact
+		kept := c.queue[:0]
+		for _, f := range c.queue {
+			if !f.state {
+				kept = append(kept, f)
+			}
+		}
+		c.queue = kept
+	}
+	if len(c.queue) >= maxQueuedFrames {
+		c.queueMu.Unlock()
+		log.Printf("Client %s is too slow, disconnecting", c.Nickname)
+		c.closeWithCode(CloseSlowConsumer, "slow consumer")
+		return ErrSlowConsumer
+	}
+	c.queue = append(c.queue, frame)
+	c.queueMu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// WritePump drains the outbound queue to the connection. It must run in its
+// own goroutine; it is the only writer on Conn, and closes it once the
+// client is closed.
+func (c *Client) WritePump() {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case <-c.done:
+		case <-c.notify:
+		}
+		// Closing takes priority over frames still queued
+		if c.closed() {
+			if c.closeMsg != nil {
+				c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.Conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
+			}
+			return
+		}
+
+		c.queueMu.Lock()
+		frames := c.queue
+		c.queue = make([]outboundFrame, 0, 16)
+		c.queueMu.Unlock()
+
+		for _, f := range frames {
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.TextMessage, f.data); err != nil {
+				log.Printf("Write error for %s: %v", c.Nickname, err)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Close stops the writer goroutine, which closes the connection. Further
+// sends return ErrClientClosed.
+func (c *Client) Close() {
+	c.shutdown(nil)
+}
+
+// closeWithCode is Close that has the writer send a close frame with code
+// and reason first. It does no I/O itself, so it is safe under locks.
+func (c *Client) closeWithCode(code int, reason string) {
+	c.shutdown(websocket.FormatCloseMessage(code, reason))
+}
+
+func (c *Client) shutdown(closeMsg []byte) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = closeMsg
+		close(c.done)
+	})
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestClientPair returns a server-side Client (writer not started) and the
+// browser-side connection reading from it.
+func newTestClientPair(t *testing.T) (*Client, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	client := NewClient("tester", <-serverConns, nil)
+	t.Cleanup(client.Close)
+	return client, peer
+}
+
+func TestSendStateCoalescesStaleFrames(t *testing.T) {
+	client, peer := newTestClientPair(t)
+
+	client.SendState(map[string]int{"tick": 1})
+	client.SendJSON(map[string]string{"type": "game_start"})
+	client.SendState(map[string]int{"tick": 2})
+	client.SendState(map[string]int{"tick": 3})
+
+	go client.WritePump()
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var first map[string]interface{}
+	if err := peer.ReadJSON(&first); err != nil {
+		t.Fatalf("read first frame: %v", err)
+	}
+	if first["type"] != "game_start" {
+		t.Errorf("Expected game_start first, got %v", first)
+	}
+
+	var second map[string]interface{}
+	if err := peer.ReadJSON(&second); err != nil {
+		t.Fatalf("read second frame: %v", err)
+	}
+	if second["tick"] != float64(3) {
+		t.Errorf("Expected only newest snapshot (tick 3), got %v", second)
+	}
+}
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	client, peer := newTestClientPair(t)
+
+	var err error
+	for i := 0; i <= maxQueuedFrames; i++ {
+		if err = client.SendJSON(map[string]int{"n": i}); err != nil {
+			break
+		}
+	}
+	if err != ErrSlowConsumer {
+		t.Fatalf("Expected ErrSlowConsumer, got %v", err)
+	}
+	if err := client.SendJSON("late"); err != ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed after disconnect, got %v", err)
+	}
+
+	// The writer sends the close frame instead of the backlog
+	go client.WritePump()
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = peer.ReadMessage()
+	if !websocket.IsCloseError(err, CloseSlowConsumer) {
+		t.Errorf("Expected close code %d, got %v", CloseSlowConsumer, err)
+	}
+}
+
+func TestCloseWithCodeReachesPeer(t *testing.T) {
+	client, peer := newTestClientPair(t)
+	go client.WritePump()
+
+	client.SendJSON(map[string]string{"type": "hello"})
+	client.closeWithCode(CloseSessionRevoked, "session revoked")
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := peer.ReadMessage()
+		if err == nil {
+			continue // The greeting may or may not have gone out first
+		}
+		if !websocket.IsCloseError(err, CloseSessionRevoked) {
+			t.Errorf("Expected close code %d, got %v", CloseSessionRevoked, err)
+		}
+		break
+	}
+}
@@ -0,0 +1,127 @@
+// Command migrate inspects, applies and rolls back database migrations. It
+// connects like the server: Postgres from the DB_* variables, or the SQLite
+// file in SQLITE_PATH when DB_HOST is unset.
+//
+//	migrate status    list migrations and whether they are applied
+//	migrate up        apply every pending migration
+//	migrate down N    roll back the last N applied migrations
+//	migrate redo      roll back the last applied migration and apply it again
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: migrate status | up | down N | redo")
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	m, closeFn, err := openMigrator()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = run(m, args)
+	closeFn()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func openMigrator() (*db.Migrator, func(), error) {
+	if os.Getenv("DB_HOST") == "" {
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			return nil, nil, fmt.Errorf("set DB_HOST for Postgres or SQLITE_PATH for SQLite")
+		}
+		store, err := db.OpenSQLiteStore(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store.Migrator(), func() { store.Close() }, nil
+	}
+
+	if err := db.Connect(); err != nil {
+		return nil, nil, err
+	}
+	store := db.PostgresStore{}
+	m, err := db.NewPostgresMigrator()
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	return m, func() { store.Close() }, nil
+}
+
+func run(m *db.Migrator, args []string) error {
+	switch args[0] {
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf("status takes no arguments")
+		}
+		return printStatus(m)
+
+	case "up":
+		if len(args) != 1 {
+			return fmt.Errorf("up takes no arguments")
+		}
+		n, err := m.Up()
+		fmt.Printf("Applied %d migration(s)\n", n)
+		return err
+
+	case "down":
+		if len(args) != 2 {
+			return fmt.Errorf("down needs the number of migrations to roll back")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid count %q", args[1])
+		}
+		done, err := m.Down(n)
+		fmt.Printf("Rolled back %d migration(s)\n", done)
+		return err
+
+	case "redo":
+		if len(args) != 1 {
+			return fmt.Errorf("redo takes no arguments")
+		}
+		return m.Redo()
+
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func printStatus(m *db.Migrator) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSTATE\tAPPLIED AT")
+	for _, st := range statuses {
+		appliedAt := ""
+		if !st.AppliedAt.IsZero() {
+			appliedAt = st.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", st.ID, st.Name, st.State, appliedAt)
+	}
+	return w.Flush()
+}
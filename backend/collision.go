@@ -1,5 +1,8 @@
 package main
 
+// DeathCauseGhost is recorded when a ghost catches the last player alive
+const DeathCauseGhost = "ghost"
+
 func (g *GameState) checkCollisions() {
 	collisions := g.getCollisions()
 	for _, c := range collisions {
@@ -17,6 +20,7 @@ func (g *GameState) checkCollisions() {
 	}
 	if !anyAlive {
 		g.GameOver = true
+		g.DeathCause = DeathCauseGhost
 	}
 }
 
@@ -29,10 +33,14 @@ func isCollision(ghost *Ghost, p *PlayerState) bool {
 func (g *GameState) resolveCollision(ghost *Ghost, p *PlayerState) {
 	if g.PowerModeTime > 0 {
 		g.Score += 200
+		g.GhostsEaten++
+		g.ghostStreak++
+		g.emit(GameEvent{Type: EventGhostEaten, Player: p.Nickname, Streak: g.ghostStreak})
 		ghost.Pos = Position{X: 9, Y: 8} // Send home
 		ghost.LastPos = Position{X: 9, Y: 8}
 	} else {
 		p.Alive = false // Kill player
+		g.emit(GameEvent{Type: EventDeath, Player: p.Nickname})
 	}
 }
 
@@ -54,3 +54,58 @@ func TestDirectCollision(t *testing.T) {
 		t.Errorf("Expected player to be dead after direct collision, but is alive")
 	}
 }
+
+func TestGhostDeathIsRecordedInResult(t *testing.T) {
+	game := NewGameOnMap([]string{"tester"}, 3, DefaultMapName)
+	p := game.Players["tester"]
+	p.Pos = Position{X: 1, Y: 1}
+	game.Ghosts[0].Pos = Position{X: 1, Y: 1}
+	game.Score = 420
+
+	game.checkCollisions()
+
+	result := game.Result(ModeSingle, "tester")
+	if result.DeathCause != DeathCauseGhost || result.Score != 420 || result.GhostCount != 3 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if result.Mode != "single" || result.MapName != DefaultMapName || result.Level != 1 {
+		t.Errorf("Unexpected game details in result %+v", result)
+	}
+}
+
+func TestDeathCauseWaitsForLastPlayer(t *testing.T) {
+	game := NewGame([]string{"alice", "bob"}, 4)
+	alice, bob := game.Players["alice"], game.Players["bob"]
+	alice.Pos = Position{X: 1, Y: 1}
+	bob.Pos = Position{X: 5, Y: 5}
+	game.Ghosts[0].Pos = Position{X: 1, Y: 1}
+
+	game.checkCollisions()
+	if alice.Alive || game.GameOver || game.DeathCause != "" {
+		t.Fatalf("Expected only alice caught, got game over %v, cause %q", game.GameOver, game.DeathCause)
+	}
+
+	game.Ghosts[1].Pos = bob.Pos
+	game.checkCollisions()
+	if !game.GameOver || game.DeathCause != DeathCauseGhost {
+		t.Errorf("Expected the ghost recorded once bob is caught, got game over %v, cause %q", game.GameOver, game.DeathCause)
+	}
+}
+
+func TestPowerModeCountsEatenGhosts(t *testing.T) {
+	game := NewGame([]string{"tester"}, 4)
+	p := game.Players["tester"]
+	p.Pos = Position{X: 1, Y: 1}
+	game.Ghosts[0].Pos = Position{X: 1, Y: 1}
+	game.Ghosts[1].Pos = Position{X: 1, Y: 1}
+	game.PowerModeTime = 5000
+
+	game.checkCollisions()
+
+	if !p.Alive || game.GhostsEaten != 2 {
+		t.Errorf("Expected two ghosts eaten, got %d (alive %v)", game.GhostsEaten, p.Alive)
+	}
+	if result := game.Result(ModeSingle, "tester"); result.Ghosts != 2 {
+		t.Errorf("Expected the result to carry the ghost count, got %+v", result)
+	}
+}
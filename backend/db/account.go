@@ -0,0 +1,223 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UserExport is everything the store keeps about a user, for handing it
+// back to them
+type UserExport struct {
+	Nickname   string           `json:"nickname"`
+	Email      string           `json:"email,omitempty"`
+	Guest      bool             `json:"guest"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	Identities []LinkedIdentity `json:"identities,omitempty"`
+	Games      []ExportedGame   `json:"games"`
+}
+
+// LinkedIdentity is an external login attached to an account
+type LinkedIdentity struct {
+	Issuer      string    `json:"issuer"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email,omitempty"`
+	LinkedAt    time.Time `json:"linkedAt"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+}
+
+// ExportedGame is one game a user played, with everything recorded about it
+type ExportedGame struct {
+	ID          int64     `json:"id"`
+	Mode        string    `json:"mode"`
+	Partner     string    `json:"partner,omitempty"`
+	GhostCount  int       `json:"ghostCount"`
+	Map         string    `json:"map,omitempty"`
+	Score       int       `json:"score"`
+	DurationSec float64   `json:"durationSeconds,omitempty"`
+	Level       int       `json:"level,omitempty"`
+	DeathCause  string    `json:"deathCause,omitempty"`
+	Dots        int       `json:"dotsEaten"`
+	Ghosts      int       `json:"ghostsEaten"`
+	PlayedAt    time.Time `json:"playedAt"`
+}
+
+// ExportUser returns a user's account and complete game history
+func ExportUser(nickname string) (UserExport, error) {
+	if db == nil {
+		return UserExport{}, fmt.Errorf("database not initialized")
+	}
+	var e UserExport
+	var email sql.NullString
+	err := db.QueryRow("SELECT nickname, email, is_guest, created_at FROM users WHERE nickname = $1", nickname).
+		Scan(&e.Nickname, &email, &e.Guest, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserExport{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserExport{}, err
+	}
+	e.Email = email.String
+
+	if e.Identities, err = linkedIdentities(db, nickname); err != nil {
+		return UserExport{}, err
+	}
+	rows, err := db.Query(`
+		SELECT id, mode, CASE WHEN player1 = $1 THEN player2 ELSE player1 END,
+			ghost_count, map, score, duration_ms, level, death_cause, dots_eaten, ghosts_eaten, created_at
+		FROM game_results
+		WHERE player1 = $1 OR player2 = $1
+		ORDER BY created_at, id`, nickname)
+	if err != nil {
+		return UserExport{}, fmt.Errorf("export games: %w", err)
+	}
+	defer rows.Close()
+	if e.Games, err = scanExportedGames(rows); err != nil {
+		return UserExport{}, err
+	}
+	return e, nil
+}
+
+// scanExportedGames reads rows shaped like ExportUser's game query, with
+// the time as a timestamp or, from SQLite, Unix microseconds
+func scanExportedGames(rows *sql.Rows) ([]ExportedGame, error) {
+	games := []ExportedGame{}
+	for rows.Next() {
+		var g ExportedGame
+		var partner, mapName, deathCause sql.NullString
+		var durationMillis, level, dots, ghosts sql.NullInt64
+		var playedAt interface{}
+		if err := rows.Scan(&g.ID, &g.Mode, &partner, &g.GhostCount, &mapName, &g.Score,
+			&durationMillis, &level, &deathCause, &dots, &ghosts, &playedAt); err != nil {
+			return nil, err
+		}
+		g.PlayedAt = scannedTime(playedAt)
+		g.Partner = partner.String
+		g.Map = mapName.String
+		g.DurationSec = float64(durationMillis.Int64) / 1000
+		g.Level = int(level.Int64)
+		g.DeathCause = deathCause.String
+		g.Dots = int(dots.Int64)
+		g.Ghosts = int(ghosts.Int64)
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+// scannedTime converts a time scanned into an interface{}: a timestamp
+// from Postgres or, from SQLite, Unix microseconds
+func scannedTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case int64:
+		return time.UnixMicro(t)
+	}
+	return time.Time{}
+}
+
+func linkedIdentities(conn *sql.DB, nickname string) ([]LinkedIdentity, error) {
+	rows, err := conn.Query(`
+		SELECT issuer, subject, email, created_at, last_login_at FROM user_identities
+		WHERE nickname = $1 ORDER BY created_at`, nickname)
+	if err != nil {
+		return nil, fmt.Errorf("export identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []LinkedIdentity{}
+	for rows.Next() {
+		var i LinkedIdentity
+		var email sql.NullString
+		var linkedAt, lastLoginAt interface{}
+		if err := rows.Scan(&i.Issuer, &i.Subject, &email, &linkedAt, &lastLoginAt); err != nil {
+			return nil, err
+		}
+		i.Email = email.String
+		i.LinkedAt = scannedTime(linkedAt)
+		i.LastLoginAt = scannedTime(lastLoginAt)
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteUser removes an account with its logins, sessions, rating and
+// achievements in one transaction. Single-player results are moved to
+// anonymousName if keepScores is set and deleted otherwise; pair results
+// belong to the partner too, so they are always moved. The admin audit log
+// is kept as it is.
+func DeleteUser(nickname, anonymousName string, keepScores bool) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the row, so a concurrent rename of the account waits for us
+	var id int
+	err = tx.QueryRow("SELECT id FROM users WHERE nickname = $1 FOR UPDATE", nickname).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := removePlayerResults(tx, postgresPairAnonymizeSQL, nickname, anonymousName, keepScores); err != nil {
+		return err
+	}
+	if err := deleteAccountRows(tx, nickname); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteAccountRows removes a user row with its rating and logins, leaving
+// results to the caller
+func deleteAccountRows(tx *sql.Tx, nickname string) error {
+	cleanups := []string{
+		"DELETE FROM ratings WHERE nickname = $1",
+		"DELETE FROM password_reset_tokens WHERE nickname = $1",
+		"DELETE FROM refresh_tokens WHERE nickname = $1",
+		"DELETE FROM sessions WHERE nickname = $1",
+		"DELETE FROM session_families WHERE nickname = $1",
+		// Identities and achievements go with the user row
+		"DELETE FROM users WHERE nickname = $1",
+	}
+	for _, q := range cleanups {
+		if _, err := tx.Exec(q, nickname); err != nil {
+			return fmt.Errorf("delete user: %w", err)
+		}
+	}
+	return nil
+}
+
+// postgresPairAnonymizeSQL renames a player in pair results, keeping each
+// pair in the byte order normalizeResult uses
+const postgresPairAnonymizeSQL = `
+	UPDATE game_results SET
+		player1 = LEAST(CASE WHEN player1 = $1 THEN $2 ELSE player1 END COLLATE "C", CASE WHEN player2 = $1 THEN $2 ELSE player2 END COLLATE "C"),
+		player2 = GREATEST(CASE WHEN player1 = $1 THEN $2 ELSE player1 END COLLATE "C", CASE WHEN player2 = $1 THEN $2 ELSE player2 END COLLATE "C")
+	WHERE mode = 'pair' AND (player1 = $1 OR player2 = $1)`
+
+// removePlayerResults deletes or anonymizes a player's results as
+// DeleteUser describes, using pairSQL to rename them in pair results
+func removePlayerResults(tx *sql.Tx, pairSQL, nickname, anonymousName string, keepScores bool) error {
+	single := "DELETE FROM game_results WHERE mode = 'single' AND player1 = $1"
+	args := []interface{}{nickname}
+	if keepScores {
+		single = "UPDATE game_results SET player1 = $2 WHERE mode = 'single' AND player1 = $1"
+		args = append(args, anonymousName)
+	}
+	if _, err := tx.Exec(single, args...); err != nil {
+		return fmt.Errorf("remove results: %w", err)
+	}
+	if _, err := tx.Exec(pairSQL, nickname, anonymousName); err != nil {
+		return fmt.Errorf("remove pair results: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// AchievementDef is an achievement as stored in the catalog
+type AchievementDef struct {
+	ID          string
+	Name        string
+	Description string
+}
+
+// UnlockedAchievement is an achievement a player has earned
+type UnlockedAchievement struct {
+	ID         string
+	UnlockedAt time.Time
+}
+
+// SyncAchievements writes the achievement catalog, updating the names and
+// descriptions of ones that already exist
+func SyncAchievements(defs []AchievementDef) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range defs {
+		_, err := tx.Exec(`
+			INSERT INTO achievements (id, name, description) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, description = EXCLUDED.description`,
+			d.ID, d.Name, d.Description)
+		if err != nil {
+			return fmt.Errorf("sync achievement %s: %w", d.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// UnlockAchievement records that a player earned an achievement, reporting
+// whether it is new to them
+func UnlockAchievement(nickname, id string) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+	res, err := db.Exec(`
+		INSERT INTO user_achievements (nickname, achievement_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, nickname, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// GetUserAchievements returns the achievements a player has earned, oldest
+// first
+func GetUserAchievements(nickname string) ([]UnlockedAchievement, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE nickname = $1)", nickname).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	rows, err := db.Query(`
+		SELECT achievement_id, unlocked_at FROM user_achievements
+		WHERE nickname = $1 ORDER BY unlocked_at, achievement_id`, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unlocked := []UnlockedAchievement{}
+	for rows.Next() {
+		var u UnlockedAchievement
+		if err := rows.Scan(&u.ID, &u.UnlockedAt); err != nil {
+			return nil, err
+		}
+		unlocked = append(unlocked, u)
+	}
+	return unlocked, rows.Err()
+}
+
+// CountGamesPlayed returns how many games a player has finished
+func CountGamesPlayed(nickname string) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM game_results WHERE player1 = $1 OR player2 = $1", nickname).Scan(&n)
+	return n, err
+}
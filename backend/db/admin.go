@@ -0,0 +1,297 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	RolePlayer = "player"
+	RoleAdmin  = "admin"
+)
+
+var ErrScoreNotFound = errors.New("score not found")
+
+// AdminScoreEntry is a single-player game result as shown to moderators
+type AdminScoreEntry struct {
+	ID         int       `json:"id"`
+	Nickname   string    `json:"nickname"`
+	Score      int       `json:"score"`
+	GhostCount int       `json:"ghostCount"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// AdminPairScoreEntry is a pair game result as shown to moderators
+type AdminPairScoreEntry struct {
+	ID         int       `json:"id"`
+	Player1    string    `json:"player1"`
+	Player2    string    `json:"player2"`
+	Score      int       `json:"score"`
+	GhostCount int       `json:"ghostCount"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// AuditEntry is one recorded admin action
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Admin     string          `json:"admin"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// UserStatus is the role and ban state of an account
+type UserStatus struct {
+	Role      string
+	Banned    bool
+	BanReason string
+}
+
+// GetUserStatus returns the role and ban state of a user
+func GetUserStatus(nickname string) (UserStatus, error) {
+	if db == nil {
+		return UserStatus{}, fmt.Errorf("database not initialized")
+	}
+	var st UserStatus
+	var bannedAt sql.NullTime
+	var reason sql.NullString
+	err := db.QueryRow("SELECT role, banned_at, ban_reason FROM users WHERE nickname = $1", nickname).
+		Scan(&st.Role, &bannedAt, &reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserStatus{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserStatus{}, err
+	}
+	st.Banned = bannedAt.Valid
+	st.BanReason = reason.String
+	return st, nil
+}
+
+// SetUserRole changes a user's role
+func SetUserRole(nickname, role string) error {
+	return execOnUser(db, "UPDATE users SET role = $2 WHERE nickname = $1", nickname, role)
+}
+
+// BanUser stops a user from logging in or connecting
+func BanUser(nickname, reason string) error {
+	return execOnUser(db, "UPDATE users SET banned_at = CURRENT_TIMESTAMP, ban_reason = $2 WHERE nickname = $1", nickname, reason)
+}
+
+// UnbanUser lifts a ban
+func UnbanUser(nickname string) error {
+	return execOnUser(db, "UPDATE users SET banned_at = NULL, ban_reason = NULL WHERE nickname = $1", nickname)
+}
+
+func execOnUser(conn *sql.DB, query, nickname string, args ...interface{}) error {
+	if conn == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	res, err := conn.Exec(query, append([]interface{}{nickname}, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RenameUser gives an account a new nickname, moving its scores and rating.
+// Logins and reset tokens issued under the old nickname are deleted in the
+// same transaction, so they cannot reach whoever registers that name next.
+func RenameUser(nickname, newNickname string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET nickname = $2 WHERE nickname = $1", nickname, newNickname)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("rename user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	if err := renamePlayerData(tx, nickname, newNickname); err != nil {
+		return err
+	}
+	cleanups := []string{
+		"DELETE FROM password_reset_tokens WHERE nickname = $1",
+		"DELETE FROM refresh_tokens WHERE nickname = $1",
+		"DELETE FROM sessions WHERE nickname = $1",
+		"DELETE FROM session_families WHERE nickname = $1",
+	}
+	for _, q := range cleanups {
+		if _, err := tx.Exec(q, nickname); err != nil {
+			return fmt.Errorf("rename user: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListScores returns single-player game results, optionally filtered by
+// nickname and ghost count (zero for all), highest first
+func ListScores(nickname string, ghostCount, limit int) ([]AdminScoreEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	return listScores(db, nickname, ghostCount, limit)
+}
+
+func listScores(conn *sql.DB, nickname string, ghostCount, limit int) ([]AdminScoreEntry, error) {
+	rows, err := conn.Query(`
+		SELECT id, player1, score, ghost_count, created_at FROM game_results
+		WHERE mode = 'single' AND ($1 = '' OR player1 = $1) AND ($2 = 0 OR ghost_count = $2)
+		ORDER BY score DESC LIMIT $3`, nickname, ghostCount, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AdminScoreEntry{}
+	for rows.Next() {
+		var e AdminScoreEntry
+		var createdAt interface{}
+		if err := rows.Scan(&e.ID, &e.Nickname, &e.Score, &e.GhostCount, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = scannedTime(createdAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ListPairScores returns pair game results, optionally filtered by a player
+// and ghost count (zero for all), highest first
+func ListPairScores(nickname string, ghostCount, limit int) ([]AdminPairScoreEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	return listPairScores(db, nickname, ghostCount, limit)
+}
+
+func listPairScores(conn *sql.DB, nickname string, ghostCount, limit int) ([]AdminPairScoreEntry, error) {
+	rows, err := conn.Query(`
+		SELECT id, player1, player2, score, ghost_count, created_at FROM game_results
+		WHERE mode = 'pair' AND ($1 = '' OR player1 = $1 OR player2 = $1) AND ($2 = 0 OR ghost_count = $2)
+		ORDER BY score DESC LIMIT $3`, nickname, ghostCount, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AdminPairScoreEntry{}
+	for rows.Next() {
+		var e AdminPairScoreEntry
+		var createdAt interface{}
+		if err := rows.Scan(&e.ID, &e.Player1, &e.Player2, &e.Score, &e.GhostCount, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = scannedTime(createdAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteScore removes a single-player game result by id. If it was the
+// player's best, the next best takes its place on the scoreboard.
+func DeleteScore(id int) error {
+	return deleteByID(db, "DELETE FROM game_results WHERE id = $1 AND mode = 'single'", id)
+}
+
+// DeletePairScore removes a pair game result by id
+func DeletePairScore(id int) error {
+	return deleteByID(db, "DELETE FROM game_results WHERE id = $1 AND mode = 'pair'", id)
+}
+
+func deleteByID(conn *sql.DB, query string, id int) error {
+	if conn == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	res, err := conn.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrScoreNotFound
+	}
+	return nil
+}
+
+// RecordAdminAction appends an entry to the audit log
+func RecordAdminAction(admin, action, target string, details interface{}) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	raw, err := auditDetails(details)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO admin_audit (admin, action, target, details)
+		VALUES ($1, $2, $3, $4)`, admin, action, target, nullableJSON(raw))
+	return err
+}
+
+// auditDetails encodes the details of an admin action, nil for none
+func auditDetails(details interface{}) ([]byte, error) {
+	if details == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return nil, fmt.Errorf("encode audit details: %w", err)
+	}
+	return raw, nil
+}
+
+func nullableJSON(raw []byte) interface{} {
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
+
+// ListAdminActions returns the most recent audit entries, newest first
+func ListAdminActions(limit int) ([]AuditEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	return listAdminActions(db, limit)
+}
+
+func listAdminActions(conn *sql.DB, limit int) ([]AuditEntry, error) {
+	rows, err := conn.Query(`
+		SELECT id, admin, action, target, details, created_at FROM admin_audit
+		ORDER BY created_at DESC, id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var details []byte
+		var createdAt interface{}
+		if err := rows.Scan(&e.ID, &e.Admin, &e.Action, &e.Target, &details, &createdAt); err != nil {
+			return nil, err
+		}
+		e.Details = details
+		e.CreatedAt = scannedTime(createdAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
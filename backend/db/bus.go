@@ -0,0 +1,133 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// boardChannel is the Postgres NOTIFY channel for board changes
+const boardChannel = "leaderboard_changes"
+
+// BoardChange says a new result may have changed the boards of a mode and
+// ghost count. The zero value means any board may have changed, which is
+// sent after missed notices could have been lost.
+type BoardChange struct {
+	Mode       string `json:"mode"`
+	GhostCount int    `json:"ghostCount"`
+}
+
+// Affects reports whether the change may touch board b
+func (c BoardChange) Affects(b Board) bool {
+	return c.Mode == "" || (c.Mode == b.Mode && c.GhostCount == b.GhostCount)
+}
+
+// BoardBus carries board changes to every server process. Handlers run on
+// their own goroutines, one per change, so they should hand slow work to a
+// worker rather than block.
+type BoardBus interface {
+	Publish(c BoardChange) error
+	Subscribe(fn func(BoardChange))
+	Close() error
+}
+
+// MemoryBus delivers changes within this process only. It is enough when
+// one server owns the storage, as with SQLite or the memory store.
+type MemoryBus struct {
+	mu       sync.RWMutex
+	handlers []func(BoardChange)
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Publish(c BoardChange) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.handlers {
+		go fn(c)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(fn func(BoardChange)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, fn)
+	b.mu.Unlock()
+}
+
+func (b *MemoryBus) Close() error { return nil }
+
+// PostgresBus sends changes with NOTIFY and receives them with LISTEN, so
+// every replica sharing the database hears about every result, its own
+// included
+type PostgresBus struct {
+	listener *pq.Listener
+	mu       sync.RWMutex
+	handlers []func(BoardChange)
+}
+
+// NewPostgresBus listens on the database opened by InitDB
+func NewPostgresBus() (*PostgresBus, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	listener := pq.NewListener(connString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Board change listener:", err)
+		}
+	})
+	if err := listener.Listen(boardChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("listen for board changes: %w", err)
+	}
+	b := &PostgresBus{listener: listener}
+	go b.run()
+	return b, nil
+}
+
+func (b *PostgresBus) run() {
+	for n := range b.listener.Notify {
+		// A nil notification follows a reconnect; anything could have
+		// changed while the connection was down
+		var c BoardChange
+		if n != nil {
+			if err := json.Unmarshal([]byte(n.Extra), &c); err != nil {
+				log.Println("Invalid board change notice:", err)
+				continue
+			}
+		}
+		b.mu.RLock()
+		for _, fn := range b.handlers {
+			go fn(c)
+		}
+		b.mu.RUnlock()
+	}
+}
+
+func (b *PostgresBus) Publish(c BoardChange) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("SELECT pg_notify($1, $2)", boardChannel, string(payload))
+	return err
+}
+
+func (b *PostgresBus) Subscribe(fn func(BoardChange)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, fn)
+	b.mu.Unlock()
+}
+
+func (b *PostgresBus) Close() error {
+	return b.listener.Close()
+}
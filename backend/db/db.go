@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
 
 	"github.com/lib/pq"
@@ -13,28 +12,15 @@ import (
 
 var db *sql.DB
 
-var ErrUsernameTaken = errors.New("username already taken")
+// connString is what db was opened with, for connections of its own such as
+// LISTEN
+var connString string
 
-// ScoreEntry represents a row in the scoreboard
-type ScoreEntry struct {
-	Nickname string `json:"nickname"`
-	Score    int    `json:"score"`
-}
-
-// PairScoreEntry represents a row in the pair scoreboard
-type PairScoreEntry struct {
-	Player1 string `json:"player1"`
-	Player2 string `json:"player2"`
-	Score   int    `json:"score"`
-}
-
-func RequireDB(w http.ResponseWriter) bool {
-	if db == nil {
-		http.Error(w, "Database not configured", http.StatusServiceUnavailable)
-		return false
-	}
-	return true
-}
+var (
+	ErrUsernameTaken = errors.New("username already taken")
+	ErrEmailTaken    = errors.New("email already in use")
+	ErrNotGuest      = errors.New("user is not a guest")
+)
 
 func InitDB() {
 	var err error
@@ -53,6 +39,25 @@ func InitDB() {
 	fmt.Println("Database initialized successfully")
 }
 
+// InitPostgres connects to the Postgres database at connStr and migrates
+// it, as InitDB does with the DB_* variables
+func InitPostgres(connStr string) error {
+	if err := openPostgres(connStr); err != nil {
+		return err
+	}
+	if err := RunMigrations(db); err != nil {
+		closeDB()
+		return fmt.Errorf("Error running migrations: %v", err)
+	}
+	return nil
+}
+
+// Connect opens the database from the DB_* variables without migrating it,
+// for tools that manage migrations themselves
+func Connect() error {
+	return connectDB()
+}
+
 func closeDB() {
 	if db != nil {
 		_ = db.Close()
@@ -75,7 +80,13 @@ func connectDB() error {
 		return fmt.Errorf("Warning: DB_HOST not set, skipping DB init")
 	}
 
+	return openPostgres(connStr)
+}
+
+// openPostgres connects the package to the database at connStr
+func openPostgres(connStr string) error {
 	var err error
+	connString = connStr
 	db, err = sql.Open("postgres", connStr)
 	if err != nil {
 		return fmt.Errorf("Error connecting to DB: %v", err)
@@ -89,98 +100,9 @@ func connectDB() error {
 	return nil
 }
 
-func SaveScore(nickname string, score int, ghostCount int) error {
-	if db == nil {
-		return fmt.Errorf("database not initialized")
-	}
-	
-	// Default to 4 ghosts if not specified (legacy logic safety, though new callers should pass it)
-	if ghostCount <= 0 {
-		ghostCount = 4
-	}
-
-	upsertSQL := `
-		INSERT INTO scores (nickname, score, ghost_count, updated_at)
-		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
-		ON CONFLICT (nickname, ghost_count)
-		DO UPDATE SET score = EXCLUDED.score, updated_at = CURRENT_TIMESTAMP
-		WHERE scores.score < EXCLUDED.score
-	`
-	_, err := db.Exec(upsertSQL, nickname, score, ghostCount)
-	return err
-}
-
-func SavePairScore(player1, player2 string, score int) error {
-	if db == nil {
-		return fmt.Errorf("database not initialized")
-	}
-
-	// Ensure alphabetical order for consistency in scoreboard
-	if player1 > player2 {
-		player1, player2 = player2, player1
-	}
-
-	// Upsert: only store the best score for each pair
-	upsertSQL := `
-		INSERT INTO pair_scores (player1, player2, score, updated_at)
-		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
-		ON CONFLICT (player1, player2)
-		DO UPDATE SET score = EXCLUDED.score, updated_at = CURRENT_TIMESTAMP
-		WHERE pair_scores.score < EXCLUDED.score
-	`
-	_, err := db.Exec(upsertSQL, player1, player2, score)
-	return err
-}
-
-func GetTopScores(ghostCount int) ([]ScoreEntry, error) {
-	if db == nil {
-		return nil, fmt.Errorf("database not initialized")
-	}
-	
-	if ghostCount <= 0 {
-		ghostCount = 4
-	}
-
-	rows, err := db.Query("SELECT nickname, score FROM scores WHERE ghost_count = $1 ORDER BY score DESC LIMIT 10", ghostCount)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var scores []ScoreEntry
-	for rows.Next() {
-		var entry ScoreEntry
-		if err := rows.Scan(&entry.Nickname, &entry.Score); err != nil {
-			continue
-		}
-		scores = append(scores, entry)
-	}
-	return scores, nil
-}
-
-func GetTopPairScores() ([]PairScoreEntry, error) {
-    if db == nil {
-		return nil, fmt.Errorf("database not initialized")
-	}
-    // Simple top list
-	rows, err := db.Query("SELECT player1, player2, score FROM pair_scores ORDER BY score DESC LIMIT 10")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var scores []PairScoreEntry
-	for rows.Next() {
-		var entry PairScoreEntry
-		if err := rows.Scan(&entry.Player1, &entry.Player2, &entry.Score); err != nil {
-			continue
-		}
-		scores = append(scores, entry)
-	}
-	return scores, nil
-}
-
-func CreateUser(nickname, password string) error {
+// CreateUser stores a new account. Email is optional and only used for
+// password resets; pass "" to leave it unset.
+func CreateUser(nickname, password, email string) error {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
 	}
@@ -188,9 +110,12 @@ func CreateUser(nickname, password string) error {
 	if err != nil {
 		return fmt.Errorf("hash password: %w", err)
 	}
-	_, err = db.Exec("INSERT INTO users (nickname, password_hash) VALUES ($1, $2)", nickname, string(hashedPassword))
+	_, err = db.Exec("INSERT INTO users (nickname, password_hash, email) VALUES ($1, $2, NULLIF($3, ''))", nickname, string(hashedPassword), email)
 	if err != nil {
 		if isUniqueViolation(err) {
+			if constraintName(err) == "users_email_key" {
+				return ErrEmailTaken
+			}
 			return ErrUsernameTaken
 		}
 		return fmt.Errorf("insert user: %w", err)
@@ -206,12 +131,23 @@ func isUniqueViolation(err error) bool {
 	return false
 }
 
+func constraintName(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
 func VerifyUser(nickname, password string) error {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
 	}
 	var storedHash string
 	err := db.QueryRow("SELECT password_hash FROM users WHERE nickname=$1", nickname).Scan(&storedHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
 	if err != nil {
 		return err
 	}
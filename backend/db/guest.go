@@ -0,0 +1,159 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CreateGuestUser stores a guest account. Guests have no password, so they
+// can only be reached through the session they were issued.
+func CreateGuestUser(nickname string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec("INSERT INTO users (nickname, password_hash, is_guest) VALUES ($1, '', TRUE)", nickname)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("insert guest: %w", err)
+	}
+	return nil
+}
+
+// IsGuest reports whether nickname belongs to a guest account
+func IsGuest(nickname string) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+	var guest bool
+	err := db.QueryRow("SELECT is_guest FROM users WHERE nickname = $1", nickname).Scan(&guest)
+	if err != nil {
+		return false, err
+	}
+	return guest, nil
+}
+
+// UpgradeGuest turns a guest into a registered account under a new nickname,
+// moving the guest's scores and rating along in the same transaction.
+func UpgradeGuest(guestNickname, nickname, password, email string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE users SET nickname = $2, password_hash = $3, email = NULLIF($4, ''), is_guest = FALSE
+		WHERE nickname = $1 AND is_guest`, guestNickname, nickname, string(hashedPassword), email)
+	if err != nil {
+		if isUniqueViolation(err) {
+			if constraintName(err) == "users_email_key" {
+				return ErrEmailTaken
+			}
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("upgrade guest: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotGuest
+	}
+
+	if err := renamePlayerData(tx, guestNickname, nickname); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// staleGuestsSQL finds guests with no login, refresh or game since $1,
+// locking them so an upgrade waits for the cleanup. Refresh tokens count
+// because rotating one keeps a login alive without any other trace.
+const staleGuestsSQL = `
+	SELECT u.nickname FROM users u
+	WHERE u.is_guest AND u.created_at < $1
+	  AND NOT EXISTS (SELECT 1 FROM session_families f WHERE f.nickname = u.nickname AND f.last_seen_at >= $1)
+	  AND NOT EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.nickname = u.nickname AND t.created_at >= $1)
+	  AND NOT EXISTS (
+		SELECT 1 FROM game_results r
+		WHERE (r.player1 = u.nickname OR r.player2 = u.nickname) AND r.created_at >= $1)
+	FOR UPDATE OF u`
+
+// DeleteStaleGuests removes guests that have not played or used their login
+// since the cutoff, together with their logins, single-player scores and
+// rating, returning the removed nicknames. Pair results belong to
+// the partner too, so the guest's side is renamed to a name from
+// anonymousName instead, as DeleteUser does.
+func DeleteStaleGuests(before time.Time, anonymousName func() (string, error)) ([]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(staleGuestsSQL, before)
+	if err != nil {
+		return nil, fmt.Errorf("find stale guests: %w", err)
+	}
+	var stale []string
+	for rows.Next() {
+		var nickname string
+		if err := rows.Scan(&nickname); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stale = append(stale, nickname)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, nickname := range stale {
+		name, err := anonymousName()
+		if err != nil {
+			return nil, err
+		}
+		if err := removePlayerResults(tx, postgresPairAnonymizeSQL, nickname, name, false); err != nil {
+			return nil, err
+		}
+		if err := deleteAccountRows(tx, nickname); err != nil {
+			return nil, err
+		}
+	}
+	return stale, tx.Commit()
+}
+
+// renamePlayerData moves scores and rating from one nickname to another.
+// Pair results are re-sorted, since the new name may order differently
+// against the partner's.
+func renamePlayerData(tx *sql.Tx, from, to string) error {
+	renames := []string{
+		"UPDATE game_results SET player1 = $2 WHERE mode = 'single' AND player1 = $1",
+		postgresPairAnonymizeSQL,
+		"UPDATE ratings SET nickname = $2 WHERE nickname = $1",
+	}
+	for _, q := range renames {
+		if _, err := tx.Exec(q, from, to); err != nil {
+			if isUniqueViolation(err) {
+				// A rating already stored under the new name from before accounts existed
+				return ErrUsernameTaken
+			}
+			return fmt.Errorf("move player data: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrIdentityNotFound = errors.New("identity not linked")
+	ErrIdentityLinked   = errors.New("identity already linked to another user")
+)
+
+// FindIdentityUser returns the nickname linked to an external identity and
+// records the login
+func FindIdentityUser(issuer, subject string) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database not initialized")
+	}
+	var nickname string
+	err := db.QueryRow(`
+		UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP
+		WHERE issuer = $1 AND subject = $2
+		RETURNING nickname`, issuer, subject).Scan(&nickname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrIdentityNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return nickname, nil
+}
+
+// CreateIdentityUser creates a passwordless account for an external identity
+// and links the two in one transaction
+func CreateIdentityUser(nickname, email, issuer, subject string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// An empty hash never matches, so the account can only sign in through the provider
+	_, err = tx.Exec("INSERT INTO users (nickname, password_hash) VALUES ($1, '')", nickname)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("insert user: %w", err)
+	}
+	if err := insertIdentity(tx, nickname, email, issuer, subject); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LinkIdentity attaches an external identity to an existing account
+func LinkIdentity(nickname, email, issuer, subject string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var linked string
+	err = tx.QueryRow("SELECT nickname FROM user_identities WHERE issuer = $1 AND subject = $2", issuer, subject).Scan(&linked)
+	switch {
+	case err == nil && linked == nickname:
+		return nil
+	case err == nil:
+		return ErrIdentityLinked
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	if err := insertIdentity(tx, nickname, email, issuer, subject); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertIdentity(tx *sql.Tx, nickname, email, issuer, subject string) error {
+	_, err := tx.Exec(`
+		INSERT INTO user_identities (issuer, subject, nickname, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))`, issuer, subject, nickname, email)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrIdentityLinked
+		}
+		return fmt.Errorf("insert identity: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var ErrNotRanked = errors.New("player has no score on this board")
+
+// Board identifies one scoreboard: a mode, a ghost count and the time it
+// counts games from (the zero time for all time)
+type Board struct {
+	Mode       string
+	GhostCount int
+	Since      time.Time
+}
+
+// BoardEntry is a player's (or pair's) best score on a board. Single-player
+// entries have a nickname, pair entries two players.
+type BoardEntry struct {
+	Rank     int    `json:"rank"`
+	Nickname string `json:"nickname,omitempty"`
+	Player1  string `json:"player1,omitempty"`
+	Player2  string `json:"player2,omitempty"`
+	Score    int    `json:"score"`
+}
+
+// PlayerRank is where a player stands on a board. Percentile is the share of
+// the other entries ranked below the player, so the leader is at 100 and the
+// last place at 0.
+type PlayerRank struct {
+	Nickname   string  `json:"nickname"`
+	Rank       int     `json:"rank"`
+	Total      int     `json:"total"`
+	Percentile float64 `json:"percentile"`
+	Score      int     `json:"score"`
+}
+
+// rankedBoardSQL ranks the best result of each player or pair on a board.
+// Ties share a rank; pos breaks them by who got there first so pages and
+// windows are stable. Single games have no player2, which DISTINCT ON treats
+// as one value.
+const rankedBoardSQL = `
+	WITH best AS (
+		SELECT DISTINCT ON (player1, player2)
+			player1, COALESCE(player2, '') AS player2, score, created_at
+		FROM game_results
+		WHERE mode = $1 AND ghost_count = $2
+		  AND created_at >= COALESCE($3::timestamptz, '-infinity')
+		  AND player1 NOT IN (SELECT nickname FROM users WHERE is_guest)
+		  AND (player2 IS NULL OR player2 NOT IN (SELECT nickname FROM users WHERE is_guest))
+		ORDER BY player1, player2, score DESC, created_at
+	), ranked AS (
+		SELECT player1, player2, score,
+			RANK() OVER by_score AS rank,
+			PERCENT_RANK() OVER by_score AS percent_rank,
+			ROW_NUMBER() OVER (ORDER BY score DESC, created_at, player1, player2) AS pos,
+			COUNT(*) OVER () AS total
+		FROM best
+		WINDOW by_score AS (ORDER BY score DESC)
+	)`
+
+func (b Board) args() []interface{} {
+	ghostCount := b.GhostCount
+	if ghostCount <= 0 {
+		ghostCount = 4
+	}
+	var since interface{}
+	if !b.Since.IsZero() {
+		since = b.Since
+	}
+	return []interface{}{b.Mode, ghostCount, since}
+}
+
+func (b Board) entry(rank int, player1, player2 string, score int) BoardEntry {
+	if b.Mode == GameModeSingle {
+		return BoardEntry{Rank: rank, Nickname: player1, Score: score}
+	}
+	return BoardEntry{Rank: rank, Player1: player1, Player2: player2, Score: score}
+}
+
+// GetBoardPage returns limit entries after skipping offset, best first,
+// along with the number of entries on the whole board
+func GetBoardPage(b Board, offset, limit int) ([]BoardEntry, int, error) {
+	if db == nil {
+		return nil, 0, fmt.Errorf("database not initialized")
+	}
+	// The outer join keeps the total when the page is past the end
+	rows, err := db.Query(rankedBoardSQL+`
+		SELECT t.total, r.player1, r.player2, r.score, r.rank
+		FROM (SELECT COUNT(*) AS total FROM best) t
+		LEFT JOIN ranked r ON r.pos > $4 AND r.pos <= $4 + $5
+		ORDER BY r.pos`, append(b.args(), offset, limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []BoardEntry{}
+	total := 0
+	for rows.Next() {
+		var player1, player2 sql.NullString
+		var score, rank sql.NullInt64
+		if err := rows.Scan(&total, &player1, &player2, &score, &rank); err != nil {
+			return nil, 0, err
+		}
+		if player1.Valid {
+			entries = append(entries, b.entry(int(rank.Int64), player1.String, player2.String, int(score.Int64)))
+		}
+	}
+	return entries, total, rows.Err()
+}
+
+// GetBoardAround returns the player's best entry with up to n entries on
+// either side of it
+func GetBoardAround(b Board, nickname string, n int) ([]BoardEntry, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	rows, err := db.Query(rankedBoardSQL+`, me AS (
+			SELECT pos FROM ranked WHERE player1 = $4 OR player2 = $4
+			ORDER BY pos LIMIT 1
+		)
+		SELECT r.player1, r.player2, r.score, r.rank
+		FROM ranked r, me
+		WHERE r.pos BETWEEN me.pos - $5 AND me.pos + $5
+		ORDER BY r.pos`, append(b.args(), nickname, n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []BoardEntry{}
+	for rows.Next() {
+		var player1, player2 string
+		var score, rank int
+		if err := rows.Scan(&player1, &player2, &score, &rank); err != nil {
+			return nil, err
+		}
+		entries = append(entries, b.entry(rank, player1, player2, score))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotRanked
+	}
+	return entries, nil
+}
+
+// GetBoardRank returns where a player's best entry stands on the board
+func GetBoardRank(b Board, nickname string) (PlayerRank, error) {
+	if db == nil {
+		return PlayerRank{}, fmt.Errorf("database not initialized")
+	}
+	rank := PlayerRank{Nickname: nickname}
+	var percentRank float64
+	err := db.QueryRow(rankedBoardSQL+`
+		SELECT rank, total, percent_rank, score FROM ranked
+		WHERE player1 = $4 OR player2 = $4
+		ORDER BY pos LIMIT 1`, append(b.args(), nickname)...).
+		Scan(&rank.Rank, &rank.Total, &percentRank, &rank.Score)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PlayerRank{}, ErrNotRanked
+	}
+	if err != nil {
+		return PlayerRank{}, err
+	}
+	rank.Percentile = percentile(percentRank)
+	return rank, nil
+}
+
+// percentile turns a PERCENT_RANK into the share of entries below, to one
+// decimal
+func percentile(percentRank float64) float64 {
+	return math.Round((1-percentRank)*1000) / 10
+}
@@ -0,0 +1,900 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type memoryUser struct {
+	nickname     string
+	passwordHash string
+	email        string
+	guest        bool
+	role         string
+	banned       bool
+	banReason    string
+	createdAt    time.Time
+}
+
+type memoryResetToken struct {
+	nickname  string
+	expiresAt time.Time
+	used      bool
+}
+
+type identityKey struct {
+	issuer  string
+	subject string
+}
+
+type memoryIdentity struct {
+	nickname    string
+	email       string
+	createdAt   time.Time
+	lastLoginAt time.Time
+}
+
+type memoryResult struct {
+	id         int64
+	mode       string
+	player1    string
+	player2    string
+	ghostCount int
+	mapName    string
+	score      int
+	duration   time.Duration
+	level      int
+	deathCause string
+	dots       int
+	ghosts     int
+	createdAt  time.Time
+}
+
+// rankedEntry is one row of a ranked board, as rankedBoardSQL builds it
+type rankedEntry struct {
+	player1     string
+	player2     string
+	score       int
+	createdAt   time.Time
+	rank        int
+	percentRank float64
+}
+
+// MemoryStore keeps accounts and results in process memory. It is used in
+// tests and when no database is configured; everything is lost on restart.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	users        map[string]memoryUser // By lowercased nickname
+	results      []memoryResult
+	lastID       int64
+	ratings      map[string]float64
+	resetTokens  map[string]memoryResetToken // By token hash
+	identities   map[identityKey]memoryIdentity
+	achievements map[string]AchievementDef
+	unlocked     map[string][]UnlockedAchievement // By nickname, oldest first
+	audit        []AuditEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:        make(map[string]memoryUser),
+		ratings:      make(map[string]float64),
+		resetTokens:  make(map[string]memoryResetToken),
+		identities:   make(map[identityKey]memoryIdentity),
+		achievements: make(map[string]AchievementDef),
+		unlocked:     make(map[string][]UnlockedAchievement),
+	}
+}
+
+func (m *MemoryStore) Migrate() error { return nil }
+
+func (m *MemoryStore) Close() error { return nil }
+
+func (m *MemoryStore) CreateUser(nickname, password, email string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[strings.ToLower(nickname)]; ok {
+		return ErrUsernameTaken
+	}
+	if m.emailTaken(email, "") {
+		return ErrEmailTaken
+	}
+	m.users[strings.ToLower(nickname)] = memoryUser{nickname: nickname, passwordHash: string(hashedPassword), email: email, role: RolePlayer, createdAt: time.Now()}
+	return nil
+}
+
+func (m *MemoryStore) CreateGuestUser(nickname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[strings.ToLower(nickname)]; ok {
+		return ErrUsernameTaken
+	}
+	m.users[strings.ToLower(nickname)] = memoryUser{nickname: nickname, guest: true, role: RolePlayer, createdAt: time.Now()}
+	return nil
+}
+
+func (m *MemoryStore) VerifyUser(nickname, password string) error {
+	m.mu.RLock()
+	u, ok := m.users[strings.ToLower(nickname)]
+	m.mu.RUnlock()
+	// Logins match the nickname exactly, as in Postgres
+	if !ok || u.nickname != nickname {
+		return ErrUserNotFound
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.passwordHash), []byte(password))
+}
+
+// emailTaken reports whether a user other than except has the email
+func (m *MemoryStore) emailTaken(email, except string) bool {
+	if email == "" {
+		return false
+	}
+	for _, u := range m.users {
+		if u.nickname != except && strings.EqualFold(u.email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) UpdatePassword(nickname, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.user(nickname)
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.passwordHash = string(hashedPassword)
+	m.users[strings.ToLower(nickname)] = u
+	return nil
+}
+
+func (m *MemoryStore) UpgradeGuest(guestNickname, nickname, password, email string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.user(guestNickname)
+	if !ok || !u.guest {
+		return ErrNotGuest
+	}
+	if m.emailTaken(email, guestNickname) {
+		return ErrEmailTaken
+	}
+	if err := m.renameUser(guestNickname, nickname); err != nil {
+		return err
+	}
+	u, _ = m.user(nickname)
+	u.passwordHash = string(hashedPassword)
+	u.email = email
+	u.guest = false
+	m.users[strings.ToLower(nickname)] = u
+	return nil
+}
+
+func (m *MemoryStore) DeleteStaleGuests(before time.Time, anonymousName func() (string, error)) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := make(map[string]bool)
+	for _, r := range m.results {
+		if !r.createdAt.Before(before) {
+			active[r.player1] = true
+			active[r.player2] = true
+		}
+	}
+	stale := []string{}
+	for _, u := range m.users {
+		if u.guest && u.createdAt.Before(before) && !active[u.nickname] {
+			stale = append(stale, u.nickname)
+		}
+	}
+	sort.Strings(stale)
+	for _, nickname := range stale {
+		name, err := anonymousName()
+		if err != nil {
+			return nil, err
+		}
+		m.deleteUser(nickname, name, false)
+	}
+	return stale, nil
+}
+
+func (m *MemoryStore) FindUserForReset(identifier string) (string, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if u, ok := m.user(identifier); ok {
+		return u.nickname, u.email, nil
+	}
+	for _, u := range m.users {
+		if u.email != "" && strings.EqualFold(u.email, identifier) {
+			return u.nickname, u.email, nil
+		}
+	}
+	return "", "", ErrUserNotFound
+}
+
+func (m *MemoryStore) CreatePasswordResetToken(tokenHash, nickname string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.user(nickname); !ok {
+		return ErrUserNotFound
+	}
+	m.resetTokens[tokenHash] = memoryResetToken{nickname: nickname, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MemoryStore) ResetPassword(tokenHash, newPassword string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.resetTokens[tokenHash]
+	if !ok || t.used || !t.expiresAt.After(time.Now()) {
+		return "", ErrInvalidResetToken
+	}
+	u, ok := m.user(t.nickname)
+	if !ok {
+		return "", ErrInvalidResetToken
+	}
+	u.passwordHash = string(hashedPassword)
+	m.users[strings.ToLower(u.nickname)] = u
+
+	t.used = true
+	m.resetTokens[tokenHash] = t
+	// Any other outstanding reset links for this user are now stale
+	for hash, other := range m.resetTokens {
+		if other.nickname == t.nickname && !other.used {
+			delete(m.resetTokens, hash)
+		}
+	}
+	return t.nickname, nil
+}
+
+func (m *MemoryStore) FindIdentityUser(issuer, subject string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := identityKey{issuer, subject}
+	i, ok := m.identities[key]
+	if !ok {
+		return "", ErrIdentityNotFound
+	}
+	i.lastLoginAt = time.Now()
+	m.identities[key] = i
+	return i.nickname, nil
+}
+
+func (m *MemoryStore) CreateIdentityUser(nickname, email, issuer, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[strings.ToLower(nickname)]; ok {
+		return ErrUsernameTaken
+	}
+	key := identityKey{issuer, subject}
+	if _, ok := m.identities[key]; ok {
+		return ErrIdentityLinked
+	}
+	// An empty hash never matches, so the account can only sign in through the provider
+	now := time.Now()
+	m.users[strings.ToLower(nickname)] = memoryUser{nickname: nickname, role: RolePlayer, createdAt: now}
+	m.identities[key] = memoryIdentity{nickname: nickname, email: email, createdAt: now, lastLoginAt: now}
+	return nil
+}
+
+func (m *MemoryStore) LinkIdentity(nickname, email, issuer, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := identityKey{issuer, subject}
+	if i, ok := m.identities[key]; ok {
+		if i.nickname == nickname {
+			return nil
+		}
+		return ErrIdentityLinked
+	}
+	if _, ok := m.user(nickname); !ok {
+		return ErrUserNotFound
+	}
+	now := time.Now()
+	m.identities[key] = memoryIdentity{nickname: nickname, email: email, createdAt: now, lastLoginAt: now}
+	return nil
+}
+
+func (m *MemoryStore) SaveGameResult(r GameResult) error {
+	r, player1, player2, err := normalizeResult(r)
+	if err != nil {
+		return err
+	}
+	createdAt := r.PlayedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	m.mu.Lock()
+	m.lastID++
+	m.results = append(m.results, memoryResult{
+		id:         m.lastID,
+		mode:       r.Mode,
+		player1:    player1,
+		player2:    player2,
+		ghostCount: r.GhostCount,
+		mapName:    r.MapName,
+		score:      r.Score,
+		duration:   r.Duration,
+		level:      r.Level,
+		deathCause: r.DeathCause,
+		dots:       r.Dots,
+		ghosts:     r.Ghosts,
+		createdAt:  createdAt,
+	})
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) isGuest(nickname string) bool {
+	u, ok := m.users[strings.ToLower(nickname)]
+	return ok && u.guest && u.nickname == nickname
+}
+
+// ranked builds the board the way rankedBoardSQL does: each player's or
+// pair's best result, ordered by score with the earliest result first on a
+// tie
+func (m *MemoryStore) ranked(b Board) []rankedEntry {
+	ghostCount := b.GhostCount
+	if ghostCount <= 0 {
+		ghostCount = 4
+	}
+
+	m.mu.RLock()
+	best := make(map[[2]string]memoryResult)
+	for _, r := range m.results {
+		if r.mode != b.Mode || r.ghostCount != ghostCount || r.createdAt.Before(b.Since) {
+			continue
+		}
+		if m.isGuest(r.player1) || (r.player2 != "" && m.isGuest(r.player2)) {
+			continue
+		}
+		key := [2]string{r.player1, r.player2}
+		cur, ok := best[key]
+		if !ok || r.score > cur.score || (r.score == cur.score && r.createdAt.Before(cur.createdAt)) {
+			best[key] = r
+		}
+	}
+	m.mu.RUnlock()
+
+	entries := make([]rankedEntry, 0, len(best))
+	for _, r := range best {
+		entries = append(entries, rankedEntry{player1: r.player1, player2: r.player2, score: r.score, createdAt: r.createdAt})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if !a.createdAt.Equal(b.createdAt) {
+			return a.createdAt.Before(b.createdAt)
+		}
+		if a.player1 != b.player1 {
+			return a.player1 < b.player1
+		}
+		return a.player2 < b.player2
+	})
+	for i := range entries {
+		if i > 0 && entries[i].score == entries[i-1].score {
+			entries[i].rank = entries[i-1].rank
+		} else {
+			entries[i].rank = i + 1
+		}
+		if len(entries) > 1 {
+			entries[i].percentRank = float64(entries[i].rank-1) / float64(len(entries)-1)
+		}
+	}
+	return entries
+}
+
+// position returns the index of the player's best entry, or -1
+func position(entries []rankedEntry, nickname string) int {
+	for i, e := range entries {
+		if e.player1 == nickname || e.player2 == nickname {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryStore) GetBoardPage(b Board, offset, limit int) ([]BoardEntry, int, error) {
+	ranked := m.ranked(b)
+	page := []BoardEntry{}
+	for i := offset; i < len(ranked) && i < offset+limit; i++ {
+		e := ranked[i]
+		page = append(page, b.entry(e.rank, e.player1, e.player2, e.score))
+	}
+	return page, len(ranked), nil
+}
+
+func (m *MemoryStore) GetBoardRank(b Board, nickname string) (PlayerRank, error) {
+	ranked := m.ranked(b)
+	i := position(ranked, nickname)
+	if i < 0 {
+		return PlayerRank{}, ErrNotRanked
+	}
+	return PlayerRank{
+		Nickname:   nickname,
+		Rank:       ranked[i].rank,
+		Total:      len(ranked),
+		Percentile: percentile(ranked[i].percentRank),
+		Score:      ranked[i].score,
+	}, nil
+}
+
+func (m *MemoryStore) GetBoardAround(b Board, nickname string, n int) ([]BoardEntry, error) {
+	ranked := m.ranked(b)
+	i := position(ranked, nickname)
+	if i < 0 {
+		return nil, ErrNotRanked
+	}
+	entries := []BoardEntry{}
+	for j := max(0, i-n); j < len(ranked) && j <= i+n; j++ {
+		e := ranked[j]
+		entries = append(entries, b.entry(e.rank, e.player1, e.player2, e.score))
+	}
+	return entries, nil
+}
+
+// user returns the account with exactly this nickname
+func (m *MemoryStore) user(nickname string) (memoryUser, bool) {
+	u, ok := m.users[strings.ToLower(nickname)]
+	return u, ok && u.nickname == nickname
+}
+
+func (m *MemoryStore) ExportUser(nickname string) (UserExport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.user(nickname)
+	if !ok {
+		return UserExport{}, ErrUserNotFound
+	}
+	e := UserExport{Nickname: u.nickname, Email: u.email, Guest: u.guest, CreatedAt: u.createdAt, Games: []ExportedGame{}}
+	for key, i := range m.identities {
+		if i.nickname == nickname {
+			e.Identities = append(e.Identities, LinkedIdentity{
+				Issuer:      key.issuer,
+				Subject:     key.subject,
+				Email:       i.email,
+				LinkedAt:    i.createdAt,
+				LastLoginAt: i.lastLoginAt,
+			})
+		}
+	}
+	sort.Slice(e.Identities, func(i, j int) bool { return e.Identities[i].LinkedAt.Before(e.Identities[j].LinkedAt) })
+	for _, r := range m.results {
+		if r.player1 != nickname && r.player2 != nickname {
+			continue
+		}
+		e.Games = append(e.Games, ExportedGame{
+			ID:          r.id,
+			Mode:        r.mode,
+			Partner:     r.partner(nickname),
+			GhostCount:  r.ghostCount,
+			Map:         r.mapName,
+			Score:       r.score,
+			DurationSec: r.duration.Seconds(),
+			Level:       r.level,
+			DeathCause:  r.deathCause,
+			Dots:        r.dots,
+			Ghosts:      r.ghosts,
+			PlayedAt:    r.createdAt,
+		})
+	}
+	return e, nil
+}
+
+func (m *MemoryStore) DeleteUser(nickname, anonymousName string, keepScores bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.user(nickname); !ok {
+		return ErrUserNotFound
+	}
+	m.deleteUser(nickname, anonymousName, keepScores)
+	return nil
+}
+
+// deleteUser removes an account and everything kept under its nickname,
+// treating results as DeleteUser describes
+func (m *MemoryStore) deleteUser(nickname, anonymousName string, keepScores bool) {
+	kept := m.results[:0]
+	for _, r := range m.results {
+		if r.mode == GameModeSingle && r.player1 == nickname && !keepScores {
+			continue
+		}
+		kept = append(kept, r.renamed(nickname, anonymousName))
+	}
+	m.results = kept
+	delete(m.ratings, nickname)
+	delete(m.unlocked, nickname)
+	m.deleteResetTokens(nickname)
+	for key, i := range m.identities {
+		if i.nickname == nickname {
+			delete(m.identities, key)
+		}
+	}
+	delete(m.users, strings.ToLower(nickname))
+}
+
+func (m *MemoryStore) deleteResetTokens(nickname string) {
+	for hash, t := range m.resetTokens {
+		if t.nickname == nickname {
+			delete(m.resetTokens, hash)
+		}
+	}
+}
+
+// renamed returns the result with the player from renamed to, keeping a
+// pair in the order normalizeResult uses
+func (r memoryResult) renamed(from, to string) memoryResult {
+	if r.player1 == from {
+		r.player1 = to
+	} else if r.player2 == from {
+		r.player2 = to
+	}
+	if r.mode == GameModePair && r.player1 > r.player2 {
+		r.player1, r.player2 = r.player2, r.player1
+	}
+	return r
+}
+
+// renameUser moves an account and everything kept under its nickname to a
+// new one, as the Postgres RenameUser does
+func (m *MemoryStore) renameUser(nickname, newNickname string) error {
+	u, ok := m.user(nickname)
+	if !ok {
+		return ErrUserNotFound
+	}
+	if other, ok := m.users[strings.ToLower(newNickname)]; ok && other.nickname != nickname {
+		return ErrUsernameTaken
+	}
+	if _, ok := m.ratings[newNickname]; ok {
+		// A rating already stored under the new name from before accounts existed
+		return ErrUsernameTaken
+	}
+
+	for i, r := range m.results {
+		m.results[i] = r.renamed(nickname, newNickname)
+	}
+	if rating, ok := m.ratings[nickname]; ok {
+		m.ratings[newNickname] = rating
+		delete(m.ratings, nickname)
+	}
+	if unlocked, ok := m.unlocked[nickname]; ok {
+		m.unlocked[newNickname] = unlocked
+		delete(m.unlocked, nickname)
+	}
+	for key, i := range m.identities {
+		if i.nickname == nickname {
+			i.nickname = newNickname
+			m.identities[key] = i
+		}
+	}
+	m.deleteResetTokens(nickname)
+
+	delete(m.users, strings.ToLower(nickname))
+	u.nickname = newNickname
+	m.users[strings.ToLower(newNickname)] = u
+	return nil
+}
+
+func (m *MemoryStore) GetRating(nickname string) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if rating, ok := m.ratings[nickname]; ok {
+		return rating, nil
+	}
+	return DefaultRating, nil
+}
+
+func (m *MemoryStore) AdjustRating(nickname string, delta float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rating, ok := m.ratings[nickname]
+	if !ok {
+		rating = DefaultRating
+	}
+	m.ratings[nickname] = rating + delta
+	return nil
+}
+
+func (m *MemoryStore) GetUserProfile(nickname string, recent int) (Profile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// Profiles match the nickname regardless of case, as in Postgres
+	u, ok := m.users[strings.ToLower(nickname)]
+	if !ok {
+		return Profile{}, ErrUserNotFound
+	}
+	p := Profile{Nickname: u.nickname, JoinedAt: u.createdAt, Guest: u.guest, Rating: DefaultRating, BestScores: []BestScore{}}
+	if rating, ok := m.ratings[u.nickname]; ok {
+		p.Rating = rating
+	}
+
+	var games []memoryResult
+	for _, r := range m.results {
+		if r.player1 == u.nickname || r.player2 == u.nickname {
+			games = append(games, r)
+		}
+	}
+
+	// Games from before durations were recorded do not count towards the
+	// average, as AVG skips them in Postgres
+	var timed int
+	var totalDuration time.Duration
+	best := make(map[[2]interface{}]int) // Index into p.BestScores by mode and ghost count
+	partners := make(map[string]*PartnerStat)
+	for _, r := range games {
+		p.Stats.GamesPlayed++
+		if r.mode == GameModeSingle {
+			p.Stats.SingleGames++
+		} else {
+			p.Stats.PairGames++
+		}
+		p.Stats.TotalDots += int64(r.dots)
+		p.Stats.GhostsEaten += int64(r.ghosts)
+		if r.duration > 0 {
+			timed++
+			totalDuration += r.duration
+		}
+
+		key := [2]interface{}{r.mode, r.ghostCount}
+		if i, ok := best[key]; !ok {
+			best[key] = len(p.BestScores)
+			p.BestScores = append(p.BestScores, BestScore{Mode: r.mode, GhostCount: r.ghostCount, Score: r.score, AchievedAt: r.createdAt})
+		} else if b := &p.BestScores[i]; r.score > b.Score || (r.score == b.Score && r.createdAt.Before(b.AchievedAt)) {
+			b.Score, b.AchievedAt = r.score, r.createdAt
+		}
+
+		if r.mode == GameModePair {
+			partner := r.partner(u.nickname)
+			ps, ok := partners[partner]
+			if !ok {
+				ps = &PartnerStat{Nickname: partner, BestScore: r.score}
+				partners[partner] = ps
+			}
+			ps.GamesPlayed++
+			ps.BestScore = max(ps.BestScore, r.score)
+		}
+	}
+	if timed > 0 {
+		p.Stats.AverageGameSeconds = totalDuration.Seconds() / float64(timed)
+	}
+	sort.Slice(p.BestScores, func(i, j int) bool {
+		a, b := p.BestScores[i], p.BestScores[j]
+		if a.Mode != b.Mode {
+			return a.Mode > b.Mode
+		}
+		return a.GhostCount < b.GhostCount
+	})
+	for _, ps := range partners {
+		f := p.FavouritePartner
+		if f == nil || ps.GamesPlayed > f.GamesPlayed ||
+			(ps.GamesPlayed == f.GamesPlayed && (ps.BestScore > f.BestScore ||
+				(ps.BestScore == f.BestScore && ps.Nickname < f.Nickname))) {
+			p.FavouritePartner = ps
+		}
+	}
+
+	sort.Slice(games, func(i, j int) bool {
+		if !games[i].createdAt.Equal(games[j].createdAt) {
+			return games[i].createdAt.After(games[j].createdAt)
+		}
+		return games[i].id > games[j].id
+	})
+	p.RecentGames = []RecentGame{}
+	for _, r := range games[:min(recent, len(games))] {
+		p.RecentGames = append(p.RecentGames, RecentGame{
+			ID:          r.id,
+			Mode:        r.mode,
+			Partner:     r.partner(u.nickname),
+			GhostCount:  r.ghostCount,
+			Map:         r.mapName,
+			Score:       r.score,
+			DurationSec: r.duration.Seconds(),
+			DeathCause:  r.deathCause,
+			PlayedAt:    r.createdAt,
+		})
+	}
+	return p, nil
+}
+
+// partner returns the other player of a pair result, or "" for a single one
+func (r memoryResult) partner(nickname string) string {
+	if r.player2 == nickname {
+		return r.player1
+	}
+	return r.player2
+}
+
+func (m *MemoryStore) SyncAchievements(defs []AchievementDef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range defs {
+		m.achievements[d.ID] = d
+	}
+	return nil
+}
+
+func (m *MemoryStore) UnlockAchievement(nickname, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.user(nickname); !ok {
+		return false, ErrUserNotFound
+	}
+	if _, ok := m.achievements[id]; !ok {
+		return false, fmt.Errorf("unknown achievement %s", id)
+	}
+	for _, u := range m.unlocked[nickname] {
+		if u.ID == id {
+			return false, nil
+		}
+	}
+	m.unlocked[nickname] = append(m.unlocked[nickname], UnlockedAchievement{ID: id, UnlockedAt: time.Now()})
+	return true, nil
+}
+
+func (m *MemoryStore) GetUserAchievements(nickname string) ([]UnlockedAchievement, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.user(nickname); !ok {
+		return nil, ErrUserNotFound
+	}
+	return append([]UnlockedAchievement{}, m.unlocked[nickname]...), nil
+}
+
+func (m *MemoryStore) CountGamesPlayed(nickname string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, r := range m.results {
+		if r.player1 == nickname || r.player2 == nickname {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStore) GetUserStatus(nickname string) (UserStatus, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.user(nickname)
+	if !ok {
+		return UserStatus{}, ErrUserNotFound
+	}
+	return UserStatus{Role: u.role, Banned: u.banned, BanReason: u.banReason}, nil
+}
+
+// updateUser applies change to the account with exactly this nickname
+func (m *MemoryStore) updateUser(nickname string, change func(u *memoryUser)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.user(nickname)
+	if !ok {
+		return ErrUserNotFound
+	}
+	change(&u)
+	m.users[strings.ToLower(nickname)] = u
+	return nil
+}
+
+func (m *MemoryStore) SetUserRole(nickname, role string) error {
+	return m.updateUser(nickname, func(u *memoryUser) { u.role = role })
+}
+
+func (m *MemoryStore) BanUser(nickname, reason string) error {
+	return m.updateUser(nickname, func(u *memoryUser) { u.banned, u.banReason = true, reason })
+}
+
+func (m *MemoryStore) UnbanUser(nickname string) error {
+	return m.updateUser(nickname, func(u *memoryUser) { u.banned, u.banReason = false, "" })
+}
+
+func (m *MemoryStore) RenameUser(nickname, newNickname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.renameUser(nickname, newNickname)
+}
+
+// listResults returns the results of a mode that a player took part in
+// (any player if nickname is empty) with the ghost count (any if zero),
+// highest score first
+func (m *MemoryStore) listResults(mode, nickname string, ghostCount, limit int) []memoryResult {
+	m.mu.RLock()
+	var found []memoryResult
+	for _, r := range m.results {
+		if r.mode != mode || (ghostCount != 0 && r.ghostCount != ghostCount) {
+			continue
+		}
+		if nickname != "" && r.player1 != nickname && r.player2 != nickname {
+			continue
+		}
+		found = append(found, r)
+	}
+	m.mu.RUnlock()
+	sort.SliceStable(found, func(i, j int) bool { return found[i].score > found[j].score })
+	return found[:min(limit, len(found))]
+}
+
+func (m *MemoryStore) ListScores(nickname string, ghostCount, limit int) ([]AdminScoreEntry, error) {
+	entries := []AdminScoreEntry{}
+	for _, r := range m.listResults(GameModeSingle, nickname, ghostCount, limit) {
+		entries = append(entries, AdminScoreEntry{ID: int(r.id), Nickname: r.player1, Score: r.score, GhostCount: r.ghostCount, CreatedAt: r.createdAt})
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) ListPairScores(nickname string, ghostCount, limit int) ([]AdminPairScoreEntry, error) {
+	entries := []AdminPairScoreEntry{}
+	for _, r := range m.listResults(GameModePair, nickname, ghostCount, limit) {
+		entries = append(entries, AdminPairScoreEntry{ID: int(r.id), Player1: r.player1, Player2: r.player2, Score: r.score, GhostCount: r.ghostCount, CreatedAt: r.createdAt})
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) DeleteScore(id int) error {
+	return m.deleteResult(GameModeSingle, id)
+}
+
+func (m *MemoryStore) DeletePairScore(id int) error {
+	return m.deleteResult(GameModePair, id)
+}
+
+func (m *MemoryStore) deleteResult(mode string, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.results {
+		if r.id == int64(id) && r.mode == mode {
+			m.results = append(m.results[:i], m.results[i+1:]...)
+			return nil
+		}
+	}
+	return ErrScoreNotFound
+}
+
+func (m *MemoryStore) RecordAdminAction(admin, action, target string, details interface{}) error {
+	raw, err := auditDetails(details)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audit = append(m.audit, AuditEntry{
+		ID:        int64(len(m.audit) + 1),
+		Admin:     admin,
+		Action:    action,
+		Target:    target,
+		Details:   raw,
+		CreatedAt: time.Now(),
+	})
+	return nil
+}
+
+func (m *MemoryStore) ListAdminActions(limit int) ([]AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := []AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.audit[i])
+	}
+	return entries, nil
+}
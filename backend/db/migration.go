@@ -1,228 +1,476 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
-	"fmt"
-	"log"
-	"sort"
+	"encoding/hex"
 )
 
+// Migration is a schema change. Up and Down are SQL scripts run in one
+// transaction each; a migration without Down cannot be rolled back. Once a
+// migration has been applied anywhere its Up must not change, which the
+// recorded checksum enforces: add a new migration instead.
 type Migration struct {
 	ID   int
 	Name string
-	Run  func(*sql.DB) error
+	Up   string
+	Down string
+}
+
+// Checksum identifies the Up script that was applied
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
 }
 
 var migrations = []Migration{
 	{
 		ID:   1,
 		Name: "InitSchema",
-		Run:  initSchema,
+		Up:   initSchemaUp,
+		Down: initSchemaDown,
 	},
 	{
 		ID:   2,
 		Name: "AddGhostCountToScores",
-		Run:  addGhostCountToScores,
+		Up:   addGhostCountToScoresUp,
+		Down: addGhostCountToScoresDown,
 	},
 	{
 		ID:   3,
 		Name: "FixPairScoresConstraint",
-		Run:  fixPairScoresConstraint,
+		Up:   fixPairScoresConstraintUp,
+		Down: fixPairScoresConstraintDown,
+	},
+	{
+		ID:   4,
+		Name: "CreateRatingsTable",
+		Up:   createRatingsTableUp,
+		Down: createRatingsTableDown,
+	},
+	{
+		ID:   5,
+		Name: "AddGhostCountToPairScores",
+		Up:   addGhostCountToPairScoresUp,
+		Down: addGhostCountToPairScoresDown,
+	},
+	{
+		ID:   6,
+		Name: "CreateSessionsTable",
+		Up:   createSessionsTableUp,
+		Down: createSessionsTableDown,
+	},
+	{
+		ID:   7,
+		Name: "CreateRefreshTokensTable",
+		Up:   createRefreshTokensTableUp,
+		Down: createRefreshTokensTableDown,
+	},
+	{
+		ID:   8,
+		Name: "CreateSessionFamiliesTable",
+		Up:   createSessionFamiliesTableUp,
+		Down: createSessionFamiliesTableDown,
+	},
+	{
+		ID:   9,
+		Name: "AddPasswordReset",
+		Up:   addPasswordResetUp,
+		Down: addPasswordResetDown,
+	},
+	{
+		ID:   10,
+		Name: "CaseInsensitiveNicknames",
+		Up:   caseInsensitiveNicknamesUp,
+		Down: caseInsensitiveNicknamesDown,
+	},
+	{
+		ID:   11,
+		Name: "AddGuestUsers",
+		Up:   addGuestUsersUp,
+		Down: addGuestUsersDown,
+	},
+	{
+		ID:   12,
+		Name: "AddRolesAndAudit",
+		Up:   addRolesAndAuditUp,
+		Down: addRolesAndAuditDown,
+	},
+	{
+		ID:   13,
+		Name: "CreateUserIdentitiesTable",
+		Up:   createUserIdentitiesTableUp,
+		Down: createUserIdentitiesTableDown,
+	},
+	{
+		ID:   14,
+		Name: "CreateGameResultsTable",
+		Up:   createGameResultsTableUp,
+		Down: createGameResultsTableDown,
+	},
+	{
+		ID:   15,
+		Name: "AddGameResultsPeriodIndex",
+		Up:   addGameResultsPeriodIndexUp,
+		Down: addGameResultsPeriodIndexDown,
+	},
+	{
+		ID:   16,
+		Name: "AddGameResultsCounters",
+		Up:   addGameResultsCountersUp,
+		Down: addGameResultsCountersDown,
+	},
+	{
+		ID:   17,
+		Name: "CreateAchievementsTables",
+		Up:   createAchievementsTablesUp,
+		Down: createAchievementsTablesDown,
 	},
 }
 
-func ensureSchemaMigrationsTable(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
-		id INT PRIMARY KEY,
-		name TEXT NOT NULL,
-		run_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`)
-	return err
-}
-
+// RunMigrations applies the pending Postgres migrations to db
 func RunMigrations(db *sql.DB) error {
-	if err := ensureSchemaMigrationsTable(db); err != nil {
-		return fmt.Errorf("ensuring migrations table: %w", err)
-	}
-
-	// Get applied migrations
-	rows, err := db.Query("SELECT id FROM schema_migrations")
-	if err != nil {
-		return fmt.Errorf("fetching migrations: %w", err)
-	}
-	defer rows.Close()
-
-	applied := make(map[int]bool)
-	for rows.Next() {
-		var id int
-		if err := rows.Scan(&id); err != nil {
-			return err
-		}
-		applied[id] = true
-	}
-
-	// Sort migrations just in case
-	sort.Slice(migrations, func(i, j int) bool {
-		return migrations[i].ID < migrations[j].ID
-	})
-
-	for _, m := range migrations {
-		if applied[m.ID] {
-			continue
-		}
-
-		log.Printf("Running migration %d: %s", m.ID, m.Name)
-		if err := m.Run(db); err != nil {
-			return fmt.Errorf("migration %d (%s) failed: %w", m.ID, m.Name, err)
-		}
-
-		_, err := db.Exec("INSERT INTO schema_migrations (id, name) VALUES ($1, $2)", m.ID, m.Name)
-		if err != nil {
-			return fmt.Errorf("recording migration %d: %w", m.ID, err)
-		}
-	}
-
-	return nil
+	_, err := postgresMigrator(db).Up()
+	return err
 }
 
 // Migration 1: Initial Schema
-func initSchema(db *sql.DB) error {
-	createUsersTableSQL := `CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		nickname TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL
-	);`
-	if _, err := db.Exec(createUsersTableSQL); err != nil {
-		return fmt.Errorf("creating users table: %w", err)
-	}
-
-	createScoresTableSQL := `CREATE TABLE IF NOT EXISTS scores (
-		id SERIAL PRIMARY KEY,
-		nickname TEXT NOT NULL,
-		score INT NOT NULL,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-	if _, err := db.Exec(createScoresTableSQL); err != nil {
-		return fmt.Errorf("creating scores table: %w", err)
-	}
-	
-	createPairScoresTableV2 := `CREATE TABLE IF NOT EXISTS pair_scores (
-		id SERIAL PRIMARY KEY,
-		player1 TEXT NOT NULL,
-		player2 TEXT NOT NULL,
-		score INT NOT NULL,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-	if _, err := db.Exec(createPairScoresTableV2); err != nil {
-		return fmt.Errorf("creating pair_scores table: %w", err)
-	}
-	
-	return nil
-}
+const initSchemaUp = `
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	nickname TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scores (
+	id SERIAL PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	score INT NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS pair_scores (
+	id SERIAL PRIMARY KEY,
+	player1 TEXT NOT NULL,
+	player2 TEXT NOT NULL,
+	score INT NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
 
-// Migration 2: Add Ghost Count
-func addGhostCountToScores(db *sql.DB) error {
-	// Check if ghost_count column exists
-	var colExists bool
-	err := db.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 FROM information_schema.columns 
-			WHERE table_name='scores' AND column_name='ghost_count'
-		)`).Scan(&colExists)
-	if err != nil {
-		return fmt.Errorf("checking for ghost_count column: %w", err)
-	}
-
-	if !colExists {
-		// Add column with default 4
-		_, err = db.Exec(`ALTER TABLE scores ADD COLUMN ghost_count INT DEFAULT 4`)
-		if err != nil {
-			return fmt.Errorf("adding ghost_count column: %w", err)
-		}
-	}
-	
-	// Check for the old unique constraint (nickname) and drop it if needed
-	var constraintExists bool
-	err = db.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 FROM pg_constraint 
-			WHERE conname = 'scores_nickname_key'
-		)`).Scan(&constraintExists)
-	if err != nil {
-		return fmt.Errorf("checking for old unique constraint: %w", err)
-	}
-
-	if constraintExists {
-		_, err = db.Exec(`ALTER TABLE scores DROP CONSTRAINT scores_nickname_key`)
-		if err != nil {
-			return fmt.Errorf("dropping old constraint: %w", err)
-		}
-	}
-
-	// Check if the new unique index/constraint exists
-	var newConstraintExists bool
-	err = db.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 FROM pg_indexes 
-			WHERE tablename = 'scores' 
-			AND indexname = 'scores_nickname_ghost_count_key'
-		)`).Scan(&newConstraintExists)
-	if err != nil {
-		return fmt.Errorf("checking for new unique index: %w", err)
-	}
-
-	if !newConstraintExists {
-		consolidateSQL := `
-			DELETE FROM scores s1
-			USING scores s2
-			WHERE s1.nickname = s2.nickname
-			  AND s1.ghost_count = s2.ghost_count
-			  AND (s1.score < s2.score OR (s1.score = s2.score AND s1.id > s2.id))
-		`
-		_, err = db.Exec(consolidateSQL)
-		if err != nil {
-			return fmt.Errorf("consolidating duplicate scores: %w", err)
-		}
-
-		_, err = db.Exec(`CREATE UNIQUE INDEX scores_nickname_ghost_count_key ON scores (nickname, ghost_count)`)
-		if err != nil {
-			return fmt.Errorf("creating new unique index: %w", err)
-		}
-	}
-	return nil
-}
+const initSchemaDown = `
+DROP TABLE IF EXISTS pair_scores;
+DROP TABLE IF EXISTS scores;
+DROP TABLE IF EXISTS users;`
+
+// Migration 2: Add Ghost Count. Very old databases had one score per
+// nickname; keep the best per nickname and ghost count.
+const addGhostCountToScoresUp = `
+ALTER TABLE scores ADD COLUMN IF NOT EXISTS ghost_count INT DEFAULT 4;
+ALTER TABLE scores DROP CONSTRAINT IF EXISTS scores_nickname_key;
+DELETE FROM scores s1
+USING scores s2
+WHERE s1.nickname = s2.nickname
+  AND s1.ghost_count = s2.ghost_count
+  AND (s1.score < s2.score OR (s1.score = s2.score AND s1.id > s2.id));
+CREATE UNIQUE INDEX IF NOT EXISTS scores_nickname_ghost_count_key ON scores (nickname, ghost_count);`
+
+const addGhostCountToScoresDown = `
+DROP INDEX IF EXISTS scores_nickname_ghost_count_key;
+ALTER TABLE scores DROP COLUMN IF EXISTS ghost_count;`
 
 // Migration 3: Pair Scores Constraint
-func fixPairScoresConstraint(db *sql.DB) error {
-	var indexExists bool
-	err := db.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 FROM pg_indexes 
-			WHERE tablename = 'pair_scores' 
-			AND indexname = 'pair_scores_player1_player2_key'
-		)`).Scan(&indexExists)
-	if err != nil {
-		return fmt.Errorf("checking for existing index: %w", err)
-	}
-
-	if !indexExists {
-		consolidateDuplicatesSQL := `
-			DELETE FROM pair_scores p1
-			USING pair_scores p2
-			WHERE p1.player1 = p2.player1 
-			  AND p1.player2 = p2.player2 
-			  AND (p1.score < p2.score OR (p1.score = p2.score AND p1.id > p2.id))
-		`
-		_, err = db.Exec(consolidateDuplicatesSQL)
-		if err != nil {
-			return fmt.Errorf("consolidating duplicate pair_scores: %w", err)
-		}
-
-		addPairScoresUniqueConstraint := `CREATE UNIQUE INDEX IF NOT EXISTS pair_scores_player1_player2_key ON pair_scores (player1, player2);`
-		_, err = db.Exec(addPairScoresUniqueConstraint)
-		if err != nil {
-			return fmt.Errorf("adding unique constraint to pair_scores: %w", err)
-		}
-	}
-	return nil
-}
+const fixPairScoresConstraintUp = `
+DELETE FROM pair_scores p1
+USING pair_scores p2
+WHERE p1.player1 = p2.player1
+  AND p1.player2 = p2.player2
+  AND (p1.score < p2.score OR (p1.score = p2.score AND p1.id > p2.id));
+CREATE UNIQUE INDEX IF NOT EXISTS pair_scores_player1_player2_key ON pair_scores (player1, player2);`
+
+const fixPairScoresConstraintDown = `
+DROP INDEX IF EXISTS pair_scores_player1_player2_key;`
+
+// Migration 4: Pair matchmaking ratings
+const createRatingsTableUp = `
+CREATE TABLE IF NOT EXISTS ratings (
+	nickname TEXT PRIMARY KEY,
+	rating DOUBLE PRECISION NOT NULL DEFAULT 1500,
+	games_played INT NOT NULL DEFAULT 0,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createRatingsTableDown = `
+DROP TABLE IF EXISTS ratings;`
+
+// Migration 5: Scope pair scores by ghost count
+const addGhostCountToPairScoresUp = `
+ALTER TABLE pair_scores ADD COLUMN IF NOT EXISTS ghost_count INT NOT NULL DEFAULT 4;
+DROP INDEX IF EXISTS pair_scores_player1_player2_key;
+CREATE UNIQUE INDEX IF NOT EXISTS pair_scores_player1_player2_ghost_count_key ON pair_scores (player1, player2, ghost_count);`
+
+// Only the best score of each pair across ghost counts survives the way back
+const addGhostCountToPairScoresDown = `
+DROP INDEX IF EXISTS pair_scores_player1_player2_ghost_count_key;
+DELETE FROM pair_scores p1
+USING pair_scores p2
+WHERE p1.player1 = p2.player1
+  AND p1.player2 = p2.player2
+  AND (p1.score < p2.score OR (p1.score = p2.score AND p1.id > p2.id));
+CREATE UNIQUE INDEX IF NOT EXISTS pair_scores_player1_player2_key ON pair_scores (player1, player2);
+ALTER TABLE pair_scores DROP COLUMN IF EXISTS ghost_count;`
+
+// Migration 6: Persistent login sessions
+const createSessionsTableUp = `
+CREATE TABLE IF NOT EXISTS sessions (
+	token_hash TEXT PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ NOT NULL,
+	last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at);
+CREATE INDEX IF NOT EXISTS sessions_nickname_idx ON sessions (nickname);`
+
+const createSessionsTableDown = `
+DROP TABLE IF EXISTS sessions;`
+
+// Migration 7: Rotating refresh tokens grouped into token families
+const createRefreshTokensTableUp = `
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS family_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS sessions_family_id_idx ON sessions (family_id);
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash TEXT PRIMARY KEY,
+	family_id TEXT NOT NULL,
+	nickname TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at TIMESTAMPTZ,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);`
+
+const createRefreshTokensTableDown = `
+DROP TABLE IF EXISTS refresh_tokens;
+DROP INDEX IF EXISTS sessions_family_id_idx;
+ALTER TABLE sessions DROP COLUMN IF EXISTS family_id;`
+
+// Migration 8: One row per login for the session management API
+const createSessionFamiliesTableUp = `
+CREATE TABLE IF NOT EXISTS session_families (
+	id TEXT PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS session_families_nickname_idx ON session_families (nickname);`
+
+const createSessionFamiliesTableDown = `
+DROP TABLE IF EXISTS session_families;`
+
+// Migration 9: Email addresses and single-use password reset tokens
+const addPasswordResetUp = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email)) WHERE email IS NOT NULL;
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	token_hash TEXT PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at TIMESTAMPTZ
+);`
+
+const addPasswordResetDown = `
+DROP TABLE IF EXISTS password_reset_tokens;
+DROP INDEX IF EXISTS users_email_key;
+ALTER TABLE users DROP COLUMN IF EXISTS email;`
+
+// Migration 10: Nicknames are unique regardless of case. The index cannot
+// be built over existing clashes, and picking a winner automatically would
+// hand one player's scores to another.
+const caseInsensitiveNicknamesUp = `
+DO $$
+DECLARE
+	clashes TEXT;
+BEGIN
+	SELECT string_agg(name, ', ') INTO clashes FROM (
+		SELECT lower(nickname) AS name FROM users
+		GROUP BY lower(nickname) HAVING COUNT(*) > 1
+	) c;
+	IF clashes IS NOT NULL THEN
+		RAISE EXCEPTION 'nicknames differing only in case must be renamed first: %', clashes;
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_lower_key ON users (lower(nickname));`
+
+const caseInsensitiveNicknamesDown = `
+DROP INDEX IF EXISTS users_nickname_lower_key;`
+
+// Migration 11: Guest accounts, kept apart from registered players
+const addGuestUsersUp = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_guest BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP;
+CREATE INDEX IF NOT EXISTS users_guest_created_at_idx ON users (created_at) WHERE is_guest;`
+
+const addGuestUsersDown = `
+DROP INDEX IF EXISTS users_guest_created_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS created_at;
+ALTER TABLE users DROP COLUMN IF EXISTS is_guest;`
+
+// Migration 12: User roles, bans and the admin audit log
+const addRolesAndAuditUp = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'player';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ban_reason TEXT;
+CREATE TABLE IF NOT EXISTS admin_audit (
+	id BIGSERIAL PRIMARY KEY,
+	admin TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT NOT NULL,
+	details JSONB,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS admin_audit_created_at_idx ON admin_audit (created_at DESC);`
+
+const addRolesAndAuditDown = `
+DROP TABLE IF EXISTS admin_audit;
+ALTER TABLE users DROP COLUMN IF EXISTS ban_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS banned_at;
+ALTER TABLE users DROP COLUMN IF EXISTS role;`
+
+// Migration 13: External OIDC identities linked to accounts
+const createUserIdentitiesTableUp = `
+CREATE TABLE IF NOT EXISTS user_identities (
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	nickname TEXT NOT NULL REFERENCES users (nickname) ON UPDATE CASCADE ON DELETE CASCADE,
+	email TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_login_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_nickname_idx ON user_identities (nickname);`
+
+const createUserIdentitiesTableDown = `
+DROP TABLE IF EXISTS user_identities;`
+
+// Migration 14: Keep every finished game and derive best scores from them.
+// The old best-only tables become the first rows of the history; their
+// timestamps are session-local, which is what the cast assumes. Best
+// results go to whoever got there first on a tie, as the old upsert did.
+const createGameResultsTableUp = `
+CREATE TABLE IF NOT EXISTS game_results (
+	id BIGSERIAL PRIMARY KEY,
+	mode TEXT NOT NULL,
+	player1 TEXT NOT NULL,
+	player2 TEXT,
+	ghost_count INT NOT NULL,
+	map TEXT,
+	score INT NOT NULL,
+	duration_ms BIGINT,
+	level INT,
+	death_cause TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS game_results_board_idx ON game_results (mode, ghost_count, score DESC);
+CREATE INDEX IF NOT EXISTS game_results_player1_idx ON game_results (player1);
+CREATE INDEX IF NOT EXISTS game_results_player2_idx ON game_results (player2) WHERE player2 IS NOT NULL;
+DO $$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = 'scores' AND table_type = 'BASE TABLE'
+	) THEN
+		INSERT INTO game_results (mode, player1, ghost_count, score, created_at)
+		SELECT 'single', nickname, COALESCE(ghost_count, 4), score, COALESCE(updated_at, CURRENT_TIMESTAMP)::timestamptz
+		FROM scores;
+		INSERT INTO game_results (mode, player1, player2, ghost_count, score, created_at)
+		SELECT 'pair', player1, player2, COALESCE(ghost_count, 4), score, COALESCE(updated_at, CURRENT_TIMESTAMP)::timestamptz
+		FROM pair_scores;
+		DROP TABLE scores;
+		DROP TABLE pair_scores;
+	END IF;
+END $$;
+CREATE OR REPLACE VIEW best_scores AS
+SELECT DISTINCT ON (player1, ghost_count)
+	id, player1 AS nickname, ghost_count, score, created_at
+FROM game_results
+WHERE mode = 'single'
+ORDER BY player1, ghost_count, score DESC, created_at, id;
+CREATE OR REPLACE VIEW best_pair_scores AS
+SELECT DISTINCT ON (player1, player2, ghost_count)
+	id, player1, player2, ghost_count, score, created_at
+FROM game_results
+WHERE mode = 'pair'
+ORDER BY player1, player2, ghost_count, score DESC, created_at, id;`
+
+// Rolling back keeps only the best scores, as the old tables did
+const createGameResultsTableDown = `
+CREATE TABLE scores (
+	id SERIAL PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	score INT NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	ghost_count INT DEFAULT 4
+);
+CREATE UNIQUE INDEX scores_nickname_ghost_count_key ON scores (nickname, ghost_count);
+CREATE TABLE pair_scores (
+	id SERIAL PRIMARY KEY,
+	player1 TEXT NOT NULL,
+	player2 TEXT NOT NULL,
+	score INT NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	ghost_count INT NOT NULL DEFAULT 4
+);
+CREATE UNIQUE INDEX pair_scores_player1_player2_ghost_count_key ON pair_scores (player1, player2, ghost_count);
+INSERT INTO scores (nickname, ghost_count, score, updated_at)
+SELECT nickname, ghost_count, score, created_at FROM best_scores;
+INSERT INTO pair_scores (player1, player2, ghost_count, score, updated_at)
+SELECT player1, player2, ghost_count, score, created_at FROM best_pair_scores;
+DROP VIEW IF EXISTS best_pair_scores;
+DROP VIEW IF EXISTS best_scores;
+DROP TABLE IF EXISTS game_results;`
+
+// Migration 15: Index game results by time for daily, weekly and monthly
+// boards. Covering the players and score lets windowed boards skip the table.
+const addGameResultsPeriodIndexUp = `
+CREATE INDEX IF NOT EXISTS game_results_period_idx
+	ON game_results (mode, ghost_count, created_at) INCLUDE (player1, player2, score);`
+
+const addGameResultsPeriodIndexDown = `
+DROP INDEX IF EXISTS game_results_period_idx;`
+
+// Migration 16: Dots and ghosts eaten per game, for player statistics.
+// Backfilled results leave them NULL since they were never recorded.
+const addGameResultsCountersUp = `
+ALTER TABLE game_results ADD COLUMN IF NOT EXISTS dots_eaten INT;
+ALTER TABLE game_results ADD COLUMN IF NOT EXISTS ghosts_eaten INT;
+CREATE INDEX IF NOT EXISTS game_results_player1_created_at_idx ON game_results (player1, created_at DESC);
+CREATE INDEX IF NOT EXISTS game_results_player2_created_at_idx ON game_results (player2, created_at DESC) WHERE player2 IS NOT NULL;
+DROP INDEX IF EXISTS game_results_player1_idx;
+DROP INDEX IF EXISTS game_results_player2_idx;`
+
+const addGameResultsCountersDown = `
+CREATE INDEX IF NOT EXISTS game_results_player1_idx ON game_results (player1);
+CREATE INDEX IF NOT EXISTS game_results_player2_idx ON game_results (player2) WHERE player2 IS NOT NULL;
+DROP INDEX IF EXISTS game_results_player2_created_at_idx;
+DROP INDEX IF EXISTS game_results_player1_created_at_idx;
+ALTER TABLE game_results DROP COLUMN IF EXISTS ghosts_eaten;
+ALTER TABLE game_results DROP COLUMN IF EXISTS dots_eaten;`
+
+// Migration 17: Achievement catalog and the achievements players have unlocked
+const createAchievementsTablesUp = `
+CREATE TABLE IF NOT EXISTS achievements (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	description TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_achievements (
+	nickname TEXT NOT NULL REFERENCES users (nickname) ON UPDATE CASCADE ON DELETE CASCADE,
+	achievement_id TEXT NOT NULL REFERENCES achievements (id) ON DELETE CASCADE,
+	unlocked_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (nickname, achievement_id)
+);`
+
+const createAchievementsTablesDown = `
+DROP TABLE IF EXISTS user_achievements;
+DROP TABLE IF EXISTS achievements;`
@@ -0,0 +1,320 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+	ErrUnknownMigration = errors.New("database has a migration this build does not know")
+	ErrIrreversible     = errors.New("migration cannot be rolled back")
+)
+
+// migrationLockID is the pg_advisory_lock key held while migrating, so
+// replicas starting together take turns
+const migrationLockID int64 = 0x7061636d616e // "pacman"
+
+// MigrationState is how a migration stands against the database
+type MigrationState string
+
+const (
+	MigrationApplied  MigrationState = "applied"
+	MigrationPending  MigrationState = "pending"
+	MigrationModified MigrationState = "modified" // Applied, but its Up has changed since
+	MigrationUnknown  MigrationState = "unknown"  // Applied, but not in this build
+)
+
+// MigrationStatus is one row of Migrator.Status
+type MigrationStatus struct {
+	ID        int
+	Name      string
+	State     MigrationState
+	AppliedAt time.Time // Zero when pending
+}
+
+// Migrator applies and rolls back a list of migrations, recording them in
+// schema_migrations. Each migration runs in its own transaction.
+type Migrator struct {
+	db           *sql.DB
+	migrations   []Migration
+	advisoryLock bool
+	// Postgres tables from before checksums get the column added; SQLite
+	// ones always had it
+	addChecksumColumn bool
+}
+
+// NewPostgresMigrator migrates the database opened by InitDB or Connect
+func NewPostgresMigrator() (*Migrator, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	return postgresMigrator(db), nil
+}
+
+func postgresMigrator(conn *sql.DB) *Migrator {
+	return &Migrator{db: conn, migrations: migrations, advisoryLock: true, addChecksumColumn: true}
+}
+
+type appliedMigration struct {
+	name      string
+	checksum  sql.NullString
+	appliedAt time.Time
+}
+
+// withConn runs fn on one connection, holding the advisory lock on
+// Postgres. The lock belongs to the session, so everything has to go
+// through the same connection.
+func (m *Migrator) withConn(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.advisoryLock {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return fmt.Errorf("taking migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+				log.Printf("Releasing migration lock: %v", err)
+			}
+		}()
+	}
+
+	if err := m.ensureTable(conn); err != nil {
+		return fmt.Errorf("ensuring migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) ensureTable(conn *sql.Conn) error {
+	ctx := context.Background()
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		id INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		run_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		checksum TEXT
+	)`)
+	if err != nil || !m.addChecksumColumn {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS checksum TEXT`)
+	return err
+}
+
+func (m *Migrator) applied(conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT id, name, checksum, run_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("fetching migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var id int
+		var a appliedMigration
+		var runAt sql.NullTime
+		if err := rows.Scan(&id, &a.name, &a.checksum, &runAt); err != nil {
+			return nil, err
+		}
+		a.appliedAt = runAt.Time
+		applied[id] = a
+	}
+	return applied, rows.Err()
+}
+
+// sorted returns the migrations in ID order
+func (m *Migrator) sorted() []Migration {
+	list := append([]Migration(nil), m.migrations...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// verify checks every applied migration against this build. Migrations
+// applied before checksums were recorded adopt the current one.
+func (m *Migrator) verify(conn *sql.Conn, applied map[int]appliedMigration) error {
+	known := make(map[int]bool, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.ID] = true
+		a, ok := applied[mig.ID]
+		if !ok {
+			continue
+		}
+		if !a.checksum.Valid {
+			if _, err := conn.ExecContext(context.Background(),
+				"UPDATE schema_migrations SET checksum = $1 WHERE id = $2", mig.Checksum(), mig.ID); err != nil {
+				return fmt.Errorf("recording checksum of migration %d: %w", mig.ID, err)
+			}
+			continue
+		}
+		if a.checksum.String != mig.Checksum() {
+			return fmt.Errorf("migration %d (%s): %w", mig.ID, mig.Name, ErrChecksumMismatch)
+		}
+	}
+	for id, a := range applied {
+		if !known[id] {
+			return fmt.Errorf("migration %d (%s): %w", id, a.name, ErrUnknownMigration)
+		}
+	}
+	return nil
+}
+
+// Status lists every migration in this build and every one recorded in the
+// database, in ID order
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withConn(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.sorted() {
+			st := MigrationStatus{ID: mig.ID, Name: mig.Name, State: MigrationPending}
+			if a, ok := applied[mig.ID]; ok {
+				st.AppliedAt = a.appliedAt
+				st.State = MigrationApplied
+				if a.checksum.Valid && a.checksum.String != mig.Checksum() {
+					st.State = MigrationModified
+				}
+				delete(applied, mig.ID)
+			}
+			statuses = append(statuses, st)
+		}
+		for id, a := range applied {
+			statuses = append(statuses, MigrationStatus{ID: id, Name: a.name, State: MigrationUnknown, AppliedAt: a.appliedAt})
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].ID < statuses[j].ID
+		})
+		return nil
+	})
+	return statuses, err
+}
+
+// Up applies every pending migration and returns how many ran
+func (m *Migrator) Up() (int, error) {
+	n := 0
+	err := m.withConn(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(conn, applied); err != nil {
+			return err
+		}
+		for _, mig := range m.sorted() {
+			if _, ok := applied[mig.ID]; ok {
+				continue
+			}
+			if err := m.up(conn, mig); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Down rolls back the last n applied migrations, newest first, and returns
+// how many were rolled back
+func (m *Migrator) Down(n int) (int, error) {
+	done := 0
+	err := m.withConn(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(conn, applied); err != nil {
+			return err
+		}
+		list := m.sorted()
+		for i := len(list) - 1; i >= 0 && done < n; i-- {
+			if _, ok := applied[list[i].ID]; !ok {
+				continue
+			}
+			if err := m.down(conn, list[i]); err != nil {
+				return err
+			}
+			done++
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Redo rolls back the last applied migration and applies it again
+func (m *Migrator) Redo() error {
+	return m.withConn(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(conn, applied); err != nil {
+			return err
+		}
+		list := m.sorted()
+		for i := len(list) - 1; i >= 0; i-- {
+			if _, ok := applied[list[i].ID]; !ok {
+				continue
+			}
+			if err := m.down(conn, list[i]); err != nil {
+				return err
+			}
+			return m.up(conn, list[i])
+		}
+		return fmt.Errorf("no migration has been applied")
+	})
+}
+
+func (m *Migrator) up(conn *sql.Conn, mig Migration) error {
+	log.Printf("Running migration %d: %s", mig.ID, mig.Name)
+	return inTx(conn, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(mig.Up); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", mig.ID, mig.Name, err)
+		}
+		_, err := tx.Exec("INSERT INTO schema_migrations (id, name, checksum) VALUES ($1, $2, $3)", mig.ID, mig.Name, mig.Checksum())
+		if err != nil {
+			return fmt.Errorf("recording migration %d: %w", mig.ID, err)
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) down(conn *sql.Conn, mig Migration) error {
+	if mig.Down == "" {
+		return fmt.Errorf("migration %d (%s): %w", mig.ID, mig.Name, ErrIrreversible)
+	}
+	log.Printf("Rolling back migration %d: %s", mig.ID, mig.Name)
+	return inTx(conn, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(mig.Down); err != nil {
+			return fmt.Errorf("rolling back migration %d (%s) failed: %w", mig.ID, mig.Name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE id = $1", mig.ID); err != nil {
+			return fmt.Errorf("unrecording migration %d: %w", mig.ID, err)
+		}
+		return nil
+	})
+}
+
+func inTx(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var testMigrations = []Migration{
+	{ID: 1, Name: "CreateA", Up: `CREATE TABLE a (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE a;`},
+	{ID: 2, Name: "CreateB", Up: `CREATE TABLE b (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE b;`},
+	{ID: 3, Name: "AddBName", Up: `ALTER TABLE b ADD COLUMN name TEXT;`, Down: `ALTER TABLE b DROP COLUMN name;`},
+}
+
+func openTestSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.db
+}
+
+func tableExists(t *testing.T, conn *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1", name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n == 1
+}
+
+func states(t *testing.T, m *Migrator) []MigrationState {
+	t.Helper()
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []MigrationState
+	for _, st := range statuses {
+		got = append(got, st.State)
+	}
+	return got
+}
+
+func sameStates(got []MigrationState, want ...MigrationState) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMigratorUpDownRedo(t *testing.T) {
+	conn := openTestSQLite(t)
+	m := &Migrator{db: conn, migrations: testMigrations}
+
+	if got := states(t, m); !sameStates(got, MigrationPending, MigrationPending, MigrationPending) {
+		t.Fatalf("Expected all pending, got %v", got)
+	}
+	if n, err := m.Up(); err != nil || n != 3 {
+		t.Fatalf("Up = %d, %v; want 3 applied", n, err)
+	}
+	if n, err := m.Up(); err != nil || n != 0 {
+		t.Fatalf("second Up = %d, %v; want nothing to do", n, err)
+	}
+
+	if n, err := m.Down(2); err != nil || n != 2 {
+		t.Fatalf("Down(2) = %d, %v", n, err)
+	}
+	if tableExists(t, conn, "b") || !tableExists(t, conn, "a") {
+		t.Error("Expected b rolled back and a kept")
+	}
+	if got := states(t, m); !sameStates(got, MigrationApplied, MigrationPending, MigrationPending) {
+		t.Errorf("After Down(2) got %v", got)
+	}
+
+	if err := m.Redo(); err != nil {
+		t.Fatalf("Redo: %v", err)
+	}
+	if !tableExists(t, conn, "a") {
+		t.Error("Expected Redo to apply the last migration again")
+	}
+
+	if n, err := m.Down(10); err != nil || n != 1 {
+		t.Fatalf("Down(10) = %d, %v; want the one applied migration", n, err)
+	}
+	if err := m.Redo(); err == nil {
+		t.Error("Expected Redo with nothing applied to fail")
+	}
+}
+
+func TestMigratorRejectsModifiedMigration(t *testing.T) {
+	conn := openTestSQLite(t)
+	if _, err := (&Migrator{db: conn, migrations: testMigrations}).Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := append([]Migration(nil), testMigrations...)
+	edited[1].Up = `CREATE TABLE b (id INTEGER PRIMARY KEY, extra TEXT);`
+	m := &Migrator{db: conn, migrations: edited}
+	if _, err := m.Up(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Up: got %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := m.Down(1); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Down: got %v, want ErrChecksumMismatch", err)
+	}
+	if got := states(t, m); !sameStates(got, MigrationApplied, MigrationModified, MigrationApplied) {
+		t.Errorf("Status = %v, want the edited migration marked", got)
+	}
+}
+
+func TestMigratorRejectsUnknownMigration(t *testing.T) {
+	conn := openTestSQLite(t)
+	if _, err := (&Migrator{db: conn, migrations: testMigrations}).Up(); err != nil {
+		t.Fatal(err)
+	}
+	older := &Migrator{db: conn, migrations: testMigrations[:2]}
+	if _, err := older.Up(); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("got %v, want ErrUnknownMigration", err)
+	}
+	if got := states(t, older); !sameStates(got, MigrationApplied, MigrationApplied, MigrationUnknown) {
+		t.Errorf("Status = %v", got)
+	}
+}
+
+func TestMigratorAdoptsMissingChecksums(t *testing.T) {
+	conn := openTestSQLite(t)
+	m := &Migrator{db: conn, migrations: testMigrations}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	// As left by the runner before checksums
+	if _, err := conn.Exec("UPDATE schema_migrations SET checksum = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	var missing int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE checksum IS NULL").Scan(&missing); err != nil {
+		t.Fatal(err)
+	}
+	if missing != 0 {
+		t.Errorf("Expected checksums to be recorded, %d still missing", missing)
+	}
+}
+
+func TestMigratorRollsBackFailedMigration(t *testing.T) {
+	conn := openTestSQLite(t)
+	broken := []Migration{
+		testMigrations[0],
+		{ID: 2, Name: "Broken", Up: `CREATE TABLE c (id INTEGER); INSERT INTO missing VALUES (1);`},
+	}
+	m := &Migrator{db: conn, migrations: broken}
+	if n, err := m.Up(); err == nil || n != 1 {
+		t.Fatalf("Up = %d, %v; want the second migration to fail", n, err)
+	}
+	if tableExists(t, conn, "c") {
+		t.Error("Expected the failed migration's table to be rolled back")
+	}
+	if got := states(t, m); !sameStates(got, MigrationApplied, MigrationPending) {
+		t.Errorf("Status = %v", got)
+	}
+}
+
+func TestMigratorIrreversible(t *testing.T) {
+	conn := openTestSQLite(t)
+	m := &Migrator{db: conn, migrations: []Migration{{ID: 1, Name: "OneWay", Up: `CREATE TABLE a (id INTEGER);`}}}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(1); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("got %v, want ErrIrreversible", err)
+	}
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	conn := openTestSQLite(t)
+	m := &Migrator{db: conn, migrations: sqliteMigrations}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(len(sqliteMigrations)); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Up after Down: %v", err)
+	}
+}
+
+// TestPostgresMigrations runs every migration down and up again, and two
+// runs at once, against the database in PACMAN_TEST_POSTGRES_DSN. It wipes
+// that database.
+func TestPostgresMigrations(t *testing.T) {
+	dsn := os.Getenv("PACMAN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("PACMAN_TEST_POSTGRES_DSN not set")
+	}
+	if err := openPostgres(dsn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeDB)
+
+	m, err := NewPostgresMigrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(len(migrations)); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+
+	// Replicas starting together take turns on the advisory lock
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = RunMigrations(db)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("concurrent run: %v", err)
+		}
+	}
+	if got := states(t, m); len(got) != len(migrations) || got[len(got)-1] != MigrationApplied {
+		t.Errorf("Status after concurrent runs = %v", got)
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+)
+
+// UpdatePassword replaces a user's password hash
+func UpdatePassword(nickname, newPassword string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	res, err := db.Exec("UPDATE users SET password_hash = $2 WHERE nickname = $1", nickname, string(hashedPassword))
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// FindUserForReset looks a user up by nickname or email and returns the
+// nickname and the email address to send the reset link to
+func FindUserForReset(identifier string) (nickname, email string, err error) {
+	if db == nil {
+		return "", "", fmt.Errorf("database not initialized")
+	}
+	var storedEmail sql.NullString
+	err = db.QueryRow(`
+		SELECT nickname, email FROM users
+		WHERE nickname = $1 OR lower(email) = lower($1)
+		LIMIT 1`, identifier).Scan(&nickname, &storedEmail)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return nickname, storedEmail.String, nil
+}
+
+// CreatePasswordResetToken stores the hash of a reset token
+func CreatePasswordResetToken(tokenHash, nickname string, expiresAt time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec(`
+		INSERT INTO password_reset_tokens (token_hash, nickname, expires_at)
+		VALUES ($1, $2, $3)`, tokenHash, nickname, expiresAt)
+	return err
+}
+
+// ResetPassword consumes a reset token and sets the new password in one
+// transaction, returning the nickname. A token can only be used once.
+func ResetPassword(tokenHash, newPassword string) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database not initialized")
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var nickname string
+	err = tx.QueryRow(`
+		UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING nickname`, tokenHash).Scan(&nickname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("consume reset token: %w", err)
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = $2 WHERE nickname = $1", nickname, string(hashedPassword)); err != nil {
+		return "", fmt.Errorf("update password: %w", err)
+	}
+	// Any other outstanding reset links for this user are now stale
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE nickname = $1 AND used_at IS NULL", nickname); err != nil {
+		return "", fmt.Errorf("delete stale reset tokens: %w", err)
+	}
+
+	return nickname, tx.Commit()
+}
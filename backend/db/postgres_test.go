@@ -0,0 +1,294 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openTestPostgres connects the package to the database in
+// PACMAN_TEST_POSTGRES_DSN, migrated and emptied, and skips the test when
+// it is not set. It wipes that database.
+func openTestPostgres(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("PACMAN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("PACMAN_TEST_POSTGRES_DSN not set")
+	}
+	if err := openPostgres(dsn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeDB)
+	if err := (PostgresStore{}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`TRUNCATE users, game_results, ratings, sessions, refresh_tokens,
+		session_families, password_reset_tokens, admin_audit CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pairPlayers returns the stored players of every pair result, oldest first
+func pairPlayers(t *testing.T) [][2]string {
+	t.Helper()
+	rows, err := db.Query("SELECT player1, player2 FROM game_results WHERE mode = 'pair' ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var pairs [][2]string
+	for rows.Next() {
+		var p [2]string
+		if err := rows.Scan(&p[0], &p[1]); err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs
+}
+
+func TestPostgresUpgradeGuestKeepsPairOrder(t *testing.T) {
+	openTestPostgres(t)
+	if err := CreateGuestUser("guest_1234"); err != nil {
+		t.Fatal(err)
+	}
+	// Stored as (guest_1234, inky); the new name sorts after inky
+	if err := SaveGameResult(pair("inky", "guest_1234", 500, storeEpoch)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveGameResult(single("guest_1234", 300, storeEpoch)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpgradeGuest("guest_1234", "pacfan", "secret123", ""); err != nil {
+		t.Fatalf("UpgradeGuest: %v", err)
+	}
+	if got := pairPlayers(t); len(got) != 1 || got[0] != [2]string{"inky", "pacfan"} {
+		t.Errorf("Expected the pair re-sorted as (inky, pacfan), got %v", got)
+	}
+	var singles int
+	db.QueryRow("SELECT COUNT(*) FROM game_results WHERE mode = 'single' AND player1 = 'pacfan'").Scan(&singles)
+	if singles != 1 {
+		t.Errorf("Expected the single result moved, got %d", singles)
+	}
+}
+
+func TestPostgresRenameUser(t *testing.T) {
+	openTestPostgres(t)
+	for _, nickname := range []string{"blinky", "inky"} {
+		if err := CreateUser(nickname, "secret123", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stored as (blinky, inky); the new name sorts before blinky
+	if err := SaveGameResult(pair("inky", "blinky", 500, storeEpoch)); err != nil {
+		t.Fatal(err)
+	}
+	expires := storeEpoch.AddDate(1, 0, 0)
+	if err := CreatePasswordResetToken("hash-1", "inky", expires); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO session_families (id, nickname) VALUES ('family-1', 'inky')"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RenameUser("inky", "aaron"); err != nil {
+		t.Fatalf("RenameUser: %v", err)
+	}
+	if got := pairPlayers(t); len(got) != 1 || got[0] != [2]string{"aaron", "blinky"} {
+		t.Errorf("Expected the pair re-sorted as (aaron, blinky), got %v", got)
+	}
+	for _, table := range []string{"password_reset_tokens", "session_families"} {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE nickname = 'inky'").Scan(&n)
+		if n != 0 {
+			t.Errorf("Expected %s rows for the old nickname deleted, got %d", table, n)
+		}
+	}
+
+	if err := RenameUser("aaron", "blinky"); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected ErrUsernameTaken, got %v", err)
+	}
+	if err := RenameUser("nobody", "someone"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestPostgresUnlockAchievementIsIdempotent(t *testing.T) {
+	openTestPostgres(t)
+	defs := []AchievementDef{
+		{ID: "test_first", Name: "First", Description: "Play a game"},
+		{ID: "test_race", Name: "Race", Description: "Unlocked from many places at once"},
+	}
+	if err := SyncAchievements(defs); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUser("pacfan", "secret123", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if isNew, err := UnlockAchievement("pacfan", "test_first"); err != nil || !isNew {
+		t.Fatalf("Expected a first unlock, got %v %v", isNew, err)
+	}
+	if isNew, err := UnlockAchievement("pacfan", "test_first"); err != nil || isNew {
+		t.Errorf("Expected a repeated unlock to be a no-op, got %v %v", isNew, err)
+	}
+
+	// Games ending together may unlock the same achievement at once; only
+	// one of them reports it as new
+	var wg sync.WaitGroup
+	var newCount atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			isNew, err := UnlockAchievement("pacfan", "test_race")
+			if err != nil {
+				t.Error(err)
+			}
+			if isNew {
+				newCount.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := newCount.Load(); n != 1 {
+		t.Errorf("Expected exactly one new unlock, got %d", n)
+	}
+
+	unlocked, err := GetUserAchievements("pacfan")
+	if err != nil || len(unlocked) != 2 {
+		t.Errorf("Expected two achievements, got %+v %v", unlocked, err)
+	}
+	if _, err := GetUserAchievements("nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := UnlockAchievement("nobody", "test_first"); err == nil {
+		t.Error("Expected an unknown user to be refused")
+	}
+
+	// Syncing again updates the catalog without touching unlocks
+	defs[0].Name = "First Game"
+	if err := SyncAchievements(defs); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	db.QueryRow("SELECT name FROM achievements WHERE id = 'test_first'").Scan(&name)
+	if name != "First Game" {
+		t.Errorf("Expected the name updated, got %q", name)
+	}
+	if unlocked, _ := GetUserAchievements("pacfan"); len(unlocked) != 2 {
+		t.Errorf("Expected unlocks kept, got %+v", unlocked)
+	}
+}
+
+func TestPostgresPairBoardFindsEitherPlayer(t *testing.T) {
+	openTestPostgres(t)
+	board := Board{Mode: GameModePair, GhostCount: 4}
+	for _, r := range []GameResult{
+		pair("pacfan", "inky", 800, storeEpoch),
+		pair("pacfan", "inky", 600, storeEpoch.Add(time.Minute)),
+		pair("blinky", "clyde", 900, storeEpoch),
+	} {
+		if err := SaveGameResult(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// inky is stored second, so the lookup has to match player2 too
+	rank, err := GetBoardRank(board, "inky")
+	if err != nil {
+		t.Fatalf("GetBoardRank: %v", err)
+	}
+	if rank.Rank != 2 || rank.Total != 2 || rank.Score != 800 || rank.Percentile != 0 {
+		t.Errorf("Expected inky 2nd of 2 with 800, got %+v", rank)
+	}
+	around, err := GetBoardAround(board, "inky", 1)
+	if err != nil || len(around) != 2 || around[1].Player1 != "inky" || around[1].Player2 != "pacfan" {
+		t.Errorf("Expected the pair entries around inky, got %+v %v", around, err)
+	}
+}
+
+func TestPostgresDeleteStaleGuests(t *testing.T) {
+	openTestPostgres(t)
+	now := time.Now()
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	longAgo := cutoff.Add(-24 * time.Hour)
+	for _, nickname := range []string{"guest_idle", "guest_online", "guest_refresh", "guest_player", "guest_new"} {
+		if err := CreateGuestUser(nickname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateUser("pacfan", "secret123", ""); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("UPDATE users SET created_at = $1 WHERE nickname <> 'guest_new'", longAgo)
+
+	store := PostgresSessionStore{}
+	logins := []struct {
+		nickname string
+		seen     time.Time
+	}{
+		{"guest_idle", longAgo},
+		{"guest_online", now},
+		{"guest_refresh", longAgo},
+	}
+	for _, l := range logins {
+		if err := store.CreateFamily(FamilyRecord{ID: "family-" + l.nickname, Nickname: l.nickname, CreatedAt: longAgo, LastSeenAt: l.seen}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreateSession(SessionRecord{TokenHash: "session-" + l.nickname, FamilyID: "family-" + l.nickname,
+			Nickname: l.nickname, CreatedAt: l.seen, ExpiresAt: now.Add(time.Hour), LastSeenAt: l.seen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rotated recently, without the access token being used since
+	if err := store.CreateRefreshToken(RefreshTokenRecord{TokenHash: "refresh-guest_refresh", FamilyID: "family-guest_refresh",
+		Nickname: "guest_refresh", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []GameResult{
+		pair("guest_idle", "pacfan", 700, longAgo),
+		single("guest_idle", 300, longAgo),
+		single("guest_player", 400, now),
+	} {
+		if err := SaveGameResult(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := DeleteStaleGuests(cutoff, func() (string, error) { return "deleted-1234", nil })
+	if err != nil {
+		t.Fatalf("DeleteStaleGuests: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != "guest_idle" {
+		t.Errorf("Expected only the idle guest removed, got %v", removed)
+	}
+	for _, nickname := range []string{"guest_online", "guest_refresh", "guest_player", "guest_new"} {
+		if _, err := IsGuest(nickname); err != nil {
+			t.Errorf("Expected %s kept, got %v", nickname, err)
+		}
+	}
+	if _, err := IsGuest("guest_idle"); err == nil {
+		t.Error("Expected guest_idle removed")
+	}
+	if _, err := store.GetSession("session-guest_idle"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected the idle guest's login revoked, got %v", err)
+	}
+	if _, err := store.GetFamily("family-guest_idle"); err == nil {
+		t.Error("Expected the idle guest's session family removed")
+	}
+
+	// The partner keeps the pair score, under an anonymous name for the guest
+	if got := pairPlayers(t); len(got) != 1 || got[0] != [2]string{"deleted-1234", "pacfan"} {
+		t.Errorf("Expected the pair kept with the guest anonymized, got %v", got)
+	}
+	var singles int
+	db.QueryRow("SELECT COUNT(*) FROM game_results WHERE mode = 'single' AND player1 = 'guest_idle'").Scan(&singles)
+	if singles != 0 {
+		t.Errorf("Expected the guest's single scores removed, got %d", singles)
+	}
+}
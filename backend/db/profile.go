@@ -0,0 +1,203 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Profile is a player's public page: account details and aggregates over
+// their game history
+type Profile struct {
+	Nickname         string       `json:"nickname"`
+	JoinedAt         time.Time    `json:"joinedAt"`
+	Guest            bool         `json:"guest"`
+	Rating           float64      `json:"rating"`
+	Stats            PlayerStats  `json:"stats"`
+	BestScores       []BestScore  `json:"bestScores"`
+	FavouritePartner *PartnerStat `json:"favouritePartner"`
+	RecentGames      []RecentGame `json:"recentGames"`
+}
+
+// PlayerStats totals a player's games. Dots and ghosts in pair games count
+// for both players, and games from before they were recorded count as zero.
+type PlayerStats struct {
+	GamesPlayed        int     `json:"gamesPlayed"`
+	SingleGames        int     `json:"singleGames"`
+	PairGames          int     `json:"pairGames"`
+	TotalDots          int64   `json:"totalDots"`
+	GhostsEaten        int64   `json:"ghostsEaten"`
+	AverageGameSeconds float64 `json:"averageGameSeconds"`
+}
+
+// BestScore is a player's best score for one mode and ghost count
+type BestScore struct {
+	Mode       string    `json:"mode"`
+	GhostCount int       `json:"ghostCount"`
+	Score      int       `json:"score"`
+	AchievedAt time.Time `json:"achievedAt"`
+}
+
+// PartnerStat is how often a player has played pair games with a partner
+type PartnerStat struct {
+	Nickname    string `json:"nickname"`
+	GamesPlayed int    `json:"gamesPlayed"`
+	BestScore   int    `json:"bestScore"`
+}
+
+// RecentGame is one game in a player's history
+type RecentGame struct {
+	ID          int64     `json:"id"`
+	Mode        string    `json:"mode"`
+	Partner     string    `json:"partner,omitempty"`
+	GhostCount  int       `json:"ghostCount"`
+	Map         string    `json:"map,omitempty"`
+	Score       int       `json:"score"`
+	DurationSec float64   `json:"durationSeconds,omitempty"`
+	DeathCause  string    `json:"deathCause,omitempty"`
+	PlayedAt    time.Time `json:"playedAt"`
+}
+
+// GetUserProfile returns a player's profile with up to recent recent games.
+// The nickname is matched regardless of case.
+func GetUserProfile(nickname string, recent int) (Profile, error) {
+	if db == nil {
+		return Profile{}, fmt.Errorf("database not initialized")
+	}
+	var p Profile
+	err := db.QueryRow("SELECT nickname, created_at, is_guest FROM users WHERE lower(nickname) = lower($1)", nickname).
+		Scan(&p.Nickname, &p.JoinedAt, &p.Guest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrUserNotFound
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if p.Rating, err = GetRating(p.Nickname); err != nil {
+		return Profile{}, err
+	}
+	if err := loadProfileGames(db, bestScoresSQL, &p, recent); err != nil {
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+// loadProfileGames fills in the aggregates over a player's games, using
+// bestSQL to find their best scores
+func loadProfileGames(conn *sql.DB, bestSQL string, p *Profile, recent int) error {
+	var err error
+	if p.Stats, err = playerStats(conn, p.Nickname); err != nil {
+		return err
+	}
+	if p.BestScores, err = playerBestScores(conn, bestSQL, p.Nickname); err != nil {
+		return err
+	}
+	if p.FavouritePartner, err = favouritePartner(conn, p.Nickname); err != nil {
+		return err
+	}
+	p.RecentGames, err = recentGames(conn, p.Nickname, recent)
+	return err
+}
+
+func playerStats(conn *sql.DB, nickname string) (PlayerStats, error) {
+	var st PlayerStats
+	var avgMillis float64
+	err := conn.QueryRow(`
+		SELECT COUNT(*),
+			COUNT(*) FILTER (WHERE mode = 'single'),
+			COUNT(*) FILTER (WHERE mode = 'pair'),
+			COALESCE(SUM(dots_eaten), 0),
+			COALESCE(SUM(ghosts_eaten), 0),
+			COALESCE(AVG(duration_ms), 0)
+		FROM game_results
+		WHERE player1 = $1 OR player2 = $1`, nickname).
+		Scan(&st.GamesPlayed, &st.SingleGames, &st.PairGames, &st.TotalDots, &st.GhostsEaten, &avgMillis)
+	if err != nil {
+		return PlayerStats{}, fmt.Errorf("player stats: %w", err)
+	}
+	st.AverageGameSeconds = avgMillis / 1000
+	return st, nil
+}
+
+// bestScoresSQL picks a player's best score for each mode and ghost count,
+// the earliest on a tie
+const bestScoresSQL = `
+	SELECT DISTINCT ON (mode, ghost_count) mode, ghost_count, score, created_at
+	FROM game_results
+	WHERE player1 = $1 OR player2 = $1
+	ORDER BY mode DESC, ghost_count, score DESC, created_at`
+
+func playerBestScores(conn *sql.DB, bestSQL, nickname string) ([]BestScore, error) {
+	rows, err := conn.Query(bestSQL, nickname)
+	if err != nil {
+		return nil, fmt.Errorf("player best scores: %w", err)
+	}
+	defer rows.Close()
+
+	best := []BestScore{}
+	for rows.Next() {
+		var b BestScore
+		var achievedAt interface{}
+		if err := rows.Scan(&b.Mode, &b.GhostCount, &b.Score, &achievedAt); err != nil {
+			return nil, err
+		}
+		b.AchievedAt = scannedTime(achievedAt)
+		best = append(best, b)
+	}
+	return best, rows.Err()
+}
+
+// favouritePartner is the player's most frequent pair partner, or nil if
+// they have not played a pair game
+func favouritePartner(conn *sql.DB, nickname string) (*PartnerStat, error) {
+	var ps PartnerStat
+	err := conn.QueryRow(`
+		SELECT CASE WHEN player1 = $1 THEN player2 ELSE player1 END AS partner,
+			COUNT(*), MAX(score)
+		FROM game_results
+		WHERE mode = 'pair' AND (player1 = $1 OR player2 = $1)
+		GROUP BY partner
+		ORDER BY COUNT(*) DESC, MAX(score) DESC, partner
+		LIMIT 1`, nickname).Scan(&ps.Nickname, &ps.GamesPlayed, &ps.BestScore)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("favourite partner: %w", err)
+	}
+	return &ps, nil
+}
+
+func recentGames(conn *sql.DB, nickname string, limit int) ([]RecentGame, error) {
+	rows, err := conn.Query(`
+		SELECT id, mode, CASE WHEN player1 = $1 THEN player2 ELSE player1 END,
+			ghost_count, map, score, duration_ms, death_cause, created_at
+		FROM game_results
+		WHERE player1 = $1 OR player2 = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`, nickname, limit)
+	if err != nil {
+		return nil, fmt.Errorf("recent games: %w", err)
+	}
+	defer rows.Close()
+
+	games := []RecentGame{}
+	for rows.Next() {
+		var g RecentGame
+		var partner, mapName, deathCause sql.NullString
+		var durationMillis sql.NullInt64
+		var playedAt interface{}
+		if err := rows.Scan(&g.ID, &g.Mode, &partner, &g.GhostCount, &mapName, &g.Score, &durationMillis, &deathCause, &playedAt); err != nil {
+			return nil, err
+		}
+		g.PlayedAt = scannedTime(playedAt)
+		g.Partner = partner.String
+		g.Map = mapName.String
+		g.DeathCause = deathCause.String
+		g.DurationSec = float64(durationMillis.Int64) / 1000
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
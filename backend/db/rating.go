@@ -0,0 +1,43 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// DefaultRating is the rating of a player who has not finished a pair game yet
+const DefaultRating = 1500.0
+
+// GetRating returns the pair matchmaking rating for a player
+func GetRating(nickname string) (float64, error) {
+	if db == nil {
+		return DefaultRating, fmt.Errorf("database not initialized")
+	}
+	var rating float64
+	err := db.QueryRow("SELECT rating FROM ratings WHERE nickname = $1", nickname).Scan(&rating)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DefaultRating, nil
+	}
+	if err != nil {
+		return DefaultRating, err
+	}
+	return rating, nil
+}
+
+// AdjustRating adds delta to a player's rating, creating the row on first use
+func AdjustRating(nickname string, delta float64) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	upsertSQL := `
+		INSERT INTO ratings (nickname, rating, games_played, updated_at)
+		VALUES ($1, $2 + $3, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (nickname)
+		DO UPDATE SET rating = ratings.rating + $3,
+			games_played = ratings.games_played + 1,
+			updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := db.Exec(upsertSQL, nickname, DefaultRating, delta)
+	return err
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	GameModeSingle = "single"
+	GameModePair   = "pair"
+)
+
+// GameResult is one finished game. Every result is kept; the best scores
+// shown on the scoreboards are derived from them.
+type GameResult struct {
+	Mode       string
+	Players    []string // One player for single games, two for pair games
+	GhostCount int
+	MapName    string
+	Score      int
+	Duration   time.Duration
+	Level      int
+	DeathCause string    // Empty when unknown
+	Dots       int       // Dots eaten
+	Ghosts     int       // Ghosts eaten during power mode
+	PlayedAt   time.Time // Zero means now
+}
+
+// SaveGameResult appends a finished game to the history
+func SaveGameResult(r GameResult) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	r, player1, player2, err := normalizeResult(r)
+	if err != nil {
+		return err
+	}
+	var playedAt interface{}
+	if !r.PlayedAt.IsZero() {
+		playedAt = r.PlayedAt
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO game_results (mode, player1, player2, ghost_count, map, score, duration_ms, level, death_cause, dots_eaten, ghosts_eaten, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), $6, NULLIF($7, 0), NULLIF($8, 0), NULLIF($9, ''), $10, $11, COALESCE($12::timestamptz, CURRENT_TIMESTAMP))`,
+		r.Mode, player1, player2, r.GhostCount, r.MapName, r.Score, r.Duration.Milliseconds(), r.Level, r.DeathCause, r.Dots, r.Ghosts, playedAt)
+	return err
+}
@@ -0,0 +1,435 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound      = errors.New("session not found")
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrFamilyNotFound       = errors.New("session family not found")
+)
+
+// SessionRecord is a stored login session. Only the SHA-256 hash of the
+// token is kept, so a leaked table cannot be replayed.
+type SessionRecord struct {
+	TokenHash  string
+	FamilyID   string // Shared by every access and refresh token of one login
+	Nickname   string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastSeenAt time.Time
+}
+
+// RefreshTokenRecord is a single-use refresh token. Rotating it marks it
+// used; presenting a used token again revokes its whole family.
+type RefreshTokenRecord struct {
+	TokenHash string
+	FamilyID  string
+	Nickname  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+// FamilyRecord describes one login (a device or browser) across all of its
+// token rotations. This is what users see as "a session".
+type FamilyRecord struct {
+	ID         string
+	Nickname   string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// SessionStore persists login sessions and refresh tokens keyed by token hash
+type SessionStore interface {
+	CreateFamily(rec FamilyRecord) error
+	GetFamily(id string) (FamilyRecord, error)
+	ListFamilies(nickname string) ([]FamilyRecord, error)
+	TouchFamily(id string, at time.Time) error
+
+	CreateSession(rec SessionRecord) error
+	GetSession(tokenHash string) (SessionRecord, error)
+	TouchSession(tokenHash string, at time.Time) error
+	DeleteSession(tokenHash string) error
+	DeleteExpiredSessions(now time.Time) (int64, error)
+
+	CreateRefreshToken(rec RefreshTokenRecord) error
+	GetRefreshToken(tokenHash string) (RefreshTokenRecord, error)
+	// MarkRefreshTokenUsed returns false if the token was already used or revoked
+	MarkRefreshTokenUsed(tokenHash string) (bool, error)
+	// RevokeFamily deletes the family and its sessions and revokes its refresh tokens
+	RevokeFamily(familyID string) error
+}
+
+// IsConfigured reports whether a database connection is available
+func IsConfigured() bool {
+	return db != nil
+}
+
+// PostgresSessionStore stores sessions in the sessions table
+type PostgresSessionStore struct{}
+
+func (PostgresSessionStore) CreateFamily(rec FamilyRecord) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec(`
+		INSERT INTO session_families (id, nickname, user_agent, ip, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		rec.ID, rec.Nickname, rec.UserAgent, rec.IP, rec.CreatedAt, rec.LastSeenAt)
+	return err
+}
+
+func (PostgresSessionStore) GetFamily(id string) (FamilyRecord, error) {
+	if db == nil {
+		return FamilyRecord{}, fmt.Errorf("database not initialized")
+	}
+	rec := FamilyRecord{ID: id}
+	err := db.QueryRow(`
+		SELECT nickname, user_agent, ip, created_at, last_seen_at
+		FROM session_families WHERE id = $1`, id).
+		Scan(&rec.Nickname, &rec.UserAgent, &rec.IP, &rec.CreatedAt, &rec.LastSeenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FamilyRecord{}, ErrFamilyNotFound
+	}
+	return rec, err
+}
+
+func (PostgresSessionStore) ListFamilies(nickname string) ([]FamilyRecord, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	rows, err := db.Query(`
+		SELECT id, user_agent, ip, created_at, last_seen_at
+		FROM session_families WHERE nickname = $1
+		ORDER BY last_seen_at DESC`, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var families []FamilyRecord
+	for rows.Next() {
+		rec := FamilyRecord{Nickname: nickname}
+		if err := rows.Scan(&rec.ID, &rec.UserAgent, &rec.IP, &rec.CreatedAt, &rec.LastSeenAt); err != nil {
+			return nil, err
+		}
+		families = append(families, rec)
+	}
+	return families, rows.Err()
+}
+
+func (PostgresSessionStore) TouchFamily(id string, at time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec("UPDATE session_families SET last_seen_at = $2 WHERE id = $1", id, at)
+	return err
+}
+
+func (PostgresSessionStore) CreateSession(rec SessionRecord) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec(`
+		INSERT INTO sessions (token_hash, family_id, nickname, created_at, expires_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		rec.TokenHash, rec.FamilyID, rec.Nickname, rec.CreatedAt, rec.ExpiresAt, rec.LastSeenAt)
+	return err
+}
+
+func (PostgresSessionStore) GetSession(tokenHash string) (SessionRecord, error) {
+	if db == nil {
+		return SessionRecord{}, fmt.Errorf("database not initialized")
+	}
+	rec := SessionRecord{TokenHash: tokenHash}
+	err := db.QueryRow(`
+		SELECT family_id, nickname, created_at, expires_at, last_seen_at
+		FROM sessions WHERE token_hash = $1`, tokenHash).
+		Scan(&rec.FamilyID, &rec.Nickname, &rec.CreatedAt, &rec.ExpiresAt, &rec.LastSeenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+	return rec, err
+}
+
+func (PostgresSessionStore) TouchSession(tokenHash string, at time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec("UPDATE sessions SET last_seen_at = $2 WHERE token_hash = $1", tokenHash, at)
+	return err
+}
+
+func (PostgresSessionStore) DeleteSession(tokenHash string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = $1", tokenHash)
+	return err
+}
+
+func (PostgresSessionStore) DeleteExpiredSessions(now time.Time) (int64, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	res, err := db.Exec("DELETE FROM sessions WHERE expires_at < $1", now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec("DELETE FROM refresh_tokens WHERE expires_at < $1", now); err != nil {
+		return n, err
+	}
+	// A family without a usable refresh token can never be resumed
+	if _, err := db.Exec(`
+		DELETE FROM session_families f
+		WHERE NOT EXISTS (
+			SELECT 1 FROM refresh_tokens r
+			WHERE r.family_id = f.id AND NOT r.revoked
+		)`); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (PostgresSessionStore) CreateRefreshToken(rec RefreshTokenRecord) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := db.Exec(`
+		INSERT INTO refresh_tokens (token_hash, family_id, nickname, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		rec.TokenHash, rec.FamilyID, rec.Nickname, rec.CreatedAt, rec.ExpiresAt)
+	return err
+}
+
+func (PostgresSessionStore) GetRefreshToken(tokenHash string) (RefreshTokenRecord, error) {
+	if db == nil {
+		return RefreshTokenRecord{}, fmt.Errorf("database not initialized")
+	}
+	rec := RefreshTokenRecord{TokenHash: tokenHash}
+	err := db.QueryRow(`
+		SELECT family_id, nickname, created_at, expires_at, used_at IS NOT NULL, revoked
+		FROM refresh_tokens WHERE token_hash = $1`, tokenHash).
+		Scan(&rec.FamilyID, &rec.Nickname, &rec.CreatedAt, &rec.ExpiresAt, &rec.Used, &rec.Revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshTokenRecord{}, ErrRefreshTokenNotFound
+	}
+	return rec, err
+}
+
+func (PostgresSessionStore) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+	// The WHERE clause makes concurrent rotations of the same token race safely
+	res, err := db.Exec(`
+		UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND NOT revoked`, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (PostgresSessionStore) RevokeFamily(familyID string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE family_id = $1", familyID); err != nil {
+		return fmt.Errorf("delete family sessions: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE family_id = $1", familyID); err != nil {
+		return fmt.Errorf("revoke family refresh tokens: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM session_families WHERE id = $1", familyID); err != nil {
+		return fmt.Errorf("delete family: %w", err)
+	}
+	return tx.Commit()
+}
+
+// MemorySessionStore keeps sessions in process memory. It is used in tests
+// and when no database is configured; sessions are lost on restart.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	families map[string]FamilyRecord
+	sessions map[string]SessionRecord
+	refresh  map[string]RefreshTokenRecord
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		families: make(map[string]FamilyRecord),
+		sessions: make(map[string]SessionRecord),
+		refresh:  make(map[string]RefreshTokenRecord),
+	}
+}
+
+func (m *MemorySessionStore) CreateFamily(rec FamilyRecord) error {
+	m.mu.Lock()
+	m.families[rec.ID] = rec
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemorySessionStore) GetFamily(id string) (FamilyRecord, error) {
+	m.mu.RLock()
+	rec, ok := m.families[id]
+	m.mu.RUnlock()
+	if !ok {
+		return FamilyRecord{}, ErrFamilyNotFound
+	}
+	return rec, nil
+}
+
+func (m *MemorySessionStore) ListFamilies(nickname string) ([]FamilyRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var families []FamilyRecord
+	for _, rec := range m.families {
+		if rec.Nickname == nickname {
+			families = append(families, rec)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].LastSeenAt.After(families[j].LastSeenAt)
+	})
+	return families, nil
+}
+
+func (m *MemorySessionStore) TouchFamily(id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.families[id]; ok {
+		rec.LastSeenAt = at
+		m.families[id] = rec
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) CreateSession(rec SessionRecord) error {
+	m.mu.Lock()
+	m.sessions[rec.TokenHash] = rec
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemorySessionStore) GetSession(tokenHash string) (SessionRecord, error) {
+	m.mu.RLock()
+	rec, ok := m.sessions[tokenHash]
+	m.mu.RUnlock()
+	if !ok {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+	return rec, nil
+}
+
+func (m *MemorySessionStore) TouchSession(tokenHash string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.sessions[tokenHash]; ok {
+		rec.LastSeenAt = at
+		m.sessions[tokenHash] = rec
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteSession(tokenHash string) error {
+	m.mu.Lock()
+	delete(m.sessions, tokenHash)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteExpiredSessions(now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for hash, rec := range m.sessions {
+		if now.After(rec.ExpiresAt) {
+			delete(m.sessions, hash)
+			n++
+		}
+	}
+	live := make(map[string]bool)
+	for hash, rec := range m.refresh {
+		if now.After(rec.ExpiresAt) {
+			delete(m.refresh, hash)
+		} else if !rec.Revoked {
+			live[rec.FamilyID] = true
+		}
+	}
+	for id := range m.families {
+		if !live[id] {
+			delete(m.families, id)
+		}
+	}
+	return n, nil
+}
+
+func (m *MemorySessionStore) CreateRefreshToken(rec RefreshTokenRecord) error {
+	m.mu.Lock()
+	m.refresh[rec.TokenHash] = rec
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemorySessionStore) GetRefreshToken(tokenHash string) (RefreshTokenRecord, error) {
+	m.mu.RLock()
+	rec, ok := m.refresh[tokenHash]
+	m.mu.RUnlock()
+	if !ok {
+		return RefreshTokenRecord{}, ErrRefreshTokenNotFound
+	}
+	return rec, nil
+}
+
+func (m *MemorySessionStore) MarkRefreshTokenUsed(tokenHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.refresh[tokenHash]
+	if !ok || rec.Used || rec.Revoked {
+		return false, nil
+	}
+	rec.Used = true
+	m.refresh[tokenHash] = rec
+	return true, nil
+}
+
+func (m *MemorySessionStore) RevokeFamily(familyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, rec := range m.sessions {
+		if rec.FamilyID == familyID {
+			delete(m.sessions, hash)
+		}
+	}
+	for hash, rec := range m.refresh {
+		if rec.FamilyID == familyID {
+			rec.Revoked = true
+			m.refresh[hash] = rec
+		}
+	}
+	delete(m.families, familyID)
+	return nil
+}
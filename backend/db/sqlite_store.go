@@ -0,0 +1,871 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStore keeps accounts and results in a single SQLite file, for
+// running the server without Postgres. Timestamps are stored as Unix
+// microseconds.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens (creating if needed) the database file at path
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	conn, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	// SQLite allows one writer at a time; a single connection queues them
+	// here instead of failing with SQLITE_BUSY
+	conn.SetMaxOpenConns(1)
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	return &SQLiteStore{db: conn}, nil
+}
+
+var sqliteMigrations = []Migration{
+	{
+		ID:   1,
+		Name: "InitSchema",
+		Up:   sqliteInitSchemaUp,
+		Down: sqliteInitSchemaDown,
+	},
+	{
+		ID:   2,
+		Name: "AccountFeatures",
+		Up:   sqliteAccountFeaturesUp,
+		Down: sqliteAccountFeaturesDown,
+	},
+}
+
+// Migration 1: Users and game results, matching the Postgres schema as of
+// its migration 17
+const sqliteInitSchemaUp = `
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	password_hash TEXT NOT NULL,
+	email TEXT,
+	is_guest INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_lower_key ON users (lower(nickname));
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email)) WHERE email IS NOT NULL;
+CREATE TABLE IF NOT EXISTS game_results (
+	id INTEGER PRIMARY KEY,
+	mode TEXT NOT NULL,
+	player1 TEXT NOT NULL,
+	player2 TEXT,
+	ghost_count INTEGER NOT NULL,
+	map TEXT,
+	score INTEGER NOT NULL,
+	duration_ms INTEGER,
+	level INTEGER,
+	death_cause TEXT,
+	dots_eaten INTEGER NOT NULL DEFAULT 0,
+	ghosts_eaten INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS game_results_period_idx ON game_results (mode, ghost_count, created_at);`
+
+const sqliteInitSchemaDown = `
+DROP TABLE IF EXISTS game_results;
+DROP TABLE IF EXISTS users;`
+
+// Migration 2: Roles and bans, password resets, external identities,
+// ratings, achievements and the admin audit log. Identities and
+// achievements follow renames of their user through the exact-nickname
+// index, as in Postgres.
+const sqliteAccountFeaturesUp = `
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'player';
+ALTER TABLE users ADD COLUMN banned_at INTEGER;
+ALTER TABLE users ADD COLUMN ban_reason TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_key ON users (nickname);
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	token_hash TEXT PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER
+);
+CREATE INDEX IF NOT EXISTS password_reset_tokens_nickname_idx ON password_reset_tokens (nickname);
+CREATE TABLE IF NOT EXISTS user_identities (
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	nickname TEXT NOT NULL REFERENCES users (nickname) ON UPDATE CASCADE ON DELETE CASCADE,
+	email TEXT,
+	created_at INTEGER NOT NULL,
+	last_login_at INTEGER NOT NULL,
+	PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_nickname_idx ON user_identities (nickname);
+CREATE TABLE IF NOT EXISTS ratings (
+	nickname TEXT PRIMARY KEY,
+	rating REAL NOT NULL DEFAULT 1500,
+	games_played INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS achievements (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	description TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_achievements (
+	nickname TEXT NOT NULL REFERENCES users (nickname) ON UPDATE CASCADE ON DELETE CASCADE,
+	achievement_id TEXT NOT NULL REFERENCES achievements (id) ON DELETE CASCADE,
+	unlocked_at INTEGER NOT NULL,
+	PRIMARY KEY (nickname, achievement_id)
+);
+CREATE TABLE IF NOT EXISTS admin_audit (
+	id INTEGER PRIMARY KEY,
+	admin TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT NOT NULL,
+	details TEXT,
+	created_at INTEGER NOT NULL
+);`
+
+const sqliteAccountFeaturesDown = `
+DROP TABLE IF EXISTS admin_audit;
+DROP TABLE IF EXISTS user_achievements;
+DROP TABLE IF EXISTS achievements;
+DROP TABLE IF EXISTS ratings;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS password_reset_tokens;
+DROP INDEX IF EXISTS users_nickname_key;
+ALTER TABLE users DROP COLUMN ban_reason;
+ALTER TABLE users DROP COLUMN banned_at;
+ALTER TABLE users DROP COLUMN role;`
+
+// Migrator applies the SQLite schema migrations
+func (s *SQLiteStore) Migrator() *Migrator {
+	return &Migrator{db: s.db, migrations: sqliteMigrations}
+}
+
+func (s *SQLiteStore) Migrate() error {
+	_, err := s.Migrator().Up()
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) CreateUser(nickname, password, email string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	_, err = s.db.Exec("INSERT INTO users (nickname, password_hash, email, created_at) VALUES ($1, $2, NULLIF($3, ''), $4)",
+		nickname, string(hashedPassword), email, time.Now().UnixMicro())
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			if strings.Contains(err.Error(), "users_email_key") {
+				return ErrEmailTaken
+			}
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("insert user: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) CreateGuestUser(nickname string) error {
+	_, err := s.db.Exec("INSERT INTO users (nickname, password_hash, is_guest, created_at) VALUES ($1, '', 1, $2)",
+		nickname, time.Now().UnixMicro())
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("insert guest: %w", err)
+	}
+	return nil
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+func (s *SQLiteStore) VerifyUser(nickname, password string) error {
+	var storedHash string
+	err := s.db.QueryRow("SELECT password_hash FROM users WHERE nickname = $1", nickname).Scan(&storedHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+}
+
+func (s *SQLiteStore) SaveGameResult(r GameResult) error {
+	r, player1, player2, err := normalizeResult(r)
+	if err != nil {
+		return err
+	}
+	createdAt := r.PlayedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO game_results (mode, player1, player2, ghost_count, map, score, duration_ms, level, death_cause, dots_eaten, ghosts_eaten, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), $6, NULLIF($7, 0), NULLIF($8, 0), NULLIF($9, ''), $10, $11, $12)`,
+		r.Mode, player1, player2, r.GhostCount, r.MapName, r.Score, r.Duration.Milliseconds(), r.Level, r.DeathCause, r.Dots, r.Ghosts, createdAt.UnixMicro())
+	return err
+}
+
+// sqliteRankedBoardSQL is rankedBoardSQL for SQLite, which has no DISTINCT
+// ON; the best result of each player or pair is numbered 1 instead
+const sqliteRankedBoardSQL = `
+	WITH candidates AS (
+		SELECT player1, COALESCE(player2, '') AS player2, score, created_at,
+			ROW_NUMBER() OVER (PARTITION BY player1, player2 ORDER BY score DESC, created_at) AS n
+		FROM game_results
+		WHERE mode = $1 AND ghost_count = $2 AND created_at >= $3
+		  AND player1 NOT IN (SELECT nickname FROM users WHERE is_guest)
+		  AND (player2 IS NULL OR player2 NOT IN (SELECT nickname FROM users WHERE is_guest))
+	), best AS (
+		SELECT player1, player2, score, created_at FROM candidates WHERE n = 1
+	), ranked AS (
+		SELECT player1, player2, score,
+			RANK() OVER by_score AS rank,
+			PERCENT_RANK() OVER by_score AS percent_rank,
+			ROW_NUMBER() OVER (ORDER BY score DESC, created_at, player1, player2) AS pos,
+			COUNT(*) OVER () AS total
+		FROM best
+		WINDOW by_score AS (ORDER BY score DESC)
+	)`
+
+func sqliteBoardArgs(b Board) []interface{} {
+	ghostCount := b.GhostCount
+	if ghostCount <= 0 {
+		ghostCount = 4
+	}
+	since := int64(math.MinInt64)
+	if !b.Since.IsZero() {
+		since = b.Since.UnixMicro()
+	}
+	return []interface{}{b.Mode, ghostCount, since}
+}
+
+func (s *SQLiteStore) GetBoardPage(b Board, offset, limit int) ([]BoardEntry, int, error) {
+	rows, err := s.db.Query(sqliteRankedBoardSQL+`
+		SELECT t.total, r.player1, r.player2, r.score, r.rank
+		FROM (SELECT COUNT(*) AS total FROM best) t
+		LEFT JOIN ranked r ON r.pos > $4 AND r.pos <= $4 + $5
+		ORDER BY r.pos`, append(sqliteBoardArgs(b), offset, limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []BoardEntry{}
+	total := 0
+	for rows.Next() {
+		var player1, player2 sql.NullString
+		var score, rank sql.NullInt64
+		if err := rows.Scan(&total, &player1, &player2, &score, &rank); err != nil {
+			return nil, 0, err
+		}
+		if player1.Valid {
+			entries = append(entries, b.entry(int(rank.Int64), player1.String, player2.String, int(score.Int64)))
+		}
+	}
+	return entries, total, rows.Err()
+}
+
+func (s *SQLiteStore) GetBoardRank(b Board, nickname string) (PlayerRank, error) {
+	rank := PlayerRank{Nickname: nickname}
+	var percentRank float64
+	err := s.db.QueryRow(sqliteRankedBoardSQL+`
+		SELECT rank, total, percent_rank, score FROM ranked
+		WHERE player1 = $4 OR player2 = $4
+		ORDER BY pos LIMIT 1`, append(sqliteBoardArgs(b), nickname)...).
+		Scan(&rank.Rank, &rank.Total, &percentRank, &rank.Score)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PlayerRank{}, ErrNotRanked
+	}
+	if err != nil {
+		return PlayerRank{}, err
+	}
+	rank.Percentile = percentile(percentRank)
+	return rank, nil
+}
+
+func (s *SQLiteStore) GetBoardAround(b Board, nickname string, n int) ([]BoardEntry, error) {
+	rows, err := s.db.Query(sqliteRankedBoardSQL+`, me AS (
+			SELECT pos FROM ranked WHERE player1 = $4 OR player2 = $4
+			ORDER BY pos LIMIT 1
+		)
+		SELECT r.player1, r.player2, r.score, r.rank
+		FROM ranked r, me
+		WHERE r.pos BETWEEN me.pos - $5 AND me.pos + $5
+		ORDER BY r.pos`, append(sqliteBoardArgs(b), nickname, n)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []BoardEntry{}
+	for rows.Next() {
+		var player1, player2 string
+		var score, rank int
+		if err := rows.Scan(&player1, &player2, &score, &rank); err != nil {
+			return nil, err
+		}
+		entries = append(entries, b.entry(rank, player1, player2, score))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotRanked
+	}
+	return entries, nil
+}
+
+func (s *SQLiteStore) ExportUser(nickname string) (UserExport, error) {
+	var e UserExport
+	var email sql.NullString
+	var createdAt int64
+	err := s.db.QueryRow("SELECT nickname, email, is_guest, created_at FROM users WHERE nickname = $1", nickname).
+		Scan(&e.Nickname, &email, &e.Guest, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserExport{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserExport{}, err
+	}
+	e.Email = email.String
+	e.CreatedAt = time.UnixMicro(createdAt)
+
+	if e.Identities, err = linkedIdentities(s.db, nickname); err != nil {
+		return UserExport{}, err
+	}
+	rows, err := s.db.Query(`
+		SELECT id, mode, CASE WHEN player1 = $1 THEN player2 ELSE player1 END,
+			ghost_count, map, score, duration_ms, level, death_cause, dots_eaten, ghosts_eaten, created_at
+		FROM game_results
+		WHERE player1 = $1 OR player2 = $1
+		ORDER BY created_at, id`, nickname)
+	if err != nil {
+		return UserExport{}, fmt.Errorf("export games: %w", err)
+	}
+	defer rows.Close()
+	if e.Games, err = scanExportedGames(rows); err != nil {
+		return UserExport{}, err
+	}
+	return e, nil
+}
+
+// sqlitePairAnonymizeSQL is postgresPairAnonymizeSQL for SQLite, whose
+// multi-argument MIN and MAX compare bytes
+const sqlitePairAnonymizeSQL = `
+	UPDATE game_results SET
+		player1 = MIN(CASE WHEN player1 = $1 THEN $2 ELSE player1 END, CASE WHEN player2 = $1 THEN $2 ELSE player2 END),
+		player2 = MAX(CASE WHEN player1 = $1 THEN $2 ELSE player1 END, CASE WHEN player2 = $1 THEN $2 ELSE player2 END)
+	WHERE mode = 'pair' AND (player1 = $1 OR player2 = $1)`
+
+func (s *SQLiteStore) DeleteUser(nickname, anonymousName string, keepScores bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := removePlayerResults(tx, sqlitePairAnonymizeSQL, nickname, anonymousName, keepScores); err != nil {
+		return err
+	}
+	if err := sqliteDeleteAccountRows(tx, nickname); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteDeleteAccountRows is deleteAccountRows for SQLite, which keeps no
+// logins
+func sqliteDeleteAccountRows(tx *sql.Tx, nickname string) error {
+	cleanups := []string{
+		"DELETE FROM ratings WHERE nickname = $1",
+		"DELETE FROM password_reset_tokens WHERE nickname = $1",
+	}
+	for _, q := range cleanups {
+		if _, err := tx.Exec(q, nickname); err != nil {
+			return fmt.Errorf("delete user: %w", err)
+		}
+	}
+	// Identities and achievements go with the user row
+	res, err := tx.Exec("DELETE FROM users WHERE nickname = $1", nickname)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpdatePassword(nickname, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	return execOnUser(s.db, "UPDATE users SET password_hash = $2 WHERE nickname = $1", nickname, string(hashedPassword))
+}
+
+func (s *SQLiteStore) UpgradeGuest(guestNickname, nickname, password, email string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE users SET nickname = $2, password_hash = $3, email = NULLIF($4, ''), is_guest = 0
+		WHERE nickname = $1 AND is_guest`, guestNickname, nickname, string(hashedPassword), email)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			if strings.Contains(err.Error(), "users_email_key") {
+				return ErrEmailTaken
+			}
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("upgrade guest: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotGuest
+	}
+	if err := sqliteRenamePlayerData(tx, guestNickname, nickname); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteRenamePlayerData is renamePlayerData for SQLite
+func sqliteRenamePlayerData(tx *sql.Tx, from, to string) error {
+	renames := []string{
+		"UPDATE game_results SET player1 = $2 WHERE mode = 'single' AND player1 = $1",
+		sqlitePairAnonymizeSQL,
+		"UPDATE ratings SET nickname = $2 WHERE nickname = $1",
+	}
+	for _, q := range renames {
+		if _, err := tx.Exec(q, from, to); err != nil {
+			if isSQLiteUniqueViolation(err) {
+				// A rating already stored under the new name from before accounts existed
+				return ErrUsernameTaken
+			}
+			return fmt.Errorf("move player data: %w", err)
+		}
+	}
+	return nil
+}
+
+// sqliteStaleGuestsSQL is staleGuestsSQL for SQLite, where only games show
+// that a guest is still around
+const sqliteStaleGuestsSQL = `
+	SELECT u.nickname FROM users u
+	WHERE u.is_guest AND u.created_at < $1
+	  AND NOT EXISTS (
+		SELECT 1 FROM game_results r
+		WHERE (r.player1 = u.nickname OR r.player2 = u.nickname) AND r.created_at >= $1)
+	ORDER BY u.nickname`
+
+func (s *SQLiteStore) DeleteStaleGuests(before time.Time, anonymousName func() (string, error)) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(sqliteStaleGuestsSQL, before.UnixMicro())
+	if err != nil {
+		return nil, fmt.Errorf("find stale guests: %w", err)
+	}
+	stale := []string{}
+	for rows.Next() {
+		var nickname string
+		if err := rows.Scan(&nickname); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stale = append(stale, nickname)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, nickname := range stale {
+		name, err := anonymousName()
+		if err != nil {
+			return nil, err
+		}
+		if err := removePlayerResults(tx, sqlitePairAnonymizeSQL, nickname, name, false); err != nil {
+			return nil, err
+		}
+		if err := sqliteDeleteAccountRows(tx, nickname); err != nil {
+			return nil, err
+		}
+	}
+	return stale, tx.Commit()
+}
+
+func (s *SQLiteStore) FindUserForReset(identifier string) (string, string, error) {
+	var nickname string
+	var email sql.NullString
+	err := s.db.QueryRow(`
+		SELECT nickname, email FROM users
+		WHERE nickname = $1 OR lower(email) = lower($1)
+		LIMIT 1`, identifier).Scan(&nickname, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return nickname, email.String, nil
+}
+
+func (s *SQLiteStore) CreatePasswordResetToken(tokenHash, nickname string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO password_reset_tokens (token_hash, nickname, created_at, expires_at)
+		VALUES ($1, $2, $3, $4)`, tokenHash, nickname, time.Now().UnixMicro(), expiresAt.UnixMicro())
+	return err
+}
+
+func (s *SQLiteStore) ResetPassword(tokenHash, newPassword string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var nickname string
+	err = tx.QueryRow(`
+		UPDATE password_reset_tokens SET used_at = $2
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		RETURNING nickname`, tokenHash, time.Now().UnixMicro()).Scan(&nickname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("consume reset token: %w", err)
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = $2 WHERE nickname = $1", nickname, string(hashedPassword)); err != nil {
+		return "", fmt.Errorf("update password: %w", err)
+	}
+	// Any other outstanding reset links for this user are now stale
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE nickname = $1 AND used_at IS NULL", nickname); err != nil {
+		return "", fmt.Errorf("delete stale reset tokens: %w", err)
+	}
+	return nickname, tx.Commit()
+}
+
+func (s *SQLiteStore) FindIdentityUser(issuer, subject string) (string, error) {
+	var nickname string
+	err := s.db.QueryRow(`
+		UPDATE user_identities SET last_login_at = $3
+		WHERE issuer = $1 AND subject = $2
+		RETURNING nickname`, issuer, subject, time.Now().UnixMicro()).Scan(&nickname)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrIdentityNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return nickname, nil
+}
+
+func (s *SQLiteStore) CreateIdentityUser(nickname, email, issuer, subject string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// An empty hash never matches, so the account can only sign in through the provider
+	_, err = tx.Exec("INSERT INTO users (nickname, password_hash, created_at) VALUES ($1, '', $2)", nickname, time.Now().UnixMicro())
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("insert user: %w", err)
+	}
+	if err := sqliteInsertIdentity(tx, nickname, email, issuer, subject); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) LinkIdentity(nickname, email, issuer, subject string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var linked string
+	err = tx.QueryRow("SELECT nickname FROM user_identities WHERE issuer = $1 AND subject = $2", issuer, subject).Scan(&linked)
+	switch {
+	case err == nil && linked == nickname:
+		return nil
+	case err == nil:
+		return ErrIdentityLinked
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	if err := sqliteInsertIdentity(tx, nickname, email, issuer, subject); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqliteInsertIdentity(tx *sql.Tx, nickname, email, issuer, subject string) error {
+	now := time.Now().UnixMicro()
+	_, err := tx.Exec(`
+		INSERT INTO user_identities (issuer, subject, nickname, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $5)`, issuer, subject, nickname, email, now)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrIdentityLinked
+		}
+		return fmt.Errorf("insert identity: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetRating(nickname string) (float64, error) {
+	var rating float64
+	err := s.db.QueryRow("SELECT rating FROM ratings WHERE nickname = $1", nickname).Scan(&rating)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DefaultRating, nil
+	}
+	if err != nil {
+		return DefaultRating, err
+	}
+	return rating, nil
+}
+
+func (s *SQLiteStore) AdjustRating(nickname string, delta float64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO ratings (nickname, rating, games_played, updated_at)
+		VALUES ($1, $2 + $3, 1, $4)
+		ON CONFLICT (nickname)
+		DO UPDATE SET rating = ratings.rating + $3,
+			games_played = ratings.games_played + 1,
+			updated_at = $4`, nickname, DefaultRating, delta, time.Now().UnixMicro())
+	return err
+}
+
+// sqliteBestScoresSQL is bestScoresSQL for SQLite, which has no DISTINCT ON
+const sqliteBestScoresSQL = `
+	SELECT mode, ghost_count, score, created_at FROM (
+		SELECT mode, ghost_count, score, created_at,
+			ROW_NUMBER() OVER (PARTITION BY mode, ghost_count ORDER BY score DESC, created_at) AS n
+		FROM game_results
+		WHERE player1 = $1 OR player2 = $1
+	)
+	WHERE n = 1
+	ORDER BY mode DESC, ghost_count`
+
+func (s *SQLiteStore) GetUserProfile(nickname string, recent int) (Profile, error) {
+	var p Profile
+	var joinedAt int64
+	err := s.db.QueryRow("SELECT nickname, created_at, is_guest FROM users WHERE lower(nickname) = lower($1)", nickname).
+		Scan(&p.Nickname, &joinedAt, &p.Guest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrUserNotFound
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	p.JoinedAt = time.UnixMicro(joinedAt)
+
+	if p.Rating, err = s.GetRating(p.Nickname); err != nil {
+		return Profile{}, err
+	}
+	if err := loadProfileGames(s.db, sqliteBestScoresSQL, &p, recent); err != nil {
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+func (s *SQLiteStore) SyncAchievements(defs []AchievementDef) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range defs {
+		_, err := tx.Exec(`
+			INSERT INTO achievements (id, name, description) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO UPDATE SET name = excluded.name, description = excluded.description`,
+			d.ID, d.Name, d.Description)
+		if err != nil {
+			return fmt.Errorf("sync achievement %s: %w", d.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UnlockAchievement(nickname, id string) (bool, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO user_achievements (nickname, achievement_id, unlocked_at) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, nickname, id, time.Now().UnixMicro())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (s *SQLiteStore) GetUserAchievements(nickname string) ([]UnlockedAchievement, error) {
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE nickname = $1)", nickname).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	rows, err := s.db.Query(`
+		SELECT achievement_id, unlocked_at FROM user_achievements
+		WHERE nickname = $1 ORDER BY unlocked_at, achievement_id`, nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unlocked := []UnlockedAchievement{}
+	for rows.Next() {
+		var u UnlockedAchievement
+		var unlockedAt int64
+		if err := rows.Scan(&u.ID, &unlockedAt); err != nil {
+			return nil, err
+		}
+		u.UnlockedAt = time.UnixMicro(unlockedAt)
+		unlocked = append(unlocked, u)
+	}
+	return unlocked, rows.Err()
+}
+
+func (s *SQLiteStore) CountGamesPlayed(nickname string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM game_results WHERE player1 = $1 OR player2 = $1", nickname).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) GetUserStatus(nickname string) (UserStatus, error) {
+	var st UserStatus
+	var bannedAt sql.NullInt64
+	var reason sql.NullString
+	err := s.db.QueryRow("SELECT role, banned_at, ban_reason FROM users WHERE nickname = $1", nickname).
+		Scan(&st.Role, &bannedAt, &reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserStatus{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserStatus{}, err
+	}
+	st.Banned = bannedAt.Valid
+	st.BanReason = reason.String
+	return st, nil
+}
+
+func (s *SQLiteStore) SetUserRole(nickname, role string) error {
+	return execOnUser(s.db, "UPDATE users SET role = $2 WHERE nickname = $1", nickname, role)
+}
+
+func (s *SQLiteStore) BanUser(nickname, reason string) error {
+	return execOnUser(s.db, "UPDATE users SET banned_at = $2, ban_reason = $3 WHERE nickname = $1", nickname, time.Now().UnixMicro(), reason)
+}
+
+func (s *SQLiteStore) UnbanUser(nickname string) error {
+	return execOnUser(s.db, "UPDATE users SET banned_at = NULL, ban_reason = NULL WHERE nickname = $1", nickname)
+}
+
+func (s *SQLiteStore) RenameUser(nickname, newNickname string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET nickname = $2 WHERE nickname = $1", nickname, newNickname)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("rename user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	if err := sqliteRenamePlayerData(tx, nickname, newNickname); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE nickname = $1", nickname); err != nil {
+		return fmt.Errorf("rename user: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ListScores(nickname string, ghostCount, limit int) ([]AdminScoreEntry, error) {
+	return listScores(s.db, nickname, ghostCount, limit)
+}
+
+func (s *SQLiteStore) ListPairScores(nickname string, ghostCount, limit int) ([]AdminPairScoreEntry, error) {
+	return listPairScores(s.db, nickname, ghostCount, limit)
+}
+
+func (s *SQLiteStore) DeleteScore(id int) error {
+	return deleteByID(s.db, "DELETE FROM game_results WHERE id = $1 AND mode = 'single'", id)
+}
+
+func (s *SQLiteStore) DeletePairScore(id int) error {
+	return deleteByID(s.db, "DELETE FROM game_results WHERE id = $1 AND mode = 'pair'", id)
+}
+
+func (s *SQLiteStore) RecordAdminAction(admin, action, target string, details interface{}) error {
+	raw, err := auditDetails(details)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO admin_audit (admin, action, target, details, created_at)
+		VALUES ($1, $2, $3, $4, $5)`, admin, action, target, nullableJSON(raw), time.Now().UnixMicro())
+	return err
+}
+
+func (s *SQLiteStore) ListAdminActions(limit int) ([]AuditEntry, error) {
+	return listAdminActions(s.db, limit)
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store is the storage behind accounts, game results, the scoreboards,
+// moderation, profiles and achievements. Postgres is the production
+// backend; SQLite and memory stores let the server run, and the tests
+// pass, without a Postgres server. Logins are kept by a SessionStore.
+type Store interface {
+	// Migrate brings the schema up to date
+	Migrate() error
+	Close() error
+
+	// CreateUser returns ErrUsernameTaken or ErrEmailTaken on a clash.
+	// Nicknames and emails are unique regardless of case.
+	CreateUser(nickname, password, email string) error
+	CreateGuestUser(nickname string) error
+	// VerifyUser returns nil only if the password matches
+	VerifyUser(nickname, password string) error
+	// UpdatePassword returns ErrUserNotFound for an unknown nickname
+	UpdatePassword(nickname, newPassword string) error
+
+	// UpgradeGuest returns ErrNotGuest unless guestNickname is a guest, and
+	// ErrUsernameTaken or ErrEmailTaken on a clash
+	UpgradeGuest(guestNickname, nickname, password, email string) error
+	// DeleteStaleGuests removes guests with no activity since before and
+	// returns their nicknames, so the caller can end their logins. Stores
+	// that do not keep logins judge activity by games alone.
+	DeleteStaleGuests(before time.Time, anonymousName func() (string, error)) ([]string, error)
+
+	// FindUserForReset returns ErrUserNotFound if no user has identifier as
+	// nickname or email; ResetPassword returns ErrInvalidResetToken for an
+	// unknown, used or expired token
+	FindUserForReset(identifier string) (nickname, email string, err error)
+	CreatePasswordResetToken(tokenHash, nickname string, expiresAt time.Time) error
+	ResetPassword(tokenHash, newPassword string) (string, error)
+
+	// FindIdentityUser returns ErrIdentityNotFound for an unlinked identity;
+	// LinkIdentity returns ErrIdentityLinked if another user has it
+	FindIdentityUser(issuer, subject string) (string, error)
+	CreateIdentityUser(nickname, email, issuer, subject string) error
+	LinkIdentity(nickname, email, issuer, subject string) error
+
+	SaveGameResult(r GameResult) error
+	GetBoardPage(b Board, offset, limit int) ([]BoardEntry, int, error)
+	GetBoardRank(b Board, nickname string) (PlayerRank, error)
+	GetBoardAround(b Board, nickname string, n int) ([]BoardEntry, error)
+
+	// GetRating returns DefaultRating for a player without a rating
+	GetRating(nickname string) (float64, error)
+	AdjustRating(nickname string, delta float64) error
+
+	// GetUserProfile and GetUserAchievements return ErrUserNotFound for an
+	// unknown nickname
+	GetUserProfile(nickname string, recent int) (Profile, error)
+	SyncAchievements(defs []AchievementDef) error
+	UnlockAchievement(nickname, id string) (bool, error)
+	GetUserAchievements(nickname string) ([]UnlockedAchievement, error)
+	CountGamesPlayed(nickname string) (int, error)
+
+	// The user operations return ErrUserNotFound for an unknown nickname,
+	// and the score deletions ErrScoreNotFound for an unknown id
+	GetUserStatus(nickname string) (UserStatus, error)
+	SetUserRole(nickname, role string) error
+	BanUser(nickname, reason string) error
+	UnbanUser(nickname string) error
+	RenameUser(nickname, newNickname string) error
+	ListScores(nickname string, ghostCount, limit int) ([]AdminScoreEntry, error)
+	ListPairScores(nickname string, ghostCount, limit int) ([]AdminPairScoreEntry, error)
+	DeleteScore(id int) error
+	DeletePairScore(id int) error
+	RecordAdminAction(admin, action, target string, details interface{}) error
+	ListAdminActions(limit int) ([]AuditEntry, error)
+
+	// ExportUser and DeleteUser return ErrUserNotFound for an unknown
+	// nickname; DeleteUser treats results as the Postgres DeleteUser does
+	ExportUser(nickname string) (UserExport, error)
+	DeleteUser(nickname, anonymousName string, keepScores bool) error
+}
+
+// PostgresStore uses the connection opened by InitDB
+type PostgresStore struct{}
+
+func (PostgresStore) Migrate() error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	return RunMigrations(db)
+}
+
+func (PostgresStore) Close() error {
+	closeDB()
+	return nil
+}
+
+func (PostgresStore) CreateUser(nickname, password, email string) error {
+	return CreateUser(nickname, password, email)
+}
+
+func (PostgresStore) CreateGuestUser(nickname string) error {
+	return CreateGuestUser(nickname)
+}
+
+func (PostgresStore) VerifyUser(nickname, password string) error {
+	return VerifyUser(nickname, password)
+}
+
+func (PostgresStore) UpdatePassword(nickname, newPassword string) error {
+	return UpdatePassword(nickname, newPassword)
+}
+
+func (PostgresStore) UpgradeGuest(guestNickname, nickname, password, email string) error {
+	return UpgradeGuest(guestNickname, nickname, password, email)
+}
+
+func (PostgresStore) DeleteStaleGuests(before time.Time, anonymousName func() (string, error)) ([]string, error) {
+	return DeleteStaleGuests(before, anonymousName)
+}
+
+func (PostgresStore) FindUserForReset(identifier string) (string, string, error) {
+	return FindUserForReset(identifier)
+}
+
+func (PostgresStore) CreatePasswordResetToken(tokenHash, nickname string, expiresAt time.Time) error {
+	return CreatePasswordResetToken(tokenHash, nickname, expiresAt)
+}
+
+func (PostgresStore) ResetPassword(tokenHash, newPassword string) (string, error) {
+	return ResetPassword(tokenHash, newPassword)
+}
+
+func (PostgresStore) FindIdentityUser(issuer, subject string) (string, error) {
+	return FindIdentityUser(issuer, subject)
+}
+
+func (PostgresStore) CreateIdentityUser(nickname, email, issuer, subject string) error {
+	return CreateIdentityUser(nickname, email, issuer, subject)
+}
+
+func (PostgresStore) LinkIdentity(nickname, email, issuer, subject string) error {
+	return LinkIdentity(nickname, email, issuer, subject)
+}
+
+func (PostgresStore) SaveGameResult(r GameResult) error {
+	return SaveGameResult(r)
+}
+
+func (PostgresStore) GetBoardPage(b Board, offset, limit int) ([]BoardEntry, int, error) {
+	return GetBoardPage(b, offset, limit)
+}
+
+func (PostgresStore) GetBoardRank(b Board, nickname string) (PlayerRank, error) {
+	return GetBoardRank(b, nickname)
+}
+
+func (PostgresStore) GetBoardAround(b Board, nickname string, n int) ([]BoardEntry, error) {
+	return GetBoardAround(b, nickname, n)
+}
+
+func (PostgresStore) GetRating(nickname string) (float64, error) {
+	return GetRating(nickname)
+}
+
+func (PostgresStore) AdjustRating(nickname string, delta float64) error {
+	return AdjustRating(nickname, delta)
+}
+
+func (PostgresStore) GetUserProfile(nickname string, recent int) (Profile, error) {
+	return GetUserProfile(nickname, recent)
+}
+
+func (PostgresStore) SyncAchievements(defs []AchievementDef) error {
+	return SyncAchievements(defs)
+}
+
+func (PostgresStore) UnlockAchievement(nickname, id string) (bool, error) {
+	return UnlockAchievement(nickname, id)
+}
+
+func (PostgresStore) GetUserAchievements(nickname string) ([]UnlockedAchievement, error) {
+	return GetUserAchievements(nickname)
+}
+
+func (PostgresStore) CountGamesPlayed(nickname string) (int, error) {
+	return CountGamesPlayed(nickname)
+}
+
+func (PostgresStore) GetUserStatus(nickname string) (UserStatus, error) {
+	return GetUserStatus(nickname)
+}
+
+func (PostgresStore) SetUserRole(nickname, role string) error {
+	return SetUserRole(nickname, role)
+}
+
+func (PostgresStore) BanUser(nickname, reason string) error {
+	return BanUser(nickname, reason)
+}
+
+func (PostgresStore) UnbanUser(nickname string) error {
+	return UnbanUser(nickname)
+}
+
+func (PostgresStore) RenameUser(nickname, newNickname string) error {
+	return RenameUser(nickname, newNickname)
+}
+
+func (PostgresStore) ListScores(nickname string, ghostCount, limit int) ([]AdminScoreEntry, error) {
+	return ListScores(nickname, ghostCount, limit)
+}
+
+func (PostgresStore) ListPairScores(nickname string, ghostCount, limit int) ([]AdminPairScoreEntry, error) {
+	return ListPairScores(nickname, ghostCount, limit)
+}
+
+func (PostgresStore) DeleteScore(id int) error {
+	return DeleteScore(id)
+}
+
+func (PostgresStore) DeletePairScore(id int) error {
+	return DeletePairScore(id)
+}
+
+func (PostgresStore) RecordAdminAction(admin, action, target string, details interface{}) error {
+	return RecordAdminAction(admin, action, target, details)
+}
+
+func (PostgresStore) ListAdminActions(limit int) ([]AuditEntry, error) {
+	return ListAdminActions(limit)
+}
+
+func (PostgresStore) ExportUser(nickname string) (UserExport, error) {
+	return ExportUser(nickname)
+}
+
+func (PostgresStore) DeleteUser(nickname, anonymousName string, keepScores bool) error {
+	return DeleteUser(nickname, anonymousName, keepScores)
+}
+
+// normalizeResult checks a result and puts its players in the order the
+// scoreboards use: pairs alphabetically
+func normalizeResult(r GameResult) (GameResult, string, string, error) {
+	// Default to 4 ghosts if not specified (legacy logic safety, though new callers should pass it)
+	if r.GhostCount <= 0 {
+		r.GhostCount = 4
+	}
+	var player1, player2 string
+	switch {
+	case r.Mode == GameModeSingle && len(r.Players) == 1:
+		player1 = r.Players[0]
+	case r.Mode == GameModePair && len(r.Players) == 2:
+		player1, player2 = r.Players[0], r.Players[1]
+		if player1 > player2 {
+			player1, player2 = player2, player1
+		}
+	default:
+		return r, "", "", fmt.Errorf("invalid game result: mode %q with %d players", r.Mode, len(r.Players))
+	}
+	return r, player1, player2, nil
+}
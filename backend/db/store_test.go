@@ -0,0 +1,945 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeFactories returns a fresh, migrated store per test. Postgres only
+// runs when PACMAN_TEST_POSTGRES_DSN points at a database the tests may
+// wipe.
+func storeFactories(t *testing.T) map[string]func(t *testing.T) Store {
+	factories := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+		"sqlite": func(t *testing.T) Store {
+			s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "pacman.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Migrate(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+	if dsn := os.Getenv("PACMAN_TEST_POSTGRES_DSN"); dsn != "" {
+		factories["postgres"] = func(t *testing.T) Store {
+			if err := openPostgres(dsn); err != nil {
+				t.Fatal(err)
+			}
+			s := PostgresStore{}
+			if err := s.Migrate(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(`TRUNCATE users, game_results, ratings, sessions, refresh_tokens,
+				session_families, password_reset_tokens, admin_audit, achievements CASCADE`); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		}
+	}
+	return factories
+}
+
+// runStoreTest runs test against every available backend
+func runStoreTest(t *testing.T, test func(t *testing.T, s Store)) {
+	for name, open := range storeFactories(t) {
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+func mustSave(t *testing.T, s Store, r GameResult) {
+	t.Helper()
+	if err := s.SaveGameResult(r); err != nil {
+		t.Fatalf("SaveGameResult(%v): %v", r.Players, err)
+	}
+}
+
+func single(nickname string, score int, at time.Time) GameResult {
+	return GameResult{Mode: GameModeSingle, Players: []string{nickname}, GhostCount: 4, Score: score, PlayedAt: at}
+}
+
+var storeEpoch = time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+
+func TestStoreUsers(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.CreateUser("Alice", "secret123", "alice@example.com"); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if err := s.CreateUser("alice", "other123", ""); !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("nickname in other case: got %v, want ErrUsernameTaken", err)
+		}
+		if err := s.CreateUser("bob", "secret123", "ALICE@example.com"); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("email in other case: got %v, want ErrEmailTaken", err)
+		}
+		if err := s.CreateUser("carol", "secret123", ""); err != nil {
+			t.Errorf("second user without email: %v", err)
+		}
+		if err := s.CreateUser("dave", "secret123", ""); err != nil {
+			t.Errorf("third user without email: %v", err)
+		}
+		if err := s.CreateGuestUser("ALICE"); !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("guest with taken nickname: got %v, want ErrUsernameTaken", err)
+		}
+
+		if err := s.VerifyUser("Alice", "secret123"); err != nil {
+			t.Errorf("VerifyUser with right password: %v", err)
+		}
+		if err := s.VerifyUser("Alice", "wrong"); err == nil {
+			t.Error("VerifyUser accepted a wrong password")
+		}
+		if err := s.VerifyUser("nobody", "secret123"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("VerifyUser unknown user: got %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestStoreRejectsInvalidResult(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		err := s.SaveGameResult(GameResult{Mode: GameModePair, Players: []string{"alice"}, Score: 10})
+		if err == nil {
+			t.Error("saved a pair result with one player")
+		}
+	})
+}
+
+func TestStoreBoardKeepsBestResultPerPlayer(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustSave(t, s, single("alice", 300, storeEpoch))
+		mustSave(t, s, single("alice", 500, storeEpoch.Add(time.Minute)))
+		mustSave(t, s, single("bob", 400, storeEpoch))
+		mustSave(t, s, single("carol", 900, storeEpoch))
+		// Other boards
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"dave"}, GhostCount: 6, Score: 1000, PlayedAt: storeEpoch})
+		mustSave(t, s, GameResult{Mode: GameModePair, Players: []string{"erin", "dave"}, GhostCount: 4, Score: 2000, PlayedAt: storeEpoch})
+
+		entries, total, err := s.GetBoardPage(Board{Mode: GameModeSingle, GhostCount: 4}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []BoardEntry{
+			{Rank: 1, Nickname: "carol", Score: 900},
+			{Rank: 2, Nickname: "alice", Score: 500},
+			{Rank: 3, Nickname: "bob", Score: 400},
+		}
+		if total != len(want) || len(entries) != len(want) {
+			t.Fatalf("got %d entries of %d, want %d: %+v", len(entries), total, len(want), entries)
+		}
+		for i := range want {
+			if entries[i] != want[i] {
+				t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+			}
+		}
+
+		pairs, _, err := s.GetBoardPage(Board{Mode: GameModePair, GhostCount: 4}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 1 || pairs[0] != (BoardEntry{Rank: 1, Player1: "dave", Player2: "erin", Score: 2000}) {
+			t.Errorf("pair board = %+v, want dave and erin sorted", pairs)
+		}
+	})
+}
+
+func TestStoreBoardExcludesGuests(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.CreateGuestUser("Guest-abc"); err != nil {
+			t.Fatal(err)
+		}
+		mustSave(t, s, single("Guest-abc", 999, storeEpoch))
+		mustSave(t, s, single("alice", 100, storeEpoch))
+		mustSave(t, s, GameResult{Mode: GameModePair, Players: []string{"alice", "Guest-abc"}, Score: 999, PlayedAt: storeEpoch})
+
+		entries, total, err := s.GetBoardPage(Board{Mode: GameModeSingle, GhostCount: 4}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(entries) != 1 || entries[0].Nickname != "alice" {
+			t.Errorf("single board = %+v (total %d), want only alice", entries, total)
+		}
+		_, total, err = s.GetBoardPage(Board{Mode: GameModePair, GhostCount: 4}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 0 {
+			t.Errorf("pair board has %d entries, want guest pairs left out", total)
+		}
+	})
+}
+
+func TestStoreBoardPeriod(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustSave(t, s, single("alice", 900, storeEpoch.Add(-time.Hour)))
+		mustSave(t, s, single("alice", 200, storeEpoch))
+		mustSave(t, s, single("bob", 300, storeEpoch.Add(time.Hour)))
+
+		entries, total, err := s.GetBoardPage(Board{Mode: GameModeSingle, GhostCount: 4, Since: storeEpoch}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []BoardEntry{
+			{Rank: 1, Nickname: "bob", Score: 300},
+			{Rank: 2, Nickname: "alice", Score: 200},
+		}
+		if total != 2 || len(entries) != 2 || entries[0] != want[0] || entries[1] != want[1] {
+			t.Errorf("period board = %+v (total %d), want %+v", entries, total, want)
+		}
+	})
+}
+
+func TestStoreBoardPaging(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		for i, name := range []string{"a", "b", "c", "d", "e"} {
+			mustSave(t, s, single(name, 100*(5-i), storeEpoch))
+		}
+		b := Board{Mode: GameModeSingle, GhostCount: 4}
+
+		entries, total, err := s.GetBoardPage(b, 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 || len(entries) != 2 || entries[0].Nickname != "c" || entries[0].Rank != 3 || entries[1].Nickname != "d" {
+			t.Errorf("page 2 = %+v (total %d)", entries, total)
+		}
+
+		entries, total, err = s.GetBoardPage(b, 10, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 || len(entries) != 0 {
+			t.Errorf("page past the end = %+v (total %d), want empty with total 5", entries, total)
+		}
+	})
+}
+
+func TestStoreBoardTiesShareRank(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustSave(t, s, single("late", 500, storeEpoch.Add(time.Minute)))
+		mustSave(t, s, single("early", 500, storeEpoch))
+		mustSave(t, s, single("last", 100, storeEpoch))
+
+		entries, _, err := s.GetBoardPage(Board{Mode: GameModeSingle, GhostCount: 4}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []BoardEntry{
+			{Rank: 1, Nickname: "early", Score: 500},
+			{Rank: 1, Nickname: "late", Score: 500},
+			{Rank: 3, Nickname: "last", Score: 100},
+		}
+		if len(entries) != len(want) {
+			t.Fatalf("got %+v, want %+v", entries, want)
+		}
+		for i := range want {
+			if entries[i] != want[i] {
+				t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+			}
+		}
+	})
+}
+
+func TestStoreBoardRank(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		for i, name := range []string{"a", "b", "c", "d"} {
+			mustSave(t, s, single(name, 100*(4-i), storeEpoch))
+		}
+		b := Board{Mode: GameModeSingle, GhostCount: 4}
+
+		rank, err := s.GetBoardRank(b, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := PlayerRank{Nickname: "b", Rank: 2, Total: 4, Percentile: 66.7, Score: 300}
+		if rank != want {
+			t.Errorf("rank = %+v, want %+v", rank, want)
+		}
+
+		if _, err := s.GetBoardRank(b, "nobody"); !errors.Is(err, ErrNotRanked) {
+			t.Errorf("unranked player: got %v, want ErrNotRanked", err)
+		}
+	})
+}
+
+func TestStoreBoardRankSingleEntry(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustSave(t, s, single("alone", 10, storeEpoch))
+		rank, err := s.GetBoardRank(Board{Mode: GameModeSingle, GhostCount: 4}, "alone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rank.Rank != 1 || rank.Total != 1 || rank.Percentile != 100 {
+			t.Errorf("rank = %+v, want first of one at 100", rank)
+		}
+	})
+}
+
+func TestStoreBoardAround(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		for i, name := range []string{"a", "b", "c", "d", "e", "f"} {
+			mustSave(t, s, single(name, 100*(6-i), storeEpoch))
+		}
+		b := Board{Mode: GameModeSingle, GhostCount: 4}
+
+		entries, err := s.GetBoardAround(b, "b", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Nickname)
+		}
+		if len(got) != 4 || got[0] != "a" || got[1] != "b" || got[3] != "d" {
+			t.Errorf("around b = %v, want [a b c d]", got)
+		}
+
+		if _, err := s.GetBoardAround(b, "nobody", 2); !errors.Is(err, ErrNotRanked) {
+			t.Errorf("unranked player: got %v, want ErrNotRanked", err)
+		}
+	})
+}
+
+func pair(a, b string, score int, at time.Time) GameResult {
+	return GameResult{Mode: GameModePair, Players: []string{a, b}, GhostCount: 4, Score: score, PlayedAt: at}
+}
+
+func TestStoreExportUser(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.CreateUser("alice", "secret123", "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"alice"}, GhostCount: 6, MapName: "classic",
+			Score: 300, Duration: 90 * time.Second, Level: 2, DeathCause: "blinky", Dots: 120, Ghosts: 3, PlayedAt: storeEpoch})
+		mustSave(t, s, pair("zed", "alice", 700, storeEpoch.Add(time.Minute)))
+		mustSave(t, s, single("bob", 900, storeEpoch))
+
+		e, err := s.ExportUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Nickname != "alice" || e.Email != "alice@example.com" || e.Guest || e.CreatedAt.IsZero() {
+			t.Errorf("Unexpected account %+v", e)
+		}
+		if len(e.Games) != 2 {
+			t.Fatalf("Expected alice's two games, got %+v", e.Games)
+		}
+		g := e.Games[0]
+		if g.Mode != GameModeSingle || g.GhostCount != 6 || g.Map != "classic" || g.Score != 300 || g.DurationSec != 90 ||
+			g.Level != 2 || g.DeathCause != "blinky" || g.Dots != 120 || g.Ghosts != 3 || !g.PlayedAt.Equal(storeEpoch) {
+			t.Errorf("Unexpected single game %+v", g)
+		}
+		if e.Games[1].Partner != "zed" || e.Games[1].Score != 700 {
+			t.Errorf("Expected the pair game with zed, got %+v", e.Games[1])
+		}
+
+		if _, err := s.ExportUser("nobody"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("got %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestStoreDeleteUserKeepingScores(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.CreateUser("mallory", "secret123", "m@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		mustSave(t, s, single("mallory", 500, storeEpoch))
+		mustSave(t, s, pair("mallory", "bob", 800, storeEpoch))
+
+		if err := s.DeleteUser("mallory", "deleted-1", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.VerifyUser("mallory", "secret123"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected the login gone, got %v", err)
+		}
+		// The email is free again
+		if err := s.CreateUser("trent", "secret123", "m@example.com"); err != nil {
+			t.Errorf("CreateUser with the deleted user's email: %v", err)
+		}
+
+		entries, _, err := s.GetBoardPage(Board{Mode: GameModeSingle, GhostCount: 4}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].Nickname != "deleted-1" {
+			t.Errorf("Expected the score kept anonymously, got %+v, %v", entries, err)
+		}
+		entries, _, err = s.GetBoardPage(Board{Mode: GameModePair, GhostCount: 4}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].Player1 != "bob" || entries[0].Player2 != "deleted-1" {
+			t.Errorf("Expected the pair kept in order, got %+v, %v", entries, err)
+		}
+
+		if err := s.DeleteUser("mallory", "deleted-2", true); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("second delete: got %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestStoreDeleteUserRemovingScores(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.CreateUser("mallory", "secret123", ""); err != nil {
+			t.Fatal(err)
+		}
+		mustSave(t, s, single("mallory", 500, storeEpoch))
+		mustSave(t, s, single("bob", 100, storeEpoch))
+		mustSave(t, s, pair("bob", "mallory", 800, storeEpoch))
+
+		if err := s.DeleteUser("mallory", "deleted-1", false); err != nil {
+			t.Fatal(err)
+		}
+		entries, _, err := s.GetBoardPage(Board{Mode: GameModeSingle, GhostCount: 4}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].Nickname != "bob" {
+			t.Errorf("Expected only bob left, got %+v, %v", entries, err)
+		}
+		// Bob's pair game stays on his record, without mallory's name
+		entries, _, err = s.GetBoardPage(Board{Mode: GameModePair, GhostCount: 4}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].Player2 != "deleted-1" {
+			t.Errorf("Expected the pair game anonymized, got %+v, %v", entries, err)
+		}
+	})
+}
+
+func mustCreateUser(t *testing.T, s Store, nickname, email string) {
+	t.Helper()
+	if err := s.CreateUser(nickname, "secret123", email); err != nil {
+		t.Fatalf("CreateUser(%s): %v", nickname, err)
+	}
+}
+
+func TestStorePasswordReset(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustCreateUser(t, s, "pacfan", "pac@example.com")
+		mustCreateUser(t, s, "inky", "")
+
+		if err := s.UpdatePassword("pacfan", "changed123"); err != nil {
+			t.Fatalf("UpdatePassword: %v", err)
+		}
+		if err := s.VerifyUser("pacfan", "changed123"); err != nil {
+			t.Errorf("Expected the changed password to work, got %v", err)
+		}
+		if err := s.UpdatePassword("nobody", "changed123"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("UpdatePassword unknown user: got %v, want ErrUserNotFound", err)
+		}
+
+		for _, identifier := range []string{"pacfan", "PAC@example.com"} {
+			nickname, email, err := s.FindUserForReset(identifier)
+			if err != nil || nickname != "pacfan" || email != "pac@example.com" {
+				t.Errorf("FindUserForReset(%q) = %q, %q, %v", identifier, nickname, email, err)
+			}
+		}
+		if _, email, err := s.FindUserForReset("inky"); err != nil || email != "" {
+			t.Errorf("Expected inky found without an email, got %q %v", email, err)
+		}
+		if _, _, err := s.FindUserForReset("nobody"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("FindUserForReset unknown: got %v, want ErrUserNotFound", err)
+		}
+
+		expires := time.Now().Add(time.Hour)
+		for _, hash := range []string{"hash-1", "hash-2"} {
+			if err := s.CreatePasswordResetToken(hash, "pacfan", expires); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.CreatePasswordResetToken("hash-expired", "inky", time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		nickname, err := s.ResetPassword("hash-1", "reset123")
+		if err != nil || nickname != "pacfan" {
+			t.Fatalf("ResetPassword = %q, %v", nickname, err)
+		}
+		if err := s.VerifyUser("pacfan", "reset123"); err != nil {
+			t.Errorf("Expected the reset password to work, got %v", err)
+		}
+		// Used, made stale by the reset, expired and unknown tokens all fail
+		for _, hash := range []string{"hash-1", "hash-2", "hash-expired", "hash-unknown"} {
+			if _, err := s.ResetPassword(hash, "again123"); !errors.Is(err, ErrInvalidResetToken) {
+				t.Errorf("ResetPassword(%s): got %v, want ErrInvalidResetToken", hash, err)
+			}
+		}
+	})
+}
+
+func TestStoreUpgradeGuest(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustCreateUser(t, s, "inky", "inky@example.com")
+		if err := s.CreateGuestUser("guest_1234"); err != nil {
+			t.Fatal(err)
+		}
+		// Stored as (guest_1234, inky); the new name sorts after inky
+		mustSave(t, s, pair("inky", "guest_1234", 500, storeEpoch))
+		mustSave(t, s, single("guest_1234", 300, storeEpoch))
+		if err := s.AdjustRating("guest_1234", 20); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.UpgradeGuest("inky", "someone", "secret123", ""); !errors.Is(err, ErrNotGuest) {
+			t.Errorf("upgrading a registered user: got %v, want ErrNotGuest", err)
+		}
+		if err := s.UpgradeGuest("guest_1234", "INKY", "secret123", ""); !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("upgrading to a taken nickname: got %v, want ErrUsernameTaken", err)
+		}
+		if err := s.UpgradeGuest("guest_1234", "pacfan", "secret123", "Inky@example.com"); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("upgrading with a taken email: got %v, want ErrEmailTaken", err)
+		}
+
+		if err := s.UpgradeGuest("guest_1234", "pacfan", "secret123", "pac@example.com"); err != nil {
+			t.Fatalf("UpgradeGuest: %v", err)
+		}
+		if err := s.VerifyUser("pacfan", "secret123"); err != nil {
+			t.Errorf("Expected the new account to log in, got %v", err)
+		}
+		e, err := s.ExportUser("pacfan")
+		if err != nil || e.Guest || e.Email != "pac@example.com" || len(e.Games) != 2 {
+			t.Errorf("Expected a registered account with both games, got %+v %v", e, err)
+		}
+		if rating, _ := s.GetRating("pacfan"); rating != DefaultRating+20 {
+			t.Errorf("Expected the rating moved, got %v", rating)
+		}
+		// No longer a guest, so the scores are on the boards, the pair re-sorted
+		entries, _, err := s.GetBoardPage(Board{Mode: GameModePair, GhostCount: 4}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].Player1 != "inky" || entries[0].Player2 != "pacfan" {
+			t.Errorf("Expected the pair as (inky, pacfan), got %+v %v", entries, err)
+		}
+		if _, err := s.GetBoardRank(Board{Mode: GameModeSingle, GhostCount: 4}, "pacfan"); err != nil {
+			t.Errorf("Expected the single score ranked, got %v", err)
+		}
+	})
+}
+
+func TestStoreDeleteStaleGuests(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		// Everyone is created before the cutoff; only a game after it counts
+		cutoff := time.Now().Add(time.Hour)
+		mustCreateUser(t, s, "pacfan", "")
+		for _, nickname := range []string{"guest_idle", "guest_player"} {
+			if err := s.CreateGuestUser(nickname); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustSave(t, s, pair("guest_idle", "pacfan", 700, storeEpoch))
+		mustSave(t, s, single("guest_idle", 300, storeEpoch))
+		mustSave(t, s, single("guest_player", 400, cutoff.Add(time.Minute)))
+
+		removed, err := s.DeleteStaleGuests(cutoff, func() (string, error) { return "deleted-1234", nil })
+		if err != nil {
+			t.Fatalf("DeleteStaleGuests: %v", err)
+		}
+		if len(removed) != 1 || removed[0] != "guest_idle" {
+			t.Errorf("Expected only the idle guest removed, got %v", removed)
+		}
+		if _, err := s.ExportUser("guest_idle"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected guest_idle gone, got %v", err)
+		}
+		for _, nickname := range []string{"guest_player", "pacfan"} {
+			if _, err := s.ExportUser(nickname); err != nil {
+				t.Errorf("Expected %s kept, got %v", nickname, err)
+			}
+		}
+
+		// The partner keeps the pair score, under an anonymous name for the guest
+		e, err := s.ExportUser("pacfan")
+		if err != nil || len(e.Games) != 1 || e.Games[0].Partner != "deleted-1234" {
+			t.Errorf("Expected the pair kept with the guest anonymized, got %+v %v", e.Games, err)
+		}
+		if scores, _ := s.ListScores("guest_idle", 0, 10); len(scores) != 0 {
+			t.Errorf("Expected the guest's single scores removed, got %+v", scores)
+		}
+	})
+}
+
+func TestStoreIdentities(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		const issuer = "https://id.example.com"
+		if _, err := s.FindIdentityUser(issuer, "sub-1"); !errors.Is(err, ErrIdentityNotFound) {
+			t.Errorf("FindIdentityUser before linking: got %v, want ErrIdentityNotFound", err)
+		}
+		if err := s.CreateIdentityUser("ada", "ada@example.com", issuer, "sub-1"); err != nil {
+			t.Fatalf("CreateIdentityUser: %v", err)
+		}
+		if nickname, err := s.FindIdentityUser(issuer, "sub-1"); err != nil || nickname != "ada" {
+			t.Errorf("FindIdentityUser = %q, %v", nickname, err)
+		}
+		if err := s.VerifyUser("ada", ""); err == nil {
+			t.Error("Expected an account created through the provider to have no password")
+		}
+		if err := s.CreateIdentityUser("ADA", "", issuer, "sub-2"); !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("CreateIdentityUser taken nickname: got %v, want ErrUsernameTaken", err)
+		}
+
+		mustCreateUser(t, s, "pacfan", "")
+		if err := s.LinkIdentity("pacfan", "", issuer, "sub-1"); !errors.Is(err, ErrIdentityLinked) {
+			t.Errorf("linking another user's identity: got %v, want ErrIdentityLinked", err)
+		}
+		if err := s.LinkIdentity("ada", "", issuer, "sub-1"); err != nil {
+			t.Errorf("relinking to the same user: %v", err)
+		}
+		if err := s.LinkIdentity("pacfan", "pac@example.com", issuer, "sub-3"); err != nil {
+			t.Fatalf("LinkIdentity: %v", err)
+		}
+		if nickname, err := s.FindIdentityUser(issuer, "sub-3"); err != nil || nickname != "pacfan" {
+			t.Errorf("FindIdentityUser after linking = %q, %v", nickname, err)
+		}
+		e, err := s.ExportUser("pacfan")
+		if err != nil || len(e.Identities) != 1 || e.Identities[0].Subject != "sub-3" || e.Identities[0].Email != "pac@example.com" {
+			t.Errorf("Expected the linked identity exported, got %+v %v", e.Identities, err)
+		}
+
+		// Deleting the account frees the identity
+		if err := s.DeleteUser("pacfan", "deleted-1", true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.FindIdentityUser(issuer, "sub-3"); !errors.Is(err, ErrIdentityNotFound) {
+			t.Errorf("Expected the identity gone with its user, got %v", err)
+		}
+	})
+}
+
+func TestStoreRatings(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if rating, err := s.GetRating("pacfan"); err != nil || rating != DefaultRating {
+			t.Errorf("Expected the default rating, got %v %v", rating, err)
+		}
+		for _, delta := range []float64{12.5, -2.5} {
+			if err := s.AdjustRating("pacfan", delta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if rating, err := s.GetRating("pacfan"); err != nil || rating != DefaultRating+10 {
+			t.Errorf("Expected both adjustments applied, got %v %v", rating, err)
+		}
+
+		// Deleting the account drops its rating
+		mustCreateUser(t, s, "pacfan", "")
+		if err := s.DeleteUser("pacfan", "deleted-1", false); err != nil {
+			t.Fatal(err)
+		}
+		if rating, _ := s.GetRating("pacfan"); rating != DefaultRating {
+			t.Errorf("Expected the rating deleted with the user, got %v", rating)
+		}
+	})
+}
+
+func TestStoreAchievements(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		defs := []AchievementDef{{"clean_level", "Untouchable", "Clear a level"}, {"games_100", "Centurion", "Play 100 games"}}
+		if err := s.SyncAchievements(defs); err != nil {
+			t.Fatalf("SyncAchievements: %v", err)
+		}
+		// Syncing again updates rather than duplicates
+		defs[0].Name = "Untouched"
+		if err := s.SyncAchievements(defs); err != nil {
+			t.Fatalf("SyncAchievements again: %v", err)
+		}
+
+		mustCreateUser(t, s, "pacfan", "")
+		if got, err := s.GetUserAchievements("pacfan"); err != nil || len(got) != 0 {
+			t.Errorf("Expected no achievements yet, got %+v %v", got, err)
+		}
+		if isNew, err := s.UnlockAchievement("pacfan", "clean_level"); err != nil || !isNew {
+			t.Errorf("first unlock = %v, %v; want new", isNew, err)
+		}
+		if isNew, err := s.UnlockAchievement("pacfan", "clean_level"); err != nil || isNew {
+			t.Errorf("second unlock = %v, %v; want not new", isNew, err)
+		}
+		got, err := s.GetUserAchievements("pacfan")
+		if err != nil || len(got) != 1 || got[0].ID != "clean_level" || got[0].UnlockedAt.IsZero() {
+			t.Errorf("Expected clean_level unlocked, got %+v %v", got, err)
+		}
+		if _, err := s.GetUserAchievements("nobody"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("GetUserAchievements unknown: got %v, want ErrUserNotFound", err)
+		}
+
+		mustSave(t, s, single("pacfan", 100, storeEpoch))
+		mustSave(t, s, pair("inky", "pacfan", 200, storeEpoch))
+		mustSave(t, s, single("inky", 300, storeEpoch))
+		if n, err := s.CountGamesPlayed("pacfan"); err != nil || n != 2 {
+			t.Errorf("CountGamesPlayed = %d, %v; want 2", n, err)
+		}
+	})
+}
+
+func TestStoreUserStatus(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustCreateUser(t, s, "pacfan", "")
+		if st, err := s.GetUserStatus("pacfan"); err != nil || st != (UserStatus{Role: RolePlayer}) {
+			t.Errorf("Expected a new user to be an unbanned player, got %+v %v", st, err)
+		}
+		if err := s.SetUserRole("pacfan", RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.BanUser("pacfan", "cheating"); err != nil {
+			t.Fatal(err)
+		}
+		if st, _ := s.GetUserStatus("pacfan"); st != (UserStatus{Role: RoleAdmin, Banned: true, BanReason: "cheating"}) {
+			t.Errorf("Expected a banned admin, got %+v", st)
+		}
+		if err := s.UnbanUser("pacfan"); err != nil {
+			t.Fatal(err)
+		}
+		if st, _ := s.GetUserStatus("pacfan"); st != (UserStatus{Role: RoleAdmin}) {
+			t.Errorf("Expected the ban lifted, got %+v", st)
+		}
+
+		if _, err := s.GetUserStatus("nobody"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("GetUserStatus unknown: got %v, want ErrUserNotFound", err)
+		}
+		for name, err := range map[string]error{
+			"SetUserRole": s.SetUserRole("nobody", RoleAdmin),
+			"BanUser":     s.BanUser("nobody", ""),
+			"UnbanUser":   s.UnbanUser("nobody"),
+		} {
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("%s unknown: got %v, want ErrUserNotFound", name, err)
+			}
+		}
+	})
+}
+
+func TestStoreRenameUser(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustCreateUser(t, s, "blinky", "")
+		mustCreateUser(t, s, "inky", "")
+		if err := s.SyncAchievements([]AchievementDef{{"clean_level", "Untouchable", "Clear a level"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UnlockAchievement("inky", "clean_level"); err != nil {
+			t.Fatal(err)
+		}
+		// Stored as (blinky, inky); the new name sorts before blinky
+		mustSave(t, s, pair("inky", "blinky", 500, storeEpoch))
+		if err := s.AdjustRating("inky", 15); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreatePasswordResetToken("hash-1", "inky", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.RenameUser("inky", "aaron"); err != nil {
+			t.Fatalf("RenameUser: %v", err)
+		}
+		pairs, err := s.ListPairScores("aaron", 0, 10)
+		if err != nil || len(pairs) != 1 || pairs[0].Player1 != "aaron" || pairs[0].Player2 != "blinky" {
+			t.Errorf("Expected the pair re-sorted as (aaron, blinky), got %+v %v", pairs, err)
+		}
+		if rating, _ := s.GetRating("aaron"); rating != DefaultRating+15 {
+			t.Errorf("Expected the rating moved, got %v", rating)
+		}
+		if got, err := s.GetUserAchievements("aaron"); err != nil || len(got) != 1 {
+			t.Errorf("Expected the achievement moved, got %+v %v", got, err)
+		}
+		// A reset link mailed to the old name must not reach whoever takes it next
+		if _, err := s.ResetPassword("hash-1", "taken123"); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("Expected the old nickname's reset token gone, got %v", err)
+		}
+
+		if err := s.RenameUser("aaron", "BLINKY"); !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("RenameUser to taken nickname: got %v, want ErrUsernameTaken", err)
+		}
+		if err := s.RenameUser("nobody", "someone"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("RenameUser unknown: got %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestStoreAdminScores(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustSave(t, s, single("pacfan", 300, storeEpoch))
+		mustSave(t, s, single("pacfan", 500, storeEpoch))
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"pacfan"}, GhostCount: 6, Score: 900, PlayedAt: storeEpoch})
+		mustSave(t, s, single("inky", 400, storeEpoch))
+		mustSave(t, s, pair("pacfan", "inky", 800, storeEpoch))
+		mustSave(t, s, pair("blinky", "clyde", 700, storeEpoch))
+
+		scores, err := s.ListScores("pacfan", 4, 10)
+		if err != nil || len(scores) != 2 || scores[0].Score != 500 || scores[1].Score != 300 {
+			t.Fatalf("Expected pacfan's 4-ghost scores, highest first, got %+v %v", scores, err)
+		}
+		if all, _ := s.ListScores("", 0, 10); len(all) != 4 {
+			t.Errorf("Expected every single score without filters, got %+v", all)
+		}
+		if top, _ := s.ListScores("", 0, 1); len(top) != 1 || top[0].Score != 900 {
+			t.Errorf("Expected the limit to keep the highest, got %+v", top)
+		}
+		pairs, err := s.ListPairScores("inky", 0, 10)
+		if err != nil || len(pairs) != 1 || pairs[0].Player1 != "inky" || pairs[0].Player2 != "pacfan" {
+			t.Fatalf("Expected inky's pair score, got %+v %v", pairs, err)
+		}
+
+		// The ids only match results of their own mode
+		if err := s.DeletePairScore(scores[0].ID); !errors.Is(err, ErrScoreNotFound) {
+			t.Errorf("DeletePairScore of a single id: got %v, want ErrScoreNotFound", err)
+		}
+		if err := s.DeleteScore(scores[0].ID); err != nil {
+			t.Fatalf("DeleteScore: %v", err)
+		}
+		if err := s.DeleteScore(scores[0].ID); !errors.Is(err, ErrScoreNotFound) {
+			t.Errorf("DeleteScore twice: got %v, want ErrScoreNotFound", err)
+		}
+		if err := s.DeletePairScore(pairs[0].ID); err != nil {
+			t.Fatalf("DeletePairScore: %v", err)
+		}
+		// The next best takes the deleted score's place on the board
+		if rank, err := s.GetBoardRank(Board{Mode: GameModeSingle, GhostCount: 4}, "pacfan"); err != nil || rank.Score != 300 {
+			t.Errorf("Expected pacfan ranked on 300, got %+v %v", rank, err)
+		}
+		if left, _ := s.ListPairScores("", 0, 10); len(left) != 1 {
+			t.Errorf("Expected one pair score left, got %+v", left)
+		}
+	})
+}
+
+func TestStoreAdminAudit(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.RecordAdminAction("warden", "ban_user", "pacfan", map[string]string{"reason": "cheating"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RecordAdminAction("warden", "unban_user", "pacfan", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := s.ListAdminActions(10)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("Expected two entries, got %+v %v", entries, err)
+		}
+		if entries[0].Action != "unban_user" || entries[1].Action != "ban_user" {
+			t.Errorf("Expected newest first, got %s then %s", entries[0].Action, entries[1].Action)
+		}
+		if entries[0].Details != nil {
+			t.Errorf("Expected no details for the unban, got %s", entries[0].Details)
+		}
+		var details map[string]string
+		if err := json.Unmarshal(entries[1].Details, &details); err != nil || details["reason"] != "cheating" {
+			t.Errorf("Expected the ban reason recorded, got %s %v", entries[1].Details, err)
+		}
+		if e := entries[1]; e.Admin != "warden" || e.Target != "pacfan" || e.CreatedAt.IsZero() {
+			t.Errorf("Unexpected ban entry %+v", e)
+		}
+		if latest, _ := s.ListAdminActions(1); len(latest) != 1 || latest[0].Action != "unban_user" {
+			t.Errorf("Expected the limit to keep the newest, got %+v", latest)
+		}
+	})
+}
+
+func TestStoreProfileAggregates(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustCreateUser(t, s, "pacfan", "")
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: 300,
+			Duration: 60 * time.Second, Dots: 100, Ghosts: 2, PlayedAt: storeEpoch})
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: 500,
+			Duration: 120 * time.Second, Dots: 150, PlayedAt: storeEpoch.Add(time.Minute)})
+		mustSave(t, s, GameResult{Mode: GameModePair, Players: []string{"pacfan", "inky"}, GhostCount: 4, Score: 800,
+			Duration: 90 * time.Second, Dots: 200, Ghosts: 4, DeathCause: "ghost", PlayedAt: storeEpoch.Add(2 * time.Minute)})
+		// Recorded before durations and counts were, so those stay empty
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"pacfan"}, GhostCount: 6, Score: 400,
+			PlayedAt: storeEpoch.Add(3 * time.Minute)})
+		// Someone else's game
+		mustSave(t, s, GameResult{Mode: GameModeSingle, Players: []string{"inky"}, GhostCount: 4, Score: 9000,
+			Dots: 999, PlayedAt: storeEpoch})
+		if err := s.AdjustRating("pacfan", 25); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := s.GetUserProfile("PACFAN", 2)
+		if err != nil {
+			t.Fatalf("GetUserProfile: %v", err)
+		}
+		if p.Nickname != "pacfan" || p.Guest || p.JoinedAt.IsZero() {
+			t.Errorf("Expected the stored account, got %q guest=%v joined=%v", p.Nickname, p.Guest, p.JoinedAt)
+		}
+		if p.Rating != DefaultRating+25 {
+			t.Errorf("Expected the rating, got %v", p.Rating)
+		}
+		wantStats := PlayerStats{GamesPlayed: 4, SingleGames: 3, PairGames: 1, TotalDots: 450, GhostsEaten: 6, AverageGameSeconds: 90}
+		if p.Stats != wantStats {
+			t.Errorf("Expected stats %+v, got %+v", wantStats, p.Stats)
+		}
+
+		wantBest := []BestScore{
+			{Mode: GameModeSingle, GhostCount: 4, Score: 500, AchievedAt: storeEpoch.Add(time.Minute)},
+			{Mode: GameModeSingle, GhostCount: 6, Score: 400, AchievedAt: storeEpoch.Add(3 * time.Minute)},
+			{Mode: GameModePair, GhostCount: 4, Score: 800, AchievedAt: storeEpoch.Add(2 * time.Minute)},
+		}
+		if len(p.BestScores) != len(wantBest) {
+			t.Fatalf("Expected %d best scores, got %+v", len(wantBest), p.BestScores)
+		}
+		for i, want := range wantBest {
+			got := p.BestScores[i]
+			if got.Mode != want.Mode || got.GhostCount != want.GhostCount || got.Score != want.Score || !got.AchievedAt.Equal(want.AchievedAt) {
+				t.Errorf("Best score %d: expected %+v, got %+v", i, want, got)
+			}
+		}
+
+		if len(p.RecentGames) != 2 {
+			t.Fatalf("Expected the 2 most recent games, got %+v", p.RecentGames)
+		}
+		if g := p.RecentGames[0]; g.Score != 400 || g.DurationSec != 0 || g.Partner != "" {
+			t.Errorf("Expected the legacy game first, got %+v", g)
+		}
+		if g := p.RecentGames[1]; g.Partner != "inky" || g.DurationSec != 90 || g.DeathCause != "ghost" {
+			t.Errorf("Expected the pair game with its partner, got %+v", g)
+		}
+		if p.FavouritePartner == nil || *p.FavouritePartner != (PartnerStat{Nickname: "inky", GamesPlayed: 1, BestScore: 800}) {
+			t.Errorf("Expected inky as the favourite partner, got %+v", p.FavouritePartner)
+		}
+
+		if _, err := s.GetUserProfile("nobody", 5); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("Expected ErrUserNotFound, got %v", err)
+		}
+	})
+}
+
+func TestStoreProfileWithoutGames(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		if err := s.CreateGuestUser("guest_1234"); err != nil {
+			t.Fatal(err)
+		}
+		p, err := s.GetUserProfile("guest_1234", 5)
+		if err != nil {
+			t.Fatalf("GetUserProfile: %v", err)
+		}
+		if !p.Guest || p.Stats != (PlayerStats{}) || p.Rating != DefaultRating {
+			t.Errorf("Expected an empty guest profile, got %+v", p)
+		}
+		if len(p.BestScores) != 0 || len(p.RecentGames) != 0 || p.FavouritePartner != nil {
+			t.Errorf("Expected no games or partner, got %+v", p)
+		}
+	})
+}
+
+func TestStoreFavouritePartnerTieBreak(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		mustCreateUser(t, s, "pacfan", "")
+		mustCreateUser(t, s, "sue", "")
+		mustSave(t, s, pair("pacfan", "inky", 500, storeEpoch))
+		mustSave(t, s, pair("inky", "pacfan", 300, storeEpoch))
+		mustSave(t, s, pair("pacfan", "blinky", 900, storeEpoch))
+		mustSave(t, s, pair("blinky", "pacfan", 100, storeEpoch))
+		// Once with the best score of all, which does not beat playing more
+		mustSave(t, s, pair("pacfan", "clyde", 2000, storeEpoch))
+		// Equal on games and best score, so the name decides
+		mustSave(t, s, pair("sue", "zed", 100, storeEpoch))
+		mustSave(t, s, pair("amy", "sue", 100, storeEpoch))
+
+		p, err := s.GetUserProfile("pacfan", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.FavouritePartner == nil || *p.FavouritePartner != (PartnerStat{Nickname: "blinky", GamesPlayed: 2, BestScore: 900}) {
+			t.Errorf("Expected blinky on games then best score, got %+v", p.FavouritePartner)
+		}
+		p, err = s.GetUserProfile("sue", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.FavouritePartner == nil || p.FavouritePartner.Nickname != "amy" {
+			t.Errorf("Expected amy on name, got %+v", p.FavouritePartner)
+		}
+	})
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
 )
 
 type PlayerState struct {
@@ -15,7 +18,33 @@ type PlayerState struct {
 	LastPos Position `json:"-"` // Internal use for collision
 }
 
+// nextGameID numbers games so moderators can refer to a running one
+var nextGameID atomic.Uint64
+
+// GameEventType names something that happened during a game
+type GameEventType string
+
+const (
+	EventDotEaten     GameEventType = "dot_eaten"
+	EventPowerPellet  GameEventType = "power_pellet"
+	EventGhostEaten   GameEventType = "ghost_eaten"
+	EventDeath        GameEventType = "death"
+	EventLevelCleared GameEventType = "level_cleared"
+	// EventGameOver is raised by the session once the game's result is saved
+	EventGameOver GameEventType = "game_over"
+)
+
+// GameEvent is passed to GameState.OnEvent as the game is played
+type GameEvent struct {
+	Type   GameEventType
+	Player string // Empty for events that concern every player
+	Level  int
+	Streak int // Ghosts eaten on the current power pellet, for EventGhostEaten
+}
+
 type GameState struct {
+	ID            uint64                  `json:"-"`
+	StartedAt     time.Time               `json:"-"`
 	Grid          [Rows][Cols]int         `json:"grid"`
 	Players       map[string]*PlayerState `json:"players"`
 	Ghosts        []Ghost                 `json:"ghosts"`
@@ -24,16 +53,29 @@ type GameState struct {
 	LastEatTime   int64                   `json:"lastEatTime"`
 	GameOver      bool                    `json:"gameOver"`
 	GhostCount    int                     `json:"ghostCount"`
+	MapName       string                  `json:"map"`
+	Level         int                     `json:"level"`
+	DeathCause    string                  `json:"-"` // What ended the game, for the results history
+	DotsEaten     int                     `json:"-"` // Shared by both players in pair games
+	GhostsEaten   int                     `json:"-"`
+	OnEvent       func(GameEvent)         `json:"-"` // Called with the game lock held
+	ghostStreak   int                     // Ghosts eaten since the last power pellet
+	dotsLeft      int                     // Dots and power pellets left on this level
+	TickInterval  time.Duration           `json:"-"` // Set by the scheduler
 	mu            sync.RWMutex            `json:"-"`
 }
 
 func NewGame(nicknames []string, ghostCount int) *GameState {
-	// Deep copy grid
-	var grid [Rows][Cols]int
-	for y := 0; y < Rows; y++ {
-		for x := 0; x < Cols; x++ {
-			grid[y][x] = InitialMap[y][x]
-		}
+	return NewGameOnMap(nicknames, ghostCount, DefaultMapName)
+}
+
+// NewGameOnMap creates a game on the named map, falling back to the default
+// map if the name is unknown.
+func NewGameOnMap(nicknames []string, ghostCount int, mapName string) *GameState {
+	layout, ok := Maps[mapName]
+	if !ok {
+		mapName = DefaultMapName
+		layout = Maps[DefaultMapName]
 	}
 
 	players := make(map[string]*PlayerState)
@@ -64,7 +106,9 @@ func NewGame(nicknames []string, ghostCount int) *GameState {
 	}
 
 	game := &GameState{
-		Grid:          grid,
+		ID:            nextGameID.Add(1),
+		StartedAt:     time.Now(),
+		Grid:          *layout, // Arrays copy, so the layout stays untouched
 		Players:       players,
 		Ghosts:        generateGhosts(ghostCount),
 		Score:         0,
@@ -72,10 +116,61 @@ func NewGame(nicknames []string, ghostCount int) *GameState {
 		LastEatTime:   time.Now().UnixMilli(),
 		GameOver:      false,
 		GhostCount:    ghostCount,
+		MapName:       mapName,
+		Level:         1,
+		TickInterval:  DefaultTickInterval,
 	}
+	game.dotsLeft = game.countDots()
 	return game
 }
 
+func (g *GameState) countDots() int {
+	n := 0
+	for y := 0; y < Rows; y++ {
+		for x := 0; x < Cols; x++ {
+			if g.Grid[y][x] == CellDot || g.Grid[y][x] == CellPower {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (g *GameState) emit(ev GameEvent) {
+	if g.OnEvent != nil {
+		ev.Level = g.Level
+		g.OnEvent(ev)
+	}
+}
+
+// clearLevel starts the next level once every dot and power pellet has been
+// eaten: the map is refilled and the ghosts go home
+func (g *GameState) clearLevel() {
+	g.emit(GameEvent{Type: EventLevelCleared})
+	g.Level++
+	g.Grid = *Maps[g.MapName]
+	g.dotsLeft = g.countDots()
+	g.Ghosts = generateGhosts(g.GhostCount)
+	g.PowerModeTime = 0
+}
+
+// Result describes the finished game for the results history. The caller
+// must hold the game lock.
+func (g *GameState) Result(mode GameMode, nicknames ...string) db.GameResult {
+	return db.GameResult{
+		Mode:       string(mode),
+		Players:    nicknames,
+		GhostCount: g.GhostCount,
+		MapName:    g.MapName,
+		Score:      g.Score,
+		Duration:   time.Since(g.StartedAt),
+		Level:      g.Level,
+		DeathCause: g.DeathCause,
+		Dots:       g.DotsEaten,
+		Ghosts:     g.GhostsEaten,
+	}
+}
+
 // UpdateGhostCount updates the number of ghosts if the game hasn't really started (no movement)
 func (g *GameState) UpdateGhostCount(count int) {
 	g.mu.Lock()
@@ -88,11 +183,11 @@ func (g *GameState) UpdateGhostCount(count int) {
 		}
 	}
 	
-	if count < 1 {
-		count = 1
+	if count < MinGhostCount {
+		count = MinGhostCount
 	}
-	if count > 10 {
-		count = 10
+	if count > MaxGhostCount {
+		count = MaxGhostCount
 	}
 
 	g.GhostCount = count
@@ -154,11 +249,16 @@ func (g *GameState) Update() {
         return
     }
 
+	if g.dotsLeft == 0 {
+		g.clearLevel()
+		return
+	}
+
 	g.moveGhosts()
 	g.checkCollisions()
 
 	if g.PowerModeTime > 0 {
-		g.PowerModeTime -= 150
+		g.PowerModeTime -= int(g.TickInterval / time.Millisecond)
 	}
 }
 
@@ -175,7 +275,7 @@ func (g *GameState) movePlayer(p *PlayerState) {
 	if currentDir != "" && g.canMove(p.Pos, currentDir) {
 		newPos := g.getNextPos(p.Pos, currentDir)
 		newPos = g.handleTeleport(newPos)
-		g.handleEating(newPos)
+		g.handleEating(p, newPos)
 		p.Pos = newPos
 	}
 }
@@ -189,7 +289,7 @@ func (g *GameState) handleTeleport(pos Position) Position {
 	return pos
 }
 
-func (g *GameState) handleEating(pos Position) {
+func (g *GameState) handleEating(p *PlayerState, pos Position) {
 	// Eat Dot
 	cell := g.Grid[pos.Y][pos.X]
 	if cell == CellDot {
@@ -206,13 +306,19 @@ func (g *GameState) handleEating(pos Position) {
 			}
 		}
 		g.Score += 10 + bonus
+		g.DotsEaten++
+		g.dotsLeft--
 		g.LastEatTime = now
+		g.emit(GameEvent{Type: EventDotEaten, Player: p.Nickname})
 	}
 	// Eat Power
 	if cell == CellPower {
 		g.Grid[pos.Y][pos.X] = CellEmpty
 		g.Score += 50
 		g.PowerModeTime = 5000
+		g.dotsLeft--
+		g.ghostStreak = 0
+		g.emit(GameEvent{Type: EventPowerPellet, Player: p.Nickname})
 	}
 }
 
@@ -13,6 +13,12 @@ const (
 	CellGate  = 9
 )
 
+const (
+	MinGhostCount     = 1
+	MaxGhostCount     = 10
+	DefaultGhostCount = 4
+)
+
 const (
 	DirUp    Direction = "UP"
 	DirDown  Direction = "DOWN"
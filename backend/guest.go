@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	// guestNicknamePrefix marks generated guest names; players cannot register it
+	guestNicknamePrefix = "guest-"
+	// guestRetention is how long a guest that never upgraded is kept after
+	// its last game or login; no shorter than refreshTokenDuration, so a
+	// guest is never removed while its login still works
+	guestRetention = refreshTokenDuration
+	// guestNameAttempts bounds retries when a generated name is already taken
+	guestNameAttempts = 5
+)
+
+// guestAlphabet leaves out characters that are easy to confuse
+const guestAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GenerateGuestNickname returns a random name such as "Guest-k7m2qx"
+func GenerateGuestNickname() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString("Guest-")
+	for _, v := range b {
+		sb.WriteByte(guestAlphabet[int(v)%len(guestAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+// CreateGuestSession registers a guest under a fresh generated nickname and
+// logs it in
+func CreateGuestSession(store db.Store, info ClientInfo) (*Session, error) {
+	for i := 0; i < guestNameAttempts; i++ {
+		nickname, err := GenerateGuestNickname()
+		if err != nil {
+			return nil, err
+		}
+		if err := store.CreateGuestUser(nickname); errors.Is(err, db.ErrUsernameTaken) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return CreateSession(nickname, info)
+	}
+	return nil, fmt.Errorf("no free guest nickname after %d attempts", guestNameAttempts)
+}
+
+// UpgradeGuest registers the guest behind session under the nickname and
+// password in req, keeping its scores. The guest's logins are ended and a
+// session for the new account is returned.
+func UpgradeGuest(store db.Store, session db.SessionRecord, req AuthRequest, info ClientInfo) (*Session, error) {
+	if err := store.UpgradeGuest(session.Nickname, req.Nickname, req.Password, req.Email); err != nil {
+		return nil, err
+	}
+	if err := RevokeAllUserSessions(session.Nickname); err != nil {
+		fmt.Println("Guest session revoke error:", err)
+	}
+	return CreateSession(req.Nickname, info)
+}
+
+// CleanupStaleGuests periodically removes guests that never upgraded and
+// have not played or used their login within guestRetention. Stores without
+// logins only see games, so their removed guests are logged out here.
+func CleanupStaleGuests(lobby *Lobby) {
+	ticker := time.NewTicker(24 * time.Hour)
+	go func() {
+		for range ticker.C {
+			removed, err := lobby.store.DeleteStaleGuests(time.Now().Add(-guestRetention), GenerateDeletedNickname)
+			if err != nil {
+				fmt.Println("Guest cleanup error:", err)
+				continue
+			}
+			for _, nickname := range removed {
+				if err := RevokeAllUserSessions(nickname); err != nil {
+					fmt.Println("Guest session revoke error:", err)
+				}
+			}
+			if len(removed) > 0 {
+				fmt.Printf("Removed %d stale guests\n", len(removed))
+				// Pair results they shared are on the boards now
+				lobby.BoardsChanged(db.BoardChange{})
+			}
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func TestGuestNicknameCannotBeRegistered(t *testing.T) {
+	nickname, err := GenerateGuestNickname()
+	if err != nil {
+		t.Fatalf("GenerateGuestNickname: %v", err)
+	}
+	for _, r := range nickname {
+		if !isNicknameRune(r) {
+			t.Fatalf("Generated nickname %q has invalid rune %q", nickname, r)
+		}
+	}
+	if ValidateNickname(nickname) == "" {
+		t.Errorf("Expected generated guest name %q to be reserved for signup", nickname)
+	}
+}
+
+func TestGuestEndpointIssuesSession(t *testing.T) {
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+
+	rec := doRequest(mux, http.MethodPost, "/api/guest", "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Nickname string `json:"nickname"`
+		Guest    bool   `json:"guest"`
+		Token    string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !body.Guest || !strings.HasPrefix(strings.ToLower(body.Nickname), guestNicknamePrefix) {
+		t.Errorf("Expected a guest nickname, got %+v", body)
+	}
+	if err := lobby.store.CreateGuestUser(body.Nickname); !errors.Is(err, db.ErrUsernameTaken) {
+		t.Errorf("Expected the guest to be registered in the store, got %v", err)
+	}
+
+	rec = doRequest(mux, http.MethodGet, "/api/sessions", body.Token)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the guest token to authenticate, got %d", rec.Code)
+	}
+}
+
+func TestGuestUpgradeShowsScoresOnBoards(t *testing.T) {
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	var guest struct {
+		Nickname string `json:"nickname"`
+		Token    string `json:"token"`
+	}
+	json.NewDecoder(doRequest(mux, http.MethodPost, "/api/guest", "").Body).Decode(&guest)
+	// Saved straight to the store, so only the upgrade can clear the cache
+	result := db.GameResult{Mode: db.GameModeSingle, Players: []string{guest.Nickname}, GhostCount: 4, Score: 500}
+	if err := lobby.store.SaveGameResult(result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Guests are left off the boards, and the empty page is now cached
+	if rec := doRequest(mux, http.MethodGet, "/api/scoreboard", ""); strings.Contains(rec.Body.String(), `"score":500`) {
+		t.Fatalf("Expected the guest's score hidden, got %s", rec.Body.String())
+	}
+
+	upgrade := `{"nickname":"pacfan","password":"secret123"}`
+	if rec := doJSON(mux, http.MethodPost, "/api/guest/upgrade", guest.Token, upgrade); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the upgrade to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(mux, http.MethodGet, "/api/scoreboard", "")
+	if body := rec.Body.String(); !strings.Contains(body, `"pacfan"`) || !strings.Contains(body, `"score":500`) {
+		t.Errorf("Expected the upgraded account's score on the board, got %s", body)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+
+	// The runtime image has no zoneinfo, so embed it for LoadLocation
+	_ "time/tzdata"
+)
+
+// Period is the time window a leaderboard covers
+type Period string
+
+const (
+	PeriodDay   Period = "day"
+	PeriodWeek  Period = "week"
+	PeriodMonth Period = "month"
+	PeriodAll   Period = "all"
+)
+
+const (
+	defaultBoardPageSize = 10
+	maxBoardPageSize     = 100
+	defaultAroundSize    = 5
+	maxAroundSize        = 25
+)
+
+var (
+	ErrInvalidPeriod   = errors.New("period must be day, week, month or all")
+	ErrInvalidTimeZone = errors.New("unknown time zone")
+)
+
+// ParsePeriod reads a period name, treating an empty one as all-time
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case "":
+		return PeriodAll, nil
+	case PeriodDay, PeriodWeek, PeriodMonth, PeriodAll:
+		return p, nil
+	}
+	return "", ErrInvalidPeriod
+}
+
+// Start returns when the period containing now began, as seen from loc.
+// Days start at local midnight and weeks on Monday, so a window can be 23 or
+// 25 hours long across a DST change. All-time returns the zero time.
+func (p Period) Start(now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	year, month, day := now.Date()
+	switch p {
+	case PeriodDay:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc)
+	case PeriodWeek:
+		sinceMonday := (int(now.Weekday()) + 6) % 7
+		return time.Date(year, month, day-sinceMonday, 0, 0, 0, 0, loc)
+	case PeriodMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	}
+	return time.Time{}
+}
+
+// End returns when the period containing now ends in loc, or the zero time
+// for all-time boards, which never roll over
+func (p Period) End(now time.Time, loc *time.Location) time.Time {
+	start := p.Start(now, loc)
+	switch p {
+	case PeriodDay:
+		return start.AddDate(0, 0, 1)
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case PeriodMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return time.Time{}
+}
+
+// leaderboardLocation is the time zone periods are measured in: the tz query
+// parameter (an IANA name such as Europe/Helsinki), then LEADERBOARD_TZ, then
+// UTC
+func leaderboardLocation(r *http.Request) (*time.Location, error) {
+	return loadLeaderboardLocation(r.URL.Query().Get("tz"))
+}
+
+// loadLeaderboardLocation loads the named zone, falling back to
+// LEADERBOARD_TZ and then UTC when name is empty
+func loadLeaderboardLocation(name string) (*time.Location, error) {
+	if name == "" {
+		name = os.Getenv("LEADERBOARD_TZ")
+	}
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, ErrInvalidTimeZone
+	}
+	return loc, nil
+}
+
+// scoreboardParams reads which board of the given mode a request is for:
+// its ghost count and period
+func scoreboardParams(r *http.Request, mode string, now time.Time) (db.Board, error) {
+	board := db.Board{Mode: mode, GhostCount: 4}
+	// Allow query param ?ghosts=N
+	if g, err := strconv.Atoi(r.URL.Query().Get("ghosts")); err == nil {
+		board.GhostCount = g
+	}
+
+	period, err := ParsePeriod(r.URL.Query().Get("period"))
+	if err != nil {
+		return db.Board{}, err
+	}
+	loc, err := leaderboardLocation(r)
+	if err != nil {
+		return db.Board{}, err
+	}
+	board.Since = period.Start(now, loc)
+	return board, nil
+}
+
+// intParam reads a non-negative integer query parameter, using def when it
+// is missing or invalid and capping it at max
+func intParam(r *http.Request, name string, def, max int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n < 0 {
+		return def
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// onApiScoreboard serves a page of a board. The body stays a plain list for
+// older clients; X-Total-Count tells newer ones how far they can page. Pages
+// come from the board cache and carry an ETag, so a client polling an
+// unchanged board gets 304 Not Modified.
+func onApiScoreboard(cache *BoardCache, mode string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		board, err := scoreboardParams(r, mode, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset := intParam(r, "offset", 0, math.MaxInt32)
+		limit := intParam(r, "limit", defaultBoardPageSize, maxBoardPageSize)
+
+		page, err := cache.Page(board, offset, limit)
+		if err != nil {
+			fmt.Println("Scoreboard query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", page.etag)
+		// Let clients keep the page but check back before reusing it
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Total-Count", strconv.Itoa(page.total))
+		if etagMatches(r.Header.Get("If-None-Match"), page.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(page.body)
+	}
+}
+
+// onApiScoreboardRank returns where the nickname in the query stands
+func onApiScoreboardRank(store db.Store, mode string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		nickname := r.URL.Query().Get("nickname")
+		if nickname == "" {
+			http.Error(w, "Missing nickname", http.StatusBadRequest)
+			return
+		}
+		board, err := scoreboardParams(r, mode, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rank, err := store.GetBoardRank(board, nickname)
+		if err != nil {
+			writeBoardError(w, err)
+			return
+		}
+		writeJSON(w, rank)
+	}
+}
+
+// onApiScoreboardAround returns the entries within ?n= places of the caller
+func onApiScoreboardAround(store db.Store, mode string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		board, err := scoreboardParams(r, mode, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, err := store.GetBoardAround(board, session.Nickname, intParam(r, "n", defaultAroundSize, maxAroundSize))
+		if err != nil {
+			writeBoardError(w, err)
+			return
+		}
+		writeJSON(w, entries)
+	}
+}
+
+func writeBoardError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrNotRanked) {
+		http.Error(w, "No score on this scoreboard", http.StatusNotFound)
+		return
+	}
+	fmt.Println("Scoreboard query error:", err)
+	http.Error(w, "Database error", http.StatusInternalServerError)
+}
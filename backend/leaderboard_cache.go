@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	boardCacheTTL = 30 * time.Second
+	// Keys include the period start, so old periods pile up until swept
+	maxBoardCacheEntries = 1000
+)
+
+type boardPageKey struct {
+	mode       string
+	ghostCount int
+	since      int64 // Unix microseconds; 0 for all-time
+	offset     int
+	limit      int
+}
+
+func newBoardPageKey(b db.Board, offset, limit int) boardPageKey {
+	key := boardPageKey{mode: b.Mode, ghostCount: b.GhostCount, offset: offset, limit: limit}
+	if key.ghostCount <= 0 {
+		// The stores read it as the 4-ghost board
+		key.ghostCount = 4
+	}
+	if !b.Since.IsZero() {
+		key.since = b.Since.UnixMicro()
+	}
+	return key
+}
+
+// boardPage is a rendered page of a board, ready to be written out
+type boardPage struct {
+	body    []byte
+	total   int
+	etag    string
+	expires time.Time
+}
+
+// boardPageCall is a load in progress that concurrent misses wait on
+type boardPageCall struct {
+	done chan struct{}
+	page *boardPage
+	err  error
+}
+
+// BoardCache keeps rendered scoreboard pages for a short while. Concurrent
+// misses on a page share one query, and pages of a board are dropped as soon
+// as a score on it changes, here or (through the bus) on another server.
+type BoardCache struct {
+	store    db.Store
+	ttl      time.Duration
+	mu       sync.Mutex
+	pages    map[boardPageKey]*boardPage
+	inflight map[boardPageKey]*boardPageCall
+	// gen counts invalidations, so a load that raced one is not cached
+	gen uint64
+}
+
+func NewBoardCache(store db.Store, bus db.BoardBus) *BoardCache {
+	c := &BoardCache{
+		store:    store,
+		ttl:      boardCacheTTL,
+		pages:    make(map[boardPageKey]*boardPage),
+		inflight: make(map[boardPageKey]*boardPageCall),
+	}
+	bus.Subscribe(c.Invalidate)
+	return c
+}
+
+// Page returns a page of board b, from the cache when it is fresh
+func (c *BoardCache) Page(b db.Board, offset, limit int) (*boardPage, error) {
+	key := newBoardPageKey(b, offset, limit)
+
+	c.mu.Lock()
+	if page, ok := c.pages[key]; ok && time.Now().Before(page.expires) {
+		c.mu.Unlock()
+		return page, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.page, call.err
+	}
+	call := &boardPageCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	gen := c.gen
+	c.mu.Unlock()
+
+	call.page, call.err = c.load(b, offset, limit)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && gen == c.gen {
+		if len(c.pages) >= maxBoardCacheEntries {
+			c.sweepLocked()
+		}
+		c.pages[key] = call.page
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.page, call.err
+}
+
+func (c *BoardCache) load(b db.Board, offset, limit int) (*boardPage, error) {
+	entries, total, err := c.store.GetBoardPage(b, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, '\n')
+	// Hash the content rather than count versions, so every server gives
+	// the same page the same tag
+	sum := sha256.Sum256(append([]byte(strconv.Itoa(total)+"\n"), body...))
+	return &boardPage{
+		body:    body,
+		total:   total,
+		etag:    `"` + hex.EncodeToString(sum[:8]) + `"`,
+		expires: time.Now().Add(c.ttl),
+	}, nil
+}
+
+// Invalidate drops the pages of every board the change may touch
+func (c *BoardCache) Invalidate(change db.BoardChange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key := range c.pages {
+		if change.Affects(db.Board{Mode: key.mode, GhostCount: key.ghostCount}) {
+			delete(c.pages, key)
+		}
+	}
+}
+
+// sweepLocked drops expired pages, or everything if none have expired
+func (c *BoardCache) sweepLocked() {
+	now := time.Now()
+	for key, page := range c.pages {
+		if !now.Before(page.expires) {
+			delete(c.pages, key)
+		}
+	}
+	if len(c.pages) >= maxBoardCacheEntries {
+		c.pages = make(map[boardPageKey]*boardPage)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header names etag. Weak
+// validators match too, as the comparison for GET is weak.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
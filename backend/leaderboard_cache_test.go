@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+// countingStore counts board queries, holding each until gate is closed
+type countingStore struct {
+	db.Store
+	queries atomic.Int32
+	gate    chan struct{}
+}
+
+func (s *countingStore) GetBoardPage(b db.Board, offset, limit int) ([]db.BoardEntry, int, error) {
+	s.queries.Add(1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	return s.Store.GetBoardPage(b, offset, limit)
+}
+
+var singleBoard = db.Board{Mode: db.GameModeSingle, GhostCount: 4}
+
+func TestBoardCacheCoalescesMisses(t *testing.T) {
+	store := &countingStore{Store: db.NewMemoryStore(), gate: make(chan struct{})}
+	cache := NewBoardCache(store, db.NewMemoryBus())
+
+	var wg sync.WaitGroup
+	pages := make([]*boardPage, 8)
+	for i := range pages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pages[i], _ = cache.Page(singleBoard, 0, 10)
+		}(i)
+	}
+	// Let the callers pile up on the first query
+	time.Sleep(50 * time.Millisecond)
+	close(store.gate)
+	wg.Wait()
+
+	if n := store.queries.Load(); n != 1 {
+		t.Errorf("Expected one query for concurrent misses, got %d", n)
+	}
+	for _, page := range pages {
+		if page != pages[0] {
+			t.Fatal("Expected every caller to get the shared page")
+		}
+	}
+}
+
+func TestBoardCacheInvalidation(t *testing.T) {
+	store := &countingStore{Store: db.NewMemoryStore()}
+	cache := NewBoardCache(store, db.NewMemoryBus())
+
+	cache.Page(singleBoard, 0, 10)
+	cache.Page(singleBoard, 0, 10)
+	if n := store.queries.Load(); n != 1 {
+		t.Fatalf("Expected the second read cached, got %d queries", n)
+	}
+
+	cache.Invalidate(db.BoardChange{Mode: db.GameModePair, GhostCount: 4})
+	cache.Page(singleBoard, 0, 10)
+	if n := store.queries.Load(); n != 1 {
+		t.Errorf("Expected another board's change to keep the page, got %d queries", n)
+	}
+
+	cache.Invalidate(db.BoardChange{Mode: db.GameModeSingle, GhostCount: 4})
+	cache.Page(singleBoard, 0, 10)
+	if n := store.queries.Load(); n != 2 {
+		t.Errorf("Expected the change to drop the page, got %d queries", n)
+	}
+
+	cache.Invalidate(db.BoardChange{})
+	cache.Page(singleBoard, 0, 10)
+	if n := store.queries.Load(); n != 3 {
+		t.Errorf("Expected a change to every board to drop the page, got %d queries", n)
+	}
+
+	cache.ttl = 0
+	cache.Invalidate(db.BoardChange{})
+	cache.Page(singleBoard, 0, 10)
+	cache.Page(singleBoard, 0, 10)
+	if n := store.queries.Load(); n != 5 {
+		t.Errorf("Expected expired pages to be reloaded, got %d queries", n)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc"`
+	for header, want := range map[string]bool{
+		``:               false,
+		`"abc"`:          true,
+		`W/"abc"`:        true,
+		`"xyz", "abc"`:   true,
+		`*`:              true,
+		`"abcd"`:         false,
+		`abc`:            false,
+		`"xyz",W/"abc" `: true,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestScoreboardNotModified(t *testing.T) {
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	save := func(nickname string, score int) {
+		result := db.GameResult{Mode: db.GameModeSingle, Players: []string{nickname}, GhostCount: 4, Score: score}
+		if err := lobby.SaveResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/scoreboard", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	save("inky", 500)
+	rec := get("")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, got %d %q", rec.Code, etag)
+	}
+
+	rec = get(etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 for an unchanged board, got %d", rec.Code)
+	}
+
+	// A new score is visible straight away, under a new tag
+	save("blinky", 900)
+	rec = get(etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("Expected 200 with a new ETag after a score, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("Expected 2 entries, got %s", rec.Header().Get("X-Total-Count"))
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+var (
+	ErrInvalidMode   = errors.New("mode must be single or pair")
+	ErrTooManyTopics = fmt.Errorf("at most %d leaderboards can be followed at once", maxLeaderboardTopics)
+)
+
+// maxLeaderboardTopics bounds the boards one client follows. Every time zone
+// is a topic of its own, so without it a client could make the hub keep and
+// recompute any number of boards.
+const maxLeaderboardTopics = 8
+
+// LeaderboardTopic is a board a client can follow over the WebSocket.
+// Periods are measured in TZ, or the server's zone when it is empty.
+type LeaderboardTopic struct {
+	Mode       string `json:"mode"`
+	GhostCount int    `json:"ghostCount"`
+	Period     Period `json:"period"`
+	TZ         string `json:"tz,omitempty"`
+}
+
+// parseLeaderboardTopic reads the topic of a subscribe or unsubscribe
+// message. Missing fields default to the single-player, 4-ghost, all-time
+// board.
+func parseLeaderboardTopic(msg map[string]interface{}) (LeaderboardTopic, error) {
+	topic := LeaderboardTopic{Mode: db.GameModeSingle, GhostCount: 4}
+	if v, ok := msg["mode"].(string); ok && v != "" {
+		if v != db.GameModeSingle && v != db.GameModePair {
+			return LeaderboardTopic{}, ErrInvalidMode
+		}
+		topic.Mode = v
+	}
+	if v, ok := msg["ghostCount"].(float64); ok {
+		topic.GhostCount = clampGhosts(int(v))
+	}
+	period, _ := msg["period"].(string)
+	var err error
+	if topic.Period, err = ParsePeriod(period); err != nil {
+		return LeaderboardTopic{}, err
+	}
+	topic.TZ, _ = msg["tz"].(string)
+	if _, err := loadLeaderboardLocation(topic.TZ); err != nil {
+		return LeaderboardTopic{}, err
+	}
+	return topic, nil
+}
+
+// handleLeaderboardSubscription answers subscribe_leaderboard and
+// unsubscribe_leaderboard messages
+func handleLeaderboardSubscription(client *Client, msgType string, msg map[string]interface{}) {
+	topic, err := parseLeaderboardTopic(msg)
+	if err != nil {
+		sendLeaderboardError(client, err.Error())
+		return
+	}
+	if msgType == "unsubscribe_leaderboard" {
+		client.Lobby.boards.Unsubscribe(client, topic)
+		return
+	}
+	if err := client.Lobby.boards.Subscribe(client, topic); err != nil {
+		if errors.Is(err, ErrTooManyTopics) {
+			sendLeaderboardError(client, err.Error())
+			return
+		}
+		fmt.Println("Live leaderboard query error:", err)
+		sendLeaderboardError(client, "Database error")
+	}
+}
+
+func sendLeaderboardError(client *Client, message string) {
+	client.SendJSON(map[string]interface{}{
+		"type":    "leaderboard_error",
+		"message": message,
+	})
+}
+
+// window returns the topic's board at now and when its period ends
+func (t LeaderboardTopic) window(now time.Time) (db.Board, time.Time) {
+	// The zone was checked when the topic was parsed
+	loc, _ := loadLeaderboardLocation(t.TZ)
+	board := db.Board{Mode: t.Mode, GhostCount: t.GhostCount, Since: t.Period.Start(now, loc)}
+	return board, t.Period.End(now, loc)
+}
+
+// leaderboardUpdate is pushed when the top of a followed board changes.
+// Changed holds new entries and ones whose rank or score moved; Removed the
+// ones pushed out. NewLeader is set when someone else took first place.
+type leaderboardUpdate struct {
+	Type      string           `json:"type"`
+	Topic     LeaderboardTopic `json:"topic"`
+	Changed   []db.BoardEntry  `json:"changed"`
+	Removed   []db.BoardEntry  `json:"removed"`
+	NewLeader *db.BoardEntry   `json:"newLeader,omitempty"`
+}
+
+// boardEntryKey identifies the player or pair an entry belongs to
+func boardEntryKey(e db.BoardEntry) string {
+	if e.Nickname != "" {
+		return e.Nickname
+	}
+	return e.Player1 + "/" + e.Player2
+}
+
+// diffBoards compares two tops of the same board
+func diffBoards(old, cur []db.BoardEntry) (changed, removed []db.BoardEntry, newLeader *db.BoardEntry) {
+	changed, removed = []db.BoardEntry{}, []db.BoardEntry{}
+	before := make(map[string]db.BoardEntry, len(old))
+	for _, e := range old {
+		before[boardEntryKey(e)] = e
+	}
+	after := make(map[string]bool, len(cur))
+	for _, e := range cur {
+		after[boardEntryKey(e)] = true
+		if prev, ok := before[boardEntryKey(e)]; !ok || prev != e {
+			changed = append(changed, e)
+		}
+	}
+	for _, e := range old {
+		if !after[boardEntryKey(e)] {
+			removed = append(removed, e)
+		}
+	}
+	if len(cur) > 0 && (len(old) == 0 || boardEntryKey(old[0]) != boardEntryKey(cur[0])) {
+		leader := cur[0]
+		newLeader = &leader
+	}
+	return changed, removed, newLeader
+}
+
+type liveBoard struct {
+	subscribers map[*Client]bool
+	top         []db.BoardEntry
+	ends        time.Time // End of the period top covers; zero for all-time
+	stale       bool      // A change may have moved top since it was read
+}
+
+// LeaderboardHub keeps the top of every followed board and pushes what
+// changes to its subscribers whenever the bus reports a new result or a
+// board's period rolls over. Changes only mark boards stale; one worker
+// rereads them, so a burst of results costs one query per board.
+type LeaderboardHub struct {
+	store db.Store
+	size  int
+	// refresh serializes recomputing tops, so diffs reach clients in order
+	refresh sync.Mutex
+	mu      sync.Mutex
+	boards  map[LeaderboardTopic]*liveBoard
+	topics  map[*Client]int // Boards each client follows
+	changes uint64          // Bus changes seen, to catch ones during Subscribe
+	wake    chan struct{}
+}
+
+func NewLeaderboardHub(store db.Store, bus db.BoardBus) *LeaderboardHub {
+	h := &LeaderboardHub{
+		store:  store,
+		size:   defaultBoardPageSize,
+		boards: make(map[LeaderboardTopic]*liveBoard),
+		topics: make(map[*Client]int),
+		wake:   make(chan struct{}, 1),
+	}
+	bus.Subscribe(h.onBoardChange)
+	go h.run()
+	return h
+}
+
+func (h *LeaderboardHub) top(topic LeaderboardTopic) ([]db.BoardEntry, time.Time, error) {
+	board, ends := topic.window(time.Now())
+	entries, _, err := h.store.GetBoardPage(board, 0, h.size)
+	return entries, ends, err
+}
+
+// signal wakes the worker, unless it already has a wake-up pending
+func (h *LeaderboardHub) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe makes client follow topic and sends it the current top. It
+// returns ErrTooManyTopics if the client already follows
+// maxLeaderboardTopics other boards.
+func (h *LeaderboardHub) Subscribe(client *Client, topic LeaderboardTopic) error {
+	h.refresh.Lock()
+	defer h.refresh.Unlock()
+
+	h.mu.Lock()
+	lb, ok := h.boards[topic]
+	following := ok && lb.subscribers[client]
+	if !following && h.topics[client] >= maxLeaderboardTopics {
+		h.mu.Unlock()
+		return ErrTooManyTopics
+	}
+	seen := h.changes
+	h.mu.Unlock()
+	if !ok {
+		top, ends, err := h.top(topic)
+		if err != nil {
+			return err
+		}
+		lb = &liveBoard{subscribers: make(map[*Client]bool), top: top, ends: ends}
+	}
+
+	h.mu.Lock()
+	if !ok {
+		// A change during the query may be missing from top, so reread
+		// it after the snapshot. The worker also needs the new period end.
+		lb.stale = h.changes != seen
+		h.signal()
+	}
+	h.boards[topic] = lb
+	if !following {
+		lb.subscribers[client] = true
+		h.topics[client]++
+	}
+	top := lb.top
+	h.mu.Unlock()
+
+	return client.SendJSON(map[string]interface{}{
+		"type":    "leaderboard_snapshot",
+		"topic":   topic,
+		"entries": top,
+	})
+}
+
+// Unsubscribe stops client following topic
+func (h *LeaderboardHub) Unsubscribe(client *Client, topic LeaderboardTopic) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if lb, ok := h.boards[topic]; ok {
+		h.dropLocked(topic, lb, client)
+	}
+}
+
+// RemoveClient drops every subscription of a disconnected client
+func (h *LeaderboardHub) RemoveClient(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for topic, lb := range h.boards {
+		h.dropLocked(topic, lb, client)
+	}
+}
+
+// dropLocked removes a subscriber, forgetting boards nobody follows
+func (h *LeaderboardHub) dropLocked(topic LeaderboardTopic, lb *liveBoard, client *Client) {
+	if !lb.subscribers[client] {
+		return
+	}
+	delete(lb.subscribers, client)
+	if h.topics[client]--; h.topics[client] <= 0 {
+		delete(h.topics, client)
+	}
+	if len(lb.subscribers) == 0 {
+		delete(h.boards, topic)
+	}
+}
+
+// onBoardChange marks the boards a change touches for the worker. The bus
+// calls it on a goroutine per notice, so it must not wait on a refresh.
+func (h *LeaderboardHub) onBoardChange(c db.BoardChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.changes++
+	for topic, lb := range h.boards {
+		if c.Affects(db.Board{Mode: topic.Mode, GhostCount: topic.GhostCount}) {
+			lb.stale = true
+		}
+	}
+	h.signal()
+}
+
+// run is the worker: it refreshes stale boards when woken, and boards whose
+// period ended when the earliest end comes
+func (h *LeaderboardHub) run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		var rollover <-chan time.Time
+		if next := h.nextRollover(); !next.IsZero() {
+			timer.Reset(time.Until(next))
+			rollover = timer.C
+		}
+		select {
+		case <-h.wake:
+			timer.Stop()
+		case <-rollover:
+			h.markRolledOver(time.Now())
+		}
+		h.refreshStale()
+	}
+}
+
+// nextRollover returns the earliest period end of the followed boards, or
+// the zero time if they are all all-time boards
+func (h *LeaderboardHub) nextRollover() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var next time.Time
+	for _, lb := range h.boards {
+		if !lb.ends.IsZero() && (next.IsZero() || lb.ends.Before(next)) {
+			next = lb.ends
+		}
+	}
+	return next
+}
+
+// markRolledOver marks the boards whose period has ended by now
+func (h *LeaderboardHub) markRolledOver(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, lb := range h.boards {
+		if !lb.ends.IsZero() && !now.Before(lb.ends) {
+			lb.stale = true
+		}
+	}
+}
+
+// refreshStale rereads every stale board and pushes what changed
+func (h *LeaderboardHub) refreshStale() {
+	h.refresh.Lock()
+	defer h.refresh.Unlock()
+
+	h.mu.Lock()
+	var topics []LeaderboardTopic
+	for topic, lb := range h.boards {
+		if lb.stale {
+			lb.stale = false
+			topics = append(topics, topic)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, topic := range topics {
+		top, ends, err := h.top(topic)
+		if err != nil {
+			fmt.Println("Live leaderboard query error:", err)
+			continue
+		}
+
+		h.mu.Lock()
+		lb, ok := h.boards[topic]
+		if !ok {
+			h.mu.Unlock()
+			continue
+		}
+		changed, removed, newLeader := diffBoards(lb.top, top)
+		lb.top = top
+		lb.ends = ends
+		subscribers := make([]*Client, 0, len(lb.subscribers))
+		for client := range lb.subscribers {
+			subscribers = append(subscribers, client)
+		}
+		h.mu.Unlock()
+
+		if len(changed) == 0 && len(removed) == 0 {
+			continue
+		}
+		update := leaderboardUpdate{
+			Type:      "leaderboard_update",
+			Topic:     topic,
+			Changed:   changed,
+			Removed:   removed,
+			NewLeader: newLeader,
+		}
+		for _, client := range subscribers {
+			client.SendJSON(update)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func TestParseLeaderboardTopic(t *testing.T) {
+	topic, err := parseLeaderboardTopic(map[string]interface{}{"type": "subscribe_leaderboard"})
+	if err != nil || topic != (LeaderboardTopic{Mode: db.GameModeSingle, GhostCount: 4, Period: PeriodAll}) {
+		t.Errorf("Expected the default board, got %+v, %v", topic, err)
+	}
+
+	topic, err = parseLeaderboardTopic(map[string]interface{}{"mode": "pair", "ghostCount": 40.0, "period": "week", "tz": "Europe/Helsinki"})
+	if err != nil || topic.Mode != db.GameModePair || topic.GhostCount != MaxGhostCount || topic.Period != PeriodWeek {
+		t.Errorf("Unexpected topic %+v, %v", topic, err)
+	}
+
+	for _, msg := range []map[string]interface{}{
+		{"mode": "coop"},
+		{"period": "year"},
+		{"tz": "Mars/Olympus"},
+	} {
+		if _, err := parseLeaderboardTopic(msg); err == nil {
+			t.Errorf("Expected %v to be rejected", msg)
+		}
+	}
+}
+
+func TestDiffBoards(t *testing.T) {
+	old := []db.BoardEntry{
+		{Rank: 1, Nickname: "inky", Score: 500},
+		{Rank: 2, Nickname: "pacfan", Score: 300},
+		{Rank: 3, Nickname: "clyde", Score: 100},
+	}
+	cur := []db.BoardEntry{
+		{Rank: 1, Nickname: "blinky", Score: 900},
+		{Rank: 2, Nickname: "inky", Score: 500},
+		{Rank: 3, Nickname: "pacfan", Score: 300},
+	}
+	changed, removed, leader := diffBoards(old, cur)
+	if len(changed) != 3 {
+		t.Errorf("Expected every moved entry as changed, got %+v", changed)
+	}
+	if len(removed) != 1 || removed[0].Nickname != "clyde" {
+		t.Errorf("Expected clyde pushed out, got %+v", removed)
+	}
+	if leader == nil || leader.Nickname != "blinky" {
+		t.Errorf("Expected blinky as the new leader, got %+v", leader)
+	}
+
+	changed, removed, leader = diffBoards(cur, cur)
+	if len(changed) != 0 || len(removed) != 0 || leader != nil {
+		t.Errorf("Expected no diff for an unchanged board, got %+v %+v %+v", changed, removed, leader)
+	}
+
+	// A better score from the leader is a change but not a new #1
+	better := append([]db.BoardEntry{{Rank: 1, Nickname: "blinky", Score: 950}}, cur[1:]...)
+	changed, _, leader = diffBoards(cur, better)
+	if len(changed) != 1 || leader != nil {
+		t.Errorf("Expected only blinky's score to change, got %+v, leader %+v", changed, leader)
+	}
+}
+
+func readLeaderboardMessage(t *testing.T, peer *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg map[string]interface{}
+	if err := peer.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+func TestLeaderboardHubPushesChanges(t *testing.T) {
+	lobby := newTestLobby()
+	client, peer := newTestClientPair(t)
+	go client.WritePump()
+
+	if err := lobby.SaveResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"inky"}, GhostCount: 4, Score: 500}); err != nil {
+		t.Fatal(err)
+	}
+	topic := LeaderboardTopic{Mode: db.GameModeSingle, GhostCount: 4, Period: PeriodAll}
+	if err := lobby.boards.Subscribe(client, topic); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := readLeaderboardMessage(t, peer)
+	if snapshot["type"] != "leaderboard_snapshot" || len(snapshot["entries"].([]interface{})) != 1 {
+		t.Fatalf("Expected a snapshot with inky, got %v", snapshot)
+	}
+
+	// Another board's results are not pushed
+	if err := lobby.SaveResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"sue"}, GhostCount: 6, Score: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lobby.SaveResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"blinky"}, GhostCount: 4, Score: 900}); err != nil {
+		t.Fatal(err)
+	}
+	update := readLeaderboardMessage(t, peer)
+	if update["type"] != "leaderboard_update" {
+		t.Fatalf("Expected an update, got %v", update)
+	}
+	leader, _ := update["newLeader"].(map[string]interface{})
+	if leader["nickname"] != "blinky" {
+		t.Errorf("Expected blinky announced as #1, got %v", update)
+	}
+	if changed := update["changed"].([]interface{}); len(changed) != 2 {
+		t.Errorf("Expected blinky and inky changed, got %v", changed)
+	}
+
+	lobby.boards.RemoveClient(client)
+	lobby.boards.mu.Lock()
+	defer lobby.boards.mu.Unlock()
+	if len(lobby.boards.boards) != 0 {
+		t.Error("Expected the board forgotten once nobody follows it")
+	}
+}
+
+func TestLeaderboardHubCapsTopicsPerClient(t *testing.T) {
+	lobby := newTestLobby()
+	client, peer := newTestClientPair(t)
+	client.Lobby = lobby
+	go client.WritePump()
+
+	subscribe := func(ghosts int) map[string]interface{} {
+		handleLeaderboardSubscription(client, "subscribe_leaderboard", map[string]interface{}{"ghostCount": float64(ghosts)})
+		return readLeaderboardMessage(t, peer)
+	}
+	for i := 1; i <= maxLeaderboardTopics; i++ {
+		if msg := subscribe(i); msg["type"] != "leaderboard_snapshot" {
+			t.Fatalf("Expected topic %d followed, got %v", i, msg)
+		}
+	}
+	// Following a board again does not take another slot
+	if msg := subscribe(1); msg["type"] != "leaderboard_snapshot" {
+		t.Errorf("Expected a repeated subscribe answered, got %v", msg)
+	}
+	handleLeaderboardSubscription(client, "subscribe_leaderboard", map[string]interface{}{"ghostCount": 1.0, "period": "day"})
+	if msg := readLeaderboardMessage(t, peer); msg["type"] != "leaderboard_error" {
+		t.Fatalf("Expected an error past the cap, got %v", msg)
+	}
+
+	handleLeaderboardSubscription(client, "unsubscribe_leaderboard", map[string]interface{}{"ghostCount": 2.0})
+	handleLeaderboardSubscription(client, "subscribe_leaderboard", map[string]interface{}{"ghostCount": 1.0, "period": "day"})
+	if msg := readLeaderboardMessage(t, peer); msg["type"] != "leaderboard_snapshot" {
+		t.Errorf("Expected a freed slot to be usable, got %v", msg)
+	}
+
+	lobby.boards.RemoveClient(client)
+	lobby.boards.mu.Lock()
+	defer lobby.boards.mu.Unlock()
+	if len(lobby.boards.topics) != 0 {
+		t.Error("Expected the client's count forgotten")
+	}
+}
+
+func TestLeaderboardHubCoalescesChanges(t *testing.T) {
+	store := &countingStore{Store: db.NewMemoryStore()}
+	bus := db.NewMemoryBus()
+	hub := NewLeaderboardHub(store, bus)
+	client, peer := newTestClientPair(t)
+	go client.WritePump()
+
+	topic := LeaderboardTopic{Mode: db.GameModeSingle, GhostCount: 4, Period: PeriodAll}
+	if err := hub.Subscribe(client, topic); err != nil {
+		t.Fatal(err)
+	}
+	readLeaderboardMessage(t, peer)
+	store.queries.Store(0)
+
+	// A burst of results while a refresh is running neither blocks the
+	// bus handlers nor queues a refresh per result
+	const burst = 50
+	hub.refresh.Lock()
+	for i := 0; i < burst; i++ {
+		nickname := "player" + strconv.Itoa(i)
+		if err := store.SaveGameResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{nickname}, GhostCount: 4, Score: 100 + i}); err != nil {
+			t.Fatal(err)
+		}
+		bus.Publish(db.BoardChange{Mode: db.GameModeSingle, GhostCount: 4})
+	}
+	waitFor(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return hub.changes == burst
+	}, "every change handled")
+	hub.refresh.Unlock()
+
+	update := readLeaderboardMessage(t, peer)
+	if update["type"] != "leaderboard_update" || len(update["changed"].([]interface{})) != defaultBoardPageSize {
+		t.Fatalf("Expected one update with a full top, got %v", update)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if reads := store.queries.Load(); reads != 1 {
+		t.Errorf("Expected the burst read once, got %d reads", reads)
+	}
+}
+
+func TestLeaderboardHubRefreshesAtPeriodEnd(t *testing.T) {
+	lobby := newTestLobby()
+	client, peer := newTestClientPair(t)
+	go client.WritePump()
+
+	topic := LeaderboardTopic{Mode: db.GameModeSingle, GhostCount: 4, Period: PeriodDay}
+	if err := lobby.boards.Subscribe(client, topic); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := readLeaderboardMessage(t, peer); len(snapshot["entries"].([]interface{})) != 0 {
+		t.Fatalf("Expected an empty board, got %v", snapshot)
+	}
+	lobby.boards.mu.Lock()
+	if want := PeriodDay.End(time.Now(), time.UTC); !lobby.boards.boards[topic].ends.Equal(want) {
+		t.Errorf("Expected the board to end at %v, got %v", want, lobby.boards.boards[topic].ends)
+	}
+	lobby.boards.mu.Unlock()
+
+	// Nothing announces this result; the rollover alone rereads the board
+	if err := lobby.store.SaveGameResult(db.GameResult{Mode: db.GameModeSingle, Players: []string{"inky"}, GhostCount: 4, Score: 500}); err != nil {
+		t.Fatal(err)
+	}
+	lobby.boards.mu.Lock()
+	lobby.boards.boards[topic].ends = time.Now().Add(20 * time.Millisecond)
+	lobby.boards.mu.Unlock()
+	lobby.boards.signal()
+
+	update := readLeaderboardMessage(t, peer)
+	leader, _ := update["newLeader"].(map[string]interface{})
+	if update["type"] != "leaderboard_update" || leader["nickname"] != "inky" {
+		t.Fatalf("Expected inky pushed at the period end, got %v", update)
+	}
+	lobby.boards.mu.Lock()
+	defer lobby.boards.mu.Unlock()
+	if ends := lobby.boards.boards[topic].ends; !ends.After(time.Now()) {
+		t.Errorf("Expected the next period end scheduled, got %v", ends)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+	return loc
+}
+
+func TestPeriodStartBoundaries(t *testing.T) {
+	helsinki := mustLoadLocation(t, "Europe/Helsinki")
+	cases := []struct {
+		name   string
+		period Period
+		now    time.Time
+		loc    *time.Location
+		want   time.Time
+	}{
+		{"day at midnight", PeriodDay,
+			time.Date(2026, 5, 14, 0, 0, 0, 0, time.UTC), time.UTC,
+			time.Date(2026, 5, 14, 0, 0, 0, 0, time.UTC)},
+		{"day just before midnight", PeriodDay,
+			time.Date(2026, 5, 14, 23, 59, 59, 999999999, time.UTC), time.UTC,
+			time.Date(2026, 5, 14, 0, 0, 0, 0, time.UTC)},
+		// 22:30 UTC is already the next day in Helsinki
+		{"day in the viewer's zone", PeriodDay,
+			time.Date(2026, 5, 14, 22, 30, 0, 0, time.UTC), helsinki,
+			time.Date(2026, 5, 15, 0, 0, 0, 0, helsinki)},
+		{"week on Sunday night", PeriodWeek,
+			time.Date(2026, 5, 17, 23, 59, 0, 0, time.UTC), time.UTC,
+			time.Date(2026, 5, 11, 0, 0, 0, 0, time.UTC)},
+		{"week on Monday", PeriodWeek,
+			time.Date(2026, 5, 18, 0, 0, 0, 0, time.UTC), time.UTC,
+			time.Date(2026, 5, 18, 0, 0, 0, 0, time.UTC)},
+		{"week across a month", PeriodWeek,
+			time.Date(2026, 7, 2, 12, 0, 0, 0, time.UTC), time.UTC,
+			time.Date(2026, 6, 29, 0, 0, 0, 0, time.UTC)},
+		{"month on the last second", PeriodMonth,
+			time.Date(2026, 2, 28, 23, 59, 59, 0, time.UTC), time.UTC,
+			time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"month across a year", PeriodMonth,
+			time.Date(2026, 12, 31, 22, 30, 0, 0, time.UTC), helsinki,
+			time.Date(2027, 1, 1, 0, 0, 0, 0, helsinki)},
+		{"all time", PeriodAll,
+			time.Date(2026, 5, 14, 12, 0, 0, 0, time.UTC), time.UTC,
+			time.Time{}},
+	}
+	for _, c := range cases {
+		if got := c.period.Start(c.now, c.loc); !got.Equal(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPeriodStartAcrossDST(t *testing.T) {
+	helsinki := mustLoadLocation(t, "Europe/Helsinki")
+
+	// Clocks go forward on 29 March 2026, so that day is 23 hours long
+	now := time.Date(2026, 3, 29, 23, 0, 0, 0, helsinki)
+	start := PeriodDay.Start(now, helsinki)
+	if want := time.Date(2026, 3, 28, 22, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("Expected the day to start at %v, got %v", want, start.UTC())
+	}
+	next := PeriodDay.Start(now.Add(time.Hour), helsinki)
+	if got := next.Sub(start); got != 23*time.Hour {
+		t.Errorf("Expected a 23 hour day, got %v", got)
+	}
+
+	// The week containing the change starts before it, at UTC+2, and the
+	// next one after it, at UTC+3
+	week := PeriodWeek.Start(now, helsinki)
+	if want := time.Date(2026, 3, 22, 22, 0, 0, 0, time.UTC); !week.Equal(want) {
+		t.Errorf("Expected the week to start at %v, got %v", want, week.UTC())
+	}
+	nextWeek := PeriodWeek.Start(now.Add(time.Hour), helsinki)
+	if got := nextWeek.Sub(week); got != 7*24*time.Hour-time.Hour {
+		t.Errorf("Expected a week one hour short, got %v", got)
+	}
+}
+
+func TestPeriodEnd(t *testing.T) {
+	helsinki := mustLoadLocation(t, "Europe/Helsinki")
+	cases := []struct {
+		name   string
+		period Period
+		now    time.Time
+		want   time.Time
+	}{
+		// The day clocks go forward ends 23 hours after it starts
+		{"day across DST", PeriodDay,
+			time.Date(2026, 3, 29, 12, 0, 0, 0, helsinki),
+			time.Date(2026, 3, 30, 0, 0, 0, 0, helsinki)},
+		{"week on Sunday night", PeriodWeek,
+			time.Date(2026, 5, 17, 23, 59, 0, 0, helsinki),
+			time.Date(2026, 5, 18, 0, 0, 0, 0, helsinki)},
+		{"month across a year", PeriodMonth,
+			time.Date(2026, 12, 31, 12, 0, 0, 0, helsinki),
+			time.Date(2027, 1, 1, 0, 0, 0, 0, helsinki)},
+		{"all time", PeriodAll,
+			time.Date(2026, 5, 14, 12, 0, 0, 0, helsinki),
+			time.Time{}},
+	}
+	for _, c := range cases {
+		if got := c.period.End(c.now, helsinki); !got.Equal(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	for in, want := range map[string]Period{"": PeriodAll, "day": PeriodDay, "week": PeriodWeek, "month": PeriodMonth, "all": PeriodAll} {
+		if got, err := ParsePeriod(in); err != nil || got != want {
+			t.Errorf("ParsePeriod(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParsePeriod("year"); err != ErrInvalidPeriod {
+		t.Errorf("Expected ErrInvalidPeriod, got %v", err)
+	}
+}
+
+func TestScoreboardParams(t *testing.T) {
+	t.Setenv("LEADERBOARD_TZ", "")
+	now := time.Date(2026, 5, 14, 22, 30, 0, 0, time.UTC)
+
+	r := httptest.NewRequest("GET", "/api/scoreboard?ghosts=6&period=day&tz=Europe/Helsinki", nil)
+	board, err := scoreboardParams(r, db.GameModeSingle, now)
+	if err != nil || board.GhostCount != 6 || board.Mode != db.GameModeSingle {
+		t.Fatalf("Unexpected board %+v %v", board, err)
+	}
+	if want := time.Date(2026, 5, 14, 21, 0, 0, 0, time.UTC); !board.Since.Equal(want) {
+		t.Errorf("Expected the Helsinki day to start at %v, got %v", want, board.Since.UTC())
+	}
+
+	r = httptest.NewRequest("GET", "/api/scoreboard?period=week", nil)
+	if board, _ := scoreboardParams(r, db.GameModePair, now); !board.Since.Equal(time.Date(2026, 5, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected a UTC week by default, got %v", board.Since)
+	}
+
+	t.Setenv("LEADERBOARD_TZ", "America/New_York")
+	if board, _ := scoreboardParams(r, db.GameModePair, now); !board.Since.Equal(time.Date(2026, 5, 11, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the LEADERBOARD_TZ week, got %v", board.Since.UTC())
+	}
+
+	r = httptest.NewRequest("GET", "/api/scoreboard?period=day&tz=Mars/Olympus", nil)
+	if _, err := scoreboardParams(r, db.GameModeSingle, now); err != ErrInvalidTimeZone {
+		t.Errorf("Expected ErrInvalidTimeZone, got %v", err)
+	}
+}
+
+func TestIntParamClamps(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/scoreboard?limit=500&offset=-3&n=abc", nil)
+	if got := intParam(r, "limit", defaultBoardPageSize, maxBoardPageSize); got != maxBoardPageSize {
+		t.Errorf("Expected limit capped at %d, got %d", maxBoardPageSize, got)
+	}
+	if got := intParam(r, "offset", 0, 1000); got != 0 {
+		t.Errorf("Expected a negative offset to fall back to 0, got %d", got)
+	}
+	if got := intParam(r, "n", defaultAroundSize, maxAroundSize); got != defaultAroundSize {
+		t.Errorf("Expected the default window, got %d", got)
+	}
+}
+
+func TestScoreboardRoutesUseStore(t *testing.T) {
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	for nickname, score := range map[string]int{"pacfan": 300, "inky": 500, "clyde": 100} {
+		result := db.GameResult{Mode: db.GameModeSingle, Players: []string{nickname}, GhostCount: 4, Score: score}
+		if err := lobby.store.SaveGameResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := doRequest(mux, "GET", "/api/scoreboard?period=week&limit=2", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var page []db.BoardEntry
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("X-Total-Count") != "3" || len(page) != 2 || page[0].Nickname != "inky" {
+		t.Errorf("Expected inky first of 3, got %+v (total %s)", page, rec.Header().Get("X-Total-Count"))
+	}
+
+	rec = doRequest(mux, "GET", "/api/scoreboard/rank?nickname=pacfan", "")
+	var rank db.PlayerRank
+	if err := json.NewDecoder(rec.Body).Decode(&rank); err != nil {
+		t.Fatal(err)
+	}
+	if rank.Rank != 2 || rank.Total != 3 {
+		t.Errorf("Expected pacfan 2nd of 3, got %+v", rank)
+	}
+
+	if rec := doRequest(mux, "GET", "/api/scoreboard/pair/rank?nickname=pacfan", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a player not on the pair board, got %d", rec.Code)
+	}
+
+	session, _ := CreateSession("clyde", ClientInfo{})
+	rec = doRequest(mux, "GET", "/api/scoreboard/around?n=1", session.Token)
+	var around []db.BoardEntry
+	if err := json.NewDecoder(rec.Body).Decode(&around); err != nil {
+		t.Fatal(err)
+	}
+	if len(around) != 2 || around[1].Nickname != "clyde" {
+		t.Errorf("Expected pacfan and clyde around clyde, got %+v", around)
+	}
+}
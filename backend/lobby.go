@@ -1,67 +1,84 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
+	"math"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/villepalo/pacman-go-react/db"
 )
 
-type Client struct {
-	Nickname string
-	Conn     *websocket.Conn
-	Send     chan []byte
-	Lobby    *Lobby
-	mu       sync.RWMutex
-	Game     *GameState // Nil if in lobby/waiting; guarded by mu
-	writeMu  sync.Mutex
-}
-
-func (c *Client) GetGame() *GameState {
-	c.mu.RLock()
-	game := c.Game
-	c.mu.RUnlock()
-	return game
-}
-
-func (c *Client) SetGame(game *GameState) {
-	c.mu.Lock()
-	c.Game = game
-	c.mu.Unlock()
-}
-
 type Lobby struct {
 	clients    map[*Client]bool
-	waiting    []*Client
+	waiting    []*pairQueueEntry
 	games      map[*GameState]bool
 	register   chan *Client
 	unregister chan *Client
 	broadcast  chan []byte
+	scheduler  *Scheduler
+	store      db.Store
+	bus        db.BoardBus
+	boards     *LeaderboardHub
+	boardCache *BoardCache
+	avgWait    time.Duration // Moving average of pair queue waits; guarded by mu
 	mu         sync.Mutex
 }
 
-func (c *Client) WriteJSON(message interface{}) error {
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
-	return c.Conn.WriteJSON(message)
-}
-
-func NewLobby() *Lobby {
+func NewLobby(scheduler *Scheduler, store db.Store, bus db.BoardBus) *Lobby {
 	return &Lobby{
 		clients:    make(map[*Client]bool),
-		waiting:    make([]*Client, 0),
+		waiting:    make([]*pairQueueEntry, 0),
 		games:      make(map[*GameState]bool),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		broadcast:  make(chan []byte),
+		scheduler:  scheduler,
+		store:      store,
+		bus:        bus,
+		boards:     NewLeaderboardHub(store, bus),
+		boardCache: NewBoardCache(store, bus),
+	}
+}
+
+// SaveResult stores a finished game and tells every server its boards may
+// have changed
+func (l *Lobby) SaveResult(result db.GameResult) error {
+	if err := l.store.SaveGameResult(result); err != nil {
+		return err
+	}
+	ghostCount := result.GhostCount
+	if ghostCount <= 0 {
+		ghostCount = 4
+	}
+	l.BoardsChanged(db.BoardChange{Mode: result.Mode, GhostCount: ghostCount})
+	return nil
+}
+
+// BoardsChanged reports a write that may have changed boards. The local
+// cache is dropped right away, so the writer's next read sees the change;
+// other servers and live subscribers hear of it through the bus.
+func (l *Lobby) BoardsChanged(change db.BoardChange) {
+	l.boardCache.Invalidate(change)
+	if err := l.bus.Publish(change); err != nil {
+		log.Println("Failed to publish board change:", err)
 	}
 }
 
 func (l *Lobby) Run() {
+	matchTicker := time.NewTicker(matchInterval)
+	defer matchTicker.Stop()
+
 	for {
 		select {
+		case now := <-matchTicker.C:
+			// Rating windows widen over time, so retry waiting players
+			l.mu.Lock()
+			l.matchWaiting(now)
+			l.mu.Unlock()
+
 		case client := <-l.register:
 			l.onClientRegistered(client)
 
@@ -70,166 +87,275 @@ func (l *Lobby) Run() {
 
 		case message := <-l.broadcast:
 			l.mu.Lock()
+			clients := make([]*Client, 0, len(l.clients))
 			for client := range l.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(l.clients, client)
-				}
+				clients = append(clients, client)
 			}
 			l.mu.Unlock()
+			for _, client := range clients {
+				// Slow clients are disconnected by enqueue; the read loop
+				// then unregisters them
+				client.enqueue(outboundFrame{data: message})
+			}
 		}
 	}
 }
 
 // JoinPairQueue handles a client's request to join the matchmaking queue.
 // It checks if the client is already waiting, adds them to the queue if not,
-// and starts a game if a pair is found. Otherwise, it notifies the client that they are waiting.
-func (l *Lobby) JoinPairQueue(client *Client) {
+// and starts a game if a partner with a similar rating and compatible
+// preferences is found. Otherwise,
+// it notifies the client that they are waiting along with an estimated wait.
+func (l *Lobby) JoinPairQueue(client *Client, prefs PairPreferences) {
+	// Joining the queue abandons any pending ready check or rematch offer
+	if session := client.PairSession(); session != nil {
+		session.Leave(client)
+	}
+
+	// Look up the rating before taking the lock to keep store latency out of it
+	rating := lookupRating(l.store, client.Nickname)
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// Check if already waiting
-	if l.isWaiting(client) {
-		return
+	// Check if already waiting; rejoining only updates preferences
+	for _, e := range l.waiting {
+		if e.client == client {
+			e.prefs = prefs
+			l.matchWaiting(time.Now())
+			return
+		}
 	}
 
-	l.waiting = append(l.waiting, client)
-	log.Printf("%s joined pair queue. Queue length: %d", client.Nickname, len(l.waiting))
+	l.enqueueLocked(&pairQueueEntry{client: client, rating: rating, prefs: prefs})
+}
 
-	if len(l.waiting) >= 2 {
-		// Match found!
-		player1 := l.waiting[0]
-		player2 := l.waiting[1]
-		l.waiting = l.waiting[2:]
+// enqueueLocked adds an entry to the pair queue, tries to match it and tells
+// the player they are waiting if no partner was found. Must hold l.mu.
+func (l *Lobby) enqueueLocked(entry *pairQueueEntry) {
+	now := time.Now()
+	entry.joinedAt = now
+	l.waiting = append(l.waiting, entry)
+	log.Printf("%s joined pair queue (rating %.0f). Queue length: %d", entry.client.Nickname, entry.rating, len(l.waiting))
 
-		l.StartPairGame(player1, player2)
-	} else {
+	l.matchWaiting(now)
+
+	if l.isWaiting(entry.client) {
 		// Notify client they are waiting
 		msg := map[string]interface{}{
-			"type": "waiting",
+			"type":             "waiting",
+			"rating":           math.Round(entry.rating),
+			"estimatedWaitSec": int(math.Ceil(l.estimateWait(entry, now).Seconds())),
+		}
+		if err := entry.client.SendJSON(msg); err != nil {
+			log.Printf("Error sending wait message: %v", err)
 		}
-		// Use a goroutine to avoid blocking the lock
-		go func() {
-			if err := client.WriteJSON(msg); err != nil {
-				log.Printf("Error sending wait message: %v", err)
-			}
-		}()
 	}
 }
 
-func (l *Lobby) StartPairGame(p1, p2 *Client) {
-	log.Printf("Starting pair game for %s and %s", p1.Nickname, p2.Nickname)
+// requeue puts players back in the pair queue after a cancelled match,
+// skipping anyone who has disconnected or queued again in the meantime.
+func (l *Lobby) requeue(entries []*pairQueueEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// Create new game with two players, default ghosts 4
-	game := NewGame([]string{p1.Nickname, p2.Nickname}, 4)
-	l.games[game] = true
-	p1.SetGame(game)
-	p2.SetGame(game)
-
-	// Start game loop
-	go func() {
-		ticker := time.NewTicker(150 * time.Millisecond)
-		defer ticker.Stop()
-
-		// Notify start
-		startMsg := map[string]interface{}{
-			"type": "game_start",
-			"mode": "pair",
-			"p1":   p1.Nickname,
-			"p2":   p2.Nickname,
+	for _, e := range entries {
+		if !l.clients[e.client] || l.isWaiting(e.client) {
+			continue
 		}
-		l.broadcastToPair(p1, p2, startMsg)
+		l.enqueueLocked(e)
+	}
+}
 
-		for range ticker.C {
-			if !l.handleGameTick(game, p1, p2) {
-				return
-			}
-		}
-	}()
+// StartPairGame opens a session for two matched players. The game itself
+// starts once both have passed the ready check and the countdown.
+func (l *Lobby) StartPairGame(a, b *pairQueueEntry, ghostCount int, mapName string) {
+	log.Printf("Ready check for %s and %s (%d ghosts, map %s)", a.client.Nickname, b.client.Nickname, ghostCount, mapName)
+	newPairSession(l, a, b, ghostCount, mapName).begin()
 }
 
 func (l *Lobby) broadcastToPair(p1, p2 *Client, message interface{}) error {
-	err1 := p1.WriteJSON(message)
-	err2 := p2.WriteJSON(message)
+	err1 := p1.SendJSON(message)
+	err2 := p2.SendJSON(message)
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// broadcastStateToPair encodes the game once and queues it for both players,
+// replacing any snapshot they have not received yet.
+func (l *Lobby) broadcastStateToPair(p1, p2 *Client, game *GameState) error {
+	data, err := json.Marshal(game)
+	if err != nil {
+		return err
+	}
+	err1 := p1.SendStateFrame(data)
+	err2 := p2.SendStateFrame(data)
 	if err1 != nil {
 		return err1
 	}
 	return err2
 }
 
-func (l *Lobby) handleGameTick(game *GameState, p1, p2 *Client) bool {
-	game.Update()
+func (l *Lobby) BroadcastPlayerCount() {
+	// This is just a helper to let clients know how many people are online
+	// to show/hide the "Pair Mode" button ideally
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	game.mu.RLock()
-	// Check if game is over (both dead)
-	if game.GameOver {
-		l.handleGameOver(game, p1, p2)
-		return false
+	count := len(l.clients)
+	if count < 2 {
+		// If 0 or 1, no pair mode possible really (unless waiting for someone)
+	}
+	msg := map[string]interface{}{
+		"type":         "lobby_stats",
+		"online_count": count,
 	}
 
-	err := l.broadcastToPair(p1, p2, game)
-	game.mu.RUnlock()
+	for client := range l.clients {
+		client.SendJSON(msg)
+	}
+}
 
-	if err != nil {
-		log.Println("Error writing to client in pair game, ending game")
-		game.mu.Lock()
-		game.GameOver = true // Stop updates
-		game.mu.Unlock()
-		l.cleanupPairGame(game, p1, p2)
-		return false
+// SendToUser queues a message for every connection of a user
+func (l *Lobby) SendToUser(nickname string, message interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client := range l.clients {
+		if client.Nickname == nickname {
+			client.SendJSON(message)
+		}
 	}
-	return true
 }
 
-func (l *Lobby) handleGameOver(game *GameState, p1, p2 *Client) {
-	game.mu.RUnlock()
-	// Send final state
-	game.mu.RLock()
-	state := game
-	game.mu.RUnlock()
+// DisconnectFamily closes every connection authenticated with a revoked login
+func (l *Lobby) DisconnectFamily(familyID string) {
+	l.disconnectWhere(func(c *Client) bool { return c.FamilyID == familyID })
+}
 
-	l.broadcastToPair(p1, p2, state)
+// DisconnectUser closes every connection of a user
+func (l *Lobby) DisconnectUser(nickname string) {
+	l.disconnectWhere(func(c *Client) bool { return c.Nickname == nickname })
+}
 
-	// Save Score
-	db.SavePairScore(p1.Nickname, p2.Nickname, state.Score)
+func (l *Lobby) disconnectWhere(match func(*Client) bool) {
+	l.mu.Lock()
+	var targets []*Client
+	for client := range l.clients {
+		if match(client) {
+			targets = append(targets, client)
+		}
+	}
+	l.mu.Unlock()
 
-	l.cleanupPairGame(game, p1, p2)
+	// The read loop notices the closed connection and unregisters the client
+	for _, client := range targets {
+		client.closeWithCode(CloseSessionRevoked, "session revoked")
+	}
 }
 
-func (l *Lobby) cleanupPairGame(game *GameState, p1, p2 *Client) {
-	p1.SetGame(nil)
-	p2.SetGame(nil)
+func (l *Lobby) addGame(game *GameState) {
+	l.mu.Lock()
+	l.games[game] = true
+	l.mu.Unlock()
+}
 
+func (l *Lobby) removeGame(game *GameState) {
 	l.mu.Lock()
 	delete(l.games, game)
 	l.mu.Unlock()
 }
 
-func (l *Lobby) BroadcastPlayerCount() {
-	// This is just a helper to let clients know how many people are online
-	// to show/hide the "Pair Mode" button ideally
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// GameInfo describes a running game for moderators
+type GameInfo struct {
+	ID         uint64    `json:"id"`
+	Mode       GameMode  `json:"mode"`
+	Players    []string  `json:"players"`
+	Score      int       `json:"score"`
+	GhostCount int       `json:"ghostCount"`
+	Map        string    `json:"map"`
+	StartedAt  time.Time `json:"startedAt"`
+}
 
-	count := len(l.clients)
-	if count < 2 {
-		// If 0 or 1, no pair mode possible really (unless waiting for someone)
+// Games lists the running games, oldest first
+func (l *Lobby) Games() []GameInfo {
+	l.mu.Lock()
+	games := make([]*GameState, 0, len(l.games))
+	for game := range l.games {
+		games = append(games, game)
 	}
-	msg := map[string]interface{}{
-		"type":         "lobby_stats",
-		"online_count": count,
+	l.mu.Unlock()
+
+	infos := make([]GameInfo, 0, len(games))
+	for _, game := range games {
+		game.mu.RLock()
+		info := GameInfo{
+			ID:         game.ID,
+			Mode:       ModeSingle,
+			Score:      game.Score,
+			GhostCount: game.GhostCount,
+			Map:        game.MapName,
+			StartedAt:  game.StartedAt,
+		}
+		for nickname := range game.Players {
+			info.Players = append(info.Players, nickname)
+		}
+		game.mu.RUnlock()
+		if len(info.Players) > 1 {
+			info.Mode = ModePair
+		}
+		sort.Strings(info.Players)
+		infos = append(infos, info)
 	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
 
+// EndGame stops a running game without recording its score and tells its
+// players why. It reports false if no such game is running.
+func (l *Lobby) EndGame(id uint64, reason string) bool {
+	l.mu.Lock()
+	var game *GameState
+	for g := range l.games {
+		if g.ID == id {
+			game = g
+			break
+		}
+	}
+	if game == nil {
+		l.mu.Unlock()
+		return false
+	}
+	delete(l.games, game)
+	var players []*Client
 	for client := range l.clients {
-		client.WriteJSON(msg)
+		if client.GetGame() == game {
+			players = append(players, client)
+		}
 	}
+	l.mu.Unlock()
+
+	l.scheduler.Stop(game)
+	for _, client := range players {
+		if session := client.PairSession(); session != nil {
+			session.abort(game)
+		}
+		client.SetGame(nil)
+		client.SendJSON(map[string]interface{}{
+			"type":   "game_ended",
+			"reason": reason,
+		})
+	}
+	return true
 }
 
 func (l *Lobby) isWaiting(client *Client) bool {
-	for _, c := range l.waiting {
-		if c == client {
+	for _, e := range l.waiting {
+		if e.client == client {
 			return true
 		}
 	}
@@ -248,16 +374,20 @@ func (l *Lobby) onClientUnregistered(client *Client) {
 	l.mu.Lock()
 	if _, ok := l.clients[client]; ok {
 		delete(l.clients, client)
-		close(client.Send)
+		client.Close()
 	}
 	// Remove from waiting list if present
-	for i, c := range l.waiting {
-		if c == client {
+	for i, e := range l.waiting {
+		if e.client == client {
 			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
 			break
 		}
 	}
 	l.mu.Unlock()
+	if session := client.PairSession(); session != nil {
+		session.Leave(client)
+	}
+	l.boards.RemoveClient(client)
 	log.Printf("Client unregistered: %s", client.Nickname)
 	l.BroadcastPlayerCount()
 }
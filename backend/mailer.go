@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is a plain-text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// mailer is the process-wide Mailer, set by InitMailer
+var mailer Mailer = NewLogMailer(io.Discard)
+
+// InitMailer configures the mailer from the environment
+func InitMailer() {
+	mailer = NewMailerFromEnv()
+}
+
+// SMTPMailer sends mail through an SMTP relay using PLAIN auth
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(mail Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + mail.To + "\r\n" +
+		"Subject: " + mail.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + mail.Body + "\r\n"
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{mail.To}, []byte(msg))
+}
+
+// LogMailer writes mail to a writer instead of sending it. It is meant for
+// local development and tests, where the reset link can be read from the log.
+type LogMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{w: w}
+}
+
+func (m *LogMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "--- mail %s ---\nTo: %s\nSubject: %s\n\n%s\n---\n",
+		time.Now().Format(time.RFC3339), mail.To, mail.Subject, mail.Body)
+	return err
+}
+
+// NewMailerFromEnv returns an SMTP mailer when SMTP_HOST is set. Otherwise
+// mail goes to MAIL_LOG_FILE, or stdout if that is unset too.
+func NewMailerFromEnv() Mailer {
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	}
+
+	if path := os.Getenv("MAIL_LOG_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err == nil {
+			return NewLogMailer(f)
+		}
+		fmt.Printf("Warning: cannot open MAIL_LOG_FILE %s: %v\n", path, err)
+	}
+	fmt.Println("Warning: SMTP_HOST not set, writing mail to stdout")
+	return NewLogMailer(os.Stdout)
+}
+
+// appBaseURL is used to build links in outgoing mail
+func appBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:6060"
+}
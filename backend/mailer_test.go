@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLogMailerWritesMail(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewLogMailer(&buf)
+
+	err := m.Send(Mail{To: "pac@example.com", Subject: "Reset", Body: "http://localhost/?reset=abc"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"To: pac@example.com", "Subject: Reset", "?reset=abc"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in mail log, got:\n%s", want, out)
+		}
+	}
+}
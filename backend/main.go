@@ -11,12 +11,21 @@ import (
 
 func main() {
 	db.InitDB()
+	InitSessionStore()
+	InitMailer()
+	InitOIDC()
 	CleanupExpiredSessions() // Start session cleanup goroutine
 	mux := http.NewServeMux()
 
-	// Initialize Lobby
-	lobby := NewLobby()
+	// Initialize game scheduler and Lobby
+	scheduler := NewSchedulerFromEnv()
+	go scheduler.Run()
+	store := NewStoreFromEnv()
+	PromoteAdminsFromEnv(store)
+	InitAchievements(store)
+	lobby := NewLobby(scheduler, store, NewBoardBusFromEnv())
 	go lobby.Run()
+	CleanupStaleGuests(lobby)
 
 	// Serve static files from frontend/dist
 	rootDir := "."
@@ -44,3 +53,38 @@ func main() {
 		fmt.Println("Error starting server:", err)
 	}
 }
+
+// NewStoreFromEnv picks the storage for accounts and scores: Postgres when
+// InitDB connected, else the SQLite file at SQLITE_PATH, else memory
+func NewStoreFromEnv() db.Store {
+	if db.IsConfigured() {
+		return db.PostgresStore{}
+	}
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		store, err := db.OpenSQLiteStore(path)
+		if err == nil {
+			if err = store.Migrate(); err == nil {
+				fmt.Println("Using SQLite store at", path)
+				return store
+			}
+			store.Close()
+		}
+		fmt.Println("Warning: cannot use SQLite store:", err)
+	}
+	fmt.Println("Warning: no database, accounts and scores are kept in memory")
+	return db.NewMemoryStore()
+}
+
+// NewBoardBusFromEnv picks how score changes reach live leaderboards: through
+// Postgres LISTEN/NOTIFY, so replicas sharing the database hear each other,
+// else within this process only
+func NewBoardBusFromEnv() db.BoardBus {
+	if db.IsConfigured() {
+		bus, err := db.NewPostgresBus()
+		if err == nil {
+			return bus
+		}
+		fmt.Println("Warning: live leaderboards limited to this server:", err)
+	}
+	return db.NewMemoryBus()
+}
@@ -1,5 +1,13 @@
 package main
 
+// DefaultMapName is the map used when no preference is given
+const DefaultMapName = "classic"
+
+// Maps holds every playable map by name
+var Maps = map[string]*[Rows][Cols]int{
+	DefaultMapName: &InitialMap,
+}
+
 var InitialMap = [Rows][Cols]int{
 	{CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall , CellWall },
 	{CellWall , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellWall , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellDot  , CellWall },
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// matchBaseWindow is the rating gap accepted as soon as a player queues
+	matchBaseWindow = 100.0
+	// matchWindowGrowth widens the accepted gap per second spent waiting
+	matchWindowGrowth = 25.0
+	// matchInterval is how often the queue is re-evaluated as windows widen
+	matchInterval = 1 * time.Second
+	// defaultWaitEstimate is reported before any match has been observed
+	defaultWaitEstimate = 30 * time.Second
+)
+
+// PairPreferences are the constraints a player puts on their pair game.
+// An empty Map or Region accepts any.
+type PairPreferences struct {
+	MinGhosts int    `json:"minGhosts"`
+	MaxGhosts int    `json:"maxGhosts"`
+	Map       string `json:"map"`
+	Region    string `json:"region"`
+}
+
+// parsePairPreferences reads preferences from a join_pair message, e.g.
+// { "type": "join_pair", "minGhosts": 3, "maxGhosts": 6, "map": "classic", "region": "eu" }
+func parsePairPreferences(msg map[string]interface{}) PairPreferences {
+	var prefs PairPreferences
+	if v, ok := msg["minGhosts"].(float64); ok {
+		prefs.MinGhosts = int(v)
+	}
+	if v, ok := msg["maxGhosts"].(float64); ok {
+		prefs.MaxGhosts = int(v)
+	}
+	if v, ok := msg["map"].(string); ok {
+		prefs.Map = v
+	}
+	if v, ok := msg["region"].(string); ok {
+		prefs.Region = v
+	}
+	return prefs.normalize()
+}
+
+// normalize fills in defaults, clamps the ghost range and drops unknown maps
+func (p PairPreferences) normalize() PairPreferences {
+	if p.MinGhosts <= 0 {
+		p.MinGhosts = MinGhostCount
+	}
+	if p.MaxGhosts <= 0 {
+		p.MaxGhosts = MaxGhostCount
+	}
+	p.MinGhosts = clampGhosts(p.MinGhosts)
+	p.MaxGhosts = clampGhosts(p.MaxGhosts)
+	if p.MinGhosts > p.MaxGhosts {
+		p.MinGhosts, p.MaxGhosts = p.MaxGhosts, p.MinGhosts
+	}
+
+	p.Map = strings.TrimSpace(p.Map)
+	if _, ok := Maps[p.Map]; !ok {
+		p.Map = ""
+	}
+	p.Region = strings.ToLower(strings.TrimSpace(p.Region))
+	return p
+}
+
+func clampGhosts(n int) int {
+	if n < MinGhostCount {
+		return MinGhostCount
+	}
+	if n > MaxGhostCount {
+		return MaxGhostCount
+	}
+	return n
+}
+
+// compatible reports whether two players can share a game
+func (p PairPreferences) compatible(o PairPreferences) bool {
+	if p.MinGhosts > o.MaxGhosts || o.MinGhosts > p.MaxGhosts {
+		return false
+	}
+	if p.Map != "" && o.Map != "" && p.Map != o.Map {
+		return false
+	}
+	if p.Region != "" && o.Region != "" && p.Region != o.Region {
+		return false
+	}
+	return true
+}
+
+// settings picks the ghost count and map for two compatible players: the
+// default ghost count clamped into the shared range, and any named map.
+func (p PairPreferences) settings(o PairPreferences) (ghostCount int, mapName string) {
+	lo := max(p.MinGhosts, o.MinGhosts)
+	hi := min(p.MaxGhosts, o.MaxGhosts)
+	ghostCount = min(max(DefaultGhostCount, lo), hi)
+
+	mapName = p.Map
+	if mapName == "" {
+		mapName = o.Map
+	}
+	if mapName == "" {
+		mapName = DefaultMapName
+	}
+	return ghostCount, mapName
+}
+
+// pairQueueEntry is a player waiting for a pair game
+type pairQueueEntry struct {
+	client   *Client
+	rating   float64
+	prefs    PairPreferences
+	joinedAt time.Time
+}
+
+// window returns the rating gap this player accepts after waiting until now
+func (e *pairQueueEntry) window(now time.Time) float64 {
+	return matchBaseWindow + matchWindowGrowth*now.Sub(e.joinedAt).Seconds()
+}
+
+func canMatch(a, b *pairQueueEntry, now time.Time) bool {
+	if !a.prefs.compatible(b.prefs) {
+		return false
+	}
+	gap := math.Abs(a.rating - b.rating)
+	return gap <= math.Max(a.window(now), b.window(now))
+}
+
+// matchWaiting pairs up queued players whose ratings are close enough,
+// oldest first, and starts their games. Must be called with l.mu held.
+func (l *Lobby) matchWaiting(now time.Time) {
+	if len(l.waiting) < 2 {
+		return
+	}
+
+	sort.SliceStable(l.waiting, func(i, j int) bool {
+		return l.waiting[i].joinedAt.Before(l.waiting[j].joinedAt)
+	})
+
+	matched := make(map[*pairQueueEntry]bool)
+	for i, a := range l.waiting {
+		if matched[a] {
+			continue
+		}
+		var best *pairQueueEntry
+		for _, b := range l.waiting[i+1:] {
+			if matched[b] || !canMatch(a, b, now) {
+				continue
+			}
+			if best == nil || math.Abs(a.rating-b.rating) < math.Abs(a.rating-best.rating) {
+				best = b
+			}
+		}
+		if best == nil {
+			continue
+		}
+		matched[a] = true
+		matched[best] = true
+		l.observeWait(now.Sub(a.joinedAt))
+		l.observeWait(now.Sub(best.joinedAt))
+		log.Printf("Matched %s (%.0f) with %s (%.0f)", a.client.Nickname, a.rating, best.client.Nickname, best.rating)
+		ghostCount, mapName := a.prefs.settings(best.prefs)
+		l.StartPairGame(a, best, ghostCount, mapName)
+	}
+
+	if len(matched) == 0 {
+		return
+	}
+	remaining := l.waiting[:0]
+	for _, e := range l.waiting {
+		if !matched[e] {
+			remaining = append(remaining, e)
+		}
+	}
+	l.waiting = remaining
+}
+
+// observeWait folds an actual wait time into the moving average
+func (l *Lobby) observeWait(wait time.Duration) {
+	if l.avgWait == 0 {
+		l.avgWait = wait
+		return
+	}
+	l.avgWait = (l.avgWait*4 + wait) / 5
+}
+
+// estimateWait predicts how long entry will wait. If someone is already
+// queued, it is the time until the windows cover the closest rating gap;
+// otherwise the recent average wait. Incompatible players are ignored. Must be called with l.mu held.
+func (l *Lobby) estimateWait(entry *pairQueueEntry, now time.Time) time.Duration {
+	estimate := time.Duration(-1)
+	for _, other := range l.waiting {
+		if other == entry || !entry.prefs.compatible(other.prefs) {
+			continue
+		}
+		gap := math.Abs(entry.rating - other.rating)
+		// Widest window of the two, solved for the time it covers gap
+		waited := math.Max(now.Sub(entry.joinedAt).Seconds(), now.Sub(other.joinedAt).Seconds())
+		secs := math.Max((gap-matchBaseWindow)/matchWindowGrowth-waited, 0)
+		if d := time.Duration(secs * float64(time.Second)); estimate < 0 || d < estimate {
+			estimate = d
+		}
+	}
+	if estimate >= 0 {
+		return estimate
+	}
+	if l.avgWait > 0 {
+		return l.avgWait
+	}
+	return defaultWaitEstimate
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newQueuedClient(l *Lobby, nickname string, rating float64, joinedAt time.Time) *Client {
+	client := NewClient(nickname, nil, l)
+	l.waiting = append(l.waiting, &pairQueueEntry{client: client, rating: rating, prefs: PairPreferences{}.normalize(), joinedAt: joinedAt})
+	return client
+}
+
+func TestMatchWaitingPairsClosestRatings(t *testing.T) {
+	l := newTestLobby()
+	now := time.Now()
+
+	a := newQueuedClient(l, "a", 1500, now)
+	b := newQueuedClient(l, "b", 1900, now)
+	c := newQueuedClient(l, "c", 1550, now)
+
+	l.matchWaiting(now)
+
+	if a.PairSession() == nil || a.PairSession() != c.PairSession() {
+		t.Error("Expected a and c to be matched")
+	}
+	if b.PairSession() != nil {
+		t.Error("Expected b to keep waiting")
+	}
+	if len(l.waiting) != 1 || l.waiting[0].client != b {
+		t.Errorf("Expected only b left in the queue, got %d entries", len(l.waiting))
+	}
+}
+
+func TestMatchWindowWidensWithWait(t *testing.T) {
+	l := newTestLobby()
+	now := time.Now()
+
+	a := newQueuedClient(l, "a", 1500, now)
+	b := newQueuedClient(l, "b", 1800, now)
+
+	l.matchWaiting(now)
+	if a.PairSession() != nil {
+		t.Fatal("Expected a 300 point gap not to match immediately")
+	}
+
+	// 100 base + 25/s: the gap is covered after 8 seconds
+	if est := l.estimateWait(l.waiting[0], now); est != 8*time.Second {
+		t.Errorf("Expected 8s estimated wait, got %v", est)
+	}
+
+	l.matchWaiting(now.Add(8 * time.Second))
+	if a.PairSession() == nil || a.PairSession() != b.PairSession() {
+		t.Error("Expected a and b to be matched once the window widened")
+	}
+}
+
+func TestPairRatingDelta(t *testing.T) {
+	// An average team hitting the baseline exactly is rated as expected
+	if d := pairRatingDelta(1500, 1500, int(baselineScore(4)), 4); d != 0 {
+		t.Errorf("Expected no change at baseline, got %f", d)
+	}
+	if d := pairRatingDelta(1500, 1500, 5000, 4); d <= 0 {
+		t.Errorf("Expected a gain above baseline, got %f", d)
+	}
+	// A strong team gains less for the same score than an average one
+	if strong, avg := pairRatingDelta(1900, 1900, 5000, 4), pairRatingDelta(1500, 1500, 5000, 4); strong >= avg {
+		t.Errorf("Expected strong team to gain less (%f) than average (%f)", strong, avg)
+	}
+	// The same score is worth more against more ghosts
+	if hard, easy := pairRatingDelta(1500, 1500, 1500, 10), pairRatingDelta(1500, 1500, 1500, 1); hard <= easy {
+		t.Errorf("Expected more ghosts to be rated higher (%f vs %f)", hard, easy)
+	}
+}
+
+func TestMatchWaitingRespectsPreferences(t *testing.T) {
+	l := newTestLobby()
+	now := time.Now()
+
+	a := newQueuedClient(l, "a", 1500, now)
+	b := newQueuedClient(l, "b", 1500, now)
+	c := newQueuedClient(l, "c", 1500, now)
+	l.waiting[0].prefs = PairPreferences{MinGhosts: 7, MaxGhosts: 10, Region: "EU"}.normalize()
+	l.waiting[1].prefs = PairPreferences{MinGhosts: 1, MaxGhosts: 3}.normalize()
+	l.waiting[2].prefs = PairPreferences{MinGhosts: 6, MaxGhosts: 8, Region: "eu"}.normalize()
+
+	l.matchWaiting(now)
+
+	session := a.PairSession()
+	if session == nil || session != c.PairSession() {
+		t.Fatal("Expected a and c to be matched on overlapping ghost range and region")
+	}
+	if b.PairSession() != nil {
+		t.Error("Expected b to keep waiting with an incompatible ghost range")
+	}
+	if session.ghostCount != 7 {
+		t.Errorf("Expected the default ghost count clamped into 7-8, got %d", session.ghostCount)
+	}
+	if session.mapName != DefaultMapName {
+		t.Errorf("Expected the default map, got %q", session.mapName)
+	}
+}
+
+func TestParsePairPreferences(t *testing.T) {
+	prefs := parsePairPreferences(map[string]interface{}{
+		"type":      "join_pair",
+		"minGhosts": float64(12),
+		"maxGhosts": float64(5),
+		"map":       "nowhere",
+		"region":    " EU ",
+	})
+	want := PairPreferences{MinGhosts: 5, MaxGhosts: 10, Map: "", Region: "eu"}
+	if prefs != want {
+		t.Errorf("Expected %+v, got %+v", want, prefs)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	// oidcLoginTimeout is how long a user has to finish signing in at the provider
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcCodeDuration is how long the frontend has to exchange a login code
+	oidcCodeDuration = 1 * time.Minute
+	// oidcStateCookie ties a login to the browser that started it
+	oidcStateCookie = "pacman_oidc_state"
+)
+
+var (
+	ErrOIDCNotConfigured = errors.New("OIDC login is not configured")
+	ErrOIDCInvalidState  = errors.New("unknown or expired OIDC login state")
+)
+
+// OIDCConfig holds the identity provider settings
+type OIDCConfig struct {
+	Name         string // Shown on the login button
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string // Empty for public clients, which rely on PKCE alone
+	RedirectURL  string
+	Scopes       []string
+}
+
+// OIDCConfigFromEnv reads the OIDC_* variables. It returns false if no
+// issuer is configured.
+func OIDCConfigFromEnv() (OIDCConfig, bool) {
+	cfg := OIDCConfig{
+		Name:         os.Getenv("OIDC_PROVIDER_NAME"),
+		IssuerURL:    os.Getenv("OIDC_ISSUER_URL"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+	}
+	if cfg.IssuerURL == "" || cfg.ClientID == "" {
+		return OIDCConfig{}, false
+	}
+	if cfg.Name == "" {
+		cfg.Name = "SSO"
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = appBaseURL() + "/api/oidc/callback"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	return cfg, true
+}
+
+// OIDCClaims are the ID token claims used to find or create the account
+type OIDCClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+type oidcPendingLogin struct {
+	verifier     string // PKCE code verifier
+	nonce        string
+	linkNickname string // Set when a signed-in user is linking their account
+	expiresAt    time.Time
+}
+
+type oidcLoginCode struct {
+	nickname  string
+	expiresAt time.Time
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against one
+// identity provider. Discovery happens on first use, so the server starts
+// even if the provider is briefly unreachable.
+type OIDCProvider struct {
+	cfg OIDCConfig
+
+	discoverMu sync.Mutex
+	oauth      *oauth2.Config
+	verifier   *oidc.IDTokenVerifier
+
+	mu      sync.Mutex
+	pending map[string]oidcPendingLogin // Keyed by state
+	codes   map[string]oidcLoginCode    // Keyed by code hash
+}
+
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		cfg:     cfg,
+		pending: make(map[string]oidcPendingLogin),
+		codes:   make(map[string]oidcLoginCode),
+	}
+}
+
+// oidcProvider is nil unless OIDC is configured
+var oidcProvider *OIDCProvider
+
+// InitOIDC enables OIDC login when the provider is configured
+func InitOIDC() {
+	if cfg, ok := OIDCConfigFromEnv(); ok {
+		oidcProvider = NewOIDCProvider(cfg)
+	}
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.discoverMu.Lock()
+	defer p.discoverMu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.cfg.IssuerURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.cfg.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+	return p.oauth, p.verifier, nil
+}
+
+// AuthURL starts a login and returns the provider URL to send the browser
+// to, along with the login's state. A non-empty linkNickname links the
+// identity to that account instead.
+func (p *OIDCProvider) AuthURL(ctx context.Context, linkNickname string) (string, string, error) {
+	oauthCfg, _, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := GenerateSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := GenerateSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	now := time.Now()
+	p.mu.Lock()
+	for s, pl := range p.pending {
+		if now.After(pl.expiresAt) {
+			delete(p.pending, s)
+		}
+	}
+	p.pending[state] = oidcPendingLogin{
+		verifier:     verifier,
+		nonce:        nonce,
+		linkNickname: linkNickname,
+		expiresAt:    now.Add(oidcLoginTimeout),
+	}
+	p.mu.Unlock()
+
+	return oauthCfg.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), state, nil
+}
+
+// setStateCookie remembers the login's state in the browser that started
+// it. Only a hash is kept, and SameSite=Lax still sends it on the
+// provider's top-level redirect back to the callback.
+func (p *OIDCProvider) setStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(state),
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkStateCookie reports whether the callback comes from the browser that
+// started the login, and clears the cookie. Without this check an attacker
+// could send a victim the callback URL of their own login and sign them in
+// to the attacker's account.
+func (p *OIDCProvider) checkStateCookie(w http.ResponseWriter, r *http.Request, state string) bool {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashToken(state))) == 1
+}
+
+// Exchange completes a login: it consumes the state, redeems the code with
+// the PKCE verifier and verifies the ID token. It returns the claims and the
+// nickname being linked, if any.
+func (p *OIDCProvider) Exchange(ctx context.Context, state, code string) (OIDCClaims, string, error) {
+	p.mu.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pending.expiresAt) {
+		return OIDCClaims{}, "", ErrOIDCInvalidState
+	}
+
+	oauthCfg, verifier, err := p.discover(ctx)
+	if err != nil {
+		return OIDCClaims{}, "", err
+	}
+	token, err := oauthCfg.Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		return OIDCClaims{}, "", fmt.Errorf("code exchange: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OIDCClaims{}, "", errors.New("token response has no id_token")
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return OIDCClaims{}, "", fmt.Errorf("verify id_token: %w", err)
+	}
+	if idToken.Nonce != pending.nonce {
+		return OIDCClaims{}, "", errors.New("id_token nonce mismatch")
+	}
+
+	var claims OIDCClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return OIDCClaims{}, "", fmt.Errorf("decode claims: %w", err)
+	}
+	return claims, pending.linkNickname, nil
+}
+
+// IssueLoginCode returns a single-use code the frontend trades for session
+// tokens, so the tokens never appear in the callback redirect
+func (p *OIDCProvider) IssueLoginCode(nickname string) (string, error) {
+	code, err := GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for h, c := range p.codes {
+		if now.After(c.expiresAt) {
+			delete(p.codes, h)
+		}
+	}
+	p.codes[hashToken(code)] = oidcLoginCode{nickname: nickname, expiresAt: now.Add(oidcCodeDuration)}
+	return code, nil
+}
+
+// RedeemLoginCode consumes a login code, returning the nickname it was issued for
+func (p *OIDCProvider) RedeemLoginCode(code string) (string, bool) {
+	hash := hashToken(code)
+	p.mu.Lock()
+	c, ok := p.codes[hash]
+	delete(p.codes, hash)
+	p.mu.Unlock()
+	if !ok || time.Now().After(c.expiresAt) {
+		return "", false
+	}
+	return c.nickname, true
+}
+
+// oidcNicknameAttempts bounds the suffixes tried when a derived nickname is taken
+const oidcNicknameAttempts = 10
+
+// resolveOIDCUser returns the account linked to the identity, creating one
+// on first login. Existing accounts are never matched by email alone, since
+// that would let anyone controlling the address at the provider take them over.
+func resolveOIDCUser(store db.Store, claims OIDCClaims) (string, error) {
+	nickname, err := store.FindIdentityUser(claims.Issuer, claims.Subject)
+	if !errors.Is(err, db.ErrIdentityNotFound) {
+		return nickname, err
+	}
+
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+	base := oidcNicknameBase(claims)
+	for i := 0; i < oidcNicknameAttempts; i++ {
+		candidate := base
+		if i > 0 {
+			suffix := fmt.Sprintf("%d", i+1)
+			if len(candidate)+len(suffix) > maxNicknameLength {
+				candidate = candidate[:maxNicknameLength-len(suffix)]
+			}
+			candidate += suffix
+		}
+		err := store.CreateIdentityUser(candidate, email, claims.Issuer, claims.Subject)
+		if errors.Is(err, db.ErrUsernameTaken) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("no free nickname for %q after %d attempts", base, oidcNicknameAttempts)
+}
+
+// oidcNicknameBase derives a valid nickname from the identity's claims
+func oidcNicknameBase(claims OIDCClaims) string {
+	localPart, _, _ := strings.Cut(claims.Email, "@")
+	for _, candidate := range []string{claims.PreferredUsername, localPart, claims.Name} {
+		var sb strings.Builder
+		for _, r := range NormalizeNickname(candidate) {
+			switch {
+			case isNicknameRune(r):
+				sb.WriteRune(r)
+			case r == ' ' || r == '.':
+				sb.WriteRune('_')
+			}
+		}
+		name := sb.String()
+		if len(name) > maxNicknameLength {
+			name = name[:maxNicknameLength]
+		}
+		if ValidateNickname(name) == "" {
+			return name
+		}
+	}
+	return "player"
+}
+
+func requireOIDC(w http.ResponseWriter) (*OIDCProvider, bool) {
+	if oidcProvider == nil {
+		http.Error(w, ErrOIDCNotConfigured.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return oidcProvider, true
+}
+
+func onApiOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := map[string]interface{}{"enabled": oidcProvider != nil}
+	if oidcProvider != nil {
+		resp["name"] = oidcProvider.cfg.Name
+	}
+	writeJSON(w, resp)
+}
+
+// onApiOIDCAuthorize returns the provider URL to start a login. With a valid
+// bearer token the identity is linked to the signed-in account instead.
+func onApiOIDCAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	provider, ok := requireOIDC(w)
+	if !ok {
+		return
+	}
+	linkNickname := ""
+	if _, hasToken := bearerToken(r); hasToken {
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		linkNickname = session.Nickname
+	}
+
+	authURL, state, err := provider.AuthURL(r.Context(), linkNickname)
+	if err != nil {
+		fmt.Println("OIDC authorize error:", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	provider.setStateCookie(w, state)
+	writeJSON(w, map[string]string{"url": authURL})
+}
+
+// onApiOIDCCallback is where the provider sends the browser back. It always
+// redirects to the frontend, which reads the outcome from the query string.
+func onApiOIDCCallback(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := requireOIDC(w)
+		if !ok {
+			return
+		}
+		fail := func(reason string) {
+			http.Redirect(w, r, "/?oidc_error="+url.QueryEscape(reason), http.StatusFound)
+		}
+
+		q := r.URL.Query()
+		if !provider.checkStateCookie(w, r, q.Get("state")) {
+			fail("invalid_state")
+			return
+		}
+		if errCode := q.Get("error"); errCode != "" {
+			fail(errCode)
+			return
+		}
+		claims, linkNickname, err := provider.Exchange(r.Context(), q.Get("state"), q.Get("code"))
+		if err != nil {
+			fmt.Println("OIDC callback error:", err)
+			fail("login_failed")
+			return
+		}
+
+		if linkNickname != "" {
+			email := ""
+			if claims.EmailVerified {
+				email = claims.Email
+			}
+			if err := store.LinkIdentity(linkNickname, email, claims.Issuer, claims.Subject); err != nil {
+				fmt.Println("OIDC link error:", err)
+				if errors.Is(err, db.ErrIdentityLinked) {
+					fail("already_linked")
+				} else {
+					fail("login_failed")
+				}
+				return
+			}
+			http.Redirect(w, r, "/?oidc_linked=1", http.StatusFound)
+			return
+		}
+
+		nickname, err := resolveOIDCUser(store, claims)
+		if err != nil {
+			fmt.Println("OIDC account error:", err)
+			fail("login_failed")
+			return
+		}
+		banned, err := isBanned(store, nickname)
+		if err != nil {
+			fmt.Println("OIDC ban check error:", err)
+			fail("unavailable")
+			return
+		}
+		if banned {
+			fail("banned")
+			return
+		}
+		code, err := provider.IssueLoginCode(nickname)
+		if err != nil {
+			fmt.Println("OIDC code error:", err)
+			fail("login_failed")
+			return
+		}
+		http.Redirect(w, r, "/?oidc_code="+url.QueryEscape(code), http.StatusFound)
+	}
+}
+
+// onApiOIDCSession trades a login code from the callback for session tokens
+func onApiOIDCSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	provider, ok := requireOIDC(w)
+	if !ok {
+		return
+	}
+	var req OIDCSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	nickname, ok := provider.RedeemLoginCode(req.Code)
+	if !ok {
+		http.Error(w, "Invalid or expired login code", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := CreateSession(nickname, clientInfoFromRequest(r))
+	if err != nil {
+		fmt.Println("Session creation error:", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"message":      "Login successful",
+		"nickname":     session.Nickname,
+		"token":        session.Token,
+		"refreshToken": session.RefreshToken,
+		"expiresIn":    int(accessTokenDuration / time.Second),
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const stubClientID = "pacman-test"
+
+// stubOIDCServer is a minimal identity provider: discovery, JWKS, an
+// authorize endpoint that signs the user in immediately, and a token
+// endpoint that enforces PKCE.
+type stubOIDCServer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu         sync.Mutex
+	codes      map[string]stubAuthRequest
+	forceNonce string // Overrides the nonce in issued ID tokens when set
+}
+
+type stubAuthRequest struct {
+	challenge string
+	nonce     string
+}
+
+func newStubOIDCServer(t *testing.T) *stubOIDCServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	s := &stubOIDCServer{key: key, codes: make(map[string]stubAuthRequest)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "PKCE required", http.StatusBadRequest)
+			return
+		}
+		code, _ := GenerateSessionToken()
+		s.mu.Lock()
+		s.codes[code] = stubAuthRequest{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+		s.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		req, ok := s.codes[r.PostForm.Get("code")]
+		delete(s.codes, r.PostForm.Get("code"))
+		nonce := req.nonce
+		if s.forceNonce != "" {
+			nonce = s.forceNonce
+		}
+		s.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"access_token": "stub-access",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token": s.signIDToken(t, map[string]interface{}{
+				"iss":                s.URL,
+				"sub":                "user-42",
+				"aud":                stubClientID,
+				"iat":                time.Now().Unix(),
+				"exp":                time.Now().Add(5 * time.Minute).Unix(),
+				"nonce":              nonce,
+				"email":              "ada.lovelace@example.com",
+				"email_verified":     true,
+				"preferred_username": "ada.lovelace",
+			}),
+		})
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubOIDCServer) signIDToken(t *testing.T, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingInput := enc(map[string]string{"alg": "RS256", "kid": "stub", "typ": "JWT"}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Errorf("sign id_token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize follows the provider's authorize redirect and returns the
+// state and code it sends back to the callback
+func (s *stubOIDCServer) authorize(t *testing.T, authURL string) (state, code string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect to the callback, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return loc.Query().Get("state"), loc.Query().Get("code")
+}
+
+func newTestOIDCProvider(s *stubOIDCServer) *OIDCProvider {
+	return NewOIDCProvider(OIDCConfig{
+		Name:        "Stub",
+		IssuerURL:   s.URL,
+		ClientID:    stubClientID,
+		RedirectURL: "http://localhost:6060/api/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	})
+}
+
+func TestOIDCLoginWithPKCE(t *testing.T) {
+	stub := newStubOIDCServer(t)
+	provider := newTestOIDCProvider(stub)
+	ctx := context.Background()
+
+	authURL, _, err := provider.AuthURL(ctx, "")
+	if err != nil {
+		t.Fatalf("AuthURL: %v", err)
+	}
+	state, code := stub.authorize(t, authURL)
+
+	claims, link, err := provider.Exchange(ctx, state, code)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "user-42" || claims.Issuer != stub.URL || !claims.EmailVerified {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if link != "" {
+		t.Errorf("Expected a plain login, got link to %q", link)
+	}
+
+	if _, _, err := provider.Exchange(ctx, state, code); err != ErrOIDCInvalidState {
+		t.Errorf("Expected a replayed state to be rejected, got %v", err)
+	}
+}
+
+func TestOIDCRejectsNonceMismatch(t *testing.T) {
+	stub := newStubOIDCServer(t)
+	stub.forceNonce = "someone-elses-nonce"
+	provider := newTestOIDCProvider(stub)
+	ctx := context.Background()
+
+	authURL, _, err := provider.AuthURL(ctx, "")
+	if err != nil {
+		t.Fatalf("AuthURL: %v", err)
+	}
+	state, code := stub.authorize(t, authURL)
+	if _, _, err := provider.Exchange(ctx, state, code); err == nil {
+		t.Error("Expected an ID token with the wrong nonce to be rejected")
+	}
+}
+
+func TestOIDCLinkKeepsNickname(t *testing.T) {
+	stub := newStubOIDCServer(t)
+	provider := newTestOIDCProvider(stub)
+	ctx := context.Background()
+
+	authURL, _, _ := provider.AuthURL(ctx, "pacfan")
+	state, code := stub.authorize(t, authURL)
+	_, link, err := provider.Exchange(ctx, state, code)
+	if err != nil || link != "pacfan" {
+		t.Errorf("Expected a link for pacfan, got %q %v", link, err)
+	}
+}
+
+// startOIDCLogin calls the authorize endpoint as a browser would, returning
+// the provider URL and the state cookie it set
+func startOIDCLogin(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	onApiOIDCAuthorize(rec, httptest.NewRequest("POST", "/api/oidc/authorize", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from authorize, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+				t.Errorf("Expected an HttpOnly SameSite=Lax cookie, got %+v", c)
+			}
+			return resp["url"], c
+		}
+	}
+	t.Fatal("Expected authorize to set the state cookie")
+	return "", nil
+}
+
+func TestOIDCCallbackRejectsOtherBrowser(t *testing.T) {
+	stub := newStubOIDCServer(t)
+	prev := oidcProvider
+	t.Cleanup(func() { oidcProvider = prev })
+	oidcProvider = newTestOIDCProvider(stub)
+
+	// The attacker starts a login and sends the callback URL to a victim,
+	// whose browser holds the cookie of a login of its own, or none
+	attackerURL, _ := startOIDCLogin(t)
+	_, victimCookie := startOIDCLogin(t)
+	state, code := stub.authorize(t, attackerURL)
+	callback := "/api/oidc/callback?state=" + url.QueryEscape(state) + "&code=" + url.QueryEscape(code)
+
+	for _, cookie := range []*http.Cookie{victimCookie, nil} {
+		req := httptest.NewRequest("GET", callback, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		onApiOIDCCallback(db.NewMemoryStore())(rec, req)
+		if loc := rec.Header().Get("Location"); loc != "/?oidc_error=invalid_state" {
+			t.Errorf("Expected the callback rejected, got %d %q", rec.Code, loc)
+		}
+	}
+
+	// The rejected callbacks did not use up the login for its own browser
+	if _, _, err := oidcProvider.Exchange(context.Background(), state, code); err != nil {
+		t.Errorf("Expected the login to stay usable, got %v", err)
+	}
+}
+
+func TestOIDCStateCookieMatchesState(t *testing.T) {
+	provider := newTestOIDCProvider(newStubOIDCServer(t))
+	rec := httptest.NewRecorder()
+	provider.setStateCookie(rec, "state-1")
+
+	for state, want := range map[string]bool{"state-1": true, "state-2": false, "": false} {
+		req := httptest.NewRequest("GET", "/api/oidc/callback", nil)
+		req.AddCookie(rec.Result().Cookies()[0])
+		if got := provider.checkStateCookie(httptest.NewRecorder(), req, state); got != want {
+			t.Errorf("checkStateCookie(%q) = %v, want %v", state, got, want)
+		}
+	}
+}
+
+func TestOIDCLoginCodeIsSingleUse(t *testing.T) {
+	provider := NewOIDCProvider(OIDCConfig{})
+	code, err := provider.IssueLoginCode("ada_lovelace")
+	if err != nil {
+		t.Fatalf("IssueLoginCode: %v", err)
+	}
+	if nickname, ok := provider.RedeemLoginCode(code); !ok || nickname != "ada_lovelace" {
+		t.Errorf("Expected ada_lovelace, got %q %v", nickname, ok)
+	}
+	if _, ok := provider.RedeemLoginCode(code); ok {
+		t.Error("Expected a second redeem to fail")
+	}
+}
+
+func TestOIDCNicknameBase(t *testing.T) {
+	cases := []struct {
+		claims OIDCClaims
+		want   string
+	}{
+		{OIDCClaims{PreferredUsername: "ada.lovelace"}, "ada_lovelace"},
+		{OIDCClaims{Email: "grace@example.com"}, "grace"},
+		{OIDCClaims{Name: "Alan Turing"}, "Alan_Turing"},
+		{OIDCClaims{PreferredUsername: "admin", Email: "x@example.com"}, "player"},
+		{OIDCClaims{}, "player"},
+	}
+	for _, c := range cases {
+		if got := oidcNicknameBase(c.claims); got != c.want {
+			t.Errorf("oidcNicknameBase(%+v) = %q, want %q", c.claims, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Timings for the pair game handshake; variables so tests can shorten them
+var (
+	readyCheckTimeout = 15 * time.Second
+	rematchTimeout    = 15 * time.Second
+	countdownStep     = 1 * time.Second
+)
+
+const countdownFrom = 3
+
+type pairPhase int
+
+const (
+	phaseReadyCheck pairPhase = iota
+	phaseCountdown
+	phasePlaying
+	phaseRematch
+	phaseClosed
+)
+
+// pairSession carries two matched players through the ready check, the
+// 3-2-1 countdown, the game itself and any rematches with the same partner.
+type pairSession struct {
+	lobby      *Lobby
+	entries    [2]*pairQueueEntry
+	ghostCount int
+	mapName    string
+
+	mu       sync.Mutex
+	phase    pairPhase
+	accepted map[*Client]bool // Ready or rematch answers in the current phase
+	timer    *time.Timer
+	game     *GameState
+}
+
+func newPairSession(l *Lobby, a, b *pairQueueEntry, ghostCount int, mapName string) *pairSession {
+	return &pairSession{
+		lobby:      l,
+		entries:    [2]*pairQueueEntry{a, b},
+		ghostCount: ghostCount,
+		mapName:    mapName,
+		accepted:   make(map[*Client]bool),
+	}
+}
+
+func (s *pairSession) p1() *Client { return s.entries[0].client }
+func (s *pairSession) p2() *Client { return s.entries[1].client }
+
+func (s *pairSession) partner(c *Client) *Client {
+	if c == s.p1() {
+		return s.p2()
+	}
+	return s.p1()
+}
+
+// begin attaches the session to both players and asks them to confirm
+func (s *pairSession) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.p1().setPairSession(s)
+	s.p2().setPairSession(s)
+
+	s.lobby.broadcastToPair(s.p1(), s.p2(), map[string]interface{}{
+		"type":       "ready_check",
+		"p1":         s.p1().Nickname,
+		"p2":         s.p2().Nickname,
+		"ghostCount": s.ghostCount,
+		"map":        s.mapName,
+		"timeoutSec": int(readyCheckTimeout / time.Second),
+	})
+	s.armTimerLocked(phaseReadyCheck, readyCheckTimeout)
+}
+
+// Ready records a player's confirmation; the countdown starts once both are ready
+func (s *pairSession) Ready(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.phase != phaseReadyCheck {
+		return
+	}
+	s.accepted[c] = true
+	s.lobby.broadcastToPair(s.p1(), s.p2(), map[string]interface{}{
+		"type":     "ready_state",
+		"nickname": c.Nickname,
+	})
+	if len(s.accepted) == 2 {
+		s.startCountdownLocked()
+	}
+}
+
+// Rematch records a player's answer to the rematch offer
+func (s *pairSession) Rematch(c *Client, accept bool) {
+	s.mu.Lock()
+	if s.phase != phaseRematch {
+		s.mu.Unlock()
+		return
+	}
+	if !accept {
+		requeue := s.closeLocked("declined")
+		s.mu.Unlock()
+		s.lobby.requeue(requeue)
+		return
+	}
+	defer s.mu.Unlock()
+
+	s.accepted[c] = true
+	s.partner(c).SendJSON(map[string]interface{}{
+		"type":     "rematch_accepted",
+		"nickname": c.Nickname,
+	})
+	if len(s.accepted) == 2 {
+		s.startCountdownLocked()
+	}
+}
+
+// Leave handles a player declining, disconnecting or starting something
+// else. A running game is left alone; it ends when the player's writes fail.
+func (s *pairSession) Leave(c *Client) {
+	s.mu.Lock()
+	var requeue []*pairQueueEntry
+	switch s.phase {
+	case phaseReadyCheck, phaseCountdown:
+		// The partner still wants a game, so put them back in the queue
+		requeue = s.closeLocked("declined", s.entryFor(s.partner(c)))
+	case phaseRematch:
+		requeue = s.closeLocked("declined")
+	}
+	s.mu.Unlock()
+	s.lobby.requeue(requeue)
+}
+
+func (s *pairSession) entryFor(c *Client) *pairQueueEntry {
+	if c == s.p1() {
+		return s.entries[0]
+	}
+	return s.entries[1]
+}
+
+func (s *pairSession) armTimerLocked(phase pairPhase, timeout time.Duration) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(timeout, func() { s.onTimeout(phase) })
+}
+
+// onTimeout ends a ready check or rematch offer that was not answered in time.
+// Players who had already accepted a ready check go back to the queue.
+func (s *pairSession) onTimeout(phase pairPhase) {
+	s.mu.Lock()
+	if s.phase != phase {
+		s.mu.Unlock()
+		return
+	}
+	var keep []*pairQueueEntry
+	if phase == phaseReadyCheck {
+		for _, e := range s.entries {
+			if s.accepted[e.client] {
+				keep = append(keep, e)
+			}
+		}
+	}
+	requeue := s.closeLocked("timeout", keep...)
+	s.mu.Unlock()
+	s.lobby.requeue(requeue)
+}
+
+// closeLocked detaches both players and tells them why. Entries in requeue are
+// returned so the caller can put them back in the queue after unlocking.
+func (s *pairSession) closeLocked(reason string, requeue ...*pairQueueEntry) []*pairQueueEntry {
+	wasRematch := s.phase == phaseRematch
+	s.phase = phaseClosed
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	msgType := "match_cancelled"
+	if wasRematch {
+		msgType = "rematch_declined"
+	}
+	var kept []*pairQueueEntry
+	for _, e := range s.entries {
+		e.client.clearPairSession(s)
+		requeued := false
+		for _, r := range requeue {
+			if r == e {
+				requeued = true
+				kept = append(kept, e)
+			}
+		}
+		e.client.SendJSON(map[string]interface{}{
+			"type":     msgType,
+			"reason":   reason,
+			"requeued": requeued,
+		})
+	}
+	return kept
+}
+
+func (s *pairSession) startCountdownLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.phase = phaseCountdown
+	startsAt := time.Now().Add(countdownFrom * countdownStep)
+	s.countdownLocked(countdownFrom, startsAt)
+}
+
+// countdownLocked broadcasts one countdown value. Every message carries the
+// same start time so clients can align their display to the server clock.
+func (s *pairSession) countdownLocked(value int, startsAt time.Time) {
+	if value == 0 {
+		s.startGameLocked()
+		return
+	}
+	s.lobby.broadcastToPair(s.p1(), s.p2(), map[string]interface{}{
+		"type":     "countdown",
+		"value":    value,
+		"startsAt": startsAt.UnixMilli(),
+	})
+	s.timer = time.AfterFunc(countdownStep, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.phase == phaseCountdown {
+			s.countdownLocked(value-1, startsAt)
+		}
+	})
+}
+
+func (s *pairSession) startGameLocked() {
+	p1, p2 := s.p1(), s.p2()
+	log.Printf("Starting pair game for %s and %s (%d ghosts, map %s)", p1.Nickname, p2.Nickname, s.ghostCount, s.mapName)
+
+	game := NewGameOnMap([]string{p1.Nickname, p2.Nickname}, s.ghostCount, s.mapName)
+	trackAchievements(s.lobby, game, ModePair)
+	s.game = game
+	s.phase = phasePlaying
+
+	s.lobby.addGame(game)
+
+	p1.SetGame(game)
+	p2.SetGame(game)
+
+	// Notify start
+	startMsg := map[string]interface{}{
+		"type":       "game_start",
+		"mode":       "pair",
+		"p1":         p1.Nickname,
+		"p2":         p2.Nickname,
+		"ghostCount": game.GhostCount,
+		"map":        game.MapName,
+	}
+	s.lobby.broadcastToPair(p1, p2, startMsg)
+
+	s.lobby.scheduler.Start(game, ModePair, func() bool {
+		return s.tick(game)
+	})
+}
+
+func (s *pairSession) tick(game *GameState) bool {
+	// The game may have been ended by a moderator
+	s.mu.Lock()
+	playing := s.phase == phasePlaying && s.game == game
+	s.mu.Unlock()
+	if !playing {
+		return false
+	}
+
+	p1, p2 := s.p1(), s.p2()
+	game.Update()
+
+	game.mu.RLock()
+	// Check if game is over (both dead)
+	if game.GameOver {
+		s.handleGameOver(game)
+		return false
+	}
+
+	err := s.lobby.broadcastStateToPair(p1, p2, game)
+	game.mu.RUnlock()
+
+	if err != nil {
+		log.Println("Error writing to client in pair game, ending game")
+		game.mu.Lock()
+		game.GameOver = true // Stop updates
+		game.mu.Unlock()
+		s.cleanupGame(game)
+
+		s.mu.Lock()
+		s.closeLocked("disconnected")
+		s.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+func (s *pairSession) handleGameOver(game *GameState) {
+	p1, p2 := s.p1(), s.p2()
+
+	// Called with game.mu read-locked; send the final state before releasing it
+	s.lobby.broadcastStateToPair(p1, p2, game)
+	result := game.Result(ModePair, p1.Nickname, p2.Nickname)
+	game.mu.RUnlock()
+
+	// Save result and ratings off the scheduler worker
+	go func() {
+		if err := s.lobby.SaveResult(result); err != nil {
+			log.Println("Failed to save pair score:", err)
+		} else {
+			checkCareerAchievements(s.lobby, ModePair, p1.Nickname, p2.Nickname)
+		}
+		recordPairRatings(s.lobby.store, p1.Nickname, p2.Nickname, result.Score, result.GhostCount)
+	}()
+
+	s.cleanupGame(game)
+	s.offerRematch()
+}
+
+func (s *pairSession) cleanupGame(game *GameState) {
+	for _, c := range []*Client{s.p1(), s.p2()} {
+		if c.GetGame() == game {
+			c.SetGame(nil)
+		}
+	}
+
+	s.lobby.removeGame(game)
+}
+
+func (s *pairSession) offerRematch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.phase != phasePlaying {
+		return
+	}
+	s.phase = phaseRematch
+	s.accepted = make(map[*Client]bool)
+	s.lobby.broadcastToPair(s.p1(), s.p2(), map[string]interface{}{
+		"type":       "rematch_offer",
+		"timeoutSec": int(rematchTimeout / time.Second),
+	})
+	s.armTimerLocked(phaseRematch, rematchTimeout)
+}
+
+// abort ends a running game without recording a score or offering a rematch
+func (s *pairSession) abort(game *GameState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.phase != phasePlaying || s.game != game {
+		return
+	}
+	s.phase = phaseClosed
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	for _, e := range s.entries {
+		e.client.clearPairSession(s)
+	}
+}
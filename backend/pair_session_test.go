@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// shortenPairTimings speeds up the handshake for the duration of a test
+func shortenPairTimings(t *testing.T) {
+	t.Helper()
+	ready, rematch, step := readyCheckTimeout, rematchTimeout, countdownStep
+	readyCheckTimeout, rematchTimeout, countdownStep = 50*time.Millisecond, 50*time.Millisecond, time.Millisecond
+	t.Cleanup(func() {
+		readyCheckTimeout, rematchTimeout, countdownStep = ready, rematch, step
+	})
+}
+
+func newTestSession(t *testing.T) (*Lobby, *pairSession, *Client, *Client) {
+	t.Helper()
+	l := newTestLobby()
+	now := time.Now()
+	a := newQueuedClient(l, "a", 1500, now)
+	b := newQueuedClient(l, "b", 1500, now)
+	l.clients[a] = true
+	l.clients[b] = true
+
+	l.mu.Lock()
+	l.matchWaiting(now)
+	l.mu.Unlock()
+
+	session := a.PairSession()
+	if session == nil {
+		t.Fatal("Expected a pair session")
+	}
+	return l, session, a, b
+}
+
+func sessionPhase(s *pairSession) pairPhase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase
+}
+
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGameStartsOnlyAfterBothReady(t *testing.T) {
+	shortenPairTimings(t)
+	_, session, a, b := newTestSession(t)
+
+	session.Ready(a)
+	if a.GetGame() != nil || sessionPhase(session) != phaseReadyCheck {
+		t.Fatal("Expected the game to wait for the second player")
+	}
+
+	session.Ready(b)
+	waitFor(t, func() bool { return a.GetGame() != nil }, "game start after countdown")
+
+	if a.GetGame() != b.GetGame() {
+		t.Error("Expected both players in the same game")
+	}
+	if sessionPhase(session) != phasePlaying {
+		t.Errorf("Expected playing phase, got %d", sessionPhase(session))
+	}
+}
+
+func TestReadyCheckTimeoutRequeuesReadyPlayer(t *testing.T) {
+	shortenPairTimings(t)
+	l, session, a, b := newTestSession(t)
+
+	session.Ready(a)
+	waitFor(t, func() bool { return sessionPhase(session) == phaseClosed }, "ready check timeout")
+
+	if a.PairSession() != nil || b.PairSession() != nil {
+		t.Error("Expected both players detached from the session")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.isWaiting(a) {
+		t.Error("Expected the ready player back in the queue")
+	}
+	if l.isWaiting(b) {
+		t.Error("Expected the player who timed out to go back to the lobby")
+	}
+}
+
+func TestRematchRestartsWithSamePartner(t *testing.T) {
+	shortenPairTimings(t)
+	_, session, a, b := newTestSession(t)
+
+	session.mu.Lock()
+	session.phase = phasePlaying
+	session.mu.Unlock()
+	session.offerRematch()
+
+	session.Rematch(a, true)
+	session.Rematch(b, true)
+	waitFor(t, func() bool { return a.GetGame() != nil }, "rematch game start")
+
+	if a.GetGame() != b.GetGame() {
+		t.Error("Expected the rematch to reuse the same partner")
+	}
+}
+
+func TestRematchDeclineReturnsBothToLobby(t *testing.T) {
+	shortenPairTimings(t)
+	l, session, a, b := newTestSession(t)
+
+	session.mu.Lock()
+	session.phase = phasePlaying
+	session.mu.Unlock()
+	session.offerRematch()
+
+	session.Rematch(a, true)
+	session.Rematch(b, false)
+
+	if sessionPhase(session) != phaseClosed {
+		t.Fatal("Expected a declined rematch to close the session")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isWaiting(a) || l.isWaiting(b) {
+		t.Error("Expected neither player to be queued after a declined rematch")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+// passwordResetDuration is how long a reset link stays valid
+const passwordResetDuration = 30 * time.Minute
+
+var ErrWrongPassword = errors.New("current password is incorrect")
+
+// ChangePassword verifies the current password, stores the new one and ends
+// every other login of the user. The session making the change stays valid.
+func ChangePassword(store db.Store, session db.SessionRecord, currentPassword, newPassword string) error {
+	if err := store.VerifyUser(session.Nickname, currentPassword); err != nil {
+		return ErrWrongPassword
+	}
+	if err := store.UpdatePassword(session.Nickname, newPassword); err != nil {
+		return err
+	}
+	return RevokeOtherUserSessions(session.Nickname, session.FamilyID)
+}
+
+// RequestPasswordReset mails a single-use reset link to the user if they
+// exist and have an email address. Unknown users are not an error, so the
+// caller cannot reveal which accounts exist.
+func RequestPasswordReset(store db.Store, identifier string) error {
+	nickname, email, err := store.FindUserForReset(identifier)
+	if errors.Is(err, db.ErrUserNotFound) || (err == nil && email == "") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if wait := authLimiters.resetMail.Attempt(accountLimitKey(nickname), time.Now()); wait > 0 {
+		// Answer as usual; the link already mailed is still valid
+		fmt.Println("Password reset mail throttled for", nickname)
+		return nil
+	}
+
+	token, err := GenerateSessionToken()
+	if err != nil {
+		return err
+	}
+	if err := store.CreatePasswordResetToken(hashToken(token), nickname, time.Now().Add(passwordResetDuration)); err != nil {
+		return fmt.Errorf("store reset token: %w", err)
+	}
+
+	link := appBaseURL() + "/?reset=" + url.QueryEscape(token)
+	return mailer.Send(Mail{
+		To:      email,
+		Subject: "Reset your Pacman password",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If you did not ask for a reset, you can ignore this email.\n",
+			nickname, int(passwordResetDuration/time.Minute), link),
+	})
+}
+
+// ConfirmPasswordReset consumes a reset token, sets the new password and
+// logs the user out everywhere. It returns the user's nickname.
+func ConfirmPasswordReset(store db.Store, token, newPassword string) (string, error) {
+	nickname, err := store.ResetPassword(hashToken(token), newPassword)
+	if err != nil {
+		return "", err
+	}
+	return nickname, RevokeAllUserSessions(nickname)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+// usePasswordTestServer returns a server with pacfan registered in its
+// store, mail captured in the returned buffer and fresh rate limits
+func usePasswordTestServer(t *testing.T) (*http.ServeMux, db.Store, *bytes.Buffer) {
+	t.Helper()
+	useMemorySessions(t)
+	mux, lobby := newTestServer(t)
+	if err := lobby.store.CreateUser("pacfan", "secret123", "pac@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mail bytes.Buffer
+	prevMailer, prevLimiters := mailer, authLimiters
+	t.Cleanup(func() { mailer, authLimiters = prevMailer, prevLimiters })
+	mailer = NewLogMailer(&mail)
+	authLimiters.ip = NewMemoryLimiter(ipLoginPolicy)
+	authLimiters.account = NewMemoryLimiter(accountLoginPolicy)
+	authLimiters.resetMail = NewMemoryLimiter(resetMailPolicy)
+	return mux, lobby.store, &mail
+}
+
+var resetLinkPattern = regexp.MustCompile(`/\?reset=(\S+)`)
+
+// mailedResetToken returns the token from the last reset link in mail
+func mailedResetToken(t *testing.T, mail *bytes.Buffer) string {
+	t.Helper()
+	matches := resetLinkPattern.FindAllStringSubmatch(mail.String(), -1)
+	if len(matches) == 0 {
+		t.Fatalf("Expected a reset link in the mail, got %q", mail.String())
+	}
+	token, err := url.QueryUnescape(matches[len(matches)-1][1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPasswordReset(t *testing.T) {
+	mux, store, mail := usePasswordTestServer(t)
+	session, _ := CreateSession("pacfan", ClientInfo{})
+
+	// Unknown accounts get the same answer and no mail
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/request", "", `{"identifier":"nobody"}`); rec.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 for an unknown account, got %d", rec.Code)
+	}
+	if mail.Len() != 0 {
+		t.Errorf("Expected no mail for an unknown account, got %q", mail.String())
+	}
+
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/request", "", `{"identifier":"PAC@example.com"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", rec.Code)
+	}
+	token := mailedResetToken(t, mail)
+
+	weak := `{"token":"` + token + `","newPassword":"x"}`
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/confirm", "", weak); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a weak password, got %d", rec.Code)
+	}
+	confirm := `{"token":"` + token + `","newPassword":"newsecret456"}`
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/confirm", "", confirm); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the reset to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if err := store.VerifyUser("pacfan", "newsecret456"); err != nil {
+		t.Errorf("Expected the new password to work, got %v", err)
+	}
+	if _, ok := ValidateSession(session.Token); ok {
+		t.Error("Expected the reset to end every session")
+	}
+	// The token is single-use
+	again := `{"token":"` + token + `","newPassword":"another789"}`
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/confirm", "", again); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a used token, got %d", rec.Code)
+	}
+	if err := store.VerifyUser("pacfan", "newsecret456"); err != nil {
+		t.Errorf("Expected the used token to leave the password alone, got %v", err)
+	}
+}
+
+func TestPasswordResetTokenExpires(t *testing.T) {
+	mux, store, _ := usePasswordTestServer(t)
+	if err := store.CreatePasswordResetToken(hashToken("expired-token"), "pacfan", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	confirm := `{"token":"expired-token","newPassword":"newsecret456"}`
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/confirm", "", confirm); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an expired token, got %d", rec.Code)
+	}
+	if err := store.VerifyUser("pacfan", "secret123"); err != nil {
+		t.Errorf("Expected the old password kept, got %v", err)
+	}
+}
+
+func TestPasswordResetReplacesOlderLinks(t *testing.T) {
+	mux, _, mail := usePasswordTestServer(t)
+
+	doJSON(mux, http.MethodPost, "/api/password/reset/request", "", `{"identifier":"pacfan"}`)
+	first := mailedResetToken(t, mail)
+	doJSON(mux, http.MethodPost, "/api/password/reset/request", "", `{"identifier":"pacfan"}`)
+	second := mailedResetToken(t, mail)
+
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/confirm", "", `{"token":"`+second+`","newPassword":"newsecret456"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the reset to succeed, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/password/reset/confirm", "", `{"token":"`+first+`","newPassword":"another789"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the older link to stop working, got %d", rec.Code)
+	}
+}
+
+func TestPasswordResetMailsAreLimitedPerAccount(t *testing.T) {
+	mux, _, mail := usePasswordTestServer(t)
+
+	for i := 0; i < 10; i++ {
+		if rec := doJSON(mux, http.MethodPost, "/api/password/reset/request", "", `{"identifier":"pacfan"}`); rec.Code != http.StatusAccepted {
+			t.Fatalf("Request %d: expected 202, got %d", i+1, rec.Code)
+		}
+	}
+	sent := len(resetLinkPattern.FindAllString(mail.String(), -1))
+	if sent != resetMailPolicy.FreeAttempts+1 {
+		t.Errorf("Expected %d reset mails, got %d", resetMailPolicy.FreeAttempts+1, sent)
+	}
+}
+
+func TestPasswordChange(t *testing.T) {
+	mux, store, _ := usePasswordTestServer(t)
+	laptop, _ := CreateSession("pacfan", ClientInfo{UserAgent: "laptop"})
+	phone, _ := CreateSession("pacfan", ClientInfo{UserAgent: "phone"})
+
+	if rec := doJSON(mux, http.MethodPost, "/api/password/change", "", `{"currentPassword":"secret123","newPassword":"newsecret456"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", rec.Code)
+	}
+	if rec := doJSON(mux, http.MethodPost, "/api/password/change", laptop.Token, `{"currentPassword":"wrong","newPassword":"newsecret456"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a wrong current password, got %d", rec.Code)
+	}
+	if _, ok := ValidateSession(phone.Token); !ok {
+		t.Fatal("Expected a failed change to keep other sessions")
+	}
+
+	rec := doJSON(mux, http.MethodPost, "/api/password/change", laptop.Token, `{"currentPassword":"secret123","newPassword":"newsecret456"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the change to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := store.VerifyUser("pacfan", "newsecret456"); err != nil {
+		t.Errorf("Expected the new password to work, got %v", err)
+	}
+	if _, ok := ValidateSession(laptop.Token); !ok {
+		t.Error("Expected the session making the change to stay valid")
+	}
+	if _, ok := ValidateSession(phone.Token); ok {
+		t.Error("Expected other sessions to be ended")
+	}
+}
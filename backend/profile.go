@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	defaultRecentGames = 10
+	maxRecentGames     = 50
+)
+
+// onApiUserProfile returns a player's public profile and statistics. The
+// number of recent games can be set with ?recent=.
+func onApiUserProfile(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		recent := intParam(r, "recent", defaultRecentGames, maxRecentGames)
+		profile, err := store.GetUserProfile(r.PathValue("nickname"), recent)
+		if err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			fmt.Println("Profile query error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, profile)
+	}
+}
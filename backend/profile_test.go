@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+func TestUserProfile(t *testing.T) {
+	mux, lobby := newTestServer(t)
+	if err := lobby.store.CreateUser("pacfan", "secret123", ""); err != nil {
+		t.Fatal(err)
+	}
+	played := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	for i, score := range []int{300, 500, 400} {
+		r := db.GameResult{Mode: db.GameModeSingle, Players: []string{"pacfan"}, GhostCount: 4, Score: score,
+			Duration: 60 * time.Second, Dots: 100, PlayedAt: played.Add(time.Duration(i) * time.Minute)}
+		if err := lobby.store.SaveGameResult(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lobby.store.SaveGameResult(db.GameResult{Mode: db.GameModePair, Players: []string{"inky", "pacfan"},
+		GhostCount: 4, Score: 800, PlayedAt: played.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doRequest(mux, "GET", "/api/users/PacFan?recent=2", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var p db.Profile
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Nickname != "pacfan" || p.Stats.GamesPlayed != 4 || p.Stats.TotalDots != 300 {
+		t.Errorf("Unexpected profile %+v", p)
+	}
+	if len(p.BestScores) != 2 || p.BestScores[0].Score != 500 || p.BestScores[1].Score != 800 {
+		t.Errorf("Expected the best single and pair scores, got %+v", p.BestScores)
+	}
+	if len(p.RecentGames) != 2 || p.RecentGames[0].Partner != "inky" || p.RecentGames[1].Score != 400 {
+		t.Errorf("Expected the 2 most recent games, newest first, got %+v", p.RecentGames)
+	}
+	if p.FavouritePartner == nil || p.FavouritePartner.Nickname != "inky" {
+		t.Errorf("Expected inky as the favourite partner, got %+v", p.FavouritePartner)
+	}
+}
+
+func TestUserProfileUnknownUser(t *testing.T) {
+	mux, _ := newTestServer(t)
+	if rec := doRequest(mux, "GET", "/api/users/pacfan", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", rec.Code)
+	}
+	if rec := doRequest(mux, "POST", "/api/users/pacfan", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptLimiter tracks attempts per key and decides how long the key has
+// to wait before trying again. An attempt counts as a failure from the
+// moment it is reserved, so concurrent requests cannot all slip in before
+// the first one is checked; a success releases or clears it again. The in-memory
+// implementation is enough for a single server; a shared store can
+// implement the same interface.
+type AttemptLimiter interface {
+	// Wait returns how long key must wait before its next attempt; zero means go ahead
+	Wait(key string, now time.Time) time.Duration
+	// Attempt reserves an attempt for key. It returns the remaining wait
+	// without recording anything if key is blocked, and zero once the
+	// attempt has been counted.
+	Attempt(key string, now time.Time) time.Duration
+	// Release takes back one attempt reserved by Attempt, for a request
+	// that turned out not to be a failure
+	Release(key string)
+	// Succeed forgets the failures recorded for key
+	Succeed(key string)
+}
+
+// LimitPolicy describes how failures turn into waiting time
+type LimitPolicy struct {
+	FreeAttempts    int           // Failures allowed before any delay
+	BaseDelay       time.Duration // Delay after the first failure past FreeAttempts, doubled for each one after
+	MaxDelay        time.Duration
+	LockoutAfter    int // Failures that lock the key out; zero disables lockout
+	LockoutDuration time.Duration
+	ForgetAfter     time.Duration // Failures are forgotten after this long without a new one
+}
+
+// delay returns the wait imposed after the given number of failures
+func (p LimitPolicy) delay(failures int) time.Duration {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration
+	}
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	// Cap the exponent before shifting so the duration cannot overflow
+	exp := math.Min(float64(over-1), 30)
+	d := p.BaseDelay * time.Duration(1<<int(exp))
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+var (
+	// accountLoginPolicy slows down guessing against one account from anywhere
+	accountLoginPolicy = LimitPolicy{
+		FreeAttempts:    5,
+		BaseDelay:       1 * time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		ForgetAfter:     1 * time.Hour,
+	}
+	// ipLoginPolicy is looser since many players can share an address, and
+	// never locks out so an attacker cannot shut out a whole network
+	ipLoginPolicy = LimitPolicy{
+		FreeAttempts: 20,
+		BaseDelay:    1 * time.Second,
+		MaxDelay:     10 * time.Minute,
+		ForgetAfter:  1 * time.Hour,
+	}
+	// resetMailPolicy limits the reset links mailed to one account, since
+	// asking for one is not a failure anywhere else
+	resetMailPolicy = LimitPolicy{
+		FreeAttempts: 3,
+		BaseDelay:    1 * time.Minute,
+		MaxDelay:     1 * time.Hour,
+		ForgetAfter:  1 * time.Hour,
+	}
+)
+
+type attemptRecord struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// MemoryLimiter is an AttemptLimiter kept in process memory
+type MemoryLimiter struct {
+	policy LimitPolicy
+
+	mu        sync.Mutex
+	records   map[string]*attemptRecord
+	lastSweep time.Time
+}
+
+func NewMemoryLimiter(policy LimitPolicy) *MemoryLimiter {
+	return &MemoryLimiter{
+		policy:  policy,
+		records: make(map[string]*attemptRecord),
+	}
+}
+
+func (l *MemoryLimiter) Wait(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec := l.recordLocked(key, now)
+	if rec == nil || !now.Before(rec.blockedUntil) {
+		return 0
+	}
+	return rec.blockedUntil.Sub(now)
+}
+
+func (l *MemoryLimiter) Attempt(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweepLocked(now)
+	rec := l.recordLocked(key, now)
+	if rec == nil {
+		rec = &attemptRecord{}
+		l.records[key] = rec
+	}
+	if now.Before(rec.blockedUntil) {
+		return rec.blockedUntil.Sub(now)
+	}
+	rec.failures++
+	rec.lastFailure = now
+	rec.blockedUntil = now.Add(l.policy.delay(rec.failures))
+	return 0
+}
+
+func (l *MemoryLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec, ok := l.records[key]
+	if !ok {
+		return
+	}
+	rec.failures--
+	if rec.failures <= 0 {
+		delete(l.records, key)
+		return
+	}
+	rec.blockedUntil = rec.lastFailure.Add(l.policy.delay(rec.failures))
+}
+
+func (l *MemoryLimiter) Succeed(key string) {
+	l.mu.Lock()
+	delete(l.records, key)
+	l.mu.Unlock()
+}
+
+// recordLocked returns the record for key, dropping it if it has gone stale
+func (l *MemoryLimiter) recordLocked(key string, now time.Time) *attemptRecord {
+	rec, ok := l.records[key]
+	if !ok {
+		return nil
+	}
+	if l.stale(rec, now) {
+		delete(l.records, key)
+		return nil
+	}
+	return rec
+}
+
+func (l *MemoryLimiter) stale(rec *attemptRecord, now time.Time) bool {
+	return now.Sub(rec.lastFailure) > l.policy.ForgetAfter && !now.Before(rec.blockedUntil)
+}
+
+// sweepLocked drops stale records at most once per ForgetAfter period, so
+// keys that never come back do not pile up
+func (l *MemoryLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < l.policy.ForgetAfter {
+		return
+	}
+	l.lastSweep = now
+	for key, rec := range l.records {
+		if l.stale(rec, now) {
+			delete(l.records, key)
+		}
+	}
+}
+
+// authLimiters throttles the authentication endpoints per client IP and per
+// account, and the reset links mailed per account
+var authLimiters = struct {
+	ip        AttemptLimiter
+	account   AttemptLimiter
+	resetMail AttemptLimiter
+}{
+	ip:        NewMemoryLimiter(ipLoginPolicy),
+	account:   NewMemoryLimiter(accountLoginPolicy),
+	resetMail: NewMemoryLimiter(resetMailPolicy),
+}
+
+func accountLimitKey(nickname string) string {
+	return strings.ToLower(nickname)
+}
+
+// authAttempt reserves an attempt from ip, and against the account if
+// nickname is not empty, before the request does any work. It returns how
+// long to wait if either is blocked; otherwise the attempt stands as a
+// failure until authSucceeded takes it back.
+func authAttempt(ip, nickname string) time.Duration {
+	now := time.Now()
+	if wait := authLimiters.ip.Attempt(ip, now); wait > 0 {
+		return wait
+	}
+	if nickname != "" {
+		if wait := authLimiters.account.Attempt(accountLimitKey(nickname), now); wait > 0 {
+			// The account refused it, so the IP did not get to try
+			authLimiters.ip.Release(ip)
+			return wait
+		}
+	}
+	return 0
+}
+
+// authSucceeded takes back the attempt authAttempt reserved from ip and
+// clears the account's failures, so only real failures count. The IP keeps
+// the rest of its history, or logging into one's own account would reset
+// the counter between guesses.
+func authSucceeded(ip, nickname string) {
+	authLimiters.ip.Release(ip)
+	if nickname != "" {
+		authLimiters.account.Succeed(accountLimitKey(nickname))
+	}
+}
+
+// writeTooManyAttempts answers 429 with a Retry-After in whole seconds
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+}
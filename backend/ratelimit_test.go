@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testPolicy = LimitPolicy{
+	FreeAttempts:    2,
+	BaseDelay:       1 * time.Second,
+	MaxDelay:        8 * time.Second,
+	LockoutAfter:    6,
+	LockoutDuration: 1 * time.Hour,
+	ForgetAfter:     10 * time.Minute,
+}
+
+func TestLimiterBacksOffExponentially(t *testing.T) {
+	l := NewMemoryLimiter(testPolicy)
+	now := time.Now()
+
+	// Each attempt waits out the delay the one before it imposed
+	want := []time.Duration{0, 0, 1 * time.Second, 2 * time.Second, 4 * time.Second}
+	for i, w := range want {
+		now = now.Add(l.Wait("pac", now))
+		if got := l.Attempt("pac", now); got != 0 {
+			t.Fatalf("Attempt %d: expected to go ahead, got wait %v", i+1, got)
+		}
+		if got := l.Wait("pac", now); got != w {
+			t.Errorf("Attempt %d: expected delay %v, got %v", i+1, w, got)
+		}
+	}
+	if got := l.Attempt("pac", now.Add(1*time.Second)); got != 3*time.Second {
+		t.Errorf("Expected 3s left to wait, got %v", got)
+	}
+	if got := l.Wait("pac", now); got != 4*time.Second {
+		t.Errorf("Expected a blocked attempt not to add to the delay, got %v", got)
+	}
+	if got := l.Wait("other", now); got != 0 {
+		t.Errorf("Expected other keys to be unaffected, got %v", got)
+	}
+}
+
+func TestLimiterReservesConcurrentAttempts(t *testing.T) {
+	l := NewMemoryLimiter(testPolicy)
+	now := time.Now()
+
+	// Attempts that arrive together are counted before any is verified, so
+	// only the free ones go ahead
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.Attempt("pac", now) == 0 {
+			allowed++
+		}
+	}
+	if allowed != testPolicy.FreeAttempts+1 {
+		t.Errorf("Expected %d attempts to go ahead, got %d", testPolicy.FreeAttempts+1, allowed)
+	}
+}
+
+func TestLimiterLocksOutAndForgets(t *testing.T) {
+	l := NewMemoryLimiter(testPolicy)
+	now := time.Now()
+
+	for i := 0; i < testPolicy.LockoutAfter; i++ {
+		now = now.Add(l.Wait("pac", now))
+		l.Attempt("pac", now)
+	}
+	if got := l.Wait("pac", now); got != testPolicy.LockoutDuration {
+		t.Fatalf("Expected lockout of %v, got %v", testPolicy.LockoutDuration, got)
+	}
+
+	later := now.Add(testPolicy.LockoutDuration + time.Second)
+	if got := l.Wait("pac", later); got != 0 {
+		t.Errorf("Expected lockout to expire, got %v", got)
+	}
+	l.Attempt("pac", later)
+	if got := l.Wait("pac", later); got != 0 {
+		t.Errorf("Expected failures to be forgotten after the lockout, got delay %v", got)
+	}
+}
+
+func TestLimiterSucceedClearsFailures(t *testing.T) {
+	l := NewMemoryLimiter(testPolicy)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		l.Attempt("pac", now)
+	}
+	l.Succeed("pac")
+	if got := l.Wait("pac", now); got != 0 {
+		t.Errorf("Expected no wait after success, got %v", got)
+	}
+}
+
+func TestLimiterReleaseTakesBackOneAttempt(t *testing.T) {
+	l := NewMemoryLimiter(testPolicy)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		now = now.Add(l.Wait("pac", now))
+		l.Attempt("pac", now)
+	}
+	l.Release("pac")
+	if got := l.Wait("pac", now); got != 1*time.Second {
+		t.Errorf("Expected the delay for 3 failures, got %v", got)
+	}
+	for i := 0; i < 3; i++ {
+		l.Release("pac")
+	}
+	if got := l.Wait("pac", now); got != 0 {
+		t.Errorf("Expected no wait once every attempt is released, got %v", got)
+	}
+	// Releasing more than was reserved does not bank free attempts
+	l.Release("pac")
+	for i := 0; i <= testPolicy.FreeAttempts; i++ {
+		l.Attempt("pac", now)
+	}
+	if l.Wait("pac", now) == 0 {
+		t.Error("Expected the usual delay after the free attempts")
+	}
+}
+
+func TestAuthSuccessKeepsIPHistory(t *testing.T) {
+	prev := authLimiters
+	t.Cleanup(func() { authLimiters = prev })
+	authLimiters.ip = NewMemoryLimiter(testPolicy)
+	authLimiters.account = NewMemoryLimiter(testPolicy)
+
+	for i := 0; i < 3; i++ {
+		authAttempt("10.0.0.1", "Victim")
+	}
+	if authLimiters.ip.Wait("10.0.0.1", time.Now()) == 0 {
+		t.Fatal("Expected the IP to be throttled")
+	}
+	if authAttempt("10.0.0.2", "victim") == 0 {
+		t.Fatal("Expected the account to be throttled from any IP, case-insensitively")
+	}
+	if authLimiters.ip.Wait("10.0.0.2", time.Now()) != 0 {
+		t.Error("Expected an attempt the account refused not to count against the IP")
+	}
+
+	authSucceeded("10.0.0.2", "victim")
+	if authAttempt("10.0.0.2", "victim") != 0 {
+		t.Error("Expected a successful login to clear the account")
+	}
+	if authAttempt("10.0.0.1", "") == 0 {
+		t.Error("Expected the IP to stay throttled after a success")
+	}
+}
+
+func TestAuthSuccessesDoNotThrottleSharedIP(t *testing.T) {
+	prev := authLimiters
+	t.Cleanup(func() { authLimiters = prev })
+	authLimiters.ip = NewMemoryLimiter(testPolicy)
+	authLimiters.account = NewMemoryLimiter(testPolicy)
+
+	// Players behind one office address logging in one after another
+	for i := 0; i < 10; i++ {
+		if wait := authAttempt("10.0.0.1", fmt.Sprintf("player%d", i)); wait > 0 {
+			t.Fatalf("Login %d: expected to go ahead, got wait %v", i+1, wait)
+		}
+		authSucceeded("10.0.0.1", fmt.Sprintf("player%d", i))
+	}
+	if got := authLimiters.ip.Wait("10.0.0.1", time.Now()); got != 0 {
+		t.Errorf("Expected successes to leave the IP alone, got %v", got)
+	}
+}
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	prev := trustedProxies
+	t.Cleanup(func() { trustedProxies = prev })
+	trustedProxies = parseTrustedProxies("10.0.0.1, 192.168.0.0/16, bogus")
+
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		// A direct client cannot pick its own address
+		{"203.0.113.9:5000", "1.2.3.4", "203.0.113.9"},
+		{"10.0.0.1:5000", "", "10.0.0.1"},
+		{"10.0.0.1:5000", "198.51.100.7", "198.51.100.7"},
+		// Hops the client made up sit left of the ones the proxies added
+		{"10.0.0.1:5000", "1.2.3.4, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:5000", "1.2.3.4, 198.51.100.7, 192.168.4.4", "198.51.100.7"},
+		{"192.168.1.1:5000", "10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientInfoFromRequest(r).IP; got != tt.want {
+			t.Errorf("%s forwarding %q: expected %s, got %s", tt.remote, tt.forwarded, tt.want, got)
+		}
+	}
+}
+
+func TestTooManyAttemptsSetsRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeTooManyAttempts(rec, 1500*time.Millisecond)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"math"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+const (
+	ratingK = 32.0
+	// ratingScale is the Elo logistic scale: a 400 point gap means 10:1 odds
+	ratingScale = 400.0
+)
+
+// baselineScore is the pair score an average (DefaultRating) team is expected
+// to reach against the given number of ghosts. More ghosts means a lower bar.
+func baselineScore(ghostCount int) float64 {
+	if ghostCount < 1 {
+		ghostCount = 1
+	}
+	baseline := 3000.0 - 200.0*float64(ghostCount-1)
+	return math.Max(baseline, 1000.0)
+}
+
+// expectedResult is the Elo expectation of a team with the given rating
+// against the ghost-count baseline, in [0, 1].
+func expectedResult(teamRating float64) float64 {
+	return 1 / (1 + math.Pow(10, (db.DefaultRating-teamRating)/ratingScale))
+}
+
+// actualResult maps a score onto [0, 1); reaching the baseline counts as 0.5.
+func actualResult(score, ghostCount int) float64 {
+	if score <= 0 {
+		return 0
+	}
+	s := float64(score)
+	return s / (s + baselineScore(ghostCount))
+}
+
+// pairRatingDelta returns the rating change applied to both team members
+func pairRatingDelta(r1, r2 float64, score, ghostCount int) float64 {
+	team := (r1 + r2) / 2
+	return ratingK * (actualResult(score, ghostCount) - expectedResult(team))
+}
+
+// lookupRating returns a player's rating, falling back to the default
+// when the store cannot be read.
+func lookupRating(store db.Store, nickname string) float64 {
+	rating, err := store.GetRating(nickname)
+	if err != nil {
+		return db.DefaultRating
+	}
+	return rating
+}
+
+// recordPairRatings updates both players' ratings after a pair game
+func recordPairRatings(store db.Store, p1, p2 string, score, ghostCount int) {
+	r1, err1 := store.GetRating(p1)
+	r2, err2 := store.GetRating(p2)
+	if err1 != nil || err2 != nil {
+		log.Printf("Skipping rating update for %s and %s: %v %v", p1, p2, err1, err2)
+		return
+	}
+
+	delta := pairRatingDelta(r1, r2, score, ghostCount)
+	for _, nick := range []string{p1, p2} {
+		if err := store.AdjustRating(nick, delta); err != nil {
+			log.Printf("Failed to update rating for %s: %v", nick, err)
+		}
+	}
+}
@@ -8,38 +8,54 @@ import (
 	"time"
 
 	"github.com/villepalo/pacman-go-react/db"
-
-	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: CheckOrigin, // Validate origin against allowed list from ALLOWED_ORIGINS env var
-}
-
 func RegisterRoutes(mux *http.ServeMux, lobby *Lobby) {
+	store := lobby.store
 	mux.HandleFunc("/api/ws", onApiWs(lobby))
-	mux.HandleFunc("/api/score", onApiScore)
-	mux.HandleFunc("/api/scoreboard", onApiScoreboard)
-	mux.HandleFunc("/api/scoreboard/pair", onApiScoreboardPair)
-	mux.HandleFunc("/api/signup", onApiSignup)
-	mux.HandleFunc("/api/login", onApiLogin)
-	mux.HandleFunc("/api/logout", onApiLogout)
+	mux.HandleFunc("/api/ws-ticket", onApiWsTicket)
+	mux.HandleFunc("/api/score", onApiScore(lobby))
+	mux.HandleFunc("/api/scoreboard", onApiScoreboard(lobby.boardCache, db.GameModeSingle))
+	mux.HandleFunc("/api/scoreboard/pair", onApiScoreboard(lobby.boardCache, db.GameModePair))
+	mux.HandleFunc("/api/scoreboard/rank", onApiScoreboardRank(store, db.GameModeSingle))
+	mux.HandleFunc("/api/scoreboard/pair/rank", onApiScoreboardRank(store, db.GameModePair))
+	mux.HandleFunc("/api/scoreboard/around", onApiScoreboardAround(store, db.GameModeSingle))
+	mux.HandleFunc("/api/scoreboard/pair/around", onApiScoreboardAround(store, db.GameModePair))
+	mux.HandleFunc("/api/users/{nickname}", onApiUserProfile(store))
+	mux.HandleFunc("/api/users/{nickname}/achievements", onApiUserAchievements(store))
+	mux.HandleFunc("/api/signup", onApiSignup(store))
+	mux.HandleFunc("/api/login", onApiLogin(store))
+	mux.HandleFunc("/api/guest", onApiGuest(store))
+	mux.HandleFunc("/api/oidc/config", onApiOIDCConfig)
+	mux.HandleFunc("/api/oidc/authorize", onApiOIDCAuthorize)
+	mux.HandleFunc("/api/oidc/callback", onApiOIDCCallback(store))
+	mux.HandleFunc("/api/oidc/session", onApiOIDCSession)
+	mux.HandleFunc("/api/guest/upgrade", onApiGuestUpgrade(lobby))
+	mux.HandleFunc("/api/logout", onApiLogout(lobby))
+	mux.HandleFunc("/api/logout/all", onApiLogoutAll(lobby))
+	mux.HandleFunc("/api/sessions", onApiSessions)
+	mux.HandleFunc("/api/me", onApiAccountDelete(lobby))
+	mux.HandleFunc("/api/me/export", onApiAccountExport(store))
+	mux.HandleFunc("/api/sessions/{id}", onApiSessionRevoke(lobby))
+	mux.HandleFunc("/api/token/refresh", onApiTokenRefresh)
+	mux.HandleFunc("/api/password/change", onApiPasswordChange(lobby))
+	mux.HandleFunc("/api/password/reset/request", onApiPasswordResetRequest(store))
+	mux.HandleFunc("/api/password/reset/confirm", onApiPasswordResetConfirm(lobby))
+	mux.HandleFunc("/api/metrics/scheduler", onApiSchedulerMetrics(lobby.scheduler))
+	registerAdminRoutes(mux, lobby)
 }
 
 func onApiWs(lobby *Lobby) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Validate session token for WebSocket authentication
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			http.Error(w, "Missing authentication token", http.StatusUnauthorized)
-			return
-		}
-
-		nickname, valid := ValidateSession(token)
+		// Validate the ticket or session token for WebSocket authentication
+		session, valid := wsSession(r)
 		if !valid {
 			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
 			return
 		}
+		if rejectBanned(w, lobby.store, session.Nickname) {
+			return
+		}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -47,12 +63,11 @@ func onApiWs(lobby *Lobby) http.HandlerFunc {
 			return
 		}
 
-		client := &Client{
-			Nickname: nickname,
-			Conn:     conn,
-			Send:     make(chan []byte, 256),
-			Lobby:    lobby,
-		}
+		client := NewClient(session.Nickname, conn, lobby)
+		// Bind the connection to the login rather than the access token, so
+		// it survives token rotation
+		client.FamilyID = session.FamilyID
+		go client.WritePump()
 
 		lobby.register <- client
 
@@ -80,287 +95,664 @@ func onApiWs(lobby *Lobby) http.HandlerFunc {
 
 				switch msgType {
 				case "join_pair":
-					lobby.JoinPairQueue(client)
+					lobby.JoinPairQueue(client, parsePairPreferences(msg))
 				case "input":
 					handleGameInput(client, msg)
+				case "ready":
+					if session := client.PairSession(); session != nil {
+						session.Ready(client)
+					}
+				case "decline":
+					if session := client.PairSession(); session != nil {
+						session.Leave(client)
+					}
+				case "rematch":
+					accept := true
+					if v, ok := msg["accept"].(bool); ok {
+						accept = v
+					}
+					if session := client.PairSession(); session != nil {
+						session.Rematch(client, accept)
+					}
 				case "start_single":
+					// Starting a single game abandons any pending pair match
+					if session := client.PairSession(); session != nil {
+						session.Leave(client)
+					}
 					ghostCount := 4
 					if countFloat, ok := msg["ghostCount"].(float64); ok {
 						ghostCount = int(countFloat)
 					}
 					startSinglePlayerGame(client, ghostCount)
-			case "update_ghost_count":
-				if countFloat, ok := msg["count"].(float64); ok {
-					if game := client.GetGame(); game != nil {
-						game.UpdateGhostCount(int(countFloat))
-						// Broadcast updated gamestate to client immediately
-						// Hold read lock to prevent data race with concurrent game.Update()
-						game.mu.RLock()
-						client.WriteJSON(game)
-						game.mu.RUnlock()
+				case "subscribe_leaderboard", "unsubscribe_leaderboard":
+					handleLeaderboardSubscription(client, msgType, msg)
+				case "update_ghost_count":
+					if countFloat, ok := msg["count"].(float64); ok {
+						// Pair games use the ghost count agreed in matchmaking
+						if game := client.GetGame(); game != nil && len(game.Players) == 1 {
+							game.UpdateGhostCount(int(countFloat))
+							// Broadcast updated gamestate to client immediately
+							// Hold read lock to prevent data race with concurrent game.Update()
+							game.mu.RLock()
+							client.SendState(game)
+							game.mu.RUnlock()
+						}
 					}
 				}
-				}
 			}
 		}()
 	}
 }
 
-func onApiScore(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func onApiSchedulerMetrics(scheduler *Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scheduler.Stats())
 	}
-	if !db.RequireDB(w) {
-		return
+}
+
+func onApiScore(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req ScoreSubmitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Using ghost count 4 as default/legacy if not provided in JSON or struct yet, 
+		// though standard request doesn't have it yet. Will update struct later.
+		// For now, assuming default 4 for legacy endpoint use, or we add field to struct.
+		result := db.GameResult{
+			Mode:       db.GameModeSingle,
+			Players:    []string{req.Nickname},
+			GhostCount: 4,
+			Score:      req.Score,
+		}
+		if err := lobby.SaveResult(result); err != nil {
+			fmt.Println("Score update error:", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Score submitted"})
 	}
+}
 
-	var req ScoreSubmitRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+func onApiSignup(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req AuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if fields := ValidateSignup(&req); fields != nil {
+			writeFieldErrors(w, http.StatusBadRequest, fields)
+			return
+		}
+
+		// Every signup costs a bcrypt hash, so failed ones count against the IP
+		ip := clientInfoFromRequest(r).IP
+		if wait := authAttempt(ip, ""); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+
+		if err := store.CreateUser(req.Nickname, req.Password, req.Email); err != nil {
+			fmt.Println("Signup error:", err)
+			switch {
+			case errors.Is(err, db.ErrUsernameTaken):
+				writeFieldErrors(w, http.StatusConflict, FieldErrors{"nickname": "Nickname already taken"})
+			case errors.Is(err, db.ErrEmailTaken):
+				writeFieldErrors(w, http.StatusConflict, FieldErrors{"email": "Email address already in use"})
+			default:
+				http.Error(w, "Server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		authSucceeded(ip, "")
+
+		// Create session token for newly registered user (auto-login)
+		session, err := CreateSession(req.Nickname, clientInfoFromRequest(r))
+		if err != nil {
+			fmt.Println("Session creation error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":      "User created",
+			"nickname":     req.Nickname,
+			"token":        session.Token,
+			"refreshToken": session.RefreshToken,
+			"expiresIn":    int(accessTokenDuration / time.Second),
+		})
 	}
+}
 
-	// Using ghost count 4 as default/legacy if not provided in JSON or struct yet, 
-	// though standard request doesn't have it yet. Will update struct later.
-	// For now, assuming default 4 for legacy endpoint use, or we add field to struct.
-	if err := db.SaveScore(req.Nickname, req.Score, 4); err != nil {
-		fmt.Println("Score update error:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+func onApiLogin(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req AuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		req.Nickname = NormalizeNickname(req.Nickname)
+		ip := clientInfoFromRequest(r).IP
+		if wait := authAttempt(ip, req.Nickname); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+		if err := store.VerifyUser(req.Nickname, req.Password); err != nil {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		authSucceeded(ip, req.Nickname)
+		if rejectBanned(w, store, req.Nickname) {
+			return
+		}
+
+		// Create session token for authenticated user
+		session, err := CreateSession(req.Nickname, clientInfoFromRequest(r))
+		if err != nil {
+			fmt.Println("Session creation error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":      "Login successful",
+			"nickname":     req.Nickname,
+			"token":        session.Token,
+			"refreshToken": session.RefreshToken,
+			"expiresIn":    int(accessTokenDuration / time.Second),
+		})
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Score submitted"})
+func onApiLogout(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Extract token from Authorization header (Bearer token)
+		token, ok := bearerToken(r)
+		if !ok {
+			http.Error(w, "Missing or invalid authorization header", http.StatusUnauthorized)
+			return
+		}
+
+		// Validate that the session exists before deleting
+		session, valid := LookupSession(token)
+		if !valid {
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+
+		// Delete the session to invalidate it
+		DeleteSession(token)
+		lobby.DisconnectFamily(session.FamilyID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Logout successful",
+		})
+	}
+}
+
+func onApiLogoutAll(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+
+		if err := RevokeAllUserSessions(session.Nickname); err != nil {
+			fmt.Println("Logout everywhere error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		lobby.DisconnectUser(session.Nickname)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Logged out everywhere",
+		})
+	}
 }
 
-func onApiScoreboard(w http.ResponseWriter, r *http.Request) {
+func onApiSessions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if !db.RequireDB(w) {
+	session, ok := requireSession(w, r)
+	if !ok {
 		return
 	}
-	
-	ghosts := 4
-	// Allow query param ?ghosts=N
-	if gStr := r.URL.Query().Get("ghosts"); gStr != "" {
-		fmt.Sscanf(gStr, "%d", &ghosts)
-	}
 
-	scores, err := db.GetTopScores(ghosts)
+	entries, err := listSessionInfos(session)
 	if err != nil {
-		fmt.Println("Scoreboard query error:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		fmt.Println("Session list error:", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(scores)
+	json.NewEncoder(w).Encode(entries)
 }
 
-func onApiScoreboardPair(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// listSessionInfos returns the logins of the session's user, marking the
+// one the session belongs to
+func listSessionInfos(session db.SessionRecord) ([]SessionInfo, error) {
+	families, err := ListSessions(session.Nickname)
+	if err != nil {
+		return nil, err
 	}
-	if !db.RequireDB(w) {
-		return
+	entries := make([]SessionInfo, 0, len(families))
+	for _, f := range families {
+		entries = append(entries, SessionInfo{
+			ID:         f.ID,
+			CreatedAt:  f.CreatedAt,
+			LastUsedAt: f.LastSeenAt,
+			UserAgent:  f.UserAgent,
+			IP:         f.IP,
+			Current:    f.ID == session.FamilyID,
+		})
 	}
+	return entries, nil
+}
 
-	scores, err := db.GetTopPairScores()
-	if err != nil {
-		fmt.Println("PairScoreboard query error:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
+func onApiSessionRevoke(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(scores)
+		familyID := r.PathValue("id")
+		found, err := RevokeUserSession(session.Nickname, familyID)
+		if err != nil {
+			fmt.Println("Session revoke error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		lobby.DisconnectFamily(familyID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Session revoked",
+		})
+	}
 }
 
-func onApiSignup(w http.ResponseWriter, r *http.Request) {
+func onApiTokenRefresh(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if !db.RequireDB(w) {
-		return
-	}
-	var req AuthRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if err := db.CreateUser(req.Nickname, req.Password); err != nil {
-		fmt.Println("Signup error:", err)
-		if errors.Is(err, db.ErrUsernameTaken) {
-			http.Error(w, "Username already taken", http.StatusConflict)
+	session, err := RefreshSession(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
 		} else {
+			fmt.Println("Token refresh error:", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
 		}
 		return
 	}
 
-	// Create session token for newly registered user (auto-login)
-	session, err := CreateSession(req.Nickname)
-	if err != nil {
-		fmt.Println("Session creation error:", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":  "User created",
-		"nickname": req.Nickname,
-		"token":    session.Token,
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nickname":     session.Nickname,
+		"token":        session.Token,
+		"refreshToken": session.RefreshToken,
+		"expiresIn":    int(accessTokenDuration / time.Second),
 	})
 }
 
-func onApiLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	if !db.RequireDB(w) {
+func handleGameInput(client *Client, msg map[string]interface{}) {
+	game := client.GetGame()
+	if game == nil {
 		return
 	}
-	var req AuthRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	// Expected: { "direction": "UP/DOWN..." }
+	if dirVal, ok := msg["direction"].(string); ok {
+		game.SetNextDirection(client.Nickname, Direction(dirVal))
 	}
+}
 
-	if err := db.VerifyUser(req.Nickname, req.Password); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+func startSinglePlayerGame(client *Client, ghostCount int) {
+	scheduler := client.Lobby.scheduler
+
+	// Starting a new single game replaces the current one
+	if old := client.GetGame(); old != nil && len(old.Players) == 1 {
+		scheduler.Stop(old)
 	}
 
-	// Create session token for authenticated user
-	session, err := CreateSession(req.Nickname)
-	if err != nil {
-		fmt.Println("Session creation error:", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+	game := NewGame([]string{client.Nickname}, ghostCount)
+	trackAchievements(client.Lobby, game, ModeSingle)
+	client.SetGame(game)
+	client.Lobby.addGame(game)
+
+	// Notify start
+	startMsg := map[string]interface{}{
+		"type": "game_start",
+		"mode": "single",
+		"p1":   client.Nickname,
 	}
+	client.SendJSON(startMsg)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":  "Login successful",
-		"nickname": req.Nickname,
-		"token":    session.Token,
+	scheduler.Start(game, ModeSingle, func() bool {
+		return singlePlayerTick(client, game)
 	})
 }
 
-func onApiLogout(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// singlePlayerTick advances a single player game and reports whether it
+// should keep running.
+func singlePlayerTick(client *Client, game *GameState) bool {
+	// Stop if the client moved on to another game or it was ended by a moderator
+	if client.GetGame() != game {
+		client.Lobby.removeGame(game)
+		return false
 	}
 
-	// Extract token from Authorization header (Bearer token)
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Missing authorization header", http.StatusUnauthorized)
-		return
-	}
+	game.Update()
 
-	// Parse "Bearer <token>" format
-	const bearerPrefix = "Bearer "
-	if len(authHeader) < len(bearerPrefix) || authHeader[:len(bearerPrefix)] != bearerPrefix {
-		http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
-		return
+	game.mu.RLock()
+	// Send update
+	err := client.SendState(game)
+	gameOver := game.GameOver
+	var result db.GameResult
+	if gameOver {
+		result = game.Result(ModeSingle, client.Nickname)
 	}
-	token := authHeader[len(bearerPrefix):]
+	game.mu.RUnlock()
 
-	// Validate that the session exists before deleting
-	if _, valid := ValidateSession(token); !valid {
-		http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
-		return
+	if err != nil {
+		client.Lobby.removeGame(game)
+		return false
 	}
 
-	// Delete the session to invalidate it
-	DeleteSession(token)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Logout successful",
-	})
+	if gameOver {
+		// Save the result off the scheduler worker
+		go func() {
+			if err := client.Lobby.SaveResult(result); err != nil {
+				fmt.Println("Failed to save score:", err)
+				return
+			}
+			checkCareerAchievements(client.Lobby, ModeSingle, client.Nickname)
+		}()
+		client.SetGame(nil)
+		client.Lobby.removeGame(game)
+		return false
+	}
+	return true
 }
 
-func handleGameInput(client *Client, msg map[string]interface{}) {
-	game := client.GetGame()
-	if game == nil {
-		return
-	}
-	// Expected: { "direction": "UP/DOWN..." }
-	if dirVal, ok := msg["direction"].(string); ok {
-		game.SetNextDirection(client.Nickname, Direction(dirVal))
+func onApiPasswordChange(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		var req PasswordChangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := ValidatePassword(req.NewPassword); msg != "" {
+			writeFieldErrors(w, http.StatusBadRequest, FieldErrors{"newPassword": msg})
+			return
+		}
+
+		ip := clientInfoFromRequest(r).IP
+		if wait := authAttempt(ip, session.Nickname); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+		if err := ChangePassword(lobby.store, session, req.CurrentPassword, req.NewPassword); err != nil {
+			if errors.Is(err, ErrWrongPassword) {
+				http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			} else {
+				fmt.Println("Password change error:", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		authSucceeded(ip, session.Nickname)
+		lobby.disconnectWhere(func(c *Client) bool {
+			return c.Nickname == session.Nickname && c.FamilyID != session.FamilyID
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Password changed",
+		})
 	}
 }
 
-func startSinglePlayerGame(client *Client, ghostCount int) {
-	// Similar to old main loop but running in goroutine per client (or associated with client)
-	// Actually, client.Game stores the state.
+func onApiPasswordResetRequest(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PasswordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Identifier == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
 
-	// If already in game, stop it?
-	// Let's assume start_single starts a new one.
+		// Requests that fail count against the IP; the mails one account gets
+		// are limited separately
+		ip := clientInfoFromRequest(r).IP
+		if wait := authAttempt(ip, ""); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
 
-	game := NewGame([]string{client.Nickname}, ghostCount)
-	client.SetGame(game)
+		// Always answer the same way so the endpoint cannot be used to probe accounts
+		if err := RequestPasswordReset(store, req.Identifier); err != nil {
+			fmt.Println("Password reset request error:", err)
+		} else {
+			authSucceeded(ip, "")
+		}
 
-	// Start Ticker Loop for this single player game
-	go func() {
-		ticker := time.NewTicker(150 * time.Millisecond)
-		defer ticker.Stop()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If the account has an email address, a reset link has been sent",
+		})
+	}
+}
 
-		// Notify start
-		startMsg := map[string]interface{}{
-			"type": "game_start",
-			"mode": "single",
-			"p1":   client.Nickname,
+func onApiPasswordResetConfirm(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PasswordResetConfirmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := ValidatePassword(req.NewPassword); msg != "" {
+			writeFieldErrors(w, http.StatusBadRequest, FieldErrors{"newPassword": msg})
+			return
 		}
-		client.WriteJSON(startMsg)
 
-		for range ticker.C {
-			// Check if client disconnected (handled by lobby unregister closing channel?)
-			// We can check if client.Game is still this game
-			if client.GetGame() != game {
-				return
+		ip := clientInfoFromRequest(r).IP
+		if wait := authAttempt(ip, ""); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+		nickname, err := ConfirmPasswordReset(lobby.store, req.Token, req.NewPassword)
+		if err != nil {
+			if errors.Is(err, db.ErrInvalidResetToken) {
+				http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+			} else {
+				fmt.Println("Password reset error:", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
 			}
+			return
+		}
+		authSucceeded(ip, "")
+		lobby.DisconnectUser(nickname)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Password has been reset",
+		})
+	}
+}
 
-			game.Update()
+func writeFieldErrors(w http.ResponseWriter, status int, fields FieldErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ValidationErrorResponse{
+		Error:  "Validation failed",
+		Fields: fields,
+	})
+}
 
-			game.mu.RLock()
-			// Send update
-			err := client.WriteJSON(game)
-			gameOver := game.GameOver
-			score := game.Score
-			game.mu.RUnlock()
+func onApiGuest(store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-			if err != nil {
-				break
-			}
+		// Guests are free to create, so failures count against the IP like a signup
+		info := clientInfoFromRequest(r)
+		if wait := authAttempt(info.IP, ""); wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
 
-			if gameOver {
-				// Save score
-				// Save score with ghost count from game state. 
-				// We need to access game.GhostCount.
-				if err := db.SaveScore(client.Nickname, score, game.GhostCount); err != nil {
-					fmt.Println("Failed to save score:", err)
-				}
-				// Sleep a bit and stop
-				time.Sleep(500 * time.Millisecond)
-				client.SetGame(nil)
-				break
+		session, err := CreateGuestSession(store, info)
+		if err != nil {
+			fmt.Println("Guest session error:", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		authSucceeded(info.IP, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":      "Guest created",
+			"nickname":     session.Nickname,
+			"guest":        true,
+			"token":        session.Token,
+			"refreshToken": session.RefreshToken,
+			"expiresIn":    int(accessTokenDuration / time.Second),
+		})
+	}
+}
+
+func onApiGuestUpgrade(lobby *Lobby) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		guestSession, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		var req AuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if fields := ValidateSignup(&req); fields != nil {
+			writeFieldErrors(w, http.StatusBadRequest, fields)
+			return
+		}
+
+		session, err := UpgradeGuest(lobby.store, guestSession, req, clientInfoFromRequest(r))
+		if err != nil {
+			fmt.Println("Guest upgrade error:", err)
+			switch {
+			case errors.Is(err, db.ErrNotGuest):
+				http.Error(w, "Only guests can be upgraded", http.StatusForbidden)
+			case errors.Is(err, db.ErrUsernameTaken):
+				writeFieldErrors(w, http.StatusConflict, FieldErrors{"nickname": "Nickname already taken"})
+			case errors.Is(err, db.ErrEmailTaken):
+				writeFieldErrors(w, http.StatusConflict, FieldErrors{"email": "Email address already in use"})
+			default:
+				http.Error(w, "Server error", http.StatusInternalServerError)
 			}
+			return
 		}
-	}()
+		// The guest's connections are bound to its old nickname
+		lobby.DisconnectUser(guestSession.Nickname)
+		// Its scores now show on the boards under the new one
+		lobby.BoardsChanged(db.BoardChange{})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":      "Account created",
+			"nickname":     session.Nickname,
+			"token":        session.Token,
+			"refreshToken": session.RefreshToken,
+			"expiresIn":    int(accessTokenDuration / time.Second),
+		})
+	}
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
+// newTestLobby returns a lobby backed by an empty memory store
+func newTestLobby() *Lobby {
+	return NewLobby(NewScheduler(1, nil), db.NewMemoryStore(), db.NewMemoryBus())
+}
+
+// newTestServer registers all routes against a fresh lobby
+func newTestServer(t *testing.T) (*http.ServeMux, *Lobby) {
+	t.Helper()
+	lobby := newTestLobby()
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, lobby)
+	return mux, lobby
+}
+
+func doRequest(mux http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// doJSON is doRequest with a JSON body
+func doJSON(mux http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSessionListAndRevoke(t *testing.T) {
+	useMemorySessions(t)
+	mux, _ := newTestServer(t)
+
+	laptop, _ := CreateSession("tester", ClientInfo{UserAgent: "laptop", IP: "10.0.0.1"})
+	phone, _ := CreateSession("tester", ClientInfo{UserAgent: "phone", IP: "10.0.0.2"})
+	stranger, _ := CreateSession("stranger", ClientInfo{})
+
+	rec := doRequest(mux, http.MethodGet, "/api/sessions", laptop.Token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var sessions []SessionInfo
+	json.NewDecoder(rec.Body).Decode(&sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == laptop.FamilyID) {
+			t.Errorf("Expected only the laptop session to be current, got %+v", s)
+		}
+	}
+
+	if rec := doRequest(mux, http.MethodDelete, "/api/sessions/"+stranger.FamilyID, laptop.Token); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking another user's session, got %d", rec.Code)
+	}
+
+	if rec := doRequest(mux, http.MethodDelete, "/api/sessions/"+phone.FamilyID, laptop.Token); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 revoking own session, got %d", rec.Code)
+	}
+	if _, ok := ValidateSession(phone.Token); ok {
+		t.Error("Expected the revoked session to be invalid")
+	}
+	if _, ok := ValidateSession(laptop.Token); !ok {
+		t.Error("Expected the caller's session to stay valid")
+	}
+}
+
+func TestLogoutEverywhere(t *testing.T) {
+	useMemorySessions(t)
+	mux, _ := newTestServer(t)
+
+	laptop, _ := CreateSession("tester", ClientInfo{})
+	phone, _ := CreateSession("tester", ClientInfo{})
+
+	if rec := doRequest(mux, http.MethodPost, "/api/logout/all", laptop.Token); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	for _, s := range []*Session{laptop, phone} {
+		if _, ok := ValidateSession(s.Token); ok {
+			t.Error("Expected every session to be revoked")
+		}
+	}
+}
+
+func TestSignupAndLoginWithoutDatabase(t *testing.T) {
+	useMemorySessions(t)
+	prev := authLimiters
+	t.Cleanup(func() { authLimiters = prev })
+	authLimiters.ip = NewMemoryLimiter(ipLoginPolicy)
+	authLimiters.account = NewMemoryLimiter(accountLoginPolicy)
+	mux, _ := newTestServer(t)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post("/api/signup", `{"nickname":"pacfan","password":"secret123"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected signup to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("/api/signup", `{"nickname":"PacFan","password":"secret123"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a taken nickname, got %d", rec.Code)
+	}
+	if rec := post("/api/login", `{"nickname":"pacfan","password":"secret123"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected login to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("/api/login", `{"nickname":"pacfan","password":"wrong"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, got %d", rec.Code)
+	}
+}
+
+func TestLoginsFromSharedAddressAreNotThrottled(t *testing.T) {
+	useMemorySessions(t)
+	prev := authLimiters
+	t.Cleanup(func() { authLimiters = prev })
+	authLimiters.ip = NewMemoryLimiter(ipLoginPolicy)
+	authLimiters.account = NewMemoryLimiter(accountLoginPolicy)
+	mux, _ := newTestServer(t)
+
+	if rec := doJSON(mux, http.MethodPost, "/api/signup", "", `{"nickname":"pacfan","password":"secret123"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected signup to succeed, got %d", rec.Code)
+	}
+	// Well past the IP's free attempts, all from the same address
+	for i := 0; i < 2*ipLoginPolicy.FreeAttempts; i++ {
+		if rec := doJSON(mux, http.MethodPost, "/api/login", "", `{"nickname":"pacfan","password":"secret123"}`); rec.Code != http.StatusOK {
+			t.Fatalf("Login %d: expected 200, got %d", i+1, rec.Code)
+		}
+	}
+}
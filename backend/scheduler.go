@@ -0,0 +1,287 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type GameMode string
+
+const (
+	ModeSingle GameMode = "single"
+	ModePair   GameMode = "pair"
+)
+
+// DefaultTickInterval is the tick rate used when a mode has no override
+const DefaultTickInterval = 150 * time.Millisecond
+
+// minBaseTick bounds how often the central ticker fires
+const minBaseTick = 10 * time.Millisecond
+
+// gameModes are the modes a scheduler runs games for
+var gameModes = []GameMode{ModeSingle, ModePair}
+
+// StepFunc advances a game by one tick. Returning false removes the game
+// from the scheduler.
+type StepFunc func() bool
+
+type scheduledGame struct {
+	game    *GameState
+	mode    GameMode
+	every   uint64 // Run on every Nth base tick
+	step    StepFunc
+	running atomic.Bool
+	stopped atomic.Bool
+}
+
+// SchedulerStats is a snapshot of the scheduler's counters
+type SchedulerStats struct {
+	ActiveGames int     `json:"activeGames"`
+	Workers     int     `json:"workers"`
+	Ticks       uint64  `json:"ticks"`
+	Steps       uint64  `json:"steps"`
+	Overruns    uint64  `json:"overruns"` // Steps skipped because the previous one had not finished
+	MaxStepMs   float64 `json:"maxStepMs"`
+}
+
+// Scheduler steps every active game from a fixed pool of workers, driven by
+// a single ticker so all games of a mode tick on the same boundaries.
+type Scheduler struct {
+	base      time.Duration
+	workers   int
+	tickRates map[GameMode]time.Duration
+
+	mu    sync.Mutex
+	games map[*GameState]*scheduledGame
+
+	jobs chan *scheduledGame
+	stop chan struct{}
+
+	ticks     atomic.Uint64
+	steps     atomic.Uint64
+	overruns  atomic.Uint64
+	maxStepNs atomic.Int64
+}
+
+func NewScheduler(workers int, tickRates map[GameMode]time.Duration) *Scheduler {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	rates := make(map[GameMode]time.Duration)
+	for mode, rate := range tickRates {
+		if rate > 0 {
+			rates[mode] = rate
+		}
+	}
+
+	// The base tick is the greatest common divisor of the rates in use so
+	// every mode lands exactly on a base tick. The default only counts if
+	// some mode falls back to it.
+	var base time.Duration
+	for _, mode := range gameModes {
+		if _, ok := rates[mode]; !ok {
+			base = DefaultTickInterval
+		}
+	}
+	for _, rate := range rates {
+		base = gcdDuration(base, rate)
+	}
+	if base < minBaseTick {
+		// Rather than tick that often, round each rate to the nearest
+		// multiple of the minimum, so the rate games run at is the one
+		// TickInterval reports
+		base = minBaseTick
+		for mode, rate := range rates {
+			rounded := (rate + base/2) / base * base
+			if rounded == 0 {
+				rounded = base
+			}
+			if rounded != rate {
+				log.Printf("Tick rate for %s games rounded from %v to %v, a multiple of the %v base tick", mode, rate, rounded, base)
+				rates[mode] = rounded
+			}
+		}
+	}
+
+	return &Scheduler{
+		base:      base,
+		workers:   workers,
+		tickRates: rates,
+		games:     make(map[*GameState]*scheduledGame),
+		jobs:      make(chan *scheduledGame, 1024),
+		stop:      make(chan struct{}),
+	}
+}
+
+// NewSchedulerFromEnv reads SCHEDULER_WORKERS, TICK_MS_SINGLE and TICK_MS_PAIR
+func NewSchedulerFromEnv() *Scheduler {
+	workers, _ := strconv.Atoi(os.Getenv("SCHEDULER_WORKERS"))
+	rates := map[GameMode]time.Duration{
+		ModeSingle: envMillis("TICK_MS_SINGLE"),
+		ModePair:   envMillis("TICK_MS_PAIR"),
+	}
+	return NewScheduler(workers, rates)
+}
+
+func envMillis(key string) time.Duration {
+	ms, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func gcdDuration(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// TickInterval returns the configured tick rate for a game mode
+func (s *Scheduler) TickInterval(mode GameMode) time.Duration {
+	if rate, ok := s.tickRates[mode]; ok {
+		return rate
+	}
+	return DefaultTickInterval
+}
+
+// Run starts the worker pool and the central ticker. It blocks until Shutdown.
+func (s *Scheduler) Run() {
+	for i := 0; i < s.workers; i++ {
+		go s.worker()
+	}
+
+	ticker := time.NewTicker(s.base)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.dispatch(s.ticks.Add(1))
+		}
+	}
+}
+
+// Shutdown stops the ticker and the workers
+func (s *Scheduler) Shutdown() {
+	close(s.stop)
+}
+
+// Start registers a game; step is called on every tick of the mode's rate
+// until it returns false or Stop is called.
+func (s *Scheduler) Start(game *GameState, mode GameMode, step StepFunc) {
+	interval := s.TickInterval(mode)
+	every := uint64(interval / s.base)
+	if every == 0 {
+		every = 1
+	}
+
+	game.mu.Lock()
+	game.TickInterval = interval
+	game.mu.Unlock()
+
+	s.mu.Lock()
+	if old, ok := s.games[game]; ok {
+		old.stopped.Store(true)
+	}
+	s.games[game] = &scheduledGame{game: game, mode: mode, every: every, step: step}
+	s.mu.Unlock()
+}
+
+// Stop removes a game. A step already in progress is allowed to finish.
+func (s *Scheduler) Stop(game *GameState) {
+	s.mu.Lock()
+	if sg, ok := s.games[game]; ok {
+		sg.stopped.Store(true)
+		delete(s.games, game)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) dispatch(tick uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sg := range s.games {
+		if tick%sg.every != 0 {
+			continue
+		}
+		if !sg.running.CompareAndSwap(false, true) {
+			s.overruns.Add(1)
+			continue
+		}
+		select {
+		case s.jobs <- sg:
+		default:
+			// Workers are saturated; skip this tick rather than stall the ticker
+			sg.running.Store(false)
+			s.overruns.Add(1)
+		}
+	}
+}
+
+func (s *Scheduler) worker() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case sg := <-s.jobs:
+			s.runStep(sg)
+		}
+	}
+}
+
+func (s *Scheduler) runStep(sg *scheduledGame) {
+	defer sg.running.Store(false)
+	if sg.stopped.Load() {
+		return
+	}
+
+	start := time.Now()
+	keep := sg.step()
+	elapsed := time.Since(start)
+
+	s.steps.Add(1)
+	for {
+		max := s.maxStepNs.Load()
+		if int64(elapsed) <= max || s.maxStepNs.CompareAndSwap(max, int64(elapsed)) {
+			break
+		}
+	}
+	if elapsed > s.TickInterval(sg.mode) {
+		log.Printf("Game step took %v, longer than the %s tick interval", elapsed, sg.mode)
+	}
+
+	if !keep {
+		s.mu.Lock()
+		if s.games[sg.game] == sg {
+			delete(s.games, sg.game)
+		}
+		s.mu.Unlock()
+		sg.stopped.Store(true)
+	}
+}
+
+// Stats returns the current scheduler counters
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	active := len(s.games)
+	s.mu.Unlock()
+
+	return SchedulerStats{
+		ActiveGames: active,
+		Workers:     s.workers,
+		Ticks:       s.ticks.Load(),
+		Steps:       s.steps.Load(),
+		Overruns:    s.overruns.Load(),
+		MaxStepMs:   float64(s.maxStepNs.Load()) / float64(time.Millisecond),
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerStepsUntilGameEnds(t *testing.T) {
+	s := NewScheduler(2, map[GameMode]time.Duration{ModeSingle: 10 * time.Millisecond})
+	go s.Run()
+	defer s.Shutdown()
+
+	game := NewGame([]string{"tester"}, 1)
+	var steps atomic.Int32
+	done := make(chan struct{})
+	s.Start(game, ModeSingle, func() bool {
+		if steps.Add(1) == 3 {
+			close(done)
+			return false
+		}
+		return true
+	})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the game to be stepped three times")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if got := steps.Load(); got != 3 {
+		t.Errorf("Expected no steps after returning false, got %d", got)
+	}
+	if active := s.Stats().ActiveGames; active != 0 {
+		t.Errorf("Expected no active games, got %d", active)
+	}
+	if game.TickInterval != 10*time.Millisecond {
+		t.Errorf("Expected game tick interval to follow the mode rate, got %v", game.TickInterval)
+	}
+}
+
+func TestSchedulerCountsOverruns(t *testing.T) {
+	s := NewScheduler(1, map[GameMode]time.Duration{ModePair: 10 * time.Millisecond})
+	go s.Run()
+	defer s.Shutdown()
+
+	game := NewGame([]string{"a", "b"}, 1)
+	s.Start(game, ModePair, func() bool {
+		time.Sleep(50 * time.Millisecond)
+		return true
+	})
+	time.Sleep(120 * time.Millisecond)
+	s.Stop(game)
+
+	if s.Stats().Overruns == 0 {
+		t.Error("Expected slow steps to be counted as overruns")
+	}
+}
+
+func TestSchedulerBaseTickAlignsModes(t *testing.T) {
+	s := NewScheduler(1, map[GameMode]time.Duration{
+		ModeSingle: 150 * time.Millisecond,
+		ModePair:   100 * time.Millisecond,
+	})
+	if s.base != 50*time.Millisecond {
+		t.Errorf("Expected base tick 50ms, got %v", s.base)
+	}
+	if s.TickInterval(ModePair) != 100*time.Millisecond {
+		t.Errorf("Expected pair rate 100ms, got %v", s.TickInterval(ModePair))
+	}
+}
+
+func TestSchedulerBaseTickIgnoresUnusedDefault(t *testing.T) {
+	s := NewScheduler(1, map[GameMode]time.Duration{
+		ModeSingle: 40 * time.Millisecond,
+		ModePair:   80 * time.Millisecond,
+	})
+	if s.base != 40*time.Millisecond {
+		t.Errorf("Expected base tick 40ms with every mode configured, got %v", s.base)
+	}
+}
+
+func TestSchedulerRoundsRatesOffTheBaseTick(t *testing.T) {
+	s := NewScheduler(1, map[GameMode]time.Duration{ModeSingle: 155 * time.Millisecond})
+	if s.base != minBaseTick {
+		t.Errorf("Expected the base tick clamped to %v, got %v", minBaseTick, s.base)
+	}
+	if got := s.TickInterval(ModeSingle); got != 160*time.Millisecond {
+		t.Errorf("Expected 155ms rounded to 160ms, got %v", got)
+	}
+
+	game := NewGame([]string{"tester"}, 1)
+	s.Start(game, ModeSingle, func() bool { return true })
+	if sg := s.games[game]; time.Duration(sg.every)*s.base != game.TickInterval {
+		t.Errorf("Expected the game to run at its reported %v, got every %d ticks", game.TickInterval, sg.every)
+	}
+}
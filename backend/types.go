@@ -1,5 +1,11 @@
 package main
 
+import (
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+)
+
 // Game Types
 
 type Direction string
@@ -26,4 +32,70 @@ type ScoreSubmitRequest struct {
 type AuthRequest struct {
 	Nickname string `json:"nickname"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Optional, used for password resets
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type PasswordResetRequest struct {
+	Identifier string `json:"identifier"` // Nickname or email
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type BanRequest struct {
+	Reason string `json:"reason"`
+}
+
+type RenameRequest struct {
+	Nickname string `json:"nickname"`
+}
+
+type OIDCSessionRequest struct {
+	Code string `json:"code"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// SessionInfo is one login as shown to its owner
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// AccountExport is the archive GET /api/me/export returns. Rating and
+// achievements are only kept with Postgres.
+type AccountExport struct {
+	ExportedAt   time.Time                `json:"exportedAt"`
+	Account      db.UserExport            `json:"account"`
+	Sessions     []SessionInfo            `json:"sessions"`
+	Rating       *float64                 `json:"rating,omitempty"`
+	Achievements []db.UnlockedAchievement `json:"achievements,omitempty"`
+}
+
+// AccountDeleteRequest confirms an account deletion. Scores is "anonymize"
+// (the default) to keep single-player scores under an anonymous name, or
+// "delete" to remove them.
+type AccountDeleteRequest struct {
+	Confirmation string `json:"confirmation"`
+	Scores       string `json:"scores,omitempty"`
+}
+
+// AccountDeleteConfirmation is sent back to DELETE /api/me to go ahead
+type AccountDeleteConfirmation struct {
+	Confirmation string `json:"confirmation"`
+	ExpiresIn    int    `json:"expiresIn"` // Seconds
+	Message      string `json:"message"`
 }
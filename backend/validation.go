@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	minNicknameLength = 3
+	maxNicknameLength = 20
+	minPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes
+	maxPasswordBytes = 72
+	maxEmailLength   = 254
+)
+
+// reservedNicknames cannot be registered, compared case-insensitively
+var reservedNicknames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"moderator":     true,
+	"root":          true,
+	"system":        true,
+	"server":        true,
+	"support":       true,
+	"staff":         true,
+	"guest":         true,
+	"anonymous":     true,
+	"null":          true,
+	"undefined":     true,
+	"me":            true,
+}
+
+// FieldErrors maps a request field to a message that can be shown next to it
+type FieldErrors map[string]string
+
+// ValidationErrorResponse is the body returned when a request fails validation
+type ValidationErrorResponse struct {
+	Error  string      `json:"error"`
+	Fields FieldErrors `json:"fields"`
+}
+
+// NormalizeNickname applies NFKC normalisation and trims surrounding space,
+// so fullwidth and other compatibility forms map to their plain letters.
+func NormalizeNickname(nickname string) string {
+	return strings.TrimSpace(norm.NFKC.String(nickname))
+}
+
+// ValidateNickname checks an already normalised nickname. Only ASCII
+// letters, digits, '_' and '-' are allowed, which rules out lookalike
+// characters from other scripts.
+func ValidateNickname(nickname string) string {
+	n := utf8.RuneCountInString(nickname)
+	switch {
+	case n == 0:
+		return "Nickname is required"
+	case n < minNicknameLength || n > maxNicknameLength:
+		return "Nickname must be between 3 and 20 characters"
+	}
+	for _, r := range nickname {
+		if !isNicknameRune(r) {
+			return "Nickname may only contain letters A-Z, digits, '_' and '-'"
+		}
+	}
+	lower := strings.ToLower(nickname)
+	if reservedNicknames[lower] || strings.HasPrefix(lower, guestNicknamePrefix) || strings.HasPrefix(lower, deletedNicknamePrefix) {
+		return "This nickname is reserved"
+	}
+	return ""
+}
+
+func isNicknameRune(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-')
+}
+
+// ValidatePassword enforces the password length policy
+func ValidatePassword(password string) string {
+	switch {
+	case password == "":
+		return "Password is required"
+	case utf8.RuneCountInString(password) < minPasswordLength:
+		return "Password must be at least 8 characters"
+	case len(password) > maxPasswordBytes:
+		return "Password must be at most 72 bytes"
+	case !utf8.ValidString(password):
+		return "Password must be valid UTF-8"
+	}
+	for _, r := range password {
+		if unicode.IsControl(r) {
+			return "Password must not contain control characters"
+		}
+	}
+	return ""
+}
+
+// ValidateEmail accepts an empty address, since email is optional
+func ValidateEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	if len(email) > maxEmailLength {
+		return "Email address is too long"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "Email address is not valid"
+	}
+	return ""
+}
+
+// ValidateSignup normalises the request in place and returns the problems
+// with each field, or nil if it is acceptable.
+func ValidateSignup(req *AuthRequest) FieldErrors {
+	req.Nickname = NormalizeNickname(req.Nickname)
+	req.Email = strings.TrimSpace(req.Email)
+
+	errs := FieldErrors{}
+	if msg := ValidateNickname(req.Nickname); msg != "" {
+		errs["nickname"] = msg
+	}
+	if msg := ValidatePassword(req.Password); msg != "" {
+		errs["password"] = msg
+	}
+	if msg := ValidateEmail(req.Email); msg != "" {
+		errs["email"] = msg
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNickname(t *testing.T) {
+	// Fullwidth letters fold to ASCII under NFKC
+	if got := NormalizeNickname("  ＰａｃＭａｎ "); got != "PacMan" {
+		t.Errorf("Expected PacMan, got %q", got)
+	}
+}
+
+func TestValidateNickname(t *testing.T) {
+	cases := []struct {
+		nickname string
+		ok       bool
+	}{
+		{"pac_man-1", true},
+		{"", false},
+		{"ab", false},
+		{strings.Repeat("a", maxNicknameLength+1), false},
+		{"pac man", false},
+		{"pac\x00man", false},
+		{"pаcman", false}, // Cyrillic 'а'
+		{"Admin", false},
+	}
+	for _, c := range cases {
+		msg := ValidateNickname(c.nickname)
+		if (msg == "") != c.ok {
+			t.Errorf("ValidateNickname(%q) = %q, want ok=%v", c.nickname, msg, c.ok)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	cases := []struct {
+		password string
+		ok       bool
+	}{
+		{"correct horse", true},
+		{"short", false},
+		{strings.Repeat("x", maxPasswordBytes), true},
+		{strings.Repeat("x", maxPasswordBytes+1), false},
+		{strings.Repeat("ä", 37), false}, // 74 bytes
+		{"tab\tinside", false},
+	}
+	for _, c := range cases {
+		msg := ValidatePassword(c.password)
+		if (msg == "") != c.ok {
+			t.Errorf("ValidatePassword(%q) = %q, want ok=%v", c.password, msg, c.ok)
+		}
+	}
+}
+
+func TestValidateSignupReportsEachField(t *testing.T) {
+	req := AuthRequest{Nickname: "x", Password: "123", Email: "not-an-email"}
+	fields := ValidateSignup(&req)
+	for _, f := range []string{"nickname", "password", "email"} {
+		if fields[f] == "" {
+			t.Errorf("Expected an error for %s, got %v", f, fields)
+		}
+	}
+
+	req = AuthRequest{Nickname: " ｐｌａｙｅｒ１ ", Password: "longenough"}
+	if fields := ValidateSignup(&req); fields != nil {
+		t.Errorf("Expected no errors, got %v", fields)
+	}
+	if req.Nickname != "player1" {
+		t.Errorf("Expected nickname normalised to player1, got %q", req.Nickname)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/villepalo/pacman-go-react/db"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsTicketDuration is how long a WebSocket ticket can wait to be used
+	wsTicketDuration = 30 * time.Second
+	// wsSubprotocol is the protocol the game speaks; clients must offer it
+	// alongside the bearer protocol so the server has one to select
+	wsSubprotocol = "pacman"
+	// wsBearerPrefix marks the Sec-WebSocket-Protocol entry carrying the token
+	wsBearerPrefix = "bearer."
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin:  CheckOrigin, // Validate origin against allowed list from ALLOWED_ORIGINS env var
+	Subprotocols: []string{wsSubprotocol},
+}
+
+type wsTicket struct {
+	session   db.SessionRecord
+	expiresAt time.Time
+}
+
+// wsTicketStore holds single-use tickets that stand in for the session token
+// in the WebSocket URL, keyed by ticket hash
+type wsTicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]wsTicket
+}
+
+var wsTickets = &wsTicketStore{tickets: make(map[string]wsTicket)}
+
+// Issue returns a new ticket for the session
+func (s *wsTicketStore) Issue(session db.SessionRecord, now time.Time) (string, error) {
+	ticket, err := GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Tickets are short-lived, so sweeping on issue keeps the map small
+	for hash, t := range s.tickets {
+		if now.After(t.expiresAt) {
+			delete(s.tickets, hash)
+		}
+	}
+	s.tickets[hashToken(ticket)] = wsTicket{session: session, expiresAt: now.Add(wsTicketDuration)}
+	return ticket, nil
+}
+
+// Redeem consumes a ticket, returning the session it was issued for
+func (s *wsTicketStore) Redeem(ticket string, now time.Time) (db.SessionRecord, bool) {
+	hash := hashToken(ticket)
+	s.mu.Lock()
+	t, ok := s.tickets[hash]
+	delete(s.tickets, hash)
+	s.mu.Unlock()
+
+	if !ok || now.After(t.expiresAt) {
+		return db.SessionRecord{}, false
+	}
+	return t.session, true
+}
+
+// allowQueryToken reports whether the legacy ?token= parameter is accepted.
+// It is off unless WS_ALLOW_QUERY_TOKEN is set, since the token then ends up
+// in proxy logs and browser history.
+func allowQueryToken() bool {
+	allow, _ := strconv.ParseBool(os.Getenv("WS_ALLOW_QUERY_TOKEN"))
+	return allow
+}
+
+// wsSession authenticates a WebSocket upgrade request. In order it accepts a
+// ticket from POST /api/ws-ticket, a token in Sec-WebSocket-Protocol, and,
+// when enabled, the legacy token query parameter.
+func wsSession(r *http.Request) (db.SessionRecord, bool) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		session, ok := wsTickets.Redeem(ticket, time.Now())
+		if !ok {
+			return db.SessionRecord{}, false
+		}
+		// The login may have been revoked since the ticket was issued
+		if _, err := sessionStore.GetFamily(session.FamilyID); err != nil {
+			return db.SessionRecord{}, false
+		}
+		return session, true
+	}
+
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, wsBearerPrefix); ok {
+			return LookupSession(token)
+		}
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" && allowQueryToken() {
+		return LookupSession(token)
+	}
+	return db.SessionRecord{}, false
+}
+
+func onApiWsTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	ticket, err := wsTickets.Issue(session, time.Now())
+	if err != nil {
+		fmt.Println("Ticket creation error:", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"ticket":    ticket,
+		"expiresIn": int(wsTicketDuration / time.Second),
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWsTestServer serves the API with a running lobby and returns the ws:// base URL
+func newWsTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	mux, lobby := newTestServer(t)
+	go lobby.Run()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+}
+
+func dialWs(t *testing.T, url string, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, resp, err := dialer.Dial(url, nil)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func TestWsTicketIsSingleUse(t *testing.T) {
+	useMemorySessions(t)
+	srv, wsURL := newWsTestServer(t)
+	session, _ := CreateSession("tester", ClientInfo{})
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/ws-ticket", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a ticket, got %v %v", resp, err)
+	}
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+
+	if _, _, err := dialWs(t, wsURL+"?ticket="+body.Ticket); err != nil {
+		t.Fatalf("Expected the ticket to authenticate: %v", err)
+	}
+	_, resp, err = dialWs(t, wsURL+"?ticket="+body.Ticket)
+	if err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a reused ticket to be rejected with 401, got %v", err)
+	}
+}
+
+func TestWsTokenInSubprotocol(t *testing.T) {
+	useMemorySessions(t)
+	_, wsURL := newWsTestServer(t)
+	session, _ := CreateSession("tester", ClientInfo{})
+
+	conn, _, err := dialWs(t, wsURL, wsSubprotocol, wsBearerPrefix+session.Token)
+	if err != nil {
+		t.Fatalf("Expected the subprotocol token to authenticate: %v", err)
+	}
+	if conn.Subprotocol() != wsSubprotocol {
+		t.Errorf("Expected the server to select %q, got %q", wsSubprotocol, conn.Subprotocol())
+	}
+
+	if _, _, err := dialWs(t, wsURL, wsSubprotocol, wsBearerPrefix+"bogus"); err == nil {
+		t.Error("Expected an invalid token to be rejected")
+	}
+}
+
+func TestWsQueryTokenNeedsConfigSwitch(t *testing.T) {
+	useMemorySessions(t)
+	_, wsURL := newWsTestServer(t)
+	session, _ := CreateSession("tester", ClientInfo{})
+
+	t.Setenv("WS_ALLOW_QUERY_TOKEN", "")
+	if _, _, err := dialWs(t, wsURL+"?token="+session.Token); err == nil {
+		t.Error("Expected the query token to be rejected by default")
+	}
+
+	t.Setenv("WS_ALLOW_QUERY_TOKEN", "true")
+	if _, _, err := dialWs(t, wsURL+"?token="+session.Token); err != nil {
+		t.Errorf("Expected the query token to work when enabled: %v", err)
+	}
+}
@@ -1,4 +1,4 @@
-import { useState } from 'react'
+import { useCallback, useEffect, useState } from 'react'
 import Game from '../game/Game/Game'
 import type { GameMode } from '../game/constants'
 import AuthForm from '../components/AuthForm/AuthForm'
@@ -7,6 +7,9 @@ import './App.css'
 
 const USERNAME_STORAGE_KEY = 'pacman.username'
 const TOKEN_STORAGE_KEY = 'pacman.token'
+const REFRESH_TOKEN_STORAGE_KEY = 'pacman.refreshToken'
+const EXPIRES_AT_STORAGE_KEY = 'pacman.expiresAt'
+const GUEST_STORAGE_KEY = 'pacman.guest'
 
 type ViewState = 'game' | 'scoreboard'
 
@@ -20,26 +23,108 @@ function App() {
     return sessionStorage.getItem(TOKEN_STORAGE_KEY)
   })
   
+  const [oidcError, setOidcError] = useState<string | undefined>()
+  const [isGuest, setIsGuest] = useState(() => sessionStorage.getItem(GUEST_STORAGE_KEY) === 'true')
+  const [showUpgrade, setShowUpgrade] = useState(false)
+  
   const [currentView, setCurrentView] = useState<ViewState>('game')
   const [onlineCount, setOnlineCount] = useState<number>(0)
   const [ghostCount, setGhostCount] = useState<number>(4)
   const [scoreboardMode, setScoreboardMode] = useState<GameMode>('single')
 
-  const handleLoginSuccess = (nickname: string, token: string) => {
-    sessionStorage.setItem(USERNAME_STORAGE_KEY, nickname)
+  const storeTokens = (token: string, refreshToken: string, expiresIn: number) => {
     sessionStorage.setItem(TOKEN_STORAGE_KEY, token)
-    setUsername(nickname)
+    sessionStorage.setItem(REFRESH_TOKEN_STORAGE_KEY, refreshToken)
+    sessionStorage.setItem(EXPIRES_AT_STORAGE_KEY, String(Date.now() + expiresIn * 1000))
     setAuthToken(token)
   }
 
-  const handleLogout = () => {
+  const handleLoginSuccess = (nickname: string, token: string, refreshToken: string, expiresIn: number, guest: boolean) => {
+    sessionStorage.setItem(USERNAME_STORAGE_KEY, nickname)
+    sessionStorage.setItem(GUEST_STORAGE_KEY, String(guest))
+    setUsername(nickname)
+    setIsGuest(guest)
+    setShowUpgrade(false)
+    storeTokens(token, refreshToken, expiresIn)
+  }
+
+  const handleLogout = useCallback(() => {
     sessionStorage.removeItem(USERNAME_STORAGE_KEY)
     sessionStorage.removeItem(TOKEN_STORAGE_KEY)
+    sessionStorage.removeItem(REFRESH_TOKEN_STORAGE_KEY)
+    sessionStorage.removeItem(EXPIRES_AT_STORAGE_KEY)
+    sessionStorage.removeItem(GUEST_STORAGE_KEY)
     setUsername(null)
+    setIsGuest(false)
+    setShowUpgrade(false)
     setAuthToken(null)
     setCurrentView('game')
     setOnlineCount(0)
-  }
+  }, [])
+
+  // Finish a single sign-on login: the callback redirects here with a
+  // one-time code that is traded for session tokens
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.search)
+    const code = params.get('oidc_code')
+    const error = params.get('oidc_error')
+    if (!code && !error) {
+      return
+    }
+    window.history.replaceState(null, '', window.location.pathname)
+    if (error) {
+      setOidcError(`Single sign-on failed (${error}).`)
+      return
+    }
+    fetch('/api/oidc/session', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ code })
+    })
+      .then(async response => {
+        if (!response.ok) throw new Error(`status ${response.status}`)
+        const data = await response.json()
+        handleLoginSuccess(data.nickname, data.token, data.refreshToken, data.expiresIn, false)
+      })
+      .catch(() => setOidcError('Single sign-on failed. Please try again.'))
+    // Runs once on load
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [])
+
+  // Rotate the access token shortly before it expires. The game WebSocket
+  // stays connected across rotations.
+  useEffect(() => {
+    if (!authToken) {
+      return
+    }
+    const expiresAt = Number(sessionStorage.getItem(EXPIRES_AT_STORAGE_KEY)) || Date.now()
+    const delay = Math.max((expiresAt - Date.now()) * 0.8, 0)
+
+    const timer = window.setTimeout(async () => {
+      const refreshToken = sessionStorage.getItem(REFRESH_TOKEN_STORAGE_KEY)
+      if (!refreshToken) {
+        handleLogout()
+        return
+      }
+      try {
+        const response = await fetch('/api/token/refresh', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ refreshToken })
+        })
+        if (!response.ok) {
+          handleLogout()
+          return
+        }
+        const data = await response.json()
+        storeTokens(data.token, data.refreshToken, data.expiresIn)
+      } catch (err) {
+        console.error('Token refresh failed', err)
+      }
+    }, delay)
+
+    return () => window.clearTimeout(timer)
+  }, [authToken, handleLogout])
 
   const handleShowScoreboard = (count?: number, mode?: GameMode) => {
     if (count) {
@@ -62,13 +147,22 @@ function App() {
       <header>
         <h1>*** PACMAN C64 ***</h1>
         <p>{isAuthenticated ? 'READY.' : 'AUTHENTICATION REQUIRED.'}</p>
-        {isAuthenticated && <p>PLAYER: {username}</p>}
+        {isAuthenticated && <p>PLAYER: {username}{isGuest && ' (GUEST)'}</p>}
+        {isAuthenticated && isGuest && !showUpgrade && (
+          <button type="button" onClick={() => setShowUpgrade(true)}>SAVE PROGRESS</button>
+        )}
         {isAuthenticated && <p>ONLINE: {onlineCount}</p>}
       </header>
       <main>
         <div className="game-container">
           {!isAuthenticated ? (
-            <AuthForm onLoginSuccess={handleLoginSuccess} />
+            <AuthForm onLoginSuccess={handleLoginSuccess} initialError={oidcError} key={oidcError} />
+          ) : showUpgrade ? (
+            <AuthForm
+              onLoginSuccess={handleLoginSuccess}
+              guestToken={authToken}
+              onCancel={() => setShowUpgrade(false)}
+            />
           ) : currentView === 'scoreboard' ? (
             <ScoreBoard onBack={handleBackToGame} initialGhostCount={ghostCount} activeMode={scoreboardMode} />
           ) : (
@@ -1,43 +1,90 @@
-import { useState, type FormEvent } from 'react'
+import { useEffect, useState, type FormEvent } from 'react'
 import './AuthForm.css'
 
 interface AuthResponse {
   message: string
   nickname: string
   token: string
+  refreshToken: string
+  expiresIn: number
+  guest?: boolean
+}
+
+type FieldErrors = Partial<Record<'nickname' | 'password' | 'email', string>>
+
+interface ValidationErrorResponse {
+  error: string
+  fields: FieldErrors
 }
 
 interface AuthFormProps {
-  onLoginSuccess: (nickname: string, token: string) => void
+  onLoginSuccess: (nickname: string, token: string, refreshToken: string, expiresIn: number, guest: boolean) => void
+  // Set while a guest is signed in; the form then upgrades the guest instead of signing up
+  guestToken?: string
+  onCancel?: () => void
+  // Error reported by the identity provider callback, if any
+  initialError?: string
 }
 
-export default function AuthForm({ onLoginSuccess }: AuthFormProps) {
-  const [isLoginMode, setIsLoginMode] = useState(true)
+interface OIDCConfig {
+  enabled: boolean
+  name?: string
+}
+
+export default function AuthForm({ onLoginSuccess, guestToken, onCancel, initialError }: AuthFormProps) {
+  const isUpgrade = !!guestToken
+  const [isLoginMode, setIsLoginMode] = useState(!isUpgrade)
   const [authNickname, setAuthNickname] = useState('')
   const [authPassword, setAuthPassword] = useState('')
-  const [authError, setAuthError] = useState('')
+  const [authEmail, setAuthEmail] = useState('')
+  const [authError, setAuthError] = useState(initialError ?? '')
+  const [oidcConfig, setOidcConfig] = useState<OIDCConfig>({ enabled: false })
+
+  useEffect(() => {
+    fetch('/api/oidc/config')
+      .then(response => response.ok ? response.json() : { enabled: false })
+      .then(setOidcConfig)
+      .catch(() => setOidcConfig({ enabled: false }))
+  }, [])
+  const [fieldErrors, setFieldErrors] = useState<FieldErrors>({})
 
   const handleAuthSubmit = async (event: FormEvent<HTMLFormElement>) => {
     event.preventDefault()
     setAuthError('')
+    setFieldErrors({})
 
     if (!authNickname.trim() || !authPassword.trim()) {
       setAuthError('Nickname and Password are required.')
       return
     }
 
-    const endpoint = isLoginMode ? '/api/login' : '/api/signup'
+    const endpoint = isLoginMode ? '/api/login' : isUpgrade ? '/api/guest/upgrade' : '/api/signup'
+    const headers: Record<string, string> = { 'Content-Type': 'application/json' }
+    if (isUpgrade && !isLoginMode) {
+      headers.Authorization = `Bearer ${guestToken}`
+    }
 
     try {
       const response = await fetch(endpoint, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ nickname: authNickname, password: authPassword })
+        headers,
+        body: JSON.stringify(isLoginMode
+          ? { nickname: authNickname, password: authPassword }
+          : { nickname: authNickname, password: authPassword, email: authEmail })
       })
 
       if (!response.ok) {
-        if (response.status === 409) throw new Error('Nickname already exists.')
+        // Signup validation errors come back per field
+        if (response.headers.get('Content-Type')?.includes('application/json')) {
+          const data: ValidationErrorResponse = await response.json()
+          setFieldErrors(data.fields ?? {})
+          return
+        }
         if (response.status === 401) throw new Error('Invalid credentials.')
+        if (response.status === 429) {
+          const retryAfter = Number(response.headers.get('Retry-After')) || 1
+          throw new Error(`Too many attempts. Try again in ${retryAfter} seconds.`)
+        }
         const errText = await response.text() 
         throw new Error(errText || 'An error occurred.')
       }
@@ -45,7 +92,7 @@ export default function AuthForm({ onLoginSuccess }: AuthFormProps) {
       const data: AuthResponse = await response.json()
       
       // Both login and signup now return a token (auto-login after signup)
-      onLoginSuccess(data.nickname, data.token)
+      onLoginSuccess(data.nickname, data.token, data.refreshToken, data.expiresIn, false)
     } catch (err) {
       if (err instanceof Error) {
         setAuthError(err.message)
@@ -55,16 +102,45 @@ export default function AuthForm({ onLoginSuccess }: AuthFormProps) {
     }
   }
 
+  const handleGuestPlay = async () => {
+    setAuthError('')
+    setFieldErrors({})
+    try {
+      const response = await fetch('/api/guest', { method: 'POST' })
+      if (!response.ok) {
+        if (response.status === 429) throw new Error('Too many guests from this address. Try again later.')
+        throw new Error('Could not start a guest session.')
+      }
+      const data: AuthResponse = await response.json()
+      onLoginSuccess(data.nickname, data.token, data.refreshToken, data.expiresIn, true)
+    } catch (err) {
+      setAuthError(err instanceof Error ? err.message : 'An unexpected error occurred.')
+    }
+  }
+
+  const handleOidcLogin = async () => {
+    setAuthError('')
+    try {
+      const response = await fetch('/api/oidc/authorize', { method: 'POST' })
+      if (!response.ok) throw new Error('Single sign-on is unavailable.')
+      const data: { url: string } = await response.json()
+      window.location.assign(data.url)
+    } catch (err) {
+      setAuthError(err instanceof Error ? err.message : 'An unexpected error occurred.')
+    }
+  }
+
   const toggleAuthMode = () => {
     setIsLoginMode(!isLoginMode)
     setAuthError('')
+    setFieldErrors({})
     setAuthPassword('')
   }
 
   return (
     <div className="username-overlay" role="dialog" aria-modal="true" aria-labelledby="auth-title">
       <form className="username-form" onSubmit={handleAuthSubmit}>
-        <h2 id="auth-title">{isLoginMode ? 'LOGIN' : 'SIGNUP'}</h2>
+        <h2 id="auth-title">{isLoginMode ? 'LOGIN' : isUpgrade ? 'SAVE PROGRESS' : 'SIGNUP'}</h2>
         
         <label htmlFor="auth-nickname">NICKNAME</label>
         <input
@@ -73,7 +149,9 @@ export default function AuthForm({ onLoginSuccess }: AuthFormProps) {
           value={authNickname}
           onChange={e => setAuthNickname(e.target.value)}
           autoFocus
+          aria-invalid={!!fieldErrors.nickname}
         />
+        {fieldErrors.nickname && <p className="username-error">{fieldErrors.nickname}</p>}
 
         <label htmlFor="auth-password">PASSWORD</label>
         <input
@@ -81,7 +159,23 @@ export default function AuthForm({ onLoginSuccess }: AuthFormProps) {
           type="password"
           value={authPassword}
           onChange={e => setAuthPassword(e.target.value)}
+          aria-invalid={!!fieldErrors.password}
         />
+        {fieldErrors.password && <p className="username-error">{fieldErrors.password}</p>}
+
+        {!isLoginMode && (
+          <>
+            <label htmlFor="auth-email">EMAIL (OPTIONAL)</label>
+            <input
+              id="auth-email"
+              type="email"
+              value={authEmail}
+              onChange={e => setAuthEmail(e.target.value)}
+              aria-invalid={!!fieldErrors.email}
+            />
+            {fieldErrors.email && <p className="username-error">{fieldErrors.email}</p>}
+          </>
+        )}
 
         {authError && <p className="username-error">{authError}</p>}
 
@@ -90,6 +184,18 @@ export default function AuthForm({ onLoginSuccess }: AuthFormProps) {
         <p style={{marginTop: '1rem', fontSize: '0.8rem', cursor: 'pointer', textDecoration: 'underline'}} onClick={toggleAuthMode}>
           {isLoginMode ? 'NEED A ACCOUNT? SIGN UP' : 'ALREADY HAVE ACCOUNT? LOGIN'}
         </p>
+
+        {!isUpgrade && oidcConfig.enabled && (
+          <button type="button" onClick={handleOidcLogin}>
+            SIGN IN WITH {(oidcConfig.name ?? 'SSO').toUpperCase()}
+          </button>
+        )}
+        {!isUpgrade && (
+          <button type="button" onClick={handleGuestPlay}>PLAY AS GUEST</button>
+        )}
+        {onCancel && (
+          <button type="button" onClick={onCancel}>BACK</button>
+        )}
       </form>
     </div>
   )
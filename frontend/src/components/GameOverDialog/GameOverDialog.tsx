@@ -9,6 +9,7 @@ interface GameOverDialogProps {
     onStartPairGame: () => void;
     showPairButton: boolean;
     score: number;
+    restartLabel?: string;
 }
 
 const GameOverDialog: React.FC<GameOverDialogProps> = ({ 
@@ -17,7 +18,8 @@ const GameOverDialog: React.FC<GameOverDialogProps> = ({
     onShowScoreboard,
     onStartPairGame,
     showPairButton,
-    score
+    score,
+    restartLabel = 'Start New Game'
 }) => {
     return (
         <div className="game-over">
@@ -25,7 +27,7 @@ const GameOverDialog: React.FC<GameOverDialogProps> = ({
             <div className="final-score">SCORE: {score}</div>
             <GameButton 
                 onClick={onRestart} 
-                label="Start New Game" 
+                label={restartLabel} 
                 className="restart-btn"
             />
             <GameButton 
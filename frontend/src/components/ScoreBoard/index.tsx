@@ -5,16 +5,32 @@ import type { GameMode } from '../../game/constants';
 import './ScoreBoard.css';
 
 interface ScoreEntry {
+    rank: number;
     nickname: string;
     score: number;
 }
 
 interface PairScoreEntry {
+    rank: number;
     player1: string;
     player2: string;
     score: number;
 }
 
+type Period = 'day' | 'week' | 'month' | 'all';
+
+const PAGE_SIZE = 10;
+
+const PERIODS: { value: Period; label: string }[] = [
+    { value: 'day', label: 'TODAY' },
+    { value: 'week', label: 'WEEK' },
+    { value: 'month', label: 'MONTH' },
+    { value: 'all', label: 'ALL TIME' }
+];
+
+// Days and weeks are counted in the player's own time zone
+const timeZone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+
 interface ScoreBoardProps {
     onBack: () => void;
     initialGhostCount?: number;
@@ -27,26 +43,52 @@ const ScoreBoard: React.FC<ScoreBoardProps> = ({ onBack, initialGhostCount = 4,
     const [loading, setLoading] = useState(true);
     const [error, setError] = useState<string | null>(null);
     const [viewGhostCount, setViewGhostCount] = useState(initialGhostCount);
+    const [period, setPeriod] = useState<Period>('all');
+    const [page, setPage] = useState(0);
+    const [total, setTotal] = useState(0);
 
     const handleGhostCountChange = (num: number) => {
         setLoading(true);
         setError(null);
         setViewGhostCount(num);
+        setPage(0);
+    };
+
+    const handlePeriodChange = (value: Period) => {
+        setLoading(true);
+        setError(null);
+        setPeriod(value);
+        setPage(0);
+    };
+
+    const handlePageChange = (next: number) => {
+        setLoading(true);
+        setError(null);
+        setPage(next);
     };
 
     useEffect(() => {
         setLoading(true);
 
         const fetchScores = async () => {
+            const params = new URLSearchParams({
+                ghosts: String(viewGhostCount),
+                period,
+                tz: timeZone,
+                offset: String(page * PAGE_SIZE),
+                limit: String(PAGE_SIZE)
+            });
             try {
                 if (activeMode === 'single') {
-                    const response = await fetch(`/api/scoreboard?ghosts=${viewGhostCount}`);
+                    const response = await fetch(`/api/scoreboard?${params}`);
                     const data = await response.json();
                     setSingleScores(data || []);
+                    setTotal(Number(response.headers.get('X-Total-Count')) || 0);
                 } else if (activeMode === 'pair') {
-                    const response = await fetch('/api/scoreboard/pair');
+                    const response = await fetch(`/api/scoreboard/pair?${params}`);
                     const data = await response.json();
                     setPairScores(data || []);
+                    setTotal(Number(response.headers.get('X-Total-Count')) || 0);
                 }
                 setError(null);
             } catch (err) {
@@ -58,18 +100,18 @@ const ScoreBoard: React.FC<ScoreBoardProps> = ({ onBack, initialGhostCount = 4,
         };
 
         fetchScores();
-    }, [viewGhostCount, activeMode]);
+    }, [viewGhostCount, period, page, activeMode]);
 
     const singleRows: ScoreTableRow[] = singleScores.map((entry, index) => ({
         key: `${entry.nickname}-${index}`,
-        rank: index + 1,
+        rank: entry.rank,
         name: entry.nickname,
         score: entry.score
     }));
 
     const pairRows: ScoreTableRow[] = pairScores.map((entry, index) => ({
         key: `${entry.player1}-${entry.player2}-${index}`,
-        rank: index + 1,
+        rank: entry.rank,
         name: `${entry.player1} & ${entry.player2}`,
         score: entry.score,
         nameClassName: 'text-small'
@@ -79,7 +121,7 @@ const ScoreBoard: React.FC<ScoreBoardProps> = ({ onBack, initialGhostCount = 4,
         <div className="scoreboard-container">
             <h2 className="scoreboard-title">*** HIGH SCORES ***</h2>
             
-            {activeMode === 'single' && (
+            {(activeMode === 'single' || activeMode === 'pair') && (
                 <div className="ghost-selector">
                     <span className="ghost-selector-label">Ghosts:</span>
                     {[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].map(num => (
@@ -93,6 +135,18 @@ const ScoreBoard: React.FC<ScoreBoardProps> = ({ onBack, initialGhostCount = 4,
                     ))}
                 </div>
             )}
+
+            <div className="ghost-selector">
+                {PERIODS.map(p => (
+                    <button
+                        key={p.value}
+                        className={`ghost-btn ${period === p.value ? 'active' : ''}`}
+                        onClick={() => handlePeriodChange(p.value)}
+                    >
+                        {p.label}
+                    </button>
+                ))}
+            </div>
             
             {loading && <div className="scoreboard-loading">LOADING...</div>}
             {error && <div className="scoreboard-error">{error}</div>}
@@ -107,6 +161,28 @@ const ScoreBoard: React.FC<ScoreBoardProps> = ({ onBack, initialGhostCount = 4,
                     )}
                 </div>
             )}
+
+            {!loading && !error && total > PAGE_SIZE && (
+                <div className="ghost-selector">
+                    <button
+                        className="ghost-btn"
+                        disabled={page === 0}
+                        onClick={() => handlePageChange(page - 1)}
+                    >
+                        PREV
+                    </button>
+                    <span className="ghost-selector-label">
+                        {page + 1} / {Math.ceil(total / PAGE_SIZE)}
+                    </span>
+                    <button
+                        className="ghost-btn"
+                        disabled={(page + 1) * PAGE_SIZE >= total}
+                        onClick={() => handlePageChange(page + 1)}
+                    >
+                        NEXT
+                    </button>
+                </div>
+            )}
             
             <GameButton 
                 onClick={onBack} 
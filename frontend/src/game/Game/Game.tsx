@@ -5,9 +5,18 @@ import GameBoard from '../GameBoard';
 import GameOverDialog from '../../components/GameOverDialog/GameOverDialog';
 import Slider from '../../components/Slider/Slider';
 import TouchControls from '../../components/TouchControls/TouchControls';
+import GameButton from '../../components/GameButton/GameButton';
 
 import './Game.css';
 
+interface Achievement {
+    id: string;
+    name: string;
+    description: string;
+}
+
+const ACHIEVEMENT_TOAST_MS = 4000;
+
 interface GameProps {
     onLogout: () => void;
     onShowScoreboard: (ghostCount?: number, mode?: GameMode) => void;
@@ -21,14 +30,22 @@ interface GameProps {
 const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountChange, username, authToken, ghostCount, onGhostCountChange }) => {
     const [gameState, setGameState] = useState<GameState | null>(null);
     const [waiting, setWaiting] = useState(false);
+    const [waitEstimate, setWaitEstimate] = useState<number | null>(null);
+    const [readyCheck, setReadyCheck] = useState<{ partner: string; ready: boolean } | null>(null);
+    const [countdown, setCountdown] = useState<number | null>(null);
+    const [rematchOffered, setRematchOffered] = useState(false);
     const [lobbyStats, setLobbyStats] = useState<LobbyStats>({ online_count: 0 });
     const [gameMode, setGameMode] = useState<GameMode>(null);
+    const [achievement, setAchievement] = useState<Achievement | null>(null);
     const [scale, setScale] = useState(1);
     
     // Derived state for local player
     const [localDirection, setLocalDirection] = useState<Direction>(null);
 
     const ws = useRef<WebSocket | null>(null);
+    // Read the token through a ref so a token rotation does not reconnect
+    const authTokenRef = useRef(authToken);
+    authTokenRef.current = authToken;
 
     // Scaling logic
     useEffect(() => {
@@ -46,58 +63,111 @@ const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountCh
     }, []);
 
     useEffect(() => {
-        // Connect to WebSocket with session token for authentication
-        const wsProtocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-        const wsHost = window.location.host;
-        const wsUrl = `${wsProtocol}://${wsHost}/api/ws?token=${encodeURIComponent(authToken)}`;
-        const socket = new WebSocket(wsUrl);
-        
-        socket.onopen = () => {
-            console.log('Connected to game server');
-            // Use current ghostCount state from props
-            socket.send(JSON.stringify({ type: 'start_single', ghostCount }));
-            setGameMode('single');
-        };
+        let socket: WebSocket | null = null;
+        let cancelled = false;
+
+        const setupSocket = (socket: WebSocket) => {
+            socket.onopen = () => {
+                console.log('Connected to game server');
+                // Use current ghostCount state from props
+                socket.send(JSON.stringify({ type: 'start_single', ghostCount }));
+                setGameMode('single');
+            };
 
-        socket.onmessage = (event) => {
-            try {
-                const msg = JSON.parse(event.data);
+            socket.onmessage = (event) => {
+                try {
+                    const msg = JSON.parse(event.data);
                 
-                if (msg.type === 'lobby_stats') {
-                    setLobbyStats({ online_count: msg.online_count });
-                    onOnlineCountChange(msg.online_count);
-                } else if (msg.type === 'waiting') {
-                    setWaiting(true);
-                    setGameMode(null);
-                    setGameState(null);
-                } else if (msg.type === 'game_start') {
-                    setWaiting(false);
-                    setGameMode(msg.mode);
-                    setLocalDirection(null);
-                } else if (msg.grid) {
-                    setGameState(msg);
+                    if (msg.type === 'lobby_stats') {
+                        setLobbyStats({ online_count: msg.online_count });
+                        onOnlineCountChange(msg.online_count);
+                    } else if (msg.type === 'waiting') {
+                        setWaiting(true);
+                        setWaitEstimate(typeof msg.estimatedWaitSec === 'number' ? msg.estimatedWaitSec : null);
+                        setGameMode(null);
+                        setGameState(null);
+                    } else if (msg.type === 'ready_check') {
+                        setWaiting(false);
+                        setRematchOffered(false);
+                        setReadyCheck({ partner: msg.p1 === username ? msg.p2 : msg.p1, ready: false });
+                    } else if (msg.type === 'countdown') {
+                        setReadyCheck(null);
+                        setRematchOffered(false);
+                        setCountdown(msg.value);
+                    } else if (msg.type === 'match_cancelled') {
+                        setReadyCheck(null);
+                        setCountdown(null);
+                        if (!msg.requeued) {
+                            setWaiting(false);
+                        }
+                    } else if (msg.type === 'rematch_offer') {
+                        setRematchOffered(true);
+                    } else if (msg.type === 'rematch_declined') {
+                        setRematchOffered(false);
+                        setCountdown(null);
+                    } else if (msg.type === 'game_ended') {
+                        // A moderator stopped the game; nothing was recorded
+                        setGameState(null);
+                        setGameMode(null);
+                        setRematchOffered(false);
+                        setCountdown(null);
+                    } else if (msg.type === 'achievement_unlocked') {
+                        setAchievement(msg.achievement);
+                    } else if (msg.type === 'game_start') {
+                        setCountdown(null);
+                        setWaiting(false);
+                        setGameMode(msg.mode);
+                        setLocalDirection(null);
+                    } else if (msg.grid) {
+                        setGameState(msg);
+                    }
+                } catch (e) {
+                    console.error('Error parsing game state', e);
                 }
-            } catch (e) {
-                console.error('Error parsing game state', e);
-            }
+            };
+
+            socket.onclose = () => {
+                console.log('Disconnected from game server');
+                if (ws.current === socket) {
+                    ws.current = null;
+                }
+            };
+
+            ws.current = socket;
         };
 
-        socket.onclose = () => {
-            console.log('Disconnected from game server');
-            if (ws.current === socket) {
-                ws.current = null;
+        // Exchange the session token for a single-use ticket so the token
+        // itself never appears in the WebSocket URL
+        const connect = async () => {
+            const response = await fetch('/api/ws-ticket', {
+                method: 'POST',
+                headers: { Authorization: `Bearer ${authTokenRef.current}` }
+            });
+            if (!response.ok) {
+                throw new Error(`Ticket request failed with ${response.status}`);
             }
+            const { ticket } = await response.json();
+            if (cancelled) {
+                return;
+            }
+            const wsProtocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
+            const wsHost = window.location.host;
+            socket = new WebSocket(`${wsProtocol}://${wsHost}/api/ws?ticket=${encodeURIComponent(ticket)}`);
+            setupSocket(socket);
         };
 
-        ws.current = socket;
+        connect().catch(err => console.error('Could not connect to game server', err));
 
         return () => {
-            if (ws.current === socket) {
-                ws.current = null;
+            cancelled = true;
+            if (socket) {
+                if (ws.current === socket) {
+                    ws.current = null;
+                }
+                socket.close();
             }
-            socket.close();
         };
-    }, [authToken, onOnlineCountChange]);
+    }, [onOnlineCountChange, username]);
 
     const handleDirectionInput = useCallback((dir: Direction) => {
         const currentSocket = ws.current;
@@ -127,16 +197,38 @@ const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountCh
         return () => window.removeEventListener('keydown', handleKeyDown);
     }, [handleDirectionInput]);
 
+    useEffect(() => {
+        if (!achievement) return;
+        const timer = window.setTimeout(() => setAchievement(null), ACHIEVEMENT_TOAST_MS);
+        return () => window.clearTimeout(timer);
+    }, [achievement]);
+
     const handleStartPairGame = () => {
         if (ws.current) {
-            ws.current.send(JSON.stringify({ type: 'join_pair' }));
+            ws.current.send(JSON.stringify({ type: 'join_pair', minGhosts: ghostCount, maxGhosts: ghostCount }));
+        }
+    };
+
+    const handleReady = () => {
+        if (ws.current) {
+            ws.current.send(JSON.stringify({ type: 'ready' }));
+            setReadyCheck(prev => prev && { ...prev, ready: true });
         }
     };
 
+    const handleDecline = () => {
+        if (ws.current) {
+            ws.current.send(JSON.stringify({ type: 'decline' }));
+        }
+        setReadyCheck(null);
+    };
+
     const handleRestart = () => {
          if (ws.current) {
-             if (gameMode === 'pair') {
-                ws.current.send(JSON.stringify({ type: 'join_pair' }));
+             if (gameMode === 'pair' && rematchOffered) {
+                ws.current.send(JSON.stringify({ type: 'rematch', accept: true }));
+             } else if (gameMode === 'pair') {
+                ws.current.send(JSON.stringify({ type: 'join_pair', minGhosts: ghostCount, maxGhosts: ghostCount }));
              } else {
                 ws.current.send(JSON.stringify({ type: 'start_single', ghostCount }));
              }
@@ -146,6 +238,38 @@ const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountCh
     // Local state for ghostCount removed, using props instead
 
 
+    if (readyCheck) {
+        return (
+            <div className="game-wrapper">
+                <div className="game-board-centered">
+                    <div className="waiting-screen">
+                        <h2>Partner found: {readyCheck.partner}</h2>
+                        {readyCheck.ready ? (
+                            <p>Waiting for partner to get ready...</p>
+                        ) : (
+                            <>
+                                <GameButton onClick={handleReady} label="Ready" />
+                                <GameButton onClick={handleDecline} label="Decline" />
+                            </>
+                        )}
+                    </div>
+                </div>
+            </div>
+        );
+    }
+
+    if (countdown !== null) {
+        return (
+            <div className="game-wrapper">
+                <div className="game-board-centered">
+                    <div className="waiting-screen">
+                        <h2>Get ready: {countdown}</h2>
+                    </div>
+                </div>
+            </div>
+        );
+    }
+
     if (waiting) {
         return (
             <div className="game-wrapper">
@@ -153,6 +277,7 @@ const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountCh
                     <div className="waiting-screen">
                         <h2>Waiting for opponent...</h2>
                         <p>Online users: {lobbyStats.online_count}</p>
+                        {waitEstimate !== null && <p>Estimated wait: {waitEstimate}s</p>}
                     </div>
                 </div>
                 <TouchControls onDirectionChange={handleDirectionInput} />
@@ -207,7 +332,8 @@ const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountCh
             >
                 {gameOver && (
                     <GameOverDialog 
-                        onRestart={handleRestart} 
+                        onRestart={handleRestart}
+                        restartLabel={gameMode === 'pair' && rematchOffered ? 'Rematch' : undefined} 
                         onLogout={onLogout}
                         onShowScoreboard={() => onShowScoreboard(ghostCount, gameMode)}
                         onStartPairGame={handleStartPairGame}
@@ -217,6 +343,13 @@ const Game: React.FC<GameProps> = ({ onLogout, onShowScoreboard, onOnlineCountCh
                 )}
             </GameBoard>
 
+            {achievement && (
+                <div className="achievement-toast" role="status">
+                    <strong>ACHIEVEMENT UNLOCKED: {achievement.name}</strong>
+                    <span>{achievement.description}</span>
+                </div>
+            )}
+
             <TouchControls onDirectionChange={handleDirectionInput} />
         </div>
     );